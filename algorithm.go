@@ -0,0 +1,227 @@
+package tokendiff
+
+import (
+	"sort"
+
+	"github.com/dacharyc/diffx"
+)
+
+// DiffAlgorithm selects the sequence diff algorithm used to compare tokens.
+type DiffAlgorithm int
+
+const (
+	// AlgoHistogram uses diffx.DiffHistogram: low-frequency tokens anchor
+	// the diff, and common words such as "the" are never used as anchors.
+	// This is the default and gives the most readable prose diffs.
+	AlgoHistogram DiffAlgorithm = iota
+
+	// AlgoMyers uses diffx.Diff, the Myers algorithm, without diffx's
+	// filtering of frequent tokens, so it finds a near-shortest edit
+	// script. It can match more tokens than histogram on highly repetitive
+	// input such as logs.
+	AlgoMyers
+
+	// AlgoPatience uses patience diff: tokens that occur exactly once in
+	// both inputs are matched in order as anchors, and the regions between
+	// anchors are diffed recursively, using Myers where no unique tokens
+	// remain. diffx has no patience implementation, so this one is built on
+	// its Myers diff.
+	AlgoPatience
+)
+
+// String returns the algorithm's name as accepted by ParseDiffAlgorithm.
+func (a DiffAlgorithm) String() string {
+	switch a {
+	case AlgoHistogram:
+		return "histogram"
+	case AlgoMyers:
+		return "myers"
+	case AlgoPatience:
+		return "patience"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseDiffAlgorithm returns the DiffAlgorithm named "histogram", "myers",
+// or "patience".
+func ParseDiffAlgorithm(name string) (DiffAlgorithm, bool) {
+	for _, a := range []DiffAlgorithm{AlgoHistogram, AlgoMyers, AlgoPatience} {
+		if a.String() == name {
+			return a, true
+		}
+	}
+	return AlgoHistogram, false
+}
+
+// myersOptions configures diffx.Diff for AlgoMyers. Frequent tokens are
+// what repetitive input consists of, so they are not filtered out.
+var myersOptions = []diffx.Option{
+	diffx.WithPreprocessing(false),
+	diffx.WithAnchorElimination(false),
+}
+
+// diffStringOps diffs two string slices with the given algorithm.
+func diffStringOps(a, b []string, algo DiffAlgorithm) []diffx.DiffOp {
+	switch algo {
+	case AlgoMyers:
+		return diffx.Diff(a, b, myersOptions...)
+	case AlgoPatience:
+		return patienceDiff(stringElements(a), stringElements(b))
+	default:
+		return diffx.DiffHistogram(a, b)
+	}
+}
+
+// diffElementOps diffs two element slices with the given algorithm.
+func diffElementOps(a, b []diffx.Element, algo DiffAlgorithm) []diffx.DiffOp {
+	switch algo {
+	case AlgoMyers:
+		return diffx.DiffElements(a, b, myersOptions...)
+	case AlgoPatience:
+		return patienceDiff(a, b)
+	default:
+		return diffx.DiffElementsHistogram(a, b)
+	}
+}
+
+// stringElements converts strings to diffx elements.
+func stringElements(s []string) []diffx.Element {
+	elems := make([]diffx.Element, len(s))
+	for i, v := range s {
+		elems[i] = diffx.StringElement(v)
+	}
+	return elems
+}
+
+// patienceDiff computes a patience diff of a and b.
+func patienceDiff(a, b []diffx.Element) []diffx.DiffOp {
+	var ops []diffx.DiffOp
+	patienceRange(a, b, 0, len(a), 0, len(b), &ops)
+	return mergeDiffOps(ops)
+}
+
+// patienceRange appends the patience diff of a[alo:ahi] and b[blo:bhi] to ops.
+func patienceRange(a, b []diffx.Element, alo, ahi, blo, bhi int, ops *[]diffx.DiffOp) {
+	equal := func(ai, bi, n int) {
+		*ops = append(*ops, diffx.DiffOp{Type: diffx.Equal, AStart: ai, AEnd: ai + n, BStart: bi, BEnd: bi + n})
+	}
+
+	// Common prefix and suffix
+	for alo < ahi && blo < bhi && a[alo].Equal(b[blo]) {
+		equal(alo, blo, 1)
+		alo++
+		blo++
+	}
+	suffix := 0
+	for alo < ahi-suffix && blo < bhi-suffix && a[ahi-1-suffix].Equal(b[bhi-1-suffix]) {
+		suffix++
+	}
+	ahi -= suffix
+	bhi -= suffix
+
+	switch {
+	case alo == ahi && blo == bhi:
+	case alo == ahi:
+		*ops = append(*ops, diffx.DiffOp{Type: diffx.Insert, AStart: alo, AEnd: alo, BStart: blo, BEnd: bhi})
+	case blo == bhi:
+		*ops = append(*ops, diffx.DiffOp{Type: diffx.Delete, AStart: alo, AEnd: ahi, BStart: blo, BEnd: blo})
+	default:
+		anchors := uniqueAnchors(a, b, alo, ahi, blo, bhi)
+		if len(anchors) == 0 {
+			for _, op := range diffx.DiffElements(a[alo:ahi], b[blo:bhi], myersOptions...) {
+				op.AStart += alo
+				op.AEnd += alo
+				op.BStart += blo
+				op.BEnd += blo
+				*ops = append(*ops, op)
+			}
+			break
+		}
+		for _, m := range anchors {
+			patienceRange(a, b, alo, m[0], blo, m[1], ops)
+			equal(m[0], m[1], 1)
+			alo, blo = m[0]+1, m[1]+1
+		}
+		patienceRange(a, b, alo, ahi, blo, bhi, ops)
+	}
+
+	if suffix > 0 {
+		equal(ahi, bhi, suffix)
+	}
+}
+
+// uniqueAnchors returns index pairs of elements that occur exactly once in
+// both a[alo:ahi] and b[blo:bhi], reduced to the longest sequence that is
+// increasing in both a and b.
+func uniqueAnchors(a, b []diffx.Element, alo, ahi, blo, bhi int) [][2]int {
+	type occurrence struct{ count, index int }
+	countA := make(map[uint64]occurrence)
+	for i := alo; i < ahi; i++ {
+		o := countA[a[i].Hash()]
+		countA[a[i].Hash()] = occurrence{o.count + 1, i}
+	}
+	countB := make(map[uint64]occurrence)
+	for i := blo; i < bhi; i++ {
+		o := countB[b[i].Hash()]
+		countB[b[i].Hash()] = occurrence{o.count + 1, i}
+	}
+
+	var matches [][2]int
+	for i := alo; i < ahi; i++ {
+		h := a[i].Hash()
+		oa, ob := countA[h], countB[h]
+		if oa.count == 1 && ob.count == 1 && a[i].Equal(b[ob.index]) {
+			matches = append(matches, [2]int{i, ob.index})
+		}
+	}
+
+	return longestIncreasing(matches)
+}
+
+// longestIncreasing returns the longest subsequence of matches, which are
+// ordered by a index, whose b indexes are increasing, using patience
+// sorting.
+func longestIncreasing(matches [][2]int) [][2]int {
+	if len(matches) == 0 {
+		return nil
+	}
+
+	var tops []int // index into matches of the top card of each pile
+	prev := make([]int, len(matches))
+	for i, m := range matches {
+		pile := sort.Search(len(tops), func(p int) bool {
+			return matches[tops[p]][1] > m[1]
+		})
+		prev[i] = -1
+		if pile > 0 {
+			prev[i] = tops[pile-1]
+		}
+		if pile == len(tops) {
+			tops = append(tops, i)
+		} else {
+			tops[pile] = i
+		}
+	}
+
+	result := make([][2]int, len(tops))
+	for i, k := len(tops)-1, tops[len(tops)-1]; i >= 0; i, k = i-1, prev[k] {
+		result[i] = matches[k]
+	}
+	return result
+}
+
+// mergeDiffOps merges adjacent ops of the same type.
+func mergeDiffOps(ops []diffx.DiffOp) []diffx.DiffOp {
+	var merged []diffx.DiffOp
+	for _, op := range ops {
+		if n := len(merged); n > 0 && merged[n-1].Type == op.Type &&
+			merged[n-1].AEnd == op.AStart && merged[n-1].BEnd == op.BStart {
+			merged[n-1].AEnd = op.AEnd
+			merged[n-1].BEnd = op.BEnd
+			continue
+		}
+		merged = append(merged, op)
+	}
+	return merged
+}
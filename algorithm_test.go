@@ -0,0 +1,183 @@
+package tokendiff
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDiffAlgorithm(t *testing.T) {
+	tests := []struct {
+		name string
+		algo DiffAlgorithm
+		ok   bool
+	}{
+		{"histogram", AlgoHistogram, true},
+		{"myers", AlgoMyers, true},
+		{"patience", AlgoPatience, true},
+		{"minimal", AlgoHistogram, false},
+		{"", AlgoHistogram, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			algo, ok := ParseDiffAlgorithm(tt.name)
+			if algo != tt.algo || ok != tt.ok {
+				t.Errorf("ParseDiffAlgorithm(%q) = %v, %v; want %v, %v", tt.name, algo, ok, tt.algo, tt.ok)
+			}
+			if ok && algo.String() != tt.name {
+				t.Errorf("String() = %q, want %q", algo.String(), tt.name)
+			}
+		})
+	}
+}
+
+// equalCount returns the number of Equal diffs.
+func equalCount(diffs []Diff) int {
+	n := 0
+	for _, d := range diffs {
+		if d.Type == Equal {
+			n++
+		}
+	}
+	return n
+}
+
+// checkReconstructs fails the test if diffs do not turn tokens1 into tokens2.
+func checkReconstructs(t *testing.T, diffs []Diff, tokens1, tokens2 []string) {
+	t.Helper()
+	var old, new []string
+	for _, d := range diffs {
+		if d.Type != Insert {
+			old = append(old, d.Token)
+		}
+		if d.Type != Delete {
+			new = append(new, d.Token)
+		}
+	}
+	if !reflect.DeepEqual(old, tokens1) {
+		t.Errorf("old side = %q, want %q", old, tokens1)
+	}
+	if !reflect.DeepEqual(new, tokens2) {
+		t.Errorf("new side = %q, want %q", new, tokens2)
+	}
+}
+
+func TestDiffAlgorithmEqualCounts(t *testing.T) {
+	// A repeated log line moved past a unique marker
+	text1 := "x ok x ok x ok start x ok x ok end"
+	text2 := "x ok start x ok x ok x ok x ok end"
+
+	tests := []struct {
+		algo   DiffAlgorithm
+		equals int
+	}{
+		{AlgoHistogram, 8},
+		{AlgoMyers, 11},
+		{AlgoPatience, 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algo.String(), func(t *testing.T) {
+			opts := Options{DiffAlgorithm: tt.algo}
+			diffs := DiffStrings(text1, text2, opts)
+			checkReconstructs(t, diffs, Tokenize(text1, opts), Tokenize(text2, opts))
+			if got := equalCount(diffs); got != tt.equals {
+				t.Errorf("Equal tokens = %d, want %d: %v", got, tt.equals, diffs)
+			}
+		})
+	}
+}
+
+func TestDiffAlgorithmPaths(t *testing.T) {
+	inputs := []struct {
+		name  string
+		text1 string
+		text2 string
+	}{
+		{"empty old", "", "a b"},
+		{"empty new", "a b", ""},
+		{"prose", "The quick brown fox jumps over the lazy dog", "The slow brown fox leaps over the dog"},
+		{"repetitive", "a b a b a b c", "b a b a b c a"},
+		{"mixed case", "Hello World again", "hello there world"},
+	}
+
+	for _, algo := range []DiffAlgorithm{AlgoHistogram, AlgoMyers, AlgoPatience} {
+		for _, in := range inputs {
+			t.Run(algo.String()+"/"+in.name, func(t *testing.T) {
+				for _, opts := range []Options{
+					{DiffAlgorithm: algo},
+					{DiffAlgorithm: algo, IgnoreCase: true},
+					{DiffAlgorithm: algo, IgnoreCase: true, PreprocessMinTokens: -1},
+					{DiffAlgorithm: algo, NumericTolerance: 0.5},
+				} {
+					text1, text2 := in.text1, in.text2
+					if opts.IgnoreCase {
+						// Equal tokens come from the new text, so only
+						// same-case inputs reconstruct exactly
+						text1, text2 = strings.ToLower(text1), strings.ToLower(text2)
+					}
+					tokens1, tokens2 := Tokenize(text1, opts), Tokenize(text2, opts)
+					checkReconstructs(t, DiffStrings(text1, text2, opts), tokens1, tokens2)
+					checkReconstructs(t, DiffStringsWithPreprocessing(text1, text2, opts), tokens1, tokens2)
+				}
+			})
+		}
+	}
+}
+
+func TestPatienceDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		text1    string
+		text2    string
+		expected []Diff
+	}{
+		{
+			name:  "unique tokens anchor the diff",
+			text1: "begin x y end",
+			text2: "begin y x end",
+			expected: []Diff{
+				{Equal, "begin"}, {Delete, "x"}, {Equal, "y"}, {Insert, "x"}, {Equal, "end"},
+			},
+		},
+		{
+			name:  "moved block keeps the longest ordered anchors",
+			text1: "one two three four",
+			text2: "three four one two",
+			expected: []Diff{
+				{Delete, "one"}, {Delete, "two"}, {Equal, "three"}, {Equal, "four"}, {Insert, "one"}, {Insert, "two"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DiffStrings(tt.text1, tt.text2, Options{DiffAlgorithm: AlgoPatience})
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("DiffStrings() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLongestIncreasing(t *testing.T) {
+	tests := []struct {
+		name     string
+		matches  [][2]int
+		expected [][2]int
+	}{
+		{"empty", nil, nil},
+		{"already increasing", [][2]int{{0, 0}, {1, 1}, {2, 2}}, [][2]int{{0, 0}, {1, 1}, {2, 2}}},
+		{"one out of order", [][2]int{{0, 2}, {1, 0}, {2, 1}}, [][2]int{{1, 0}, {2, 1}}},
+		{"reversed", [][2]int{{0, 2}, {1, 1}, {2, 0}}, [][2]int{{2, 0}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := longestIncreasing(tt.matches); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("longestIncreasing() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
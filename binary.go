@@ -0,0 +1,17 @@
+package tokendiff
+
+import "bytes"
+
+// BinaryCheckLen is the number of leading bytes LooksBinary examines.
+const BinaryCheckLen = 8192
+
+// LooksBinary returns true if data appears to be binary rather than text:
+// if a NUL byte occurs in its first BinaryCheckLen bytes, the check git and
+// GNU diff make. UTF-8 text never contains NUL bytes, so text with high
+// code points is not reported as binary.
+func LooksBinary(data []byte) bool {
+	if len(data) > BinaryCheckLen {
+		data = data[:BinaryCheckLen]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
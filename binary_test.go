@@ -0,0 +1,30 @@
+package tokendiff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLooksBinary(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"empty", nil, false},
+		{"ascii text", []byte("hello world\n"), false},
+		{"utf-8 with high code points", []byte("naïve café 日本語 😀 \U0010FFFD\n"), false},
+		{"nul byte", []byte("hello\x00world"), true},
+		{"png header", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), true},
+		{"nul within limit", []byte(strings.Repeat("a", BinaryCheckLen-1) + "\x00"), true},
+		{"nul past limit", []byte(strings.Repeat("a", BinaryCheckLen) + "\x00"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := LooksBinary(tt.data); got != tt.want {
+				t.Errorf("LooksBinary() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package tokendiff
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+)
+
+// CaseFold selects how IgnoreCase makes tokens comparable.
+type CaseFold int
+
+const (
+	// CaseFoldNone lowercases tokens with strings.ToLower without folding
+	// them, so "σ" and "ς", or "ß" and "ss", differ. This is the default.
+	CaseFoldNone CaseFold = iota
+
+	// CaseFoldSimple applies Unicode simple case folding, the folding
+	// strings.EqualFold uses: every rune is mapped to one representative
+	// of the runes that are case variants of it, so "σ", "ς", and "Σ", or
+	// "K" and the Kelvin sign, compare equal. Each rune still folds to a
+	// single rune.
+	CaseFoldSimple
+
+	// CaseFoldUnicode applies Unicode full case folding, as the Fold caser
+	// of golang.org/x/text/cases does: as CaseFoldSimple, but runes whose
+	// folding is several runes, such as "ß" and "ẞ" to "ss" and "ﬁ" to
+	// "fi", are expanded, so "STRASSE" and "straße" compare equal.
+	// Locale-specific foldings, such as the Turkish dotless "ı", are not
+	// applied.
+	CaseFoldUnicode
+)
+
+// String returns the folding's name as accepted by ParseCaseFold.
+func (f CaseFold) String() string {
+	switch f {
+	case CaseFoldNone:
+		return "none"
+	case CaseFoldSimple:
+		return "simple"
+	case CaseFoldUnicode:
+		return "unicode"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseCaseFold returns the CaseFold named "none", "simple", or "unicode".
+func ParseCaseFold(name string) (CaseFold, bool) {
+	for _, f := range []CaseFold{CaseFoldNone, CaseFoldSimple, CaseFoldUnicode} {
+		if f.String() == name {
+			return f, true
+		}
+	}
+	return CaseFoldNone, false
+}
+
+// Fold returns the comparison key of s, under which IgnoreCase compares
+// tokens. Keys are only compared, never shown, so they need not be
+// lowercase.
+func (f CaseFold) Fold(s string) string {
+	switch f {
+	case CaseFoldSimple:
+		return strings.Map(simpleFold, s)
+	case CaseFoldUnicode:
+		// A Caser keeps state, so each call needs its own
+		return cases.Fold().String(s)
+	default:
+		return strings.ToLower(s)
+	}
+}
+
+// foldTokens returns the comparison keys of tokens.
+func (f CaseFold) foldTokens(tokens []string) []string {
+	keys := make([]string, len(tokens))
+	for i, t := range tokens {
+		keys[i] = f.Fold(t)
+	}
+	return keys
+}
+
+// equal reports whether a and b are equal under the folding.
+func (f CaseFold) equal(a, b string) bool {
+	if f == CaseFoldUnicode {
+		return f.Fold(a) == f.Fold(b)
+	}
+	return strings.EqualFold(a, b)
+}
+
+// simpleFold maps r to the lowercase of the smallest rune in its
+// unicode.SimpleFold orbit, which is the same for all case variants of r.
+func simpleFold(r rune) rune {
+	if r < utf8.RuneSelf {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}
+	smallest := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		smallest = min(smallest, f)
+	}
+	return unicode.ToLower(smallest)
+}
@@ -0,0 +1,136 @@
+package tokendiff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCaseFold(t *testing.T) {
+	tests := []struct {
+		name string
+		fold CaseFold
+		ok   bool
+	}{
+		{"none", CaseFoldNone, true},
+		{"simple", CaseFoldSimple, true},
+		{"unicode", CaseFoldUnicode, true},
+		{"turkic", CaseFoldNone, false},
+		{"", CaseFoldNone, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fold, ok := ParseCaseFold(tt.name)
+			if fold != tt.fold || ok != tt.ok {
+				t.Errorf("ParseCaseFold(%q) = %v, %v; want %v, %v", tt.name, fold, ok, tt.fold, tt.ok)
+			}
+			if ok && fold.String() != tt.name {
+				t.Errorf("String() = %q, want %q", fold.String(), tt.name)
+			}
+		})
+	}
+}
+
+func TestCaseFoldEqual(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		none    bool
+		simple  bool
+		unicode bool
+	}{
+		{"ascii", "Hello", "hELLO", true, true, true},
+		{"different words", "hello", "world", false, false, false},
+		{"final sigma", "ΣΟΦΟΣ", "σοφος", false, true, true},
+		{"kelvin sign", "K", "k", true, true, true},
+		{"long s", "ſ", "S", false, true, true},
+		{"sharp s", "STRASSE", "straße", false, false, true},
+		{"capital sharp s", "STRAẞE", "strasse", false, false, true},
+		{"ligature", "ﬁle", "FILE", false, false, true},
+		{"iota with dialytika and tonos", "\u0390", "\u03B9\u0308\u0301", false, false, true},
+		{"upsilon with dialytika and tonos", "\u03B0", "\u03C5\u0308\u0301", false, false, true},
+		{"ypogegrammeni", "\u1F80", "\u1F00\u03B9", false, false, true},
+		{"prosgegrammeni", "\u1FFC", "\u03C9\u03B9", false, false, true},
+		{"prosgegrammeni and ypogegrammeni", "\u1F88", "\u1F80", true, true, true},
+		{"dotless i is not folded", "ı", "I", false, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, c := range []struct {
+				fold CaseFold
+				want bool
+			}{{CaseFoldNone, tt.none}, {CaseFoldSimple, tt.simple}, {CaseFoldUnicode, tt.unicode}} {
+				if got := c.fold.Fold(tt.a) == c.fold.Fold(tt.b); got != c.want {
+					t.Errorf("%v: fold(%q) == fold(%q) = %v, want %v", c.fold, tt.a, tt.b, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCaseFoldDiff(t *testing.T) {
+	text1 := "Die STRASSE ist lang"
+	text2 := "die straße ist kurz"
+	want := map[CaseFold][]Diff{
+		CaseFoldNone: {
+			{Type: Equal, Token: "die"},
+			{Type: Delete, Token: "STRASSE"},
+			{Type: Insert, Token: "straße"},
+			{Type: Equal, Token: "ist"},
+			{Type: Delete, Token: "lang"},
+			{Type: Insert, Token: "kurz"},
+		},
+		CaseFoldUnicode: {
+			{Type: Equal, Token: "die"},
+			{Type: Equal, Token: "straße"},
+			{Type: Equal, Token: "ist"},
+			{Type: Delete, Token: "lang"},
+			{Type: Insert, Token: "kurz"},
+		},
+	}
+
+	for fold, expected := range want {
+		opts := DefaultOptions()
+		opts.IgnoreCase = true
+		opts.CaseFold = fold
+		opts.PreprocessMinTokens = -1
+		for name, diff := range map[string]func(string, string, Options) []Diff{
+			"DiffStrings":                  DiffStrings,
+			"DiffStringsWithPreprocessing": DiffStringsWithPreprocessing,
+		} {
+			if got := diff(text1, text2, opts); !reflect.DeepEqual(got, expected) {
+				t.Errorf("%v: %s() = %v, want %v", fold, name, got, expected)
+			}
+		}
+
+		// Without IgnoreCase the folding has no effect
+		opts.IgnoreCase = false
+		if got := DiffStrings("STRASSE", "straße", opts); len(got) != 2 {
+			t.Errorf("%v without IgnoreCase: DiffStrings() = %v, want a delete and an insert", fold, got)
+		}
+	}
+}
+
+func TestCaseFoldStatistics(t *testing.T) {
+	text1 := "Die STRASSE ist lang"
+	text2 := "die straße ist kurz"
+	diffs := DiffStrings(text1, text2, DefaultOptions())
+
+	tests := []struct {
+		fold CaseFold
+		want DiffStatistics
+	}{
+		{CaseFoldNone, DiffStatistics{OldWords: 4, NewWords: 4, DeletedWords: 2, InsertedWords: 2, CommonWords: 2, DeletedChars: 11, InsertedChars: 10, CommonChars: 6}},
+		{CaseFoldUnicode, DiffStatistics{OldWords: 4, NewWords: 4, DeletedWords: 1, InsertedWords: 1, CommonWords: 3, DeletedChars: 4, InsertedChars: 4, CommonChars: 12}},
+	}
+
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		opts.IgnoreCase = true
+		opts.CaseFold = tt.fold
+		if got := ComputeStatistics(text1, text2, diffs, opts); got != tt.want {
+			t.Errorf("%v: ComputeStatistics() = %+v, want %+v", tt.fold, got, tt.want)
+		}
+	}
+}
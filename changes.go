@@ -0,0 +1,139 @@
+package tokendiff
+
+import "fmt"
+
+// Change is a run of adjacent Delete and Insert diffs bounded by Equal
+// tokens or the ends of the input. Its ID is derived from where the change
+// starts, so rendering the same diff again yields the same IDs, and review
+// comments or HTML anchors can refer to a change by ID.
+type Change struct {
+	ID       string   `json:"id"`                 // "c<old>-<new>": token indexes where the change starts
+	Deleted  []string `json:"deleted,omitempty"`  // deleted tokens, in order
+	Inserted []string `json:"inserted,omitempty"` // inserted tokens, in order
+	OldStart int      `json:"oldStart"`           // byte offset of the change in Text1
+	OldEnd   int      `json:"oldEnd"`             // byte offset after the last deleted token
+	NewStart int      `json:"newStart"`           // byte offset of the change in Text2
+	NewEnd   int      `json:"newEnd"`             // byte offset after the last inserted token
+}
+
+// ChangeID returns the ID of a change starting at token index old in the old
+// text and new in the new text.
+func ChangeID(old, new int) string {
+	return fmt.Sprintf("c%d-%d", old, new)
+}
+
+// Changes groups the diffs in result into changes with stable IDs. Byte
+// offsets come from the result's positions; for a pure insertion, OldStart
+// and OldEnd both mark where the text was inserted, and likewise for a pure
+// deletion in the new text. Offsets are 0 if result has no positions.
+func Changes(result DiffResult) []Change {
+	var changes []Change
+	var cur *Change
+	idx1, idx2 := 0, 0
+
+	finish := func() {
+		if cur == nil {
+			return
+		}
+		cur.OldEnd = tokenEnd(result.Positions1, idx1)
+		cur.NewEnd = tokenEnd(result.Positions2, idx2)
+		changes = append(changes, *cur)
+		cur = nil
+	}
+
+	for _, d := range result.Diffs {
+		if d.Type == Equal {
+			finish()
+			idx1++
+			idx2++
+			continue
+		}
+		if cur == nil {
+			cur = &Change{
+				ID:       ChangeID(idx1, idx2),
+				OldStart: tokenEnd(result.Positions1, idx1),
+				NewStart: tokenEnd(result.Positions2, idx2),
+			}
+		}
+		switch d.Type {
+		case Delete:
+			if len(cur.Deleted) == 0 && idx1 < len(result.Positions1) {
+				cur.OldStart = result.Positions1[idx1].Start
+			}
+			cur.Deleted = append(cur.Deleted, d.Token)
+			idx1++
+		case Insert:
+			if len(cur.Inserted) == 0 && idx2 < len(result.Positions2) {
+				cur.NewStart = result.Positions2[idx2].Start
+			}
+			cur.Inserted = append(cur.Inserted, d.Token)
+			idx2++
+		}
+	}
+	finish()
+
+	return changes
+}
+
+// ChangeRange is the byte range of a run of deleted or inserted tokens, for
+// mapping changes onto the files, as an editor highlighting them does. A
+// deletion has an empty new range, and an insertion an empty old range,
+// marking where the run was deleted or inserted.
+type ChangeRange struct {
+	Type     Operation // Delete or Insert
+	OldStart int       // byte offset of the run in Text1
+	OldEnd   int       // byte offset after the run in Text1
+	NewStart int       // byte offset of the run in Text2
+	NewEnd   int       // byte offset after the run in Text2
+}
+
+// ExtractChangeRanges returns the byte ranges of the runs of Delete and
+// Insert diffs in result, in order, using its positions. A replacement is a
+// deletion followed by an insertion. Empty ranges are placed as in Changes,
+// and offsets are 0 if result has no positions.
+func ExtractChangeRanges(result DiffResult) []ChangeRange {
+	var ranges []ChangeRange
+	idx1, idx2 := 0, 0
+	for i := 0; i < len(result.Diffs); {
+		op := result.Diffs[i].Type
+		start := i
+		for i < len(result.Diffs) && result.Diffs[i].Type == op {
+			i++
+		}
+		n := i - start
+
+		switch op {
+		case Equal:
+			idx1 += n
+			idx2 += n
+		case Delete:
+			r := ChangeRange{Type: Delete, NewStart: tokenEnd(result.Positions2, idx2)}
+			r.NewEnd = r.NewStart
+			if idx1+n <= len(result.Positions1) {
+				r.OldStart = result.Positions1[idx1].Start
+				r.OldEnd = result.Positions1[idx1+n-1].End
+			}
+			ranges = append(ranges, r)
+			idx1 += n
+		case Insert:
+			r := ChangeRange{Type: Insert, OldStart: tokenEnd(result.Positions1, idx1)}
+			r.OldEnd = r.OldStart
+			if idx2+n <= len(result.Positions2) {
+				r.NewStart = result.Positions2[idx2].Start
+				r.NewEnd = result.Positions2[idx2+n-1].End
+			}
+			ranges = append(ranges, r)
+			idx2 += n
+		}
+	}
+	return ranges
+}
+
+// tokenEnd returns the byte offset just after token i-1, or 0 if i is 0 or
+// out of range.
+func tokenEnd(positions []TokenPos, i int) int {
+	if i <= 0 || i > len(positions) {
+		return 0
+	}
+	return positions[i-1].End
+}
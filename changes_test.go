@@ -0,0 +1,162 @@
+package tokendiff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		text1    string
+		text2    string
+		expected []Change
+	}{
+		{
+			name:     "identical",
+			text1:    "hello world",
+			text2:    "hello world",
+			expected: nil,
+		},
+		{
+			name:  "replacement",
+			text1: "the quick fox",
+			text2: "the slow fox",
+			expected: []Change{
+				{ID: "c1-1", Deleted: []string{"quick"}, Inserted: []string{"slow"}, OldStart: 4, OldEnd: 9, NewStart: 4, NewEnd: 8},
+			},
+		},
+		{
+			name:  "insertion and deletion",
+			text1: "a b c d",
+			text2: "a x b d",
+			expected: []Change{
+				{ID: "c1-1", Inserted: []string{"x"}, OldStart: 1, OldEnd: 1, NewStart: 2, NewEnd: 3},
+				{ID: "c2-3", Deleted: []string{"c"}, OldStart: 4, OldEnd: 5, NewStart: 5, NewEnd: 5},
+			},
+		},
+		{
+			name:  "insertion at start",
+			text1: "b",
+			text2: "a b",
+			expected: []Change{
+				{ID: "c0-0", Inserted: []string{"a"}, OldStart: 0, OldEnd: 0, NewStart: 0, NewEnd: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := DiffStringsWithPositions(tt.text1, tt.text2, DefaultOptions())
+			got := Changes(result)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Changes() = %+v, want %+v", got, tt.expected)
+			}
+			// Rendering the same diff again yields the same IDs
+			if again := Changes(result); !reflect.DeepEqual(again, got) {
+				t.Errorf("Changes() not stable: %+v, then %+v", got, again)
+			}
+		})
+	}
+}
+
+func TestChangesWithoutPositions(t *testing.T) {
+	result := DiffResult{Diffs: []Diff{{Equal, "a"}, {Delete, "b"}, {Insert, "c"}}}
+	expected := []Change{{ID: "c1-1", Deleted: []string{"b"}, Inserted: []string{"c"}}}
+
+	if got := Changes(result); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Changes() = %+v, want %+v", got, expected)
+	}
+}
+
+func TestExtractChangeRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		text1    string
+		text2    string
+		expected []ChangeRange
+	}{
+		{
+			name:     "identical",
+			text1:    "same text",
+			text2:    "same text",
+			expected: nil,
+		},
+		{
+			name:  "replacement and trailing insertion",
+			text1: "the quick brown fox",
+			text2: "the slow brown fox jumps",
+			expected: []ChangeRange{
+				{Type: Delete, OldStart: 4, OldEnd: 9, NewStart: 3, NewEnd: 3},
+				{Type: Insert, OldStart: 9, OldEnd: 9, NewStart: 4, NewEnd: 8},
+				{Type: Insert, OldStart: 19, OldEnd: 19, NewStart: 19, NewEnd: 24},
+			},
+		},
+		{
+			name:  "deleted run spans the whitespace between its tokens",
+			text1: "one two  three four",
+			text2: "one four",
+			expected: []ChangeRange{
+				{Type: Delete, OldStart: 4, OldEnd: 14, NewStart: 3, NewEnd: 3},
+			},
+		},
+		{
+			name:  "leading insertion",
+			text1: "world",
+			text2: "hello world",
+			expected: []ChangeRange{
+				{Type: Insert, OldStart: 0, OldEnd: 0, NewStart: 0, NewEnd: 5},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := DiffStringsWithPositions(tt.text1, tt.text2, DefaultOptions())
+			ranges := ExtractChangeRanges(result)
+			if !reflect.DeepEqual(ranges, tt.expected) {
+				t.Fatalf("ExtractChangeRanges() =\n%+v\nwant\n%+v", ranges, tt.expected)
+			}
+
+			// Each range covers exactly the tokens of its run
+			idx1, idx2 := 0, 0
+			for _, d := range result.Diffs {
+				switch d.Type {
+				case Equal:
+					idx1++
+					idx2++
+				case Delete:
+					if !rangeCovers(ranges, Delete, result.Positions1[idx1], func(r ChangeRange) (int, int) { return r.OldStart, r.OldEnd }) {
+						t.Errorf("deleted token %q at %+v is not in a Delete range", d.Token, result.Positions1[idx1])
+					}
+					idx1++
+				case Insert:
+					if !rangeCovers(ranges, Insert, result.Positions2[idx2], func(r ChangeRange) (int, int) { return r.NewStart, r.NewEnd }) {
+						t.Errorf("inserted token %q at %+v is not in an Insert range", d.Token, result.Positions2[idx2])
+					}
+					idx2++
+				}
+			}
+		})
+	}
+}
+
+// rangeCovers reports whether one of the ranges of type op contains pos,
+// using span to pick the side.
+func rangeCovers(ranges []ChangeRange, op Operation, pos TokenPos, span func(ChangeRange) (int, int)) bool {
+	for _, r := range ranges {
+		start, end := span(r)
+		if r.Type == op && start <= pos.Start && pos.End <= end {
+			return true
+		}
+	}
+	return false
+}
+
+func TestExtractChangeRangesWithoutPositions(t *testing.T) {
+	result := DiffResult{Diffs: DiffStrings("a b", "a c", DefaultOptions())}
+	expected := []ChangeRange{{Type: Delete}, {Type: Insert}}
+	if got := ExtractChangeRanges(result); !reflect.DeepEqual(got, expected) {
+		t.Errorf("ExtractChangeRanges() = %+v, want %+v", got, expected)
+	}
+}
@@ -0,0 +1,143 @@
+package tokendiff
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// CharacterDiff computes a character-level diff between two tokens, using
+// the same algorithm as DiffTokens on their runes. Adjacent characters with
+// the same operation are combined, so the result is a sequence of runs:
+// CharacterDiff("getData", "setData") returns Delete[g] Insert[s]
+// Equal[etData]. Multi-byte runes are never split.
+func CharacterDiff(tok1, tok2 string) []Diff {
+	return diffRuns(runeStrings(tok1), runeStrings(tok2))
+}
+
+// GraphemeDiff is CharacterDiff on user-perceived characters (grapheme
+// clusters) instead of runes: a base character with its combining marks,
+// an emoji with its skin-tone modifier or variation selector, a sequence
+// of emoji joined by zero-width joiners such as "👩\u200d💻", a flag's
+// pair of regional indicators, and "\r\n" are each diffed as one unit, so
+// a changed emoji is never shown partly deleted.
+func GraphemeDiff(tok1, tok2 string) []Diff {
+	return diffRuns(graphemeStrings(tok1), graphemeStrings(tok2))
+}
+
+// diffRuns diffs two character sequences and combines adjacent characters
+// with the same operation into runs.
+func diffRuns(chars1, chars2 []string) []Diff {
+	diffs := DiffTokens(chars1, chars2)
+
+	var runs []Diff
+	for _, d := range diffs {
+		if n := len(runs); n > 0 && runs[n-1].Type == d.Type {
+			runs[n-1].Token += d.Token
+			continue
+		}
+		runs = append(runs, d)
+	}
+	return runs
+}
+
+// runeStrings splits s into one string per rune. Invalid UTF-8 bytes are
+// kept as single-byte strings, so joining the result reproduces s.
+func runeStrings(s string) []string {
+	chars := make([]string, 0, len(s))
+	for len(s) > 0 {
+		_, size := utf8.DecodeRuneInString(s)
+		chars = append(chars, s[:size])
+		s = s[size:]
+	}
+	return chars
+}
+
+// graphemeStrings splits s into one string per grapheme cluster, as
+// described for GraphemeDiff. It approximates Unicode's extended grapheme
+// clusters with the rules that matter for diffing: combining marks,
+// emoji modifiers, tags, and variation selectors extend the cluster before
+// them, a zero-width joiner joins the next rune to it, and regional
+// indicators pair up. Invalid UTF-8 bytes are kept as single-byte strings,
+// so joining the result reproduces s.
+func graphemeStrings(s string) []string {
+	clusters := make([]string, 0, len(s))
+	for len(s) > 0 {
+		n := graphemeLen(s)
+		clusters = append(clusters, s[:n])
+		s = s[n:]
+	}
+	return clusters
+}
+
+// graphemeLen returns the length in bytes of the grapheme cluster at the
+// start of s, which must not be empty.
+func graphemeLen(s string) int {
+	r, n := utf8.DecodeRuneInString(s)
+	switch {
+	case r == utf8.RuneError && n == 1:
+		return 1
+	case r == '\r':
+		if len(s) > 1 && s[1] == '\n' {
+			return 2
+		}
+		return 1
+	case isRegionalIndicator(r):
+		if next, size := utf8.DecodeRuneInString(s[n:]); isRegionalIndicator(next) {
+			n += size
+		}
+	}
+
+	for joined := false; n < len(s); {
+		next, size := utf8.DecodeRuneInString(s[n:])
+		if next == utf8.RuneError && size == 1 {
+			break
+		}
+		if !extendsGrapheme(next) && !(joined && next >= 0x20) {
+			break
+		}
+		joined = next == zeroWidthJoiner
+		n += size
+	}
+	return n
+}
+
+// extendsGrapheme reports whether r belongs to the grapheme cluster before
+// it: a combining mark, a zero-width joiner, an emoji skin-tone modifier,
+// or a tag character, as used in subdivision flags.
+func extendsGrapheme(r rune) bool {
+	switch {
+	case r == zeroWidthJoiner:
+		return true
+	case r >= 0x1F3FB && r <= 0x1F3FF:
+		return true
+	case r >= 0xE0020 && r <= 0xE007F:
+		return true
+	default:
+		return r >= 0x300 && unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc)
+	}
+}
+
+// isRegionalIndicator reports whether r is one of the regional indicator
+// symbols, pairs of which are drawn as a flag.
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// refinable returns the character-level diff of a replaced token pair if
+// the two tokens share at least one character, so that refining them shows
+// less changed text than replacing the whole token. With graphemes, the
+// characters are grapheme clusters, as for GraphemeDiff.
+func refinable(old, new string, graphemes bool) ([]Diff, bool) {
+	var runs []Diff
+	if graphemes {
+		runs = GraphemeDiff(old, new)
+	} else {
+		runs = CharacterDiff(old, new)
+	}
+	for _, d := range runs {
+		if d.Type == Equal {
+			return runs, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,234 @@
+package tokendiff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCharacterDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		tok1     string
+		tok2     string
+		expected []Diff
+	}{
+		{
+			name:     "single letter changed",
+			tok1:     "getData",
+			tok2:     "setData",
+			expected: []Diff{{Delete, "g"}, {Insert, "s"}, {Equal, "etData"}},
+		},
+		{
+			name:     "identical",
+			tok1:     "same",
+			tok2:     "same",
+			expected: []Diff{{Equal, "same"}},
+		},
+		{
+			name:     "suffix added",
+			tok1:     "item",
+			tok2:     "items",
+			expected: []Diff{{Equal, "item"}, {Insert, "s"}},
+		},
+		{
+			name:     "multi-byte runes",
+			tok1:     "café",
+			tok2:     "cafés",
+			expected: []Diff{{Equal, "café"}, {Insert, "s"}},
+		},
+		{
+			name:     "multi-byte rune replaced",
+			tok1:     "naïve",
+			tok2:     "naive",
+			expected: []Diff{{Equal, "na"}, {Delete, "ï"}, {Insert, "i"}, {Equal, "ve"}},
+		},
+		{
+			name:     "empty old token",
+			tok1:     "",
+			tok2:     "ab",
+			expected: []Diff{{Insert, "ab"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CharacterDiff(tt.tok1, tt.tok2); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("CharacterDiff(%q, %q) = %v, want %v", tt.tok1, tt.tok2, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRuneStrings(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"abc", []string{"a", "b", "c"}},
+		{"日本", []string{"日", "本"}},
+		{"a\xffb", []string{"a", "\xff", "b"}},
+		{"", []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := runeStrings(tt.input); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("runeStrings(%q) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestGraphemeDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		tok1     string
+		tok2     string
+		expected []Diff
+	}{
+		{
+			name:     "ascii as CharacterDiff",
+			tok1:     "getData",
+			tok2:     "setData",
+			expected: []Diff{{Delete, "g"}, {Insert, "s"}, {Equal, "etData"}},
+		},
+		{
+			name:     "ZWJ sequence is one unit",
+			tok1:     "dev\U0001F469\u200d\U0001F4BB",
+			tok2:     "dev\U0001F469\u200d\U0001F52C",
+			expected: []Diff{{Equal, "dev"}, {Delete, "\U0001F469\u200d\U0001F4BB"}, {Insert, "\U0001F469\u200d\U0001F52C"}},
+		},
+		{
+			name:     "skin-tone modifier",
+			tok1:     "ok\U0001F44D",
+			tok2:     "ok\U0001F44D\U0001F3FD",
+			expected: []Diff{{Equal, "ok"}, {Delete, "\U0001F44D"}, {Insert, "\U0001F44D\U0001F3FD"}},
+		},
+		{
+			name:     "combining accent",
+			tok1:     "cafe\u0301",
+			tok2:     "cafe",
+			expected: []Diff{{Equal, "caf"}, {Delete, "e\u0301"}, {Insert, "e"}},
+		},
+		{
+			name:     "flags",
+			tok1:     "\U0001F1EB\U0001F1F7\U0001F1E9\U0001F1EA",
+			tok2:     "\U0001F1EB\U0001F1F7\U0001F1EA\U0001F1F8",
+			expected: []Diff{{Equal, "\U0001F1EB\U0001F1F7"}, {Delete, "\U0001F1E9\U0001F1EA"}, {Insert, "\U0001F1EA\U0001F1F8"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GraphemeDiff(tt.tok1, tt.tok2); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("GraphemeDiff(%q, %q) = %q, want %q", tt.tok1, tt.tok2, got, tt.expected)
+			}
+		})
+	}
+
+	// By rune, the shared woman and joiner would be split from the rest
+	if got := CharacterDiff("\U0001F469\u200d\U0001F4BB", "\U0001F469\u200d\U0001F52C"); len(got) == 0 || got[0] != (Diff{Equal, "\U0001F469\u200d"}) {
+		t.Errorf("CharacterDiff() = %q, want a partial emoji in common", got)
+	}
+}
+
+func TestGraphemeStrings(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"abc", []string{"a", "b", "c"}},
+		{"e\u0301\u0327x", []string{"e\u0301\u0327", "x"}},
+		{"\U0001F468\u200d\U0001F469\u200d\U0001F467!", []string{"\U0001F468\u200d\U0001F469\u200d\U0001F467", "!"}},
+		{"\u2764\ufe0f", []string{"\u2764\ufe0f"}},
+		{"\U0001F1FA\U0001F1F8\U0001F1EC", []string{"\U0001F1FA\U0001F1F8", "\U0001F1EC"}},
+		{"a\r\nb\r", []string{"a", "\r\n", "b", "\r"}},
+		{"\u0301a", []string{"\u0301", "a"}},
+		{"a\xff\u0301", []string{"a", "\xff", "\u0301"}},
+		{"", []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := graphemeStrings(tt.input); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("graphemeStrings(%q) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestFormatRefineTokens(t *testing.T) {
+	markers := FormatOptions{StartDelete: "[-", StopDelete: "-]", StartInsert: "{+", StopInsert: "+}"}
+	refine := markers
+	refine.RefineTokens = true
+
+	tests := []struct {
+		name     string
+		text1    string
+		text2    string
+		opts     FormatOptions
+		expected string
+	}{
+		{
+			name:     "refined single token",
+			text1:    "x = getData()",
+			text2:    "x = setData()",
+			opts:     refine,
+			expected: "x = [-g-]{+s+}etData()",
+		},
+		{
+			name:     "opt-in",
+			text1:    "x = getData()",
+			text2:    "x = setData()",
+			opts:     markers,
+			expected: "x = [-getData()-] {+setData()+}",
+		},
+		{
+			name:     "no common characters",
+			text1:    "a foo b",
+			text2:    "a bar b",
+			opts:     refine,
+			expected: "a [-foo-] {+bar+} b",
+		},
+		{
+			name:     "larger change is not refined",
+			text1:    "a old words b",
+			text2:    "a new b",
+			opts:     refine,
+			expected: "a [-old words-] {+new+} b",
+		},
+		{
+			name:     "multi-byte runes",
+			text1:    "le café noir",
+			text2:    "le cafés noir",
+			opts:     refine,
+			expected: "le café{+s+} noir",
+		},
+		{
+			name:     "no deleted",
+			text1:    "getData now",
+			text2:    "setData now",
+			opts:     FormatOptions{StartInsert: "{+", StopInsert: "+}", NoDeleted: true, RefineTokens: true},
+			expected: "{+s+}etData now",
+		},
+		{
+			name:     "emoji split by rune",
+			text1:    "hi \U0001F469\u200d\U0001F4BB all",
+			text2:    "hi \U0001F469\u200d\U0001F52C all",
+			opts:     refine,
+			expected: "hi \U0001F469\u200d[-\U0001F4BB-]{+\U0001F52C+} all",
+		},
+		{
+			name:     "emoji kept whole in grapheme mode",
+			text1:    "hi \U0001F469\u200d\U0001F4BB all",
+			text2:    "hi \U0001F469\u200d\U0001F52C all",
+			opts:     FormatOptions{StartDelete: "[-", StopDelete: "-]", StartInsert: "{+", StopInsert: "+}", RefineTokens: true, GraphemeMode: true},
+			expected: "hi [-\U0001F469\u200d\U0001F4BB-] {+\U0001F469\u200d\U0001F52C+} all",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := DiffStringsWithPositions(tt.text1, tt.text2, DefaultOptions())
+			if got := FormatDiffResultAdvanced(result, tt.opts); got != tt.expected {
+				t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
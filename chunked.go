@@ -0,0 +1,268 @@
+package tokendiff
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// DefaultChunkSize is the approximate number of bytes of old text diffed per
+// window by DiffChunked when no chunk size is given.
+const DefaultChunkSize = 1 << 20
+
+// blockReader reads text in blocks that end at a blank line, or at the end
+// of the line that brings a block to maxSize bytes, so that text without
+// blank lines is still read in pieces. Each block includes its trailing blank
+// lines, so concatenating blocks reproduces the input exactly.
+type blockReader struct {
+	r       *bufio.Reader
+	maxSize int    // block size at which a block ends early, if positive
+	pending string // first line of the next block, already read
+	eof     bool
+}
+
+// newBlockReader creates a blockReader reading from r in blocks of at most
+// about maxSize bytes; a maxSize of 0 or less ends blocks only at blank lines.
+func newBlockReader(r io.Reader, maxSize int) *blockReader {
+	return &blockReader{r: bufio.NewReader(r), maxSize: maxSize}
+}
+
+// next returns the next block, or "" with io.EOF when input is exhausted.
+func (b *blockReader) next() (string, error) {
+	var sb strings.Builder
+	sb.WriteString(b.pending)
+	b.pending = ""
+	sawBlank := false
+
+	for !b.eof {
+		line, err := b.r.ReadString('\n')
+		if err == io.EOF {
+			b.eof = true
+		} else if err != nil {
+			return "", err
+		}
+		if line == "" {
+			break
+		}
+
+		blank := isBlankLine(line)
+		if sawBlank && !blank {
+			// First line of the next block
+			b.pending = line
+			break
+		}
+		sb.WriteString(line)
+		if blank {
+			sawBlank = true
+		}
+		if b.maxSize > 0 && sb.Len() >= b.maxSize {
+			break
+		}
+	}
+
+	if sb.Len() == 0 {
+		return "", io.EOF
+	}
+	return sb.String(), nil
+}
+
+// exhausted returns true if no blocks remain to be read.
+func (b *blockReader) exhausted() bool {
+	if b.pending == "" && !b.eof {
+		if _, err := b.r.Peek(1); err == io.EOF {
+			b.eof = true
+		}
+	}
+	return b.pending == "" && b.eof
+}
+
+// isBlankLine returns true if line contains only a line terminator.
+func isBlankLine(line string) bool {
+	return line == "\n" || line == "\r\n"
+}
+
+// DiffChunked performs a whole-file diff of two large inputs without holding
+// either in memory. Both inputs are split into blocks at blank lines, or at a
+// line boundary once a block reaches chunkSize bytes, and aligned windows
+// (the same number of blocks from each side, sized so the old side holds
+// about chunkSize bytes and the new side at most about chunkSize bytes more)
+// are diffed independently. Each window's formatted output is written to w
+// as soon as it is computed, so peak memory is bounded by a few times
+// chunkSize rather than the file size. A single line is never split, so a
+// line longer than chunkSize is held whole.
+//
+// Because windows are diffed independently, a change that moves text across
+// a window boundary, or inserts or removes whole blocks, may be reported as
+// separate deletions and insertions in neighboring windows. Line numbers are
+// not supported in chunked mode. A chunkSize of 0 or less uses
+// DefaultChunkSize.
+//
+// Returns the aggregate statistics for all windows.
+func DiffChunked(r1, r2 io.Reader, opts Options, fmtOpts FormatOptions, chunkSize int, w io.Writer) (DiffStatistics, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	fmtOpts.ShowLineNumbers = false
+
+	blocks1 := newBlockReader(r1, chunkSize)
+	blocks2 := newBlockReader(r2, chunkSize)
+
+	var total DiffStatistics
+	var trailing string
+	for {
+		window1, window2, err := readWindows(blocks1, blocks2, chunkSize)
+		if err != nil {
+			return total, err
+		}
+		if window1 == "" && window2 == "" {
+			break
+		}
+
+		result := DiffWholeFiles(window1, window2, opts, fmtOpts)
+		total.Add(result.Statistics)
+		if len(result.Result.Positions1) == 0 && len(result.Result.Positions2) == 0 {
+			// A window of whitespace alone, such as a run of blank lines
+			// cut off from its block, joins the carried-over whitespace
+			trailing += window2
+			continue
+		}
+
+		// The formatter drops whitespace after a window's last token. Carry it
+		// over and write it only if another window follows, which matches
+		// the whole-file output of the final window.
+		if _, err := io.WriteString(w, trailing+result.Formatted); err != nil {
+			return total, err
+		}
+		trailing = trailingWhitespace(window2, result.Result.Positions2)
+	}
+
+	return total, nil
+}
+
+// DiffReaders performs a line-by-line diff of two inputs, as DiffLineByLine
+// does with the "best" algorithm and DefaultLineThreshold, reading them
+// incrementally and writing each line as RenderLineDiff would, or as
+// RenderLineDiffWithNumbers when fmtOpts.ShowLineNumbers is set. Set
+// fmtOpts.LineNumWidth yourself; it cannot be sized from inputs not yet read.
+//
+// DiffLineByLine holds both inputs and every line result in memory. DiffReaders
+// instead splits the inputs into blocks at blank lines, like DiffChunked, and
+// diffs aligned windows of about DefaultChunkSize bytes one at a time, so
+// peak memory is bounded by a few times the window size, plus the longest
+// line, rather than the file size. The
+// tradeoff is that lines are only matched within a window: a line moved
+// across a window boundary, or whole blocks inserted or removed, may be
+// reported as separate deletions and insertions where the in-memory diff
+// would pair them. Inputs that fit in one window produce the same output as
+// the in-memory path.
+func DiffReaders(r1, r2 io.Reader, opts Options, fmtOpts FormatOptions, w io.Writer) error {
+	return diffReaders(r1, r2, opts, fmtOpts, DefaultChunkSize, w)
+}
+
+// diffReaders implements DiffReaders with windows of chunkSize bytes.
+func diffReaders(r1, r2 io.Reader, opts Options, fmtOpts FormatOptions, chunkSize int, w io.Writer) error {
+	blocks1 := newBlockReader(r1, chunkSize)
+	blocks2 := newBlockReader(r2, chunkSize)
+
+	// The text after the last newline is a line of its own, even when empty,
+	// as it is for strings.Split in DiffLineByLine
+	endsInNewline1, endsInNewline2 := true, true
+	oldLineNum, newLineNum := 1, 1
+	for {
+		window1, window2, err := readWindows(blocks1, blocks2, chunkSize)
+		if err != nil {
+			return err
+		}
+
+		lines1, lines2 := windowLines(window1), windowLines(window2)
+		if window1 != "" {
+			endsInNewline1 = strings.HasSuffix(window1, "\n")
+		}
+		if window2 != "" {
+			endsInNewline2 = strings.HasSuffix(window2, "\n")
+		}
+		done := blocks1.exhausted() && blocks2.exhausted()
+		if done {
+			if endsInNewline1 {
+				lines1 = append(lines1, "")
+			}
+			if endsInNewline2 {
+				lines2 = append(lines2, "")
+			}
+		}
+
+		var output LineDiffOutput
+		streamLines(lines1, lines2, oldLineNum, newLineNum, opts, fmtOpts, "best", DefaultLineThreshold, func(r LineDiffResult) {
+			output.Lines = append(output.Lines, r)
+		})
+		rendered := RenderLineDiff(output, 0, fmtOpts)
+		if fmtOpts.ShowLineNumbers {
+			rendered = RenderLineDiffWithNumbers(output, 0, fmtOpts)
+		}
+		if _, err := io.WriteString(w, rendered); err != nil {
+			return err
+		}
+		oldLineNum += len(lines1)
+		newLineNum += len(lines2)
+
+		if done {
+			return nil
+		}
+	}
+}
+
+// windowLines splits a window into its lines, dropping the empty string after
+// a final newline; the next window continues on a new line.
+func windowLines(window string) []string {
+	if window == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(window, "\n"), "\n")
+}
+
+// readWindows reads the next pair of aligned windows: about chunkSize bytes
+// of blocks from blocks1, and as many blocks from blocks2, stopping early
+// once the new window holds chunkSize bytes more than the old one so that a
+// large insertion is spread over several windows. Once blocks1 is exhausted,
+// the rest of blocks2 is read in windows of about chunkSize bytes.
+func readWindows(blocks1, blocks2 *blockReader, chunkSize int) (string, string, error) {
+	window1, count, err := readWindow(blocks1, chunkSize, -1)
+	if err != nil {
+		return "", "", err
+	}
+	window2, _, err := readWindow(blocks2, len(window1)+chunkSize, count)
+	if err != nil {
+		return "", "", err
+	}
+	return window1, window2, nil
+}
+
+// readWindow reads blocks until either the window holds at least size bytes
+// (when size >= 0) or count blocks have been read (when count > 0). When
+// reading by size, at least one block is read. Returns the window text and the
+// number of blocks it contains.
+func readWindow(blocks *blockReader, size, count int) (string, int, error) {
+	var sb strings.Builder
+	n := 0
+	for (size < 0 || sb.Len() < size) && (count <= 0 || n < count) {
+		block, err := blocks.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", n, err
+		}
+		sb.WriteString(block)
+		n++
+	}
+	return sb.String(), n, nil
+}
+
+// trailingWhitespace returns the text after the last token in text, or all of
+// text if it has no tokens.
+func trailingWhitespace(text string, positions []TokenPos) string {
+	if len(positions) == 0 {
+		return text
+	}
+	return text[positions[len(positions)-1].End:]
+}
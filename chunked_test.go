@@ -0,0 +1,270 @@
+package tokendiff
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBlockReader(t *testing.T) {
+	input := "para one\nline two\n\n\npara two\n\npara three"
+	br := newBlockReader(strings.NewReader(input), 0)
+
+	var blocks []string
+	for {
+		block, err := br.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("next() error = %v", err)
+		}
+		blocks = append(blocks, block)
+	}
+
+	want := []string{"para one\nline two\n\n\n", "para two\n\n", "para three"}
+	if len(blocks) != len(want) {
+		t.Fatalf("got %d blocks %q, want %q", len(blocks), blocks, want)
+	}
+	for i := range want {
+		if blocks[i] != want[i] {
+			t.Errorf("block %d = %q, want %q", i, blocks[i], want[i])
+		}
+	}
+	if strings.Join(blocks, "") != input {
+		t.Error("blocks do not reconstruct the input")
+	}
+}
+
+func TestBlockReaderMaxSize(t *testing.T) {
+	input := "one\ntwo\nthree\nfour\n\nfive"
+	br := newBlockReader(strings.NewReader(input), 6)
+
+	var blocks []string
+	for {
+		block, err := br.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("next() error = %v", err)
+		}
+		blocks = append(blocks, block)
+	}
+
+	// Blocks end at the line that reaches 6 bytes, or earlier at a blank line
+	want := []string{"one\ntwo\n", "three\n", "four\n\n", "five"}
+	if len(blocks) != len(want) {
+		t.Fatalf("got %d blocks %q, want %q", len(blocks), blocks, want)
+	}
+	for i := range want {
+		if blocks[i] != want[i] {
+			t.Errorf("block %d = %q, want %q", i, blocks[i], want[i])
+		}
+	}
+}
+
+// windowWriter records the length of the longest write made to it.
+type windowWriter struct {
+	strings.Builder
+	longest int
+}
+
+func (w *windowWriter) Write(p []byte) (int, error) {
+	w.longest = max(w.longest, len(p))
+	return w.Builder.Write(p)
+}
+
+func (w *windowWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func TestDiffChunkedNoBlankLines(t *testing.T) {
+	const chunkSize = 1000
+	line := "The quick brown fox jumps over the lazy dog.\n"
+	var old, new strings.Builder
+	for i := 0; i < 2000; i++ {
+		old.WriteString(line)
+		if i%500 == 250 {
+			new.WriteString("The quick red fox jumps over the lazy dog.\n")
+		} else {
+			new.WriteString(line)
+		}
+	}
+	inserted := strings.Repeat("an inserted line without any blank line after it\n", 2000)
+	// Many short old blocks whose new blocks are each nearly chunkSize
+	var short, grown strings.Builder
+	for i := 0; i < 30; i++ {
+		short.WriteString("para\n\n")
+		grown.WriteString("para\n" + strings.Repeat("more words\n", 80) + "\n")
+	}
+
+	// An insertion spread over several windows is marked once per window,
+	// and growing blocks fall out of alignment, so only the changed words
+	// match the whole-file diff
+	tests := []struct {
+		name         string
+		text1, text2 string
+		aligned      bool
+	}{
+		{"changed words", old.String(), new.String(), true},
+		{"large insertion", line, line + inserted, false},
+		{"new side only", "", inserted, false},
+		{"growing blocks", short.String(), grown.String(), false},
+	}
+
+	fmtOpts := FormatOptions{
+		StartDelete: "[-",
+		StopDelete:  "-]",
+		StartInsert: "{+",
+		StopInsert:  "+}",
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whole := DiffWholeFiles(tt.text1, tt.text2, DefaultOptions(), fmtOpts)
+
+			var out windowWriter
+			st, err := DiffChunked(strings.NewReader(tt.text1), strings.NewReader(tt.text2), DefaultOptions(), fmtOpts, chunkSize, &out)
+			if err != nil {
+				t.Fatalf("DiffChunked() error = %v", err)
+			}
+			if st.OldWords != whole.Statistics.OldWords || st.NewWords != whole.Statistics.NewWords {
+				t.Errorf("statistics = %+v, want %d old and %d new words", st, whole.Statistics.OldWords, whole.Statistics.NewWords)
+			}
+			if tt.aligned && st != whole.Statistics {
+				t.Errorf("statistics = %+v, want %+v", st, whole.Statistics)
+			}
+			if tt.aligned && out.String() != whole.Formatted {
+				t.Errorf("output differs from whole-file output")
+			}
+			// Each window holds at most about chunkSize bytes of old text
+			// and chunkSize more of new text, plus the markup
+			if limit := 4 * chunkSize; out.longest > limit {
+				t.Errorf("longest window output = %d bytes, want at most %d", out.longest, limit)
+			}
+		})
+	}
+}
+
+func TestDiffChunked(t *testing.T) {
+	var old, new strings.Builder
+	for i := 0; i < 20; i++ {
+		old.WriteString("The quick brown fox jumps over the lazy dog.\nSecond line here.\n\n")
+		if i == 7 || i == 15 {
+			new.WriteString("The quick red fox jumps over the lazy dog.\nSecond line here.\n\n")
+		} else {
+			new.WriteString("The quick brown fox jumps over the lazy dog.\nSecond line here.\n\n")
+		}
+	}
+	text1, text2 := old.String(), new.String()
+
+	opts := DefaultOptions()
+	fmtOpts := FormatOptions{
+		StartDelete: "[-",
+		StopDelete:  "-]",
+		StartInsert: "{+",
+		StopInsert:  "+}",
+	}
+	whole := DiffWholeFiles(text1, text2, opts, fmtOpts)
+
+	for _, chunkSize := range []int{1, 100, 500, 0} {
+		var out strings.Builder
+		st, err := DiffChunked(strings.NewReader(text1), strings.NewReader(text2), opts, fmtOpts, chunkSize, &out)
+		if err != nil {
+			t.Fatalf("DiffChunked(chunkSize=%d) error = %v", chunkSize, err)
+		}
+		if out.String() != whole.Formatted {
+			t.Errorf("DiffChunked(chunkSize=%d) output differs from whole-file output:\ngot:\n%s\nwant:\n%s",
+				chunkSize, out.String(), whole.Formatted)
+		}
+		if st != whole.Statistics {
+			t.Errorf("DiffChunked(chunkSize=%d) statistics = %+v, want %+v", chunkSize, st, whole.Statistics)
+		}
+	}
+}
+
+func TestDiffChunkedUnevenInputs(t *testing.T) {
+	text1 := "one\n\ntwo\n"
+	text2 := "one\n\ntwo\n\nthree\n\nfour\n"
+	fmtOpts := FormatOptions{
+		StartDelete: "[-",
+		StopDelete:  "-]",
+		StartInsert: "{+",
+		StopInsert:  "+}",
+	}
+
+	var out strings.Builder
+	st, err := DiffChunked(strings.NewReader(text1), strings.NewReader(text2), DefaultOptions(), fmtOpts, 1, &out)
+	if err != nil {
+		t.Fatalf("DiffChunked() error = %v", err)
+	}
+	if st.InsertedWords != 2 || st.DeletedWords != 0 {
+		t.Errorf("statistics = %+v, want 2 inserted, 0 deleted", st)
+	}
+	for _, want := range []string{"{+three+}", "{+four+}"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output %q missing %q", out.String(), want)
+		}
+	}
+}
+
+func TestDiffReaders(t *testing.T) {
+	var old, new strings.Builder
+	for i := 0; i < 20; i++ {
+		old.WriteString("The quick brown fox jumps over the lazy dog.\nSecond line here.\n\n")
+		switch i {
+		case 7:
+			new.WriteString("The quick red fox jumps over the lazy dog.\nSecond line here.\n\n")
+		case 15:
+			new.WriteString("The quick brown fox jumps over the lazy dog.\nAn added line.\nSecond line here.\n\n")
+		default:
+			new.WriteString("The quick brown fox jumps over the lazy dog.\nSecond line here.\n\n")
+		}
+	}
+
+	tests := []struct {
+		name         string
+		text1, text2 string
+	}{
+		{"blocks", old.String(), new.String()},
+		{"no final newline", "a\nb\nc", "a\nx\nc"},
+		{"final newline removed", "a\nb\n", "a\nb"},
+		{"final newline added", "a\nb", "a\nb\n"},
+		{"old empty", "", "a\n\nb\n"},
+		{"new empty", "a\n\nb\n", ""},
+		{"identical", "a\n\nb\n", "a\n\nb\n"},
+	}
+
+	opts := DefaultOptions()
+	for _, tt := range tests {
+		for _, numbers := range []bool{false, true} {
+			fmtOpts := DefaultFormatOptions()
+			fmtOpts.ShowLineNumbers = numbers
+			fmtOpts.LineNumWidth = 3
+
+			output := DiffLineByLine(tt.text1, tt.text2, opts, fmtOpts, "best", DefaultLineThreshold)
+			want := RenderLineDiff(output, 0, fmtOpts)
+			if numbers {
+				want = RenderLineDiffWithNumbers(output, 0, fmtOpts)
+			}
+
+			var out strings.Builder
+			if err := DiffReaders(strings.NewReader(tt.text1), strings.NewReader(tt.text2), opts, fmtOpts, &out); err != nil {
+				t.Fatalf("%s: DiffReaders() error = %v", tt.name, err)
+			}
+			if out.String() != want {
+				t.Errorf("%s (numbers=%v): DiffReaders() =\n%q\nwant\n%q", tt.name, numbers, out.String(), want)
+			}
+
+			// Windows of two blocks each still line up with the in-memory
+			// diff, since each change is within a block
+			out.Reset()
+			if err := diffReaders(strings.NewReader(tt.text1), strings.NewReader(tt.text2), opts, fmtOpts, 100, &out); err != nil {
+				t.Fatalf("%s: diffReaders() error = %v", tt.name, err)
+			}
+			if out.String() != want {
+				t.Errorf("%s (numbers=%v, windowed): diffReaders() =\n%q\nwant\n%q", tt.name, numbers, out.String(), want)
+			}
+		}
+	}
+}
@@ -9,15 +9,27 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/dacharyc/tokendiff"
 	flag "github.com/spf13/pflag"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
 )
 
 // Version is set at build time via -ldflags
@@ -27,9 +39,12 @@ var Version = "dev"
 const (
 	defaultDeleteColor = "\033[0;31;1m" // bold red
 	defaultInsertColor = "\033[0;32;1m" // bold green
-	defaultChangeColor = "\033[0;33;1m" // bold yellow (for line markers)
 )
 
+// autoChunkThreshold is the input file size above which whole-file mode
+// switches to chunked diffing to bound memory use
+const autoChunkThreshold = 64 << 20
+
 // Exit codes
 const (
 	exitIdentical = 0 // files are identical
@@ -37,6 +52,47 @@ const (
 	exitError     = 2 // error occurred
 )
 
+// usageError reports invalid command-line arguments. If showUsage is set,
+// the usage message is printed after the error.
+type usageError struct {
+	msg       string
+	showUsage bool
+}
+
+func (e *usageError) Error() string { return e.msg }
+
+// configError reports a configuration file that could not be found or loaded.
+type configError struct {
+	path string // empty if the file could not be located
+	err  error
+}
+
+func (e *configError) Error() string {
+	if e.path == "" {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("loading config %s: %v", e.path, e.err)
+}
+
+func (e *configError) Unwrap() error { return e.err }
+
+// readError reports an input that could not be read.
+type readError struct {
+	path string // "stdin" for standard input
+	err  error
+}
+
+func (e *readError) Error() string { return fmt.Sprintf("reading %s: %v", e.path, e.err) }
+
+func (e *readError) Unwrap() error { return e.err }
+
+// binaryError reports an input that looks binary, without --text.
+type binaryError struct {
+	path string // "stdin" for standard input
+}
+
+func (e *binaryError) Error() string { return e.path + " appears to be binary" }
+
 // config holds configuration from profile files
 type config struct {
 	delimiters          string
@@ -44,35 +100,64 @@ type config struct {
 	usePunctuation      bool
 	noColor             bool
 	colorSpec           string
+	deleteColor         string // ANSI sequence from delete-color, validated at load
+	insertColor         string // ANSI sequence from insert-color, validated at load
+	commonColor         string // ANSI sequence from common-color, validated at load
 	lineNumbers         int
+	lineNumberSide      tokendiff.LineNumberSide // from line-numbers = old or new
+	changedLineNumbers  bool
 	lineByLine          bool
+	sideBySide          bool
+	detectMoves         bool
+	lineStats           bool
 	context             int
 	startDelete         string
 	stopDelete          string
 	startInsert         string
 	stopInsert          string
 	repeatMarkers       bool
-	lessMode            bool
+	lessMode            string // "", "overstrike", or "ansi"
 	printerMode         bool
+	unicodeStrike       bool
 	noDeleted           bool
 	noInserted          bool
 	noCommon            bool
 	statistics          bool
+	summary             bool
 	ignoreCase          bool
+	normalizeEOL        bool
 	matchContext        int
-	algorithm           string  // line pairing algorithm: "best", "normal", "fast"
+	maxTokens           int
+	collapse            int // hide unchanged stretches longer than this many characters
+	tabWidth            int // expand leading tabs to this many columns (0 keeps tabs)
+	newlineNote         bool
+	transpositions      bool
+	refineTokens        bool
+	graphemes           bool
+	aliasFile           string  // path to a token alias file
+	ignoreFile          string  // path to a file of tokens to ignore
+	tokenPattern        string  // regular expression matching tokens
+	contextSeparator    string  // line between non-adjacent context groups
+	changeMarker        string  // marker column of changed lines in line mode
+	algorithm           string  // line pairing algorithm: "best", "auto", "optimal", "normal", "fast"
 	similarityThreshold float64 // minimum similarity for line pairing (0.0-1.0)
+	similarity          string  // line similarity for -A best: "token" or "edit"
 }
 
 // cliFlags holds all parsed command-line flags
 type cliFlags struct {
-	delimiters     *string
+	delimiters     *[]string
 	whitespace     *string
 	usePunctuation *bool
 	noColor        *bool
 	colorSpec      *string
 	lineNumbers    *int
+	lineNumberSide *tokendiff.LineNumberSide
+	changedNumbers *bool
 	lineByLine     *bool
+	sideBySide     *bool
+	detectMoves    *bool
+	lineStats      *bool
 	context        *int
 	stdinMode      *bool
 	help           *bool
@@ -82,24 +167,68 @@ type cliFlags struct {
 	startInsert    *string
 	stopInsert     *string
 	repeatMarkers  *bool
-	lessMode       *bool
+	lessMode       *string
 	printerMode    *bool
+	unicodeStrike  *bool
 	noDeleted      *bool
 	noInserted     *bool
 	noCommon       *bool
 	statistics     *bool
+	statsFormat    *string
+	statsFile      *string
+	output         *string
+	swap           *bool
+	text           *bool
+	summary        *bool
+	statsOnly      *bool
 	ignoreCase     *bool
+	normalizeEOL   *bool
+	jsonAware      *bool
 	matchContext   *int
+	maxTokens      *int
+	collapse       *int
+	tabWidth       *int
+	newlineNote    *bool
+	transpositions *bool
+	refineTokens   *bool
+	graphemes      *bool
+	aliasFile      *string
+	ignoreFile     *string
+	tokenPattern   *string
+	contextSep     *string
+	contextRegex   *string
+	changeMarker   *string
 	diffInput      *bool
+	keepPrefixes   *bool
+	emitUnified    *bool
+	gitWords       *bool
+	explain        *bool
+	tokenStats     *bool
+	range1         *string
+	range2         *string
+	stat           *bool
+	hyperlinks     *bool
+	encoding       *string
+	outputEncoding *string
 	algorithm      *string
 	threshold      *float64
+	similarity     *string
+	brief          *bool
+	quiet          *bool
+	recursive      *bool
+	chunked        *bool
+	dumpTokens     *string
+	emptyAsBanner  *bool
+	since          *string
+	changes        *bool
+	format         *string
 }
 
-// prescanProfile extracts --profile value before flag parsing
-func prescanProfile() string {
-	for i, arg := range os.Args[1:] {
-		if arg == "--profile" && i+1 < len(os.Args)-1 {
-			return os.Args[i+2]
+// prescanProfile extracts --profile value from args before flag parsing
+func prescanProfile(args []string) string {
+	for i, arg := range args {
+		if arg == "--profile" && i+1 < len(args) {
+			return args[i+1]
 		}
 		if strings.HasPrefix(arg, "--profile=") {
 			return strings.TrimPrefix(arg, "--profile=")
@@ -108,369 +237,1641 @@ func prescanProfile() string {
 	return ""
 }
 
-// defineFlags sets up all command-line flags with config defaults
-func defineFlags(cfg config) cliFlags {
-	_ = flag.String("profile", "", "use settings from ~/.tokendiffrc.<profile> or $XDG_CONFIG_HOME/tokendiff/config.<profile>")
+// defineFlags sets up all command-line flags on flags with config defaults
+func defineFlags(flags *flag.FlagSet, cfg config) cliFlags {
+	_ = flags.String("profile", "", "use settings from ~/.tokendiffrc.<profile> or $XDG_CONFIG_HOME/tokendiff/config.<profile>")
 
 	f := cliFlags{
-		delimiters:     flag.StringP("delimiters", "d", cfg.delimiters, "delimiter characters"),
-		whitespace:     flag.StringP("white-space", "W", cfg.whitespace, "whitespace characters"),
-		usePunctuation: flag.BoolP("punctuation", "P", cfg.usePunctuation, "use punctuation characters as delimiters"),
-		noColor:        flag.Bool("no-color", cfg.noColor, "disable colored output"),
-		colorSpec:      flag.StringP("color", "c", cfg.colorSpec, "set colors for deleted/inserted text (format: del_fg[:del_bg],ins_fg[:ins_bg], or 'list')"),
-		lineNumbers:    flag.IntP("line-numbers", "L", cfg.lineNumbers, "show line numbers with specified width (0 for auto-width)"),
-		lineByLine:     flag.Bool("line-mode", cfg.lineByLine, "compare files line by line"),
-		context:        flag.IntP("context", "C", cfg.context, "show N lines of context around changes (implies --line-mode)"),
-		stdinMode:      flag.Bool("stdin", false, "read first input from stdin, second from argument"),
-		help:           flag.BoolP("help", "h", false, "show help"),
-		version:        flag.BoolP("version", "v", false, "show version"),
-		startDelete:    flag.StringP("start-delete", "w", cfg.startDelete, "string to mark begin of deleted text"),
-		stopDelete:     flag.StringP("stop-delete", "x", cfg.stopDelete, "string to mark end of deleted text"),
-		startInsert:    flag.StringP("start-insert", "y", cfg.startInsert, "string to mark begin of inserted text"),
-		stopInsert:     flag.StringP("stop-insert", "z", cfg.stopInsert, "string to mark end of inserted text"),
-		repeatMarkers:  flag.BoolP("repeat-markers", "R", cfg.repeatMarkers, "repeat markers at line boundaries for multi-line changes"),
-		lessMode:       flag.BoolP("less-mode", "l", cfg.lessMode, "use overstrike to highlight text for less -r"),
-		printerMode:    flag.BoolP("printer", "p", cfg.printerMode, "use overstrike to highlight text for printing"),
-		noDeleted:      flag.BoolP("no-deleted", "1", cfg.noDeleted, "suppress printing of deleted words"),
-		noInserted:     flag.BoolP("no-inserted", "2", cfg.noInserted, "suppress printing of inserted words"),
-		noCommon:       flag.BoolP("no-common", "3", cfg.noCommon, "suppress printing of common words"),
-		statistics:     flag.BoolP("statistics", "s", cfg.statistics, "print statistics"),
-		ignoreCase:     flag.BoolP("ignore-case", "i", cfg.ignoreCase, "ignore case when comparing"),
-		matchContext:   flag.IntP("match-context", "m", cfg.matchContext, "minimum matching words between changes"),
-		diffInput:      flag.Bool("diff-input", false, "read unified diff from stdin and apply word-level diff"),
-		algorithm:      flag.StringP("algorithm", "A", cfg.algorithm, "line pairing algorithm: best (similarity), normal (positional), fast (positional)"),
-		threshold:      flag.Float64("threshold", cfg.similarityThreshold, "minimum similarity for line pairing with -A best (0.0-1.0)"),
-	}
-
-	flag.Lookup("color").NoOptDefVal = "default"
-	flag.Lookup("line-numbers").NoOptDefVal = "0"
-
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] file1 file2\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "       %s [options] -stdin file2\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "\nWord-level diff with delimiter support.\n\n")
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		flag.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nExamples:\n")
-		fmt.Fprintf(os.Stderr, "  %s old.txt new.txt\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s --line-mode -C 3 old.go new.go\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  git show HEAD:file.go | %s -stdin file.go\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  git diff | %s --diff-input\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "\nExit codes:\n")
-		fmt.Fprintf(os.Stderr, "  0  files are identical\n")
-		fmt.Fprintf(os.Stderr, "  1  files differ\n")
-		fmt.Fprintf(os.Stderr, "  2  error occurred\n")
+		delimiters:     flags.StringArrayP("delimiters", "d", []string{cfg.delimiters}, "delimiter characters; repeat to add more, or name a group: @code for (){}[]<>,.;: or @math for +-*/=<>"),
+		whitespace:     flags.StringP("white-space", "W", cfg.whitespace, "whitespace characters"),
+		usePunctuation: flags.BoolP("punctuation", "P", cfg.usePunctuation, "use punctuation characters as delimiters"),
+		noColor:        flags.Bool("no-color", cfg.noColor, "disable colored output"),
+		colorSpec:      flags.StringP("color", "c", cfg.colorSpec, "set colors for deleted/inserted text (format: del_fg[:del_bg],ins_fg[:ins_bg], or 'list')"),
+		lineNumbers:    new(int),
+		lineNumberSide: new(tokendiff.LineNumberSide),
+		changedNumbers: flags.Bool("changed-line-numbers", cfg.changedLineNumbers, "with --line-numbers, number only lines that contain changes"),
+		lineByLine:     flags.Bool("line-mode", cfg.lineByLine, "compare files line by line"),
+		sideBySide:     flags.BoolP("side-by-side", "S", cfg.sideBySide, "show old and new lines in two columns sized to the terminal (implies --line-mode)"),
+		detectMoves:    flags.Bool("detect-moves", cfg.detectMoves, "mark lines deleted in one place and inserted in another with ~ (implies --line-mode)"),
+		lineStats:      flags.Bool("line-stats", cfg.lineStats, "print each changed line's deleted and inserted word counts after it (implies --line-mode)"),
+		context:        flags.IntP("context", "C", cfg.context, "show N lines of context around changes (implies --line-mode)"),
+		contextRegex:   flags.String("context-regex", "", "show each change's whole block, from the nearest line before it matching the pattern up to the next such line (implies --line-mode)"),
+		contextSep:     flags.String("context-separator", cfg.contextSeparator, "line printed between non-adjacent groups of context lines (empty for none)"),
+		changeMarker:   flags.String("change-marker", cfg.changeMarker, "marker printed before changed lines in line mode; unchanged lines are padded to its width"),
+		stdinMode:      flags.Bool("stdin", false, "read first input from stdin, second from argument"),
+		help:           flags.BoolP("help", "h", false, "show help"),
+		version:        flags.BoolP("version", "v", false, "show version"),
+		startDelete:    flags.StringP("start-delete", "w", cfg.startDelete, "string to mark begin of deleted text"),
+		stopDelete:     flags.StringP("stop-delete", "x", cfg.stopDelete, "string to mark end of deleted text"),
+		startInsert:    flags.StringP("start-insert", "y", cfg.startInsert, "string to mark begin of inserted text"),
+		stopInsert:     flags.StringP("stop-insert", "z", cfg.stopInsert, "string to mark end of inserted text"),
+		repeatMarkers:  flags.BoolP("repeat-markers", "R", cfg.repeatMarkers, "repeat markers at line boundaries for multi-line changes"),
+		lessMode:       flags.StringP("less-mode", "l", cfg.lessMode, "highlight text for less: overstrike for less -r (default), or ansi to keep color, reset on each line, for less -R"),
+		printerMode:    flags.BoolP("printer", "p", cfg.printerMode, "use overstrike to highlight text for printing"),
+		unicodeStrike:  flags.Bool("unicode-strikethrough", cfg.unicodeStrike, "strike through deleted and underline inserted text with Unicode combining characters"),
+		noDeleted:      flags.BoolP("no-deleted", "1", cfg.noDeleted, "suppress printing of deleted words"),
+		noInserted:     flags.BoolP("no-inserted", "2", cfg.noInserted, "suppress printing of inserted words"),
+		noCommon:       flags.BoolP("no-common", "3", cfg.noCommon, "suppress printing of common words"),
+		statistics:     flags.BoolP("statistics", "s", cfg.statistics, "print statistics"),
+		statsFormat:    flags.String("stats-format", "text", "statistics format: text, or json with percentages on stdout (implies --statistics)"),
+		statsFile:      flags.String("stats-file", "", "write statistics to FILE instead of stderr or stdout (implies --statistics)"),
+		output:         flags.StringP("output", "o", "", "write the diff to FILE instead of stdout (statistics are not redirected)"),
+		swap:           flags.Bool("swap", false, "exchange the inputs, showing the diff from the second to the first"),
+		encoding:       flags.String("encoding", "", "decode the inputs from this character encoding, such as latin1 or shift_jis, instead of UTF-8"),
+		outputEncoding: flags.String("output-encoding", "", "encode the diff output in this character encoding instead of UTF-8"),
+		text:           flags.Bool("text", false, "diff inputs that look binary (contain a NUL byte) as text instead of failing"),
+		summary:        flags.Bool("summary", cfg.summary, "after the diff, print counts of changes by kind (renamed, moved, deleted, ...)"),
+		hyperlinks:     flags.Bool("hyperlinks", false, "with --recursive, make each file name a clickable file:// link when writing to a terminal that supports OSC 8"),
+		stat:           flags.Bool("stat", false, "print only a 'path: +N -M' line of inserted and deleted words for the new file, or each differing file with --recursive"),
+		statsOnly:      flags.Bool("stats-only", false, "print only whole-file statistics, skipping the diff output (implies --statistics)"),
+		ignoreCase:     flags.BoolP("ignore-case", "i", cfg.ignoreCase, "ignore case when comparing"),
+		normalizeEOL:   flags.Bool("normalize-eol", cfg.normalizeEOL, "in line mode, ignore CRLF versus LF line endings when comparing lines"),
+		jsonAware:      flags.Bool("json-aware", false, "parse both inputs as JSON and diff them re-serialized with sorted keys and stable indentation"),
+		matchContext:   flags.IntP("match-context", "m", cfg.matchContext, "minimum matching words between changes"),
+		maxTokens:      flags.Int("max-tokens", cfg.maxTokens, "if either input has more than N tokens, diff whole lines instead of words (0 for no limit)"),
+		collapse:       flags.Int("collapse", cfg.collapse, "in whole-file mode, replace unchanged text longer than N characters with a placeholder (0 shows all)"),
+		tabWidth:       flags.Int("tab-width", cfg.tabWidth, "expand tabs in the indentation of unchanged text to N columns, keeping line-numbered output aligned (0 keeps tabs)"),
+		newlineNote:    flags.Bool("newline-note", cfg.newlineNote, "in whole-file mode, note when only one input ends with a newline instead of ignoring it"),
+		transpositions: flags.Bool("transpositions", cfg.transpositions, "show two swapped adjacent words as a single change"),
+		refineTokens:   flags.Bool("refine-tokens", cfg.refineTokens, "show a replaced word as a character-level diff when the old and new word share letters"),
+		graphemes:      flags.Bool("graphemes", cfg.graphemes, "with --refine-tokens, compare whole user-perceived characters, so emoji sequences are never split"),
+		tokenPattern:   flags.String("token-pattern", cfg.tokenPattern, "split input into the matches of REGEX instead of using delimiters and whitespace"),
+		aliasFile:      flags.String("alias-file", cfg.aliasFile, "treat tokens as equal per FILE, one 'canonical: variant1, variant2' per line"),
+		ignoreFile:     flags.String("ignore-file", cfg.ignoreFile, "never report the tokens listed in FILE, one per line, as changes"),
+		diffInput:      flags.Bool("diff-input", false, "read unified diff from stdin and apply word-level diff"),
+		keepPrefixes:   flags.Bool("keep-prefixes", false, "with --diff-input, keep each hunk's -/+ lines, highlighting words within them"),
+		emitUnified:    flags.Bool("emit-unified", false, "with --diff-input, write a valid unified diff with words highlighted within its -/+ lines"),
+		gitWords:       flags.Bool("git-words", false, "color changes as git diff --color-words does: git's colors, with each replacement's new words right after its old words"),
+		algorithm:      flags.StringP("algorithm", "A", cfg.algorithm, "line pairing algorithm: best (similarity), auto (similarity, threshold chosen automatically), optimal (similarity, maximizing the total), normal (positional), fast (positional)"),
+		threshold:      flags.Float64("threshold", cfg.similarityThreshold, "minimum similarity for line pairing with -A best or optimal (0.0-1.0)"),
+		similarity:     flags.String("similarity", cfg.similarity, "line similarity for -A best, auto, and optimal: token (shared tokens) or edit (token edit distance)"),
+		range1:         flags.String("range1", "", "diff only lines START:END (1-based, inclusive; either may be omitted) of the old input"),
+		range2:         flags.String("range2", "", "diff only lines START:END of the new input"),
+		since:          flags.String("since", "", "diff the file against its most recent backup matching this glob pattern"),
+		brief:          flags.Bool("brief", false, "only list files that differ (files or directories, like diff -rq)"),
+		quiet:          flags.BoolP("quiet", "q", false, "print nothing; only set the exit status to whether the inputs differ"),
+		recursive:      flags.BoolP("recursive", "r", false, "diff two directory trees, printing each file that differs under a header"),
+		tokenStats:     flags.Bool("token-stats", false, "print the most frequent tokens shared by the inputs, and those too frequent to anchor the diff, to stderr"),
+		explain:        flags.Bool("explain", false, "print the effective settings, with where each came from, and the options derived from them, then exit without diffing"),
+		dumpTokens:     flags.String("dump-tokens", "", "print the tokens of both inputs and exit (text or json)"),
+		format:         flags.String("format", "text", "output format: text, json, html, or markdown (all but text are whole-file only)"),
+		changes:        flags.Bool("changes", false, "print the changes as JSON, each with a stable ID, instead of the formatted diff"),
+		emptyAsBanner:  flags.Bool("empty-as-banner", false, "when one input is empty, print a one-line new/deleted file banner instead of marking every word"),
+		chunked:        flags.Bool("chunked", false, "diff large files in windows split at blank lines to bound memory (automatic above 64MB)"),
+	}
+
+	*f.lineNumbers, *f.lineNumberSide = cfg.lineNumbers, cfg.lineNumberSide
+	flags.VarP(lineNumbersValue{f.lineNumbers, f.lineNumberSide}, "line-numbers", "L", "show line numbers: `N|SIDE` is the column width (0 for auto-width), or old or new to number only that file's lines, at auto-width")
+	flags.Lookup("color").NoOptDefVal = "default"
+	flags.Lookup("line-numbers").NoOptDefVal = "0"
+	flags.Lookup("dump-tokens").NoOptDefVal = "text"
+	flags.Lookup("less-mode").NoOptDefVal = "overstrike"
+
+	flags.Usage = func() {
+		w := flags.Output()
+		fmt.Fprintf(w, "Usage: %s [options] file1 file2\n", flags.Name())
+		fmt.Fprintf(w, "       %s [options] -stdin file2\n", flags.Name())
+		fmt.Fprintf(w, "\nWord-level diff with delimiter support.\n\n")
+		fmt.Fprintf(w, "Options:\n")
+		flags.PrintDefaults()
+		fmt.Fprintf(w, "\nExamples:\n")
+		fmt.Fprintf(w, "  %s old.txt new.txt\n", flags.Name())
+		fmt.Fprintf(w, "  %s --line-mode -C 3 old.go new.go\n", flags.Name())
+		fmt.Fprintf(w, "  git show HEAD:file.go | %s -stdin file.go\n", flags.Name())
+		fmt.Fprintf(w, "  git diff | %s --diff-input\n", flags.Name())
+		fmt.Fprintf(w, "  %s --brief old_dir new_dir\n", flags.Name())
+		fmt.Fprintf(w, "  %s -r old_dir new_dir\n", flags.Name())
+		fmt.Fprintf(w, "  %s --since 'app.conf.*' app.conf\n", flags.Name())
+		fmt.Fprintf(w, "\nExit codes:\n")
+		fmt.Fprintf(w, "  0  files are identical\n")
+		fmt.Fprintf(w, "  1  files differ\n")
+		fmt.Fprintf(w, "  2  error occurred\n")
 	}
 
 	return f
 }
 
-// showColorList prints available colors and exits
-func showColorList() {
-	fmt.Println("Available colors:")
+// showColorList prints available colors
+func showColorList(w io.Writer) {
+	fmt.Fprintln(w, "Available colors:")
 	colors := tokendiff.ColorNames()
 	if len(colors) > 8 {
-		fmt.Printf("  %s\n", strings.Join(colors[:8], ", "))
-		fmt.Printf("  %s\n", strings.Join(colors[8:], ", "))
+		fmt.Fprintf(w, "  %s\n", strings.Join(colors[:8], ", "))
+		fmt.Fprintf(w, "  %s\n", strings.Join(colors[8:], ", "))
 	} else {
-		fmt.Printf("  %s\n", strings.Join(colors, ", "))
+		fmt.Fprintf(w, "  %s\n", strings.Join(colors, ", "))
 	}
-	fmt.Println("\nUsage: -c delete_color[:delete_bg],insert_color[:insert_bg]")
-	fmt.Println("Example: -c red,green")
-	fmt.Println("Example: -c brightred:white,brightgreen:black")
-	os.Exit(exitIdentical)
+	fmt.Fprintln(w, "  color0 ... color255 (xterm-256 palette)")
+	fmt.Fprintln(w, "  #RRGGBB or #RGB (truecolor)")
+	fmt.Fprintln(w, "\nUsage: -c delete_color[:delete_bg],insert_color[:insert_bg]")
+	fmt.Fprintln(w, "Example: -c red,green")
+	fmt.Fprintln(w, "Example: -c brightred:white,brightgreen:black")
 }
 
-// parseColorSpec parses the color specification and returns delete/insert colors
-func parseColors(colorSpec string) (deleteColor, insertColor string) {
+// parseColors parses the color specification and returns delete/insert colors
+func parseColors(colorSpec string) (deleteColor, insertColor string, err error) {
 	deleteColor = defaultDeleteColor
 	insertColor = defaultInsertColor
 	if colorSpec != "" && colorSpec != "default" {
-		var err error
 		deleteColor, insertColor, err = tokendiff.ParseColorSpec(colorSpec)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(exitError)
+			return "", "", &usageError{msg: err.Error()}
 		}
 	}
-	return
+	return deleteColor, insertColor, nil
+}
+
+// applyRoleColors overrides delete/insert colors with any role-specific
+// colors set in the config file
+func applyRoleColors(cfg config, deleteColor, insertColor string) (string, string) {
+	if cfg.deleteColor != "" {
+		deleteColor = cfg.deleteColor
+	}
+	if cfg.insertColor != "" {
+		insertColor = cfg.insertColor
+	}
+	return deleteColor, insertColor
+}
+
+// mixedLineEndings returns true if the texts, together, have both CRLF and
+// LF line endings, which line mode reports as changed lines.
+func mixedLineEndings(texts ...string) bool {
+	var crlf, lf bool
+	for _, text := range texts {
+		n := strings.Count(text, "\r\n")
+		crlf = crlf || n > 0
+		lf = lf || strings.Count(text, "\n") > n
+	}
+	return crlf && lf
 }
 
 // validateAlgorithm checks if the algorithm is valid
-func validateAlgorithm(algorithm string) {
+func validateAlgorithm(algorithm string) error {
 	switch algorithm {
-	case "best", "normal", "fast":
-		// valid
+	case "best", "auto", "optimal", "normal", "fast":
+		return nil
+	default:
+		return &usageError{msg: fmt.Sprintf("invalid algorithm %q (use best, auto, optimal, normal, or fast)", algorithm)}
+	}
+}
+
+// similarityFunc returns the line similarity function named by similarity
+func similarityFunc(similarity string) (tokendiff.SimilarityFunc, error) {
+	switch similarity {
+	case "token":
+		return tokendiff.ComputeTokenSimilarity, nil
+	case "edit":
+		return tokendiff.ComputeEditSimilarity, nil
+	default:
+		return nil, &usageError{msg: fmt.Sprintf("invalid similarity %q (use token or edit)", similarity)}
+	}
+}
+
+// validateFormat checks if the output format is valid
+func validateFormat(format string) error {
+	switch format {
+	case "text", "json", "html", "markdown":
+		return nil
 	default:
-		fmt.Fprintf(os.Stderr, "Error: invalid algorithm %q (use best, normal, or fast)\n", algorithm)
-		os.Exit(exitError)
+		return &usageError{msg: fmt.Sprintf("invalid format %q (use text, json, html, or markdown)", format)}
 	}
 }
 
-// readInputTexts reads input from stdin or files
-func readInputTexts(stdinMode bool) (text1, text2 string) {
-	var err error
+// readInputTexts reads input from stdin or the files named in args,
+// decoding it from enc unless enc is nil. Unless text is set, an input that
+// looks binary is an error.
+func readInputTexts(args []string, stdinMode, text bool, enc encoding.Encoding, stdin io.Reader) (text1, text2 string, err error) {
 	if stdinMode {
-		if flag.NArg() < 1 {
-			fmt.Fprintln(os.Stderr, "Error: -stdin mode requires one file argument")
-			os.Exit(exitError)
+		if len(args) < 1 {
+			return "", "", &usageError{msg: "-stdin mode requires one file argument"}
 		}
-		text1, err = readStdin()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading stdin: %v\n", err)
-			os.Exit(exitError)
+		text1, err = readStdin(stdin)
+		if err == nil {
+			text1, err = decodeText(enc, text1)
 		}
-		text2, err = readFile(flag.Arg(0))
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", flag.Arg(0), err)
-			os.Exit(exitError)
+			return "", "", &readError{path: "stdin", err: err}
 		}
-	} else {
-		if flag.NArg() < 2 {
-			fmt.Fprintln(os.Stderr, "Error: requires two file arguments")
-			flag.Usage()
-			os.Exit(exitError)
+		text2, err = readFile(args[0])
+		if err == nil {
+			text2, err = decodeText(enc, text2)
 		}
-		text1, err = readFile(flag.Arg(0))
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", flag.Arg(0), err)
-			os.Exit(exitError)
+			return "", "", &readError{path: args[0], err: err}
 		}
-		text2, err = readFile(flag.Arg(1))
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", flag.Arg(1), err)
-			os.Exit(exitError)
+		if err := checkBinary(text, "stdin", text1); err != nil {
+			return "", "", err
 		}
+		if err := checkBinary(text, args[0], text2); err != nil {
+			return "", "", err
+		}
+		return text1, text2, nil
 	}
-	return
+
+	if len(args) < 2 {
+		return "", "", &usageError{msg: "requires two file arguments", showUsage: true}
+	}
+	text1, err = readFile(args[0])
+	if err == nil {
+		text1, err = decodeText(enc, text1)
+	}
+	if err != nil {
+		return "", "", &readError{path: args[0], err: err}
+	}
+	text2, err = readFile(args[1])
+	if err == nil {
+		text2, err = decodeText(enc, text2)
+	}
+	if err != nil {
+		return "", "", &readError{path: args[1], err: err}
+	}
+	if err := checkBinary(text, args[0], text1); err != nil {
+		return "", "", err
+	}
+	if err := checkBinary(text, args[1], text2); err != nil {
+		return "", "", err
+	}
+	return text1, text2, nil
+}
+
+// canonicalizeInputs returns the inputs read by readInputTexts in the
+// canonical JSON form of tokendiff.CanonicalizeJSON, for --json-aware.
+func canonicalizeInputs(args []string, stdinMode bool, text1, text2 string) (string, string, error) {
+	var name1, name2 string
+	if stdinMode {
+		name1, name2 = "stdin", args[0]
+	} else {
+		name1, name2 = args[0], args[1]
+	}
+	canon1, err := tokendiff.CanonicalizeJSON(text1)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", name1, err)
+	}
+	canon2, err := tokendiff.CanonicalizeJSON(text2)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %w", name2, err)
+	}
+	return canon1, canon2, nil
+}
+
+// lookupEncoding returns the character encoding named by the value of the
+// named flag, or nil for an empty value, which means UTF-8. Names are the
+// WHATWG encoding labels, such as latin1, shift_jis, or utf-16le.
+func lookupEncoding(flagName, name string) (encoding.Encoding, error) {
+	if name == "" {
+		return nil, nil
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, &usageError{msg: fmt.Sprintf("unknown %s %q", flagName, name)}
+	}
+	return enc, nil
+}
+
+// decodeText returns s decoded from enc to UTF-8, or s unchanged if enc is
+// nil
+func decodeText(enc encoding.Encoding, s string) (string, error) {
+	if enc == nil {
+		return s, nil
+	}
+	decoded, err := enc.NewDecoder().String(s)
+	if err != nil {
+		return "", fmt.Errorf("decoding: %w", err)
+	}
+	return decoded, nil
+}
+
+// decodeStream wraps rc to decode it from enc to UTF-8 as it is read, or
+// returns rc unchanged if enc is nil
+func decodeStream(enc encoding.Encoding, rc io.ReadCloser) io.ReadCloser {
+	if enc == nil {
+		return rc
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{enc.NewDecoder().Reader(rc), rc}
+}
+
+// checkBinary returns a *binaryError if content, read from path, looks
+// binary, unless text is set
+func checkBinary(text bool, path, content string) error {
+	if !text && tokendiff.LooksBinary([]byte(content)) {
+		return &binaryError{path: path}
+	}
+	return nil
 }
 
 func main() {
+	os.Exit(Run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// Run runs tokendiff with the given command-line arguments (excluding the
+// program name) and streams, and returns the process exit code: 0 if the
+// inputs are identical, 1 if they differ, and 2 on error. Errors are
+// reported on stderr, followed by the usage message for usage errors.
+func Run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("tokendiff", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	code, err := run(flags, args, stdin, stdout, stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		var ue *usageError
+		if errors.As(err, &ue) && ue.showUsage && flags.Usage != nil {
+			flags.Usage()
+		}
+		return exitError
+	}
+	return code
+}
+
+// run implements Run, defining flags on the given flag set. Returns the exit
+// code, or an error of type *usageError, *configError, *readError, or
+// *binaryError, or any other error encountered while diffing or writing the
+// output.
+func run(flags *flag.FlagSet, args []string, stdin io.Reader, stdout, stderr io.Writer) (code int, err error) {
 	// Pre-scan for --profile flag before defining other flags
-	profile := prescanProfile()
+	profile := prescanProfile(args)
 
 	// Load configuration from profile
 	configPath, err := findConfigFile(profile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(exitError)
+		return exitError, &configError{err: err}
 	}
 	cfg, err := loadConfig(configPath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading config %s: %v\n", configPath, err)
-		os.Exit(exitError)
+		return exitError, &configError{path: configPath, err: err}
 	}
 
 	// Define and parse flags
-	f := defineFlags(cfg)
-	flag.Parse()
+	f := defineFlags(flags, cfg)
+	if err := flags.Parse(args); err != nil {
+		return exitError, &usageError{msg: err.Error(), showUsage: true}
+	}
 
 	if *f.version {
-		fmt.Printf("tokendiff version %s\n", Version)
-		os.Exit(exitIdentical)
+		fmt.Fprintf(stdout, "tokendiff version %s\n", Version)
+		return exitIdentical, nil
+	}
+
+	if *f.help {
+		flags.Usage()
+		return exitIdentical, nil
+	}
+
+	// Handle -c list
+	if *f.colorSpec == "list" {
+		showColorList(stdout)
+		return exitIdentical, nil
+	}
+
+	// Parse color spec and validate algorithm
+	deleteColor, insertColor, err := parseColors(*f.colorSpec)
+	if err != nil {
+		return exitError, err
+	}
+	if !flags.Changed("color") {
+		deleteColor, insertColor = applyRoleColors(cfg, deleteColor, insertColor)
+	}
+	if err := validateAlgorithm(*f.algorithm); err != nil {
+		return exitError, err
+	}
+	if *f.lessMode != "" && *f.lessMode != "overstrike" && *f.lessMode != "ansi" {
+		return exitError, &usageError{msg: fmt.Sprintf("invalid --less-mode %q (use overstrike or ansi)", *f.lessMode)}
+	}
+	if *f.statsFormat != "text" && *f.statsFormat != "json" {
+		return exitError, &usageError{msg: fmt.Sprintf("invalid --stats-format %q (use text or json)", *f.statsFormat)}
+	}
+	stats := statsOutput{
+		show:   *f.statistics || *f.statsFormat == "json" || *f.statsFile != "" || *f.statsOnly,
+		format: *f.statsFormat,
+		file:   *f.statsFile,
+		stdout: stdout,
+		stderr: stderr,
+	}
+	if err := validateFormat(*f.format); err != nil {
+		return exitError, err
+	}
+	similarity, err := similarityFunc(*f.similarity)
+	if err != nil {
+		return exitError, err
+	}
+	if *f.sideBySide && *f.lineNumbers >= 0 {
+		return exitError, &usageError{msg: "--side-by-side cannot be combined with --line-numbers"}
+	}
+	if *f.sideBySide && *f.lineStats {
+		return exitError, &usageError{msg: "--side-by-side cannot be combined with --line-stats"}
+	}
+	if *f.contextRegex != "" {
+		if *f.context > 0 {
+			return exitError, &usageError{msg: "--context-regex cannot be combined with --context"}
+		}
+		if _, err := regexp.Compile(*f.contextRegex); err != nil {
+			return exitError, &usageError{msg: fmt.Sprintf("invalid --context-regex: %v", err)}
+		}
+	}
+	if *f.format != "text" && (*f.lineByLine || *f.sideBySide || *f.detectMoves || *f.lineStats || *f.context > 0 || *f.contextRegex != "" || *f.lineNumbers >= 0 || *f.chunked) {
+		return exitError, &usageError{msg: fmt.Sprintf("--format %s cannot be combined with line mode, line numbers, or --chunked", *f.format)}
+	}
+	if *f.format != "text" && *f.collapse > 0 {
+		return exitError, &usageError{msg: fmt.Sprintf("--collapse applies only to text output, not --format %s", *f.format)}
+	}
+	if *f.format != "text" && (*f.emptyAsBanner || *f.summary) {
+		return exitError, &usageError{msg: fmt.Sprintf("--format %s cannot be combined with --empty-as-banner or --summary", *f.format)}
+	}
+	if *f.changes && (*f.format != "text" || *f.lineByLine || *f.sideBySide || *f.detectMoves || *f.lineStats || *f.context > 0 || *f.contextRegex != "" || *f.lineNumbers >= 0 || *f.lessMode != "") {
+		return exitError, &usageError{msg: "--changes cannot be combined with --format, line mode, line numbers, or --less-mode"}
+	}
+
+	// Resolve --since to the latest matching backup and the current file
+	args = flags.Args()
+	if *f.since != "" {
+		if len(args) != 1 || *f.stdinMode {
+			return exitError, &usageError{msg: "--since requires exactly one file argument"}
+		}
+		backup, err := latestBackup(*f.since, args[0])
+		if err != nil {
+			return exitError, err
+		}
+		args = []string{backup, args[0]}
+	}
+
+	range1, err := parseLineRange("--range1", *f.range1)
+	if err != nil {
+		return exitError, err
+	}
+	range2, err := parseLineRange("--range2", *f.range2)
+	if err != nil {
+		return exitError, err
+	}
+	ranged := *f.range1 != "" || *f.range2 != ""
+	if ranged && (*f.diffInput || *f.brief || *f.recursive || *f.chunked) {
+		return exitError, &usageError{msg: "--range1 and --range2 cannot be combined with --diff-input, --brief, --recursive, or --chunked"}
+	}
+
+	// These need the whole inputs, so they are never diffed in chunks
+	wholeInputs := *f.summary || *f.tokenStats || *f.newlineNote || *f.emptyAsBanner
+	if wholeInputs && *f.chunked {
+		return exitError, &usageError{msg: "--chunked cannot be combined with --summary, --token-stats, --newline-note, or --empty-as-banner"}
+	}
+
+	inputEncoding, err := lookupEncoding("--encoding", *f.encoding)
+	if err != nil {
+		return exitError, err
+	}
+	outputEncoding, err := lookupEncoding("--output-encoding", *f.outputEncoding)
+	if err != nil {
+		return exitError, err
+	}
+	if inputEncoding != nil && (*f.diffInput || *f.brief || *f.recursive) {
+		return exitError, &usageError{msg: "--encoding cannot be combined with --diff-input, --brief, or --recursive"}
+	}
+
+	if *f.jsonAware && (*f.diffInput || *f.brief || *f.recursive || *f.chunked) {
+		return exitError, &usageError{msg: "--json-aware cannot be combined with --diff-input, --brief, --recursive, or --chunked"}
+	}
+
+	if *f.keepPrefixes && !*f.diffInput {
+		return exitError, &usageError{msg: "--keep-prefixes requires --diff-input"}
+	}
+	// graphemes in a config file is a no-op without refine-tokens
+	if flags.Changed("graphemes") && *f.graphemes && !*f.refineTokens {
+		return exitError, &usageError{msg: "--graphemes requires --refine-tokens"}
+	}
+	if *f.emitUnified && !*f.diffInput {
+		return exitError, &usageError{msg: "--emit-unified requires --diff-input"}
+	}
+	if *f.hyperlinks && !*f.recursive {
+		return exitError, &usageError{msg: "--hyperlinks requires --recursive"}
+	}
+	if *f.stat && (*f.diffInput || *f.brief || *f.statsOnly) {
+		return exitError, &usageError{msg: "--stat cannot be combined with --diff-input, --brief, or --stats-only"}
+	}
+	if *f.statsOnly && (*f.diffInput || *f.brief || *f.recursive || *f.changes || *f.summary || *f.output != "") {
+		return exitError, &usageError{msg: "--stats-only cannot be combined with --diff-input, --brief, --recursive, --changes, --summary, or --output"}
+	}
+	if *f.quiet && (*f.diffInput || *f.stat || stats.show) {
+		return exitError, &usageError{msg: "--quiet cannot be combined with --diff-input, --stat, or statistics"}
+	}
+
+	// --swap exchanges the inputs. Named files are swapped here; stdin in
+	// -stdin mode is swapped with the file once both are read or opened.
+	if *f.swap {
+		if *f.diffInput {
+			return exitError, &usageError{msg: "--swap cannot be combined with --diff-input"}
+		}
+		if !*f.stdinMode && len(args) >= 2 {
+			args[0], args[1] = args[1], args[0]
+		}
+	}
+	swapStdin := *f.swap && *f.stdinMode
+
+	// Configure diff options
+	delimiters, err := resolveDelimiters(*f.delimiters)
+	if err != nil {
+		return exitError, err
+	}
+	opts := tokendiff.Options{
+		Delimiters:         delimiters,
+		Whitespace:         parseEscapeSequences(*f.whitespace),
+		UsePunctuation:     *f.usePunctuation,
+		IgnoreCase:         *f.ignoreCase,
+		NormalizeEOL:       *f.normalizeEOL,
+		PreserveWhitespace: false,
+		LineSimilarity:     similarity,
+		MaxTokens:          *f.maxTokens,
+		TokenPattern:       *f.tokenPattern,
+	}
+	if _, err := tokendiff.TokenizeE("", opts); err != nil {
+		return exitError, &usageError{msg: err.Error()}
+	}
+	if *f.aliasFile != "" {
+		aliases, err := loadAliasFile(*f.aliasFile)
+		if err != nil {
+			return exitError, err
+		}
+		opts.TokenAliases = aliases
+	}
+	if *f.ignoreFile != "" {
+		tokens, err := loadIgnoreFile(*f.ignoreFile)
+		if err != nil {
+			return exitError, err
+		}
+		opts.IgnoreTokens = tokens
+	}
+
+	// Send the diff to the -o file. As it is not a terminal, color is then
+	// off unless asked for.
+	if *f.output != "" {
+		file, err := os.OpenFile(*f.output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+		if err != nil {
+			return exitError, fmt.Errorf("opening output: %w", err)
+		}
+		defer func() {
+			if cerr := file.Close(); cerr != nil && err == nil {
+				code, err = exitError, fmt.Errorf("closing output: %w", cerr)
+			}
+		}()
+		stdout = file
+	}
+
+	// Determine color output
+	out, isFile := stdout.(*os.File)
+	useColor := !*f.noColor && os.Getenv("NO_COLOR") == "" && ((isFile && isTerminal(out)) || *f.colorSpec != "" || *f.lessMode == "ansi" || *f.gitWords)
+	if *f.lessMode == "overstrike" || *f.printerMode || *f.unicodeStrike {
+		useColor = false
+	}
+	hyperlinks := *f.hyperlinks && isFile && isTerminal(out)
+
+	// Encode the output, replacing characters the encoding lacks
+	if outputEncoding != nil {
+		ew := transform.NewWriter(stdout, encoding.ReplaceUnsupported(outputEncoding.NewEncoder()))
+		// Closing flushes the encoded output, so a failure loses the diff
+		defer func() {
+			if cerr := ew.Close(); cerr != nil && err == nil {
+				code, err = exitError, fmt.Errorf("writing output: %w", cerr)
+			}
+		}()
+		stdout = ew
+	}
+
+	// Build format options using the core library's FormatOptions
+	fmtOpts := tokendiff.FormatOptions{
+		StartDelete:              *f.startDelete,
+		StopDelete:               *f.stopDelete,
+		StartInsert:              *f.startInsert,
+		StopInsert:               *f.stopInsert,
+		NoDeleted:                *f.noDeleted,
+		NoInserted:               *f.noInserted,
+		NoCommon:                 *f.noCommon,
+		UseColor:                 useColor,
+		DeleteColor:              deleteColor,
+		InsertColor:              insertColor,
+		CommonColor:              cfg.commonColor,
+		ColorReset:               tokendiff.ANSIReset,
+		ClearToEOL:               tokendiff.ANSIClearEOL,
+		RepeatMarkers:            *f.repeatMarkers,
+		LessMode:                 *f.lessMode == "overstrike",
+		LessModeANSI:             *f.lessMode == "ansi",
+		PrinterMode:              *f.printerMode,
+		UnicodeStrikethrough:     *f.unicodeStrike,
+		MatchContext:             *f.matchContext,
+		Transpositions:           *f.transpositions,
+		RefineTokens:             *f.refineTokens,
+		GraphemeMode:             *f.graphemes,
+		LineNumbersOnChangesOnly: *f.changedNumbers,
+		LineNumberSide:           *f.lineNumberSide,
+		HeuristicSpacing:         true,
+		ContextSeparator:         *f.contextSep,
+		ContextPattern:           *f.contextRegex,
+		ShowLineStats:            *f.lineStats,
+		ChangeMarker:             *f.changeMarker,
+		CollapseContext:          *f.collapse,
+		CollapsePlaceholder:      tokendiff.DefaultCollapsePlaceholder,
+		KeepDiffPrefixes:         *f.keepPrefixes,
+		EmitUnified:              *f.emitUnified,
+		TabWidth:                 *f.tabWidth,
+		NoNewlineNote:            *f.newlineNote,
+	}
+	if *f.gitWords {
+		git := tokendiff.GitColorWords()
+		fmtOpts.JoinReplacements = true
+		fmtOpts.ColorReset = git.ColorReset
+		if !flags.Changed("color") {
+			fmtOpts.DeleteColor, fmtOpts.InsertColor = git.DeleteColor, git.InsertColor
+		}
+	}
+
+	// Show the settings in effect instead of diffing
+	if *f.explain {
+		explainSettings(stdout, flags, configPath, opts, fmtOpts)
+		return exitIdentical, nil
+	}
+
+	// Handle --diff-input mode
+	if *f.diffInput {
+		if err := tokendiff.ProcessUnifiedDiff(stdin, stdout, opts, fmtOpts); err != nil {
+			return exitError, err
+		}
+		return exitIdentical, nil
+	}
+
+	// Handle --brief mode, and --quiet for directories
+	if *f.brief || (*f.quiet && *f.recursive) {
+		if len(args) < 2 || *f.stdinMode {
+			if !*f.brief {
+				return exitError, &usageError{msg: "--quiet with --recursive requires two directory arguments"}
+			}
+			return exitError, &usageError{msg: "--brief requires two file or directory arguments"}
+		}
+		w := stdout
+		if *f.quiet {
+			w = io.Discard
+		}
+		differ, err := briefDiff(w, args[0], args[1], opts)
+		if err != nil {
+			return exitError, err
+		}
+		if differ {
+			return exitDiffer, nil
+		}
+		return exitIdentical, nil
+	}
+
+	// Handle --recursive mode
+	if *f.recursive {
+		if len(args) < 2 || *f.stdinMode {
+			return exitError, &usageError{msg: "--recursive requires two directory arguments"}
+		}
+		if *f.lineByLine || *f.context > 0 || *f.contextRegex != "" || *f.lineNumbers >= 0 || *f.sideBySide || *f.detectMoves || *f.lineStats || *f.format != "text" || *f.changes || *f.summary {
+			return exitError, &usageError{msg: "--recursive supports only whole-file text output"}
+		}
+		return recursiveDiff(stdout, stderr, args[0], args[1], opts, fmtOpts, stats, *f.stat, *f.text, *f.emptyAsBanner, hyperlinks)
+	}
+
+	// Context, side-by-side output, move detection, and line statistics
+	// imply line-by-line mode
+	lineByLine := *f.lineByLine
+	if *f.context > 0 || *f.contextRegex != "" || *f.sideBySide || *f.detectMoves || *f.lineStats {
+		lineByLine = true
+	}
+
+	// Line numbers imply line-by-line mode for correct output
+	if *f.lineNumbers >= 0 {
+		lineByLine = true
+	}
+
+	if lineByLine && *f.collapse > 0 {
+		return exitError, &usageError{msg: "--collapse applies only to whole-file output (use --context in line mode)"}
+	}
+
+	// Large inputs in whole-file mode are diffed in chunks to bound memory.
+	// -q reads the whole inputs regardless: windows can fall out of
+	// alignment, and a misaligned window would report token-wise identical
+	// inputs as differing
+	chunked := !lineByLine && *f.format == "text" && !*f.changes && (*f.chunked || !ranged && !*f.jsonAware && !wholeInputs && inputsExceed(args, *f.stdinMode, autoChunkThreshold))
+
+	// readTexts reads the inputs in the order they are diffed and takes
+	// their --range1 and --range2 lines, setting start1 and start2 to the
+	// byte offsets of the ranges in the inputs
+	var start1, start2 int
+	readTexts := func() (string, string, error) {
+		text1, text2, err := readInputTexts(args, *f.stdinMode, *f.text, inputEncoding, stdin)
+		if err != nil {
+			return "", "", err
+		}
+		if *f.jsonAware {
+			if text1, text2, err = canonicalizeInputs(args, *f.stdinMode, text1, text2); err != nil {
+				return "", "", err
+			}
+		}
+		if swapStdin {
+			text1, text2 = text2, text1
+		}
+		text1, start1 = range1.slice(text1)
+		text2, start2 = range2.slice(text2)
+		return text1, text2, nil
+	}
+
+	// Only the exit status, so nothing is formatted
+	if *f.quiet {
+		text1, text2, err := readTexts()
+		if err != nil {
+			return exitError, err
+		}
+		if tokendiff.TextsDiffer(text1, text2, opts) {
+			return exitDiffer, nil
+		}
+		return exitIdentical, nil
+	}
+
+	// Statistics alone need no formatting
+	if *f.statsOnly {
+		if lineByLine || *f.format != "text" {
+			return exitError, &usageError{msg: "--stats-only applies only to whole-file text mode"}
+		}
+		if chunked {
+			st, err := diffChunkedInputs(io.Discard, args, *f.stdinMode, swapStdin, *f.text, inputEncoding, stdin, opts, fmtOpts)
+			if err != nil {
+				return exitError, err
+			}
+			return statisticsExitCode(st, stats)
+		}
+		text1, text2, err := readTexts()
+		if err != nil {
+			return exitError, err
+		}
+		return statisticsExitCode(tokendiff.QuickStats(text1, text2, opts), stats)
+	}
+
+	// A change count line replaces the formatted diff
+	if *f.stat {
+		if lineByLine || *f.format != "text" || *f.changes || *f.summary {
+			return exitError, &usageError{msg: "--stat applies only to whole-file text mode"}
+		}
+		path := args[len(args)-1]
+		if swapStdin {
+			path = "stdin"
+		}
+		if chunked {
+			st, err := diffChunkedInputs(io.Discard, args, *f.stdinMode, swapStdin, *f.text, inputEncoding, stdin, opts, fmtOpts)
+			if err != nil {
+				return exitError, err
+			}
+			printStat(stdout, path, st)
+			return statisticsExitCode(st, stats)
+		}
+		text1, text2, err := readTexts()
+		if err != nil {
+			return exitError, err
+		}
+		result := tokendiff.DiffWholeFiles(text1, text2, opts, fmtOpts)
+		printStat(stdout, path, result.Statistics)
+		return statisticsExitCode(result.Statistics, stats)
+	}
+
+	// Stream the chunked diff to the output
+	if chunked {
+		st, err := diffChunkedInputs(stdout, args, *f.stdinMode, swapStdin, *f.text, inputEncoding, stdin, opts, fmtOpts)
+		if err != nil {
+			return exitError, err
+		}
+		return statisticsExitCode(st, stats)
+	}
+
+	// Get input texts
+	text1, text2, err := readTexts()
+	if err != nil {
+		return exitError, err
+	}
+
+	// Report the token frequencies behind the preprocessing
+	if *f.tokenStats {
+		printTokenStats(stderr, text1, text2, opts)
+	}
+
+	// Handle --dump-tokens diagnostic
+	if *f.dumpTokens != "" {
+		if err := dumpTokens(stdout, *f.dumpTokens, text1, text2, opts); err != nil {
+			return exitError, err
+		}
+		return exitIdentical, nil
+	}
+
+	// Summarize added or deleted files instead of marking every word
+	if *f.emptyAsBanner {
+		if banner, st, ok := emptyBanner(text1, text2, opts); ok {
+			fmt.Fprintln(stdout, banner)
+			return statisticsExitCode(st, stats)
+		}
+	}
+
+	// List changes with stable IDs for review tools
+	if *f.changes {
+		result := tokendiff.DiffWholeFiles(text1, text2, opts, fmtOpts)
+		offsetPositions(&result.Result, start1, start2)
+		if err := printChanges(stdout, result.Result); err != nil {
+			return exitError, err
+		}
+		return statisticsExitCode(result.Statistics, stats)
+	}
+
+	// Machine-readable and HTML output
+	switch *f.format {
+	case "json":
+		result := tokendiff.DiffWholeFiles(text1, text2, opts, fmtOpts)
+		offsetPositions(&result.Result, start1, start2)
+		if err := printJSON(stdout, result); err != nil {
+			return exitError, err
+		}
+		return statisticsExitCode(result.Statistics, stats)
+	case "html":
+		result := tokendiff.DiffWholeFiles(text1, text2, opts, fmtOpts)
+		fmt.Fprintln(stdout, tokendiff.FormatDiffHTML(result.Result, tokendiff.HTMLOptions{Wrap: true}))
+		return statisticsExitCode(result.Statistics, stats)
+	case "markdown":
+		result := tokendiff.DiffWholeFiles(text1, text2, opts, fmtOpts)
+		fmt.Fprintln(stdout, tokendiff.FormatMarkdown(result.Result))
+		return statisticsExitCode(result.Statistics, stats)
+	}
+
+	// Set line number display options
+	fmtOpts.ShowLineNumbers = *f.lineNumbers >= 0
+	if *f.lineNumbers == 0 {
+		// Auto-calculate width based on file lengths
+		// Only the numbered file's lines count toward the width
+		lines1, lines2 := strings.Count(text1, "\n")+range1.offset(), strings.Count(text2, "\n")+range2.offset()
+		switch fmtOpts.LineNumberSide {
+		case tokendiff.LineNumbersOld:
+			lines2 = 0
+		case tokendiff.LineNumbersNew:
+			lines1 = 0
+		}
+		maxLines := max(lines1, lines2) + 1
+		fmtOpts.LineNumWidth = len(fmt.Sprintf("%d", maxLines))
+		if fmtOpts.LineNumWidth < 3 {
+			fmtOpts.LineNumWidth = 3
+		}
+	} else {
+		fmtOpts.LineNumWidth = *f.lineNumbers
+	}
+
+	var st tokendiff.DiffStatistics
+	var diffs []tokendiff.Diff
+	var newlineNoted bool
+	if lineByLine {
+		if !opts.NormalizeEOL && mixedLineEndings(text1, text2) {
+			fmt.Fprintln(stderr, "Note: inputs mix CRLF and LF line endings; use --normalize-eol to ignore the difference")
+		}
+		output := tokendiff.DiffLineByLine(text1, text2, opts, fmtOpts, *f.algorithm, *f.threshold)
+		offsetLineNumbers(output.Lines, range1.offset(), range2.offset())
+		st = output.Statistics
+		if *f.detectMoves {
+			output = tokendiff.DetectMovedLines(output)
+		}
+
+		// Print in columns, with context, or all lines
+		if *f.sideBySide {
+			lines := output.Lines
+			if *f.context > 0 {
+				lines = tokendiff.FilterWithContext(lines, *f.context)
+			}
+			if *f.contextRegex != "" {
+				// Validated above
+				lines, _ = tokendiff.FilterWithContextRegex(lines, *f.contextRegex)
+			}
+			width := (terminalWidth(stdout) - 3) / 2
+			fmt.Fprintln(stdout, tokendiff.FormatSideBySide(tokendiff.LineDiffOutput{Lines: lines}, width, fmtOpts))
+		} else if fmtOpts.ShowLineNumbers {
+			fmt.Fprint(stdout, tokendiff.RenderLineDiffWithNumbers(output, *f.context, fmtOpts))
+		} else {
+			fmt.Fprint(stdout, tokendiff.RenderLineDiff(output, *f.context, fmtOpts))
+		}
+	} else {
+		result := tokendiff.DiffWholeFiles(text1, text2, opts, fmtOpts)
+		st = result.Statistics
+		diffs = result.Result.Diffs
+		fmt.Fprintln(stdout, result.Formatted)
+		if result.Result.Truncated {
+			fmt.Fprintf(stderr, "Note: inputs exceed --max-tokens %d; showing a line-level diff\n", *f.maxTokens)
+		}
+		newlineNoted = result.TrailingNewlineDiff && fmtOpts.NoNewlineNote
+	}
+
+	if *f.summary {
+		if diffs == nil {
+			diffs = tokendiff.DiffStringsWithPreprocessing(text1, text2, opts)
+		}
+		fmt.Fprintln(stdout, tokendiff.ClassifyChanges(diffs))
+	}
+
+	code, err = statisticsExitCode(st, stats)
+	if newlineNoted && code == exitIdentical {
+		// The note reports a difference the statistics do not count
+		code = exitDiffer
+	}
+	return code, err
+}
+
+// lineRange is a --range1 or --range2 line range. The zero value is the
+// whole input.
+type lineRange struct {
+	start, end int // 1-based and inclusive; 0 for the first or last line
+}
+
+// parseLineRange parses spec, of the form START:END, START:, :END, or a
+// single line number, as the value of the named flag. An empty spec is the
+// whole input.
+func parseLineRange(name, spec string) (lineRange, error) {
+	if spec == "" {
+		return lineRange{}, nil
+	}
+	startSpec, endSpec, found := strings.Cut(spec, ":")
+	if !found {
+		endSpec = startSpec
+	}
+	bound := func(s string) (int, bool) {
+		if s == "" {
+			return 0, true
+		}
+		n, err := strconv.Atoi(s)
+		return n, err == nil && n >= 1
+	}
+	start, ok1 := bound(startSpec)
+	end, ok2 := bound(endSpec)
+	if !ok1 || !ok2 || (startSpec == "" && endSpec == "") {
+		return lineRange{}, &usageError{msg: fmt.Sprintf("invalid %s %q (use START:END with 1-based line numbers)", name, spec)}
+	}
+	if end > 0 && end < start {
+		return lineRange{}, &usageError{msg: fmt.Sprintf("invalid %s %q (END is before START)", name, spec)}
+	}
+	return lineRange{start: start, end: end}, nil
+}
+
+// slice returns the lines of text in the range, without the line ending of
+// the last, so it is not diffed as the start of a line past the range, and
+// the byte offset of the range in text
+func (r lineRange) slice(text string) (string, int) {
+	if r == (lineRange{}) {
+		return text, 0
+	}
+	start := 0
+	if r.start > 1 {
+		start = len(tokendiff.SliceLines(text, 1, r.start-1))
+	}
+	return strings.TrimSuffix(tokendiff.SliceLines(text, r.start, r.end), "\n"), start
+}
+
+// offset returns the number of lines before the range
+func (r lineRange) offset() int {
+	return max(r.start-1, 0)
+}
+
+// offsetLineNumbers renumbers lines diffed from ranges of the inputs to
+// their line numbers in the whole inputs
+func offsetLineNumbers(lines []tokendiff.LineDiffResult, offset1, offset2 int) {
+	for i := range lines {
+		lines[i].OldLineNum += offset1
+		lines[i].NewLineNum += offset2
+	}
+}
+
+// offsetPositions shifts the token positions of a result diffed from
+// ranges of the inputs to byte offsets in the whole inputs. The result's
+// texts are not shifted, so it can then only be reported, not formatted.
+func offsetPositions(result *tokendiff.DiffResult, offset1, offset2 int) {
+	for i := range result.Positions1 {
+		result.Positions1[i].Start += offset1
+		result.Positions1[i].End += offset1
+	}
+	for i := range result.Positions2 {
+		result.Positions2[i].Start += offset2
+		result.Positions2[i].End += offset2
+	}
+}
+
+// statisticsExitCode prints statistics as requested by stats and returns an
+// exit code based on whether differences were found
+func statisticsExitCode(st tokendiff.DiffStatistics, stats statsOutput) (int, error) {
+	if err := stats.print(st); err != nil {
+		return exitError, err
+	}
+
+	if st.DeletedWords > 0 || st.InsertedWords > 0 {
+		return exitDiffer, nil
+	}
+	return exitIdentical, nil
+}
+
+// inputsExceed returns true if any input file in args is larger than size bytes
+func inputsExceed(args []string, stdinMode bool, size int64) bool {
+	if stdinMode && len(args) > 1 {
+		args = args[:1]
+	} else if len(args) > 2 {
+		args = args[:2]
+	}
+	for _, path := range args {
+		if fi, err := os.Stat(path); err == nil && fi.Size() > size {
+			return true
+		}
+	}
+	return false
+}
+
+// diffChunkedInputs streams a chunked whole-file diff of the inputs to w,
+// from the file to stdin if swap is set in -stdin mode. Unless text is set,
+// an input that looks binary is an error.
+func diffChunkedInputs(w io.Writer, args []string, stdinMode, swap, text bool, enc encoding.Encoding, stdin io.Reader, opts tokendiff.Options, fmtOpts tokendiff.FormatOptions) (tokendiff.DiffStatistics, error) {
+	r1, r2, err := openInputs(args, stdinMode, stdin)
+	if err != nil {
+		return tokendiff.DiffStatistics{}, err
+	}
+	defer r1.Close()
+	defer r2.Close()
+	r1, r2 = decodeStream(enc, r1), decodeStream(enc, r2)
+	if !text {
+		name1, name2 := "stdin", args[0]
+		if !stdinMode {
+			name1, name2 = args[0], args[1]
+		}
+		if r1, err = sniffBinary(name1, r1); err != nil {
+			return tokendiff.DiffStatistics{}, err
+		}
+		if r2, err = sniffBinary(name2, r2); err != nil {
+			return tokendiff.DiffStatistics{}, err
+		}
+	}
+	if swap {
+		r1, r2 = r2, r1
+	}
+
+	bw := bufio.NewWriter(w)
+	st, err := tokendiff.DiffChunked(r1, r2, opts, fmtOpts, tokendiff.DefaultChunkSize, bw)
+	if err == nil {
+		_, err = fmt.Fprintln(bw)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	return st, err
+}
+
+// openInputs opens the inputs for streaming from stdin or the files in args
+func openInputs(args []string, stdinMode bool, stdin io.Reader) (r1, r2 io.ReadCloser, err error) {
+	if stdinMode {
+		if len(args) < 1 {
+			return nil, nil, &usageError{msg: "-stdin mode requires one file argument"}
+		}
+		r1, err = decompressStream("", io.NopCloser(stdin))
+		if err != nil {
+			return nil, nil, &readError{path: "stdin", err: err}
+		}
+		r2, err = openInput(args[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		return r1, r2, nil
+	}
+
+	if len(args) < 2 {
+		return nil, nil, &usageError{msg: "requires two file arguments", showUsage: true}
+	}
+	r1, err = openInput(args[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	r2, err = openInput(args[1])
+	if err != nil {
+		r1.Close()
+		return nil, nil, err
+	}
+	return r1, r2, nil
+}
+
+// openInput opens the file at path for streaming, decompressing it if it
+// is gzip compressed
+func openInput(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, &readError{path: path, err: err}
+	}
+	r, err := decompressStream(path, f)
+	if err != nil {
+		f.Close()
+		return nil, &readError{path: path, err: err}
+	}
+	return r, nil
+}
+
+// sniffBinary returns a reader for the rest of rc, which must not have been
+// read from, or a *binaryError if its first tokendiff.BinaryCheckLen bytes
+// look binary. Closing the reader closes rc.
+func sniffBinary(path string, rc io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReaderSize(rc, tokendiff.BinaryCheckLen)
+	head, err := br.Peek(tokendiff.BinaryCheckLen)
+	if err != nil && err != io.EOF {
+		return nil, &readError{path: path, err: err}
+	}
+	if tokendiff.LooksBinary(head) {
+		return nil, &binaryError{path: path}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, rc}, nil
+}
+
+// emptyBanner returns a one-line summary and the statistics for a diff where
+// exactly one input is empty. Returns false if both or neither are empty.
+func emptyBanner(text1, text2 string, opts tokendiff.Options) (string, tokendiff.DiffStatistics, bool) {
+	switch {
+	case text1 == "" && text2 != "":
+		st := tokendiff.QuickStats(text1, text2, opts)
+		return fmt.Sprintf("<new file: %d words>", st.NewWords), st, true
+	case text1 != "" && text2 == "":
+		st := tokendiff.QuickStats(text1, text2, opts)
+		return fmt.Sprintf("<deleted file: %d words>", st.OldWords), st, true
+	}
+	return "", tokendiff.DiffStatistics{}, false
+}
+
+// explainSettings prints the settings in effect for --explain: each flag's
+// value with its source, "flag" if given on the command line, "config" if
+// the config file at configPath changed its default, or "default", then
+// the fields of the Options and FormatOptions derived from them.
+func explainSettings(w io.Writer, flags *flag.FlagSet, configPath string, opts tokendiff.Options, fmtOpts tokendiff.FormatOptions) {
+	if configPath == "" {
+		configPath = "none"
+	}
+	fmt.Fprintf(w, "# config file: %s\n", configPath)
+
+	defaults := flag.NewFlagSet("defaults", flag.ContinueOnError)
+	defineFlags(defaults, defaultConfig())
+	flags.VisitAll(func(fl *flag.Flag) {
+		source := "default"
+		if flags.Changed(fl.Name) {
+			source = "flag"
+		} else if d := defaults.Lookup(fl.Name); d != nil && d.DefValue != fl.DefValue {
+			source = "config"
+		}
+		value := fl.Value.String()
+		switch fl.Value.Type() {
+		case "string":
+			value = strconv.Quote(value)
+		case "stringArray":
+			// Each value quoted, as for a repeated flag
+			var quoted []string
+			for _, v := range fl.Value.(flag.SliceValue).GetSlice() {
+				quoted = append(quoted, strconv.Quote(v))
+			}
+			value = strings.Join(quoted, " ")
+		}
+		fmt.Fprintf(w, "%s=%s (%s)\n", fl.Name, value, source)
+	})
+
+	for _, section := range []struct {
+		name  string
+		value any
+	}{{"Options", opts}, {"FormatOptions", fmtOpts}} {
+		fmt.Fprintf(w, "# %s\n", section.name)
+		v := reflect.ValueOf(section.value)
+		for i := 0; i < v.NumField(); i++ {
+			// Unexported fields are derived state, not settings
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			fmt.Fprintf(w, "%s.%s=%s\n", section.name, v.Type().Field(i).Name, explainValue(v.Field(i)))
+		}
+	}
+}
+
+// explainValue formats an option for --explain: strings quoted, so markers
+// and color sequences are visible, and functions as whether they are set.
+func explainValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Func, reflect.Interface:
+		if v.IsNil() {
+			return "<nil>"
+		}
+		return "<set>"
+	default:
+		return fmt.Sprint(v.Interface())
+	}
+}
+
+// tokenDump is a single token in --dump-tokens=json output
+type tokenDump struct {
+	Index int    `json:"index"`
+	Token string `json:"token"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// dumpTokens prints the tokens of both inputs with their byte positions.
+// format is "text" for a human-readable listing or "json" for an object
+// with "old" and "new" arrays.
+func dumpTokens(w io.Writer, format, text1, text2 string, opts tokendiff.Options) error {
+	tokens := func(text string) []tokenDump {
+		toks, pos := tokendiff.TokenizeWithPositions(text, opts)
+		dump := make([]tokenDump, len(toks))
+		for i, tok := range toks {
+			dump[i] = tokenDump{Index: i, Token: tok, Start: pos[i].Start, End: pos[i].End}
+		}
+		return dump
+	}
+	old, new := tokens(text1), tokens(text2)
+
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(map[string][]tokenDump{"old": old, "new": new}, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	case "text":
+		for _, side := range []struct {
+			name   string
+			tokens []tokenDump
+		}{{"old", old}, {"new", new}} {
+			fmt.Fprintf(w, "%s: %d tokens\n", side.name, len(side.tokens))
+			for _, t := range side.tokens {
+				fmt.Fprintf(w, "%6d  %d-%d  %q\n", t.Index, t.Start, t.End, t.Token)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid --dump-tokens format %q (use text or json)", format)
+	}
+}
+
+// printChanges prints the changes in result as a JSON array. Each change
+// has an "id" that is the same every time the same diff is printed.
+func printChanges(w io.Writer, result tokendiff.DiffResult) error {
+	changes := tokendiff.Changes(result)
+	if changes == nil {
+		changes = []tokendiff.Change{}
+	}
+	data, err := json.MarshalIndent(changes, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// jsonOutput is the top-level object printed by --format json
+type jsonOutput struct {
+	Diffs      json.RawMessage          `json:"diffs"`
+	Statistics tokendiff.DiffStatistics `json:"statistics"`
+}
+
+// printJSON prints a whole-file diff result as a JSON object with the
+// per-token "diffs" from tokendiff.FormatDiffJSON and the "statistics"
+func printJSON(w io.Writer, result tokendiff.WholeFileDiffResult) error {
+	diffs, err := tokendiff.FormatDiffJSON(result.Result)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(jsonOutput{Diffs: diffs, Statistics: result.Statistics})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// statsOutput says whether, in what format, and where to print statistics.
+// stdout stays the standard output when the diff is redirected with -o.
+type statsOutput struct {
+	show   bool
+	format string // "text" or "json"
+	file   string // path to write to instead of stderr (text) or stdout (json)
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// print writes st as requested, if at all: text to stderr and JSON to
+// stdout, or either to the statistics file
+func (so statsOutput) print(st tokendiff.DiffStatistics) error {
+	if !so.show {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	w := io.Writer(&buf)
+	if so.file == "" {
+		w = so.stderr
+		if so.format == "json" {
+			w = so.stdout
+		}
+	}
+	if so.format == "json" {
+		data, err := statisticsJSON(st)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(data))
+	} else {
+		printStatistics(w, st)
+	}
+
+	if so.file != "" {
+		if err := os.WriteFile(so.file, buf.Bytes(), 0o644); err != nil {
+			return fmt.Errorf("writing statistics: %w", err)
+		}
+	}
+	return nil
+}
+
+// jsonStatistics is the object printed by --stats-format json: the
+// statistics and the percentages printStatistics shows
+type jsonStatistics struct {
+	tokendiff.DiffStatistics
+	OldCommonPercent   int `json:"oldCommonPercent"`
+	OldDeletedPercent  int `json:"oldDeletedPercent"`
+	NewCommonPercent   int `json:"newCommonPercent"`
+	NewInsertedPercent int `json:"newInsertedPercent"`
+}
+
+// statisticsJSON marshals st and its percentages as indented JSON
+func statisticsJSON(st tokendiff.DiffStatistics) ([]byte, error) {
+	return json.MarshalIndent(jsonStatistics{
+		DiffStatistics:     st,
+		OldCommonPercent:   percent(st.CommonWords, st.OldWords),
+		OldDeletedPercent:  percent(st.DeletedWords, st.OldWords),
+		NewCommonPercent:   percent(st.CommonWords, st.NewWords),
+		NewInsertedPercent: percent(st.InsertedWords, st.NewWords),
+	}, "", "  ")
+}
+
+// printStatistics prints diff statistics to w (stderr in the CLI)
+func printStatistics(w io.Writer, st tokendiff.DiffStatistics) {
+	fmt.Fprintln(w, "")
+	fmt.Fprintf(w, "old: %d words  %d %d%% common  %d %d%% deleted\n",
+		st.OldWords,
+		st.CommonWords, percent(st.CommonWords, st.OldWords),
+		st.DeletedWords, percent(st.DeletedWords, st.OldWords))
+	fmt.Fprintf(w, "new: %d words  %d %d%% common  %d %d%% inserted\n",
+		st.NewWords,
+		st.CommonWords, percent(st.CommonWords, st.NewWords),
+		st.InsertedWords, percent(st.InsertedWords, st.NewWords))
+	fmt.Fprintf(w, "chars: %d common  %d deleted  %d inserted\n",
+		st.CommonChars, st.DeletedChars, st.InsertedChars)
+}
+
+// tokenStatsShared is the number of shared tokens --token-stats lists
+const tokenStatsShared = 10
+
+// printTokenStats prints the FrequencyReport of the inputs' tokens to w
+// (stderr in the CLI): the discard threshold, the most frequent shared
+// tokens, and the tokens excluded from matching. Tokens are folded with
+// --ignore-case, by opts.CaseFold, as the diff compares them. Inputs too
+// small to be preprocessed are noted as such, without discard decisions.
+func printTokenStats(w io.Writer, text1, text2 string, opts tokendiff.Options) {
+	tokens1, tokens2 := tokendiff.Tokenize(text1, opts), tokendiff.Tokenize(text2, opts)
+	if opts.IgnoreCase {
+		for i, t := range tokens1 {
+			tokens1[i] = opts.CaseFold.Fold(t)
+		}
+		for i, t := range tokens2 {
+			tokens2[i] = opts.CaseFold.Fold(t)
+		}
+	}
+	report := tokendiff.TokenFrequencyReport(tokens1, tokens2)
+
+	fmt.Fprintf(w, "token stats: %d old and %d new tokens, threshold %d\n", len(tokens1), len(tokens2), report.Threshold)
+	minTokens := opts.PreprocessMinTokens
+	if minTokens == 0 {
+		minTokens = tokendiff.DefaultPreprocessMinTokens
+	}
+	preprocessed := len(tokens1)+len(tokens2) >= minTokens
+	if preprocessed {
+		fmt.Fprintf(w, "discarded: %d old and %d new tokens\n", report.DiscardedOld, report.DiscardedNew)
+	} else {
+		fmt.Fprintf(w, "discarding does not apply: inputs have fewer than %d tokens\n", minTokens)
+	}
+	shared := report.Shared[:min(len(report.Shared), tokenStatsShared)]
+	if len(shared) > 0 {
+		fmt.Fprintf(w, "most frequent shared tokens (of %d):\n", len(report.Shared))
+		for _, tf := range shared {
+			fmt.Fprintf(w, "%6d old %6d new  %q\n", tf.Old, tf.New, tf.Token)
+		}
+	}
+	if !preprocessed {
+		return
+	}
+	if len(report.Provisional) > 0 {
+		fmt.Fprintf(w, "provisionally discarded: %s\n", quoteTokens(report.Provisional))
 	}
-
-	if *f.help {
-		flag.Usage()
-		os.Exit(exitIdentical)
+	if len(report.Discarded) > 0 {
+		fmt.Fprintf(w, "discarded from matching: %s\n", quoteTokens(report.Discarded))
 	}
+}
 
-	// Handle -c list
-	if *f.colorSpec == "list" {
-		showColorList()
+// quoteTokens returns tokens quoted and separated by spaces
+func quoteTokens(tokens []string) string {
+	quoted := make([]string, len(tokens))
+	for i, t := range tokens {
+		quoted[i] = strconv.Quote(t)
 	}
+	return strings.Join(quoted, " ")
+}
 
-	// Parse color spec and validate algorithm
-	deleteColor, insertColor := parseColors(*f.colorSpec)
-	validateAlgorithm(*f.algorithm)
+// printStat prints the --stat line for path: its inserted and deleted words
+func printStat(w io.Writer, path string, st tokendiff.DiffStatistics) {
+	fmt.Fprintf(w, "%s: +%d -%d\n", path, st.InsertedWords, st.DeletedWords)
+}
 
-	// Configure diff options
-	opts := tokendiff.Options{
-		Delimiters:         parseEscapeSequences(*f.delimiters),
-		Whitespace:         parseEscapeSequences(*f.whitespace),
-		UsePunctuation:     *f.usePunctuation,
-		IgnoreCase:         *f.ignoreCase,
-		PreserveWhitespace: false,
+// percent calculates percentage, handling division by zero
+func percent(part, total int) int {
+	if total == 0 {
+		return 0
 	}
+	return (part * 100) / total
+}
 
-	// Determine color output
-	useColor := !*f.noColor && os.Getenv("NO_COLOR") == "" && (isTerminal(os.Stdout) || *f.colorSpec != "")
-	if *f.lessMode || *f.printerMode {
-		useColor = false
+// briefDiff writes the paths of files that differ between path1 and path2,
+// one per line, like diff -rq. Both paths must be files or both directories.
+// For directories, paths are relative to the roots, files present in only one
+// tree are reported as differing, files that look binary are compared byte
+// for byte, and symlinks are not followed.
+// Returns true if any differences were found.
+func briefDiff(w io.Writer, path1, path2 string, opts tokendiff.Options) (bool, error) {
+	info1, err := os.Stat(path1)
+	if err != nil {
+		return false, err
 	}
-
-	// Build format options using the core library's FormatOptions
-	fmtOpts := tokendiff.FormatOptions{
-		StartDelete:      *f.startDelete,
-		StopDelete:       *f.stopDelete,
-		StartInsert:      *f.startInsert,
-		StopInsert:       *f.stopInsert,
-		NoDeleted:        *f.noDeleted,
-		NoInserted:       *f.noInserted,
-		NoCommon:         *f.noCommon,
-		UseColor:         useColor,
-		DeleteColor:      deleteColor,
-		InsertColor:      insertColor,
-		ColorReset:       tokendiff.ANSIReset,
-		ClearToEOL:       tokendiff.ANSIClearEOL,
-		RepeatMarkers:    *f.repeatMarkers,
-		LessMode:         *f.lessMode,
-		PrinterMode:      *f.printerMode,
-		MatchContext:     *f.matchContext,
-		HeuristicSpacing: true,
+	info2, err := os.Stat(path2)
+	if err != nil {
+		return false, err
+	}
+	if info1.IsDir() != info2.IsDir() {
+		return false, fmt.Errorf("cannot compare a file with a directory: %s, %s", path1, path2)
 	}
 
-	// Handle --diff-input mode
-	if *f.diffInput {
-		if err := tokendiff.ProcessUnifiedDiff(os.Stdin, os.Stdout, opts, fmtOpts); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(exitError)
+	if !info1.IsDir() {
+		differ, err := filesDiffer(path1, path2, opts)
+		if err != nil {
+			return false, err
+		}
+		if differ {
+			fmt.Fprintln(w, path2)
 		}
-		os.Exit(exitIdentical)
+		return differ, nil
 	}
 
-	// Context implies line-by-line mode
-	lineByLine := *f.lineByLine
-	if *f.context > 0 {
-		lineByLine = true
+	read := func(path string) (string, bool, error) {
+		content, err := readFile(path)
+		return content, tokendiff.LooksBinary([]byte(content)), err
 	}
-
-	// Line numbers imply line-by-line mode for correct output
-	if *f.lineNumbers >= 0 {
-		lineByLine = true
+	files, err := tokendiff.CompareDirectoriesWith(path1, path2, read, opts)
+	if err != nil {
+		return false, err
 	}
+	for _, fd := range files {
+		fmt.Fprintln(w, fd.Path)
+	}
+	return len(files) > 0, nil
+}
 
-	// Get input texts
-	text1, text2 := readInputTexts(*f.stdinMode)
-
-	// Set line number display options
-	fmtOpts.ShowLineNumbers = *f.lineNumbers >= 0
-	if *f.lineNumbers == 0 {
-		// Auto-calculate width based on file lengths
-		maxLines := max(strings.Count(text1, "\n"), strings.Count(text2, "\n")) + 1
-		fmtOpts.LineNumWidth = len(fmt.Sprintf("%d", maxLines))
-		if fmtOpts.LineNumWidth < 3 {
-			fmtOpts.LineNumWidth = 3
+// recursiveDiff diffs the directory trees dir1 and dir2, reading gzip
+// compressed files decompressed, as readFile does, and writing each file
+// that differs to w under a "--- old\n+++ new" header, with /dev/null for
+// the missing side of an added or deleted file, or with stat, only its
+// printStat line. With emptyAsBanner, a file with one side empty is shown
+// as its emptyBanner line instead of diffed. Unless text is set, files that look binary are not
+// diffed; each that differs is reported as "Binary files X and Y differ".
+// With hyperlinks, the header paths are OSC 8 links to the files.
+// Statistics, if requested, are totaled over all files and printed as
+// requested by stats.
+func recursiveDiff(w, errW io.Writer, dir1, dir2 string, opts tokendiff.Options, fmtOpts tokendiff.FormatOptions, stats statsOutput, stat, text, emptyAsBanner, hyperlinks bool) (int, error) {
+	for _, dir := range []string{dir1, dir2} {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return exitError, err
+		}
+		if !info.IsDir() {
+			return exitError, &usageError{msg: fmt.Sprintf("--recursive requires directories: %s is not a directory", dir)}
 		}
-	} else {
-		fmtOpts.LineNumWidth = *f.lineNumbers
 	}
 
-	var st tokendiff.DiffStatistics
-	if lineByLine {
-		output := tokendiff.DiffLineByLine(text1, text2, opts, fmtOpts, *f.algorithm, *f.threshold)
-		st = output.Statistics
+	read := func(path string) (string, bool, error) {
+		content, err := readFile(path)
+		return content, !text && tokendiff.LooksBinary([]byte(content)), err
+	}
+	files, err := tokendiff.DiffDirectoriesWith(dir1, dir2, read, opts, fmtOpts)
+	if err != nil {
+		return exitError, err
+	}
 
-		// Print with context or all lines
-		if *f.context > 0 {
-			printWithContext(output.Lines, *f.context, fmtOpts)
-		} else {
-			printLineResults(output.Lines, fmtOpts)
+	var total tokendiff.DiffStatistics
+	for _, fd := range files {
+		oldPath, newPath := filepath.Join(dir1, fd.Path), filepath.Join(dir2, fd.Path)
+		if fd.Added {
+			oldPath = "/dev/null"
+		}
+		if fd.Deleted {
+			newPath = "/dev/null"
+		}
+		st := fd.Result.Statistics
+		switch {
+		case fd.Binary:
+			fmt.Fprintf(w, "Binary files %s and %s differ\n", fileLink(oldPath, hyperlinks), fileLink(newPath, hyperlinks))
+		case stat:
+			printStat(w, fd.Path, st)
+		default:
+			fmt.Fprintf(w, "--- %s\n+++ %s\n", fileLink(oldPath, hyperlinks), fileLink(newPath, hyperlinks))
+			banner, _, ok := emptyBanner(fd.Result.Result.Text1, fd.Result.Result.Text2, opts)
+			if emptyAsBanner && ok {
+				fmt.Fprintln(w, banner)
+			} else {
+				fmt.Fprintln(w, fd.Result.Formatted)
+			}
 		}
-	} else {
-		result := tokendiff.DiffWholeFiles(text1, text2, opts, fmtOpts)
-		st = result.Statistics
-		fmt.Println(result.Formatted)
-	}
 
-	if *f.statistics {
-		printStatistics(st)
+		total.Add(st)
 	}
 
-	// Exit with appropriate code based on whether differences were found
-	if st.DeletedWords > 0 || st.InsertedWords > 0 {
-		os.Exit(exitDiffer)
+	if err := stats.print(total); err != nil {
+		return exitError, err
 	}
-	os.Exit(exitIdentical)
+	if len(files) > 0 {
+		return exitDiffer, nil
+	}
+	return exitIdentical, nil
 }
 
-// printLineResults prints all line diff results
-func printLineResults(results []tokendiff.LineDiffResult, fmtOpts tokendiff.FormatOptions) {
-	for _, r := range results {
-		printLineDiffResult(r, fmtOpts)
+// fileLink returns path as an OSC 8 hyperlink to its file:// URL if
+// hyperlinks is set and path is not /dev/null, and as is otherwise.
+func fileLink(path string, hyperlinks bool) string {
+	if !hyperlinks || path == "/dev/null" {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	abs = filepath.ToSlash(abs)
+	if !strings.HasPrefix(abs, "/") {
+		abs = "/" + abs // Windows drive letter
 	}
+	return tokendiff.OSC8Link((&url.URL{Scheme: "file", Path: abs}).String(), path)
 }
 
-// printLineDiffResult prints a single line diff result with appropriate formatting
-func printLineDiffResult(r tokendiff.LineDiffResult, fmtOpts tokendiff.FormatOptions) {
-	if fmtOpts.ShowLineNumbers {
-		width := fmtOpts.LineNumWidth
-		oldWidth := width + 1
-		newWidth := width + 2
-		oldStr := fmt.Sprintf("%*d", oldWidth, r.OldLineNum)
-		newStr := fmt.Sprintf("%-*d", newWidth, r.NewLineNum)
-		if r.OldLineNum == 0 {
-			oldStr = strings.Repeat(" ", oldWidth)
-		}
-		if r.NewLineNum == 0 {
-			newStr = strings.Repeat(" ", newWidth)
-		}
-		fmt.Printf("%s:%s%s\n", oldStr, newStr, r.Output)
-	} else {
-		prefix := "  "
-		if r.HasChanges {
-			prefix = "| "
-			if fmtOpts.UseColor {
-				prefix = defaultChangeColor + "| " + tokendiff.ANSIReset
-			}
-		}
-		lineNum := r.NewLineNum
-		if lineNum == 0 {
-			lineNum = r.OldLineNum
-		}
-		fmt.Printf("%s%4d: %s\n", prefix, lineNum, r.Output)
+// filesDiffer reports whether two files differ token-wise, as TextsDiffer
+// does, so unchanged files are cheap.
+func filesDiffer(path1, path2 string, opts tokendiff.Options) (bool, error) {
+	text1, err := readFile(path1)
+	if err != nil {
+		return false, err
+	}
+	text2, err := readFile(path2)
+	if err != nil {
+		return false, err
 	}
+	return tokendiff.TextsDiffer(text1, text2, opts), nil
 }
 
-// printWithContext prints only changed lines with surrounding context
-func printWithContext(results []tokendiff.LineDiffResult, contextLines int, fmtOpts tokendiff.FormatOptions) {
-	// Find ranges to print
-	toPrint := make([]bool, len(results))
-	for i, r := range results {
-		if r.HasChanges {
-			start := max(0, i-contextLines)
-			end := min(len(results), i+contextLines+1)
-			for j := start; j < end; j++ {
-				toPrint[j] = true
-			}
-		}
+// latestBackup returns the most recently modified regular file matching the
+// glob pattern, other than current itself. Ties are broken by the later name,
+// so backups stamped with sortable timestamps resolve predictably.
+func latestBackup(pattern, current string) (string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid --since pattern %q: %w", pattern, err)
 	}
 
-	// Print with separators for gaps
-	lastPrinted := -1
-	for i, r := range results {
-		if !toPrint[i] {
+	var best string
+	var bestTime time.Time
+	for _, path := range matches {
+		if sameFile(path, current) {
 			continue
 		}
-
-		if lastPrinted >= 0 && i > lastPrinted+1 {
-			fmt.Println("---")
+		fi, err := os.Stat(path)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		mt := fi.ModTime()
+		if best == "" || mt.After(bestTime) || (mt.Equal(bestTime) && path > best) {
+			best, bestTime = path, mt
 		}
-
-		printLineDiffResult(r, fmtOpts)
-		lastPrinted = i
 	}
-}
 
-// printStatistics prints diff statistics to stderr
-func printStatistics(st tokendiff.DiffStatistics) {
-	fmt.Fprintln(os.Stderr, "")
-	fmt.Fprintf(os.Stderr, "old: %d words  %d %d%% common  %d %d%% deleted\n",
-		st.OldWords,
-		st.CommonWords, percent(st.CommonWords, st.OldWords),
-		st.DeletedWords, percent(st.DeletedWords, st.OldWords))
-	fmt.Fprintf(os.Stderr, "new: %d words  %d %d%% common  %d %d%% inserted\n",
-		st.NewWords,
-		st.CommonWords, percent(st.CommonWords, st.NewWords),
-		st.InsertedWords, percent(st.InsertedWords, st.NewWords))
+	if best == "" {
+		return "", fmt.Errorf("no backup matches %q", pattern)
+	}
+	return best, nil
 }
 
-// percent calculates percentage, handling division by zero
-func percent(part, total int) int {
-	if total == 0 {
-		return 0
-	}
-	return (part * 100) / total
+// sameFile returns true if both paths name the same existing file
+func sameFile(path1, path2 string) bool {
+	fi1, err1 := os.Stat(path1)
+	fi2, err2 := os.Stat(path2)
+	return err1 == nil && err2 == nil && os.SameFile(fi1, fi2)
 }
 
 // readFile reads an entire file into a string
@@ -479,26 +1880,94 @@ func readFile(path string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	data, err = decompress(path, data)
+	if err != nil {
+		return "", err
+	}
 	return string(data), nil
 }
 
-// readStdin reads all of stdin into a string
-func readStdin() (string, error) {
-	reader := bufio.NewReader(os.Stdin)
+// readStdin reads all of r (stdin in the CLI) into a string. The input is
+// copied straight into the string's buffer, decompressing on the fly, rather
+// than read whole into a byte slice and copied again.
+func readStdin(r io.Reader) (string, error) {
+	rc, err := decompressStream("", io.NopCloser(r))
+	if err != nil {
+		return "", err
+	}
 	var sb strings.Builder
-	for {
-		line, err := reader.ReadString('\n')
-		sb.WriteString(line)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return "", err
-		}
+	if _, err := io.Copy(&sb, rc); err != nil {
+		return "", err
 	}
 	return sb.String(), nil
 }
 
+// gzipMagic is the header that starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isGzip returns true if an input named name starting with head is gzip
+// compressed, going by the magic bytes or a ".gz" extension
+func isGzip(name string, head []byte) bool {
+	return bytes.HasPrefix(head, gzipMagic) || strings.HasSuffix(name, ".gz")
+}
+
+// decompress returns data decompressed if it is gzip compressed, and data
+// unchanged otherwise
+func decompress(name string, data []byte) ([]byte, error) {
+	if !isGzip(name, data) {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing gzip: %w", err)
+	}
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing gzip: %w", err)
+	}
+	return out, nil
+}
+
+// gzipReadCloser reads decompressed data and closes the underlying input
+type gzipReadCloser struct {
+	*gzip.Reader
+	input io.Closer
+}
+
+func (r gzipReadCloser) Close() error { return r.input.Close() }
+
+// decompressStream wraps rc to decompress it on the fly if it is gzip
+// compressed, for inputs streamed rather than read whole
+func decompressStream(name string, rc io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(rc)
+	head, _ := br.Peek(len(gzipMagic))
+	if !isGzip(name, head) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, rc}, nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing gzip: %w", err)
+	}
+	return gzipReadCloser{zr, rc}, nil
+}
+
+// terminalWidth returns the width of the terminal w writes to, then the
+// width in $COLUMNS, then 80
+func terminalWidth(w io.Writer) int {
+	if f, ok := w.(*os.File); ok && isTerminal(f) {
+		if cols := terminalColumns(f); cols > 0 {
+			return cols
+		}
+	}
+	if cols, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && cols > 0 {
+		return cols
+	}
+	return 80
+}
+
 // isTerminal returns true if the file is a terminal
 func isTerminal(f *os.File) bool {
 	fi, err := f.Stat()
@@ -553,6 +2022,49 @@ func parseEscapeSequences(s string) string {
 	return result.String()
 }
 
+// delimiterGroups are the named sets of delimiters -d accepts as "@name".
+var delimiterGroups = map[string]string{
+	"code": "(){}[]<>,.;:",
+	"math": "+-*/=<>",
+}
+
+// resolveDelimiters returns the union of the delimiters given with each -d,
+// in order and without repeats: a named group from delimiterGroups, written
+// "@name", or characters with escape sequences as for parseEscapeSequences.
+// Only "@" followed by letters names a group, so "@" alone or followed by
+// other characters, as in "@:#", is those characters.
+func resolveDelimiters(specs []string) (string, error) {
+	var sb strings.Builder
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		chars := parseEscapeSequences(spec)
+		if name, ok := strings.CutPrefix(spec, "@"); ok && isLetters(name) {
+			if chars, ok = delimiterGroups[name]; !ok {
+				return "", &usageError{msg: fmt.Sprintf("unknown delimiter group %q (known: @code, @math)", spec)}
+			}
+		}
+		for chars != "" {
+			_, size := utf8.DecodeRuneInString(chars)
+			if c := chars[:size]; !seen[c] {
+				seen[c] = true
+				sb.WriteString(c)
+			}
+			chars = chars[size:]
+		}
+	}
+	return sb.String(), nil
+}
+
+// isLetters returns true if s is one or more ASCII letters
+func isLetters(s string) bool {
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return s != ""
+}
+
 // findConfigFile returns the path to the config file for the given profile.
 // If a profile is specified but the file doesn't exist, it returns an error.
 func findConfigFile(profile string) (string, error) {
@@ -604,12 +2116,52 @@ func loadConfig(path string) (config, error) {
 		return cfg, nil
 	}
 
+	err := loadConfigInto(&cfg, path, make(map[string]bool))
+	return cfg, err
+}
+
+// configEntry is one key=value line of a config file.
+type configEntry struct {
+	lineNum    int
+	key, value string
+}
+
+// envReference matches a ${VAR} reference to an environment variable in a
+// config value.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces each ${VAR} in value with the environment variable, or
+// with nothing if it is unset. Other "$" characters are kept, so values such
+// as a start-delete of "$[" or a token-pattern ending in "$" are unchanged.
+func expandEnv(value string) string {
+	return envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		return os.Getenv(ref[2 : len(ref)-1])
+	})
+}
+
+// loadConfigInto applies the config file at path to cfg. ${VAR} in values
+// is replaced as by expandEnv before the value is parsed. The file's
+// include directives are applied first, in order, so its other options
+// override those it includes. visited holds the files being loaded, to
+// detect include cycles.
+func loadConfigInto(cfg *config, path string, visited map[string]bool) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if visited[abs] {
+		return fmt.Errorf("include cycle: %s includes itself", abs)
+	}
+	visited[abs] = true
+	defer delete(visited, abs)
+
 	file, err := os.Open(path)
 	if err != nil {
-		return cfg, err
+		return err
 	}
 	defer file.Close()
 
+	var includes, options []configEntry
 	scanner := bufio.NewScanner(file)
 	lineNum := 0
 	for scanner.Scan() {
@@ -623,18 +2175,156 @@ func loadConfig(path string) (config, error) {
 		var key, value string
 		if idx := strings.Index(line, "="); idx >= 0 {
 			key = strings.TrimSpace(line[:idx])
-			value = strings.TrimSpace(line[idx+1:])
+			value = expandEnv(strings.TrimSpace(line[idx+1:]))
 		} else {
 			key = line
 			value = "true"
 		}
 
-		if err := applyConfigOption(&cfg, key, value); err != nil {
-			return cfg, fmt.Errorf("line %d: %w", lineNum, err)
+		if key == "include" {
+			includes = append(includes, configEntry{lineNum, key, value})
+		} else {
+			options = append(options, configEntry{lineNum, key, value})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, e := range includes {
+		included, err := resolveInclude(abs, e.value)
+		if err == nil {
+			err = loadConfigInto(cfg, included, visited)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: include %s: %w", e.lineNum, e.value, err)
+		}
+	}
+	for _, e := range options {
+		if err := applyConfigOption(cfg, e.key, e.value); err != nil {
+			return fmt.Errorf("line %d: %w", e.lineNum, err)
+		}
+	}
+	return nil
+}
+
+// resolveInclude returns the path of the config file named by an include
+// directive in the file at from. A target containing a path separator, or
+// starting with "~/", is a path, relative to from's directory unless
+// absolute; otherwise it is a profile name, found as for --profile.
+func resolveInclude(from, target string) (string, error) {
+	switch {
+	case target == "" || target == "true":
+		return "", fmt.Errorf("include requires a profile name or path")
+	case strings.HasPrefix(target, "~/"):
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, target[2:]), nil
+	case strings.ContainsRune(target, '/') || strings.ContainsRune(target, filepath.Separator):
+		if filepath.IsAbs(target) {
+			return target, nil
+		}
+		return filepath.Join(filepath.Dir(from), target), nil
+	default:
+		path, err := findConfigFile(target)
+		if err == nil && path == "" {
+			err = fmt.Errorf("profile config file not found: %s", target)
+		}
+		return path, err
+	}
+}
+
+// loadAliasFile reads a token alias file for Options.TokenAliases. Each line
+// has the form "canonical: variant1, variant2"; blank lines and lines
+// starting with # are ignored. Returns an error naming the line for
+// malformed entries.
+func loadAliasFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, &readError{path: path, err: err}
+	}
+	defer file.Close()
+
+	aliases := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := parseAliasLine(aliases, line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &readError{path: path, err: err}
+	}
+
+	return aliases, nil
+}
+
+// loadIgnoreFile reads a file of tokens never to report as changes, one per
+// line, such as build stamps. Surrounding whitespace is trimmed; blank lines
+// and lines starting with # are ignored.
+func loadIgnoreFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, &readError{path: path, err: err}
+	}
+	defer file.Close()
+
+	var tokens []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
+		tokens = append(tokens, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &readError{path: path, err: err}
+	}
+
+	return tokens, nil
+}
+
+// parseAliasLine parses one "canonical: variant1, variant2" line into aliases
+func parseAliasLine(aliases map[string]string, line string) error {
+	canonical, list, ok := strings.Cut(line, ":")
+	if !ok {
+		return fmt.Errorf("malformed alias line %q (expected \"canonical: variant1, variant2\")", line)
+	}
+	canonical = strings.TrimSpace(canonical)
+	if canonical == "" {
+		return fmt.Errorf("missing canonical token in %q", line)
+	}
+	if strings.ContainsAny(canonical, " \t") {
+		return fmt.Errorf("canonical token %q contains whitespace", canonical)
+	}
+	if strings.TrimSpace(list) == "" {
+		return fmt.Errorf("no variants for %q", canonical)
 	}
 
-	return cfg, scanner.Err()
+	for _, variant := range strings.Split(list, ",") {
+		variant = strings.TrimSpace(variant)
+		if variant == "" {
+			return fmt.Errorf("empty variant for %q", canonical)
+		}
+		if strings.ContainsAny(variant, " \t") {
+			return fmt.Errorf("variant %q contains whitespace", variant)
+		}
+		if prev, ok := aliases[variant]; ok && prev != canonical {
+			return fmt.Errorf("%q is already an alias of %q", variant, prev)
+		}
+		aliases[variant] = canonical
+	}
+	return nil
 }
 
 // defaultConfig returns a config with default values
@@ -648,7 +2338,10 @@ func defaultConfig() config {
 		startInsert:         "{+",
 		stopInsert:          "+}",
 		algorithm:           "best",
-		similarityThreshold: 0.1,
+		similarityThreshold: tokendiff.DefaultLineThreshold,
+		similarity:          "token",
+		contextSeparator:    tokendiff.DefaultContextSeparator,
+		changeMarker:        tokendiff.DefaultChangeMarker,
 	}
 }
 
@@ -669,6 +2362,14 @@ func applyStringOption(cfg *config, key, value string) bool {
 		cfg.startInsert = value
 	case "stop-insert", "z":
 		cfg.stopInsert = value
+	case "alias-file":
+		cfg.aliasFile = value
+	case "ignore-file":
+		cfg.ignoreFile = value
+	case "context-separator":
+		cfg.contextSeparator = value
+	case "change-marker":
+		cfg.changeMarker = value
 	default:
 		return false
 	}
@@ -684,12 +2385,29 @@ func applyBoolOption(cfg *config, key, value string) bool {
 		cfg.noColor = parseBool(value)
 	case "line-mode":
 		cfg.lineByLine = parseBool(value)
+	case "side-by-side", "S":
+		cfg.sideBySide = parseBool(value)
+	case "detect-moves":
+		cfg.detectMoves = parseBool(value)
+	case "line-stats":
+		cfg.lineStats = parseBool(value)
+	case "changed-line-numbers":
+		cfg.changedLineNumbers = parseBool(value)
 	case "repeat-markers", "R":
 		cfg.repeatMarkers = parseBool(value)
 	case "less-mode", "l":
-		cfg.lessMode = parseBool(value)
+		switch {
+		case value == "overstrike" || value == "ansi":
+			cfg.lessMode = value
+		case parseBool(value):
+			cfg.lessMode = "overstrike"
+		default:
+			cfg.lessMode = ""
+		}
 	case "printer", "p":
 		cfg.printerMode = parseBool(value)
+	case "unicode-strikethrough":
+		cfg.unicodeStrike = parseBool(value)
 	case "no-deleted", "1":
 		cfg.noDeleted = parseBool(value)
 	case "no-inserted", "2":
@@ -698,8 +2416,20 @@ func applyBoolOption(cfg *config, key, value string) bool {
 		cfg.noCommon = parseBool(value)
 	case "statistics", "s":
 		cfg.statistics = parseBool(value)
+	case "summary":
+		cfg.summary = parseBool(value)
 	case "ignore-case", "i":
 		cfg.ignoreCase = parseBool(value)
+	case "normalize-eol":
+		cfg.normalizeEOL = parseBool(value)
+	case "newline-note":
+		cfg.newlineNote = parseBool(value)
+	case "transpositions":
+		cfg.transpositions = parseBool(value)
+	case "refine-tokens":
+		cfg.refineTokens = parseBool(value)
+	case "graphemes":
+		cfg.graphemes = parseBool(value)
 	default:
 		return false
 	}
@@ -710,11 +2440,21 @@ func applyBoolOption(cfg *config, key, value string) bool {
 func applyIntOption(cfg *config, key, value string) bool {
 	switch key {
 	case "line-numbers", "L":
+		if side, ok := tokendiff.ParseLineNumberSide(value); ok {
+			cfg.lineNumbers, cfg.lineNumberSide = 0, side
+			break
+		}
 		cfg.lineNumbers = parseInt(value, -1)
 	case "context", "C":
 		cfg.context = parseInt(value, 0)
 	case "match-context", "m":
 		cfg.matchContext = parseInt(value, 0)
+	case "max-tokens":
+		cfg.maxTokens = parseInt(value, 0)
+	case "collapse":
+		cfg.collapse = parseInt(value, 0)
+	case "tab-width":
+		cfg.tabWidth = parseInt(value, 0)
 	default:
 		return false
 	}
@@ -737,10 +2477,35 @@ func applyConfigOption(cfg *config, key, value string) error {
 	switch key {
 	case "algorithm", "A":
 		switch value {
-		case "best", "normal", "fast":
+		case "best", "auto", "optimal", "normal", "fast":
 			cfg.algorithm = value
 		default:
-			return fmt.Errorf("invalid algorithm: %s (use best, normal, or fast)", value)
+			return fmt.Errorf("invalid algorithm: %s (use best, auto, optimal, normal, or fast)", value)
+		}
+	case "delete-color", "insert-color", "common-color":
+		code, err := tokendiff.ParseColor(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		switch key {
+		case "delete-color":
+			cfg.deleteColor = code
+		case "insert-color":
+			cfg.insertColor = code
+		default:
+			cfg.commonColor = code
+		}
+	case "token-pattern":
+		if _, err := tokendiff.TokenizeE("", tokendiff.Options{TokenPattern: value}); err != nil {
+			return err
+		}
+		cfg.tokenPattern = value
+	case "similarity":
+		switch value {
+		case "token", "edit":
+			cfg.similarity = value
+		default:
+			return fmt.Errorf("invalid similarity: %s (use token or edit)", value)
 		}
 	case "threshold":
 		t := parseFloat(value, -1)
@@ -760,6 +2525,35 @@ func parseBool(s string) bool {
 	return s == "true" || s == "yes" || s == "1" || s == ""
 }
 
+// lineNumbersValue is the value of -L/--line-numbers: a column width, or
+// the name of the side to number, old, new, or both, at auto-width.
+type lineNumbersValue struct {
+	width *int
+	side  *tokendiff.LineNumberSide
+}
+
+func (v lineNumbersValue) String() string {
+	if *v.side != tokendiff.LineNumbersBoth {
+		return v.side.String()
+	}
+	return strconv.Itoa(*v.width)
+}
+
+func (v lineNumbersValue) Set(s string) error {
+	if side, ok := tokendiff.ParseLineNumberSide(s); ok {
+		*v.width, *v.side = 0, side
+		return nil
+	}
+	width, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("want a width or old, new, or both")
+	}
+	*v.width, *v.side = width, tokendiff.LineNumbersBoth
+	return nil
+}
+
+func (v lineNumbersValue) Type() string { return "lineNumbers" }
+
 // parseInt parses an integer value from a string
 func parseInt(s string, defaultVal int) int {
 	var val int
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/dacharyc/tokendiff"
+	flag "github.com/spf13/pflag"
 )
 
 func TestFormatDiffsAdvanced(t *testing.T) {
@@ -252,6 +262,299 @@ func TestReadFile(t *testing.T) {
 	}
 }
 
+// gzipBytes returns content gzip compressed
+func gzipBytes(t *testing.T, content string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadFileGzip(t *testing.T) {
+	dir := t.TempDir()
+	content := "hello\nworld\n"
+
+	tests := []struct {
+		name    string
+		file    string
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{"gz extension", "log.txt.gz", gzipBytes(t, content), content, false},
+		{"magic bytes without extension", "snapshot", gzipBytes(t, content), content, false},
+		{"plain file", "plain.txt", []byte(content), content, false},
+		{"corrupt gz", "broken.gz", []byte("not gzip at all"), "", true},
+		{"truncated gz", "truncated.gz", gzipBytes(t, content)[:12], "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.file)
+			if err := os.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "decompressing gzip") {
+				t.Errorf("readFile() error = %v, want a decompression error", err)
+			}
+			if got != tt.want {
+				t.Errorf("readFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// writeTree creates files under root from a map of relative path to content
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for rel, content := range files {
+		path := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", rel, err)
+		}
+	}
+}
+
+func TestBriefDiff(t *testing.T) {
+	dir1 := filepath.Join(t.TempDir(), "old")
+	dir2 := filepath.Join(t.TempDir(), "new")
+	writeTree(t, dir1, map[string]string{
+		"same.txt":       "unchanged content",
+		"changed.txt":    "hello world",
+		"spacing.txt":    "a  b\n",
+		"sub/nested.txt": "foo bar",
+		"only-old.txt":   "gone",
+	})
+	writeTree(t, dir2, map[string]string{
+		"same.txt":       "unchanged content",
+		"changed.txt":    "hello universe",
+		"spacing.txt":    "a b",
+		"sub/nested.txt": "foo baz",
+		"only-new.txt":   "added",
+	})
+
+	var out strings.Builder
+	differ, err := briefDiff(&out, dir1, dir2, tokendiff.DefaultOptions())
+	if err != nil {
+		t.Fatalf("briefDiff() error = %v", err)
+	}
+	if !differ {
+		t.Error("briefDiff() = false, want true")
+	}
+
+	want := strings.Join([]string{
+		"changed.txt",
+		"only-new.txt",
+		"only-old.txt",
+		filepath.Join("sub", "nested.txt"),
+	}, "\n") + "\n"
+	if out.String() != want {
+		t.Errorf("briefDiff() output:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestRecursiveDiff(t *testing.T) {
+	dir1 := filepath.Join(t.TempDir(), "old")
+	dir2 := filepath.Join(t.TempDir(), "new")
+	writeTree(t, dir1, map[string]string{
+		"same.txt":    "unchanged content",
+		"changed.txt": "hello world",
+		"old.txt":     "gone",
+	})
+	writeTree(t, dir2, map[string]string{
+		"same.txt":    "unchanged content",
+		"changed.txt": "hello universe",
+		"new.txt":     "added",
+	})
+	t.Setenv("NO_COLOR", "1")
+
+	var stdout, stderr strings.Builder
+	code := Run([]string{"-r", dir1, dir2}, strings.NewReader(""), &stdout, &stderr)
+	if code != exitDiffer {
+		t.Errorf("Run() = %d, want %d (stderr: %q)", code, exitDiffer, stderr.String())
+	}
+	want := "--- " + filepath.Join(dir1, "changed.txt") + "\n+++ " + filepath.Join(dir2, "changed.txt") + "\n" +
+		"hello [-world-] {+universe+}\n" +
+		"--- /dev/null\n+++ " + filepath.Join(dir2, "new.txt") + "\n{+added+}\n" +
+		"--- " + filepath.Join(dir1, "old.txt") + "\n+++ /dev/null\n[-gone-]\n"
+	if stdout.String() != want {
+		t.Errorf("stdout =\n%s\nwant\n%s", stdout.String(), want)
+	}
+
+	// Change counts only
+	stdout.Reset()
+	if code := Run([]string{"-r", "--stat", dir1, dir2}, strings.NewReader(""), &stdout, &stderr); code != exitDiffer {
+		t.Errorf("Run() --stat = %d, want %d (stderr: %q)", code, exitDiffer, stderr.String())
+	}
+	if want := "changed.txt: +1 -1\nnew.txt: +1 -0\nold.txt: +0 -1\n"; stdout.String() != want {
+		t.Errorf("--stat stdout =\n%s\nwant\n%s", stdout.String(), want)
+	}
+
+	// File names as hyperlinks
+	stdout.Reset()
+	if _, err := recursiveDiff(&stdout, &stderr, dir1, dir2, tokendiff.DefaultOptions(), tokendiff.DefaultFormatOptions(), statsOutput{}, false, false, false, true); err != nil {
+		t.Fatalf("recursiveDiff() hyperlinks error: %v", err)
+	}
+	link := "\033]8;;file://" + filepath.ToSlash(filepath.Join(dir2, "changed.txt")) + "\033\\" + filepath.Join(dir2, "changed.txt") + "\033]8;;\033\\"
+	if !strings.Contains(stdout.String(), "+++ "+link+"\n") || !strings.Contains(stdout.String(), "--- /dev/null\n") {
+		t.Errorf("hyperlinks stdout =\n%q\nwant a header with %q and a plain /dev/null", stdout.String(), link)
+	}
+
+	// Hyperlinks need a terminal
+	stdout.Reset()
+	Run([]string{"-r", "--hyperlinks", dir1, dir2}, strings.NewReader(""), &stdout, &stderr)
+	if stdout.String() != want {
+		t.Errorf("--hyperlinks to a pipe stdout =\n%s\nwant\n%s", stdout.String(), want)
+	}
+
+	// Added and deleted files as banners
+	stdout.Reset()
+	if code := Run([]string{"-r", "--empty-as-banner", dir1, dir2}, strings.NewReader(""), &stdout, &stderr); code != exitDiffer {
+		t.Errorf("Run() --empty-as-banner = %d, want %d (stderr: %q)", code, exitDiffer, stderr.String())
+	}
+	wantBanner := "--- " + filepath.Join(dir1, "changed.txt") + "\n+++ " + filepath.Join(dir2, "changed.txt") + "\n" +
+		"hello [-world-] {+universe+}\n" +
+		"--- /dev/null\n+++ " + filepath.Join(dir2, "new.txt") + "\n<new file: 1 words>\n" +
+		"--- " + filepath.Join(dir1, "old.txt") + "\n+++ /dev/null\n<deleted file: 1 words>\n"
+	if stdout.String() != wantBanner {
+		t.Errorf("--empty-as-banner stdout =\n%s\nwant\n%s", stdout.String(), wantBanner)
+	}
+
+	// Identical trees
+	stdout.Reset()
+	if code := Run([]string{"--recursive", dir1, dir1}, strings.NewReader(""), &stdout, &stderr); code != exitIdentical || stdout.Len() != 0 {
+		t.Errorf("Run() identical = %d, %q; want %d with no output", code, stdout.String(), exitIdentical)
+	}
+
+	// Files are not directories
+	stderr.Reset()
+	file := filepath.Join(dir1, "same.txt")
+	if code := Run([]string{"-r", file, file}, strings.NewReader(""), &stdout, &stderr); code != exitError || !strings.Contains(stderr.String(), "is not a directory") {
+		t.Errorf("Run() files = %d, %q; want %d with a directory error", code, stderr.String(), exitError)
+	}
+
+	// Binary files are reported, not diffed, unless --text is given
+	bin1 := filepath.Join(t.TempDir(), "old")
+	bin2 := filepath.Join(t.TempDir(), "new")
+	writeTree(t, bin1, map[string]string{"data.bin": "abc\x00def"})
+	writeTree(t, bin2, map[string]string{"data.bin": "abc\x00xyz"})
+	stdout.Reset()
+	wantBinary := "Binary files " + filepath.Join(bin1, "data.bin") + " and " + filepath.Join(bin2, "data.bin") + " differ\n"
+	if code := Run([]string{"-r", bin1, bin2}, strings.NewReader(""), &stdout, &stderr); code != exitDiffer || stdout.String() != wantBinary {
+		t.Errorf("Run() binary = %d, %q; want %d with %q", code, stdout.String(), exitDiffer, wantBinary)
+	}
+	stdout.Reset()
+	if code := Run([]string{"-r", "--text", bin1, bin2}, strings.NewReader(""), &stdout, &stderr); code != exitDiffer || !strings.Contains(stdout.String(), "[-") {
+		t.Errorf("Run() binary with --text = %d, %q; want %d with a diff", code, stdout.String(), exitDiffer)
+	}
+
+	// Compressed files are diffed decompressed
+	gz1 := filepath.Join(t.TempDir(), "old")
+	gz2 := filepath.Join(t.TempDir(), "new")
+	writeTree(t, gz1, map[string]string{"log.txt.gz": string(gzipBytes(t, "hello world\n"))})
+	writeTree(t, gz2, map[string]string{"log.txt.gz": string(gzipBytes(t, "hello there\n"))})
+	stdout.Reset()
+	if code := Run([]string{"-r", "--stat", gz1, gz2}, strings.NewReader(""), &stdout, &stderr); code != exitDiffer || stdout.String() != "log.txt.gz: +1 -1\n" {
+		t.Errorf("Run() gzip = %d, %q; want %d with %q", code, stdout.String(), exitDiffer, "log.txt.gz: +1 -1\n")
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.txt": "same words\n",
+		"b.txt": "same   words",
+		"c.txt": "other words\n",
+	})
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	c := filepath.Join(dir, "c.txt")
+
+	tests := []struct {
+		name  string
+		args  []string
+		stdin string
+		want  int
+	}{
+		{"identical", []string{"-q", a, a}, "", exitIdentical},
+		{"whitespace only", []string{"-q", a, b}, "", exitIdentical},
+		{"differing", []string{"--quiet", a, c}, "", exitDiffer},
+		{"stdin", []string{"-q", "--stdin", a}, "other words", exitDiffer},
+		{"line mode", []string{"-q", "--line-mode", "-C", "2", a, c}, "", exitDiffer},
+		{"directories", []string{"-q", "-r", dir, dir}, "", exitIdentical},
+		{"missing file", []string{"-q", a, filepath.Join(dir, "missing.txt")}, "", exitError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr strings.Builder
+			code := Run(tt.args, strings.NewReader(tt.stdin), &stdout, &stderr)
+			if code != tt.want {
+				t.Errorf("Run() = %d, want %d (stderr: %q)", code, tt.want, stderr.String())
+			}
+			if stdout.Len() != 0 {
+				t.Errorf("stdout = %q, want nothing", stdout.String())
+			}
+			if code != exitError && stderr.Len() != 0 {
+				t.Errorf("stderr = %q, want nothing", stderr.String())
+			}
+		})
+	}
+
+	// Quiet directory comparison names its own requirement
+	var stdout, stderr strings.Builder
+	code := Run([]string{"-q", "-r", "--stdin", dir}, strings.NewReader(""), &stdout, &stderr)
+	if want := "--quiet with --recursive requires two directory arguments"; code != exitError || !strings.Contains(stderr.String(), want) {
+		t.Errorf("Run() -q -r --stdin = %d, %q; want %d with %q", code, stderr.String(), exitError, want)
+	}
+}
+
+func TestBriefDiffFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.txt": "same words",
+		"b.txt": "same  words\n",
+		"c.txt": "other words",
+	})
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	c := filepath.Join(dir, "c.txt")
+
+	var out strings.Builder
+	differ, err := briefDiff(&out, a, b, tokendiff.DefaultOptions())
+	if err != nil {
+		t.Fatalf("briefDiff() error = %v", err)
+	}
+	if differ || out.Len() != 0 {
+		t.Errorf("briefDiff() = %v, %q; want false with no output", differ, out.String())
+	}
+
+	differ, err = briefDiff(&out, a, c, tokendiff.DefaultOptions())
+	if err != nil {
+		t.Fatalf("briefDiff() error = %v", err)
+	}
+	if !differ || out.String() != c+"\n" {
+		t.Errorf("briefDiff() = %v, %q; want true with %q", differ, out.String(), c)
+	}
+
+	if _, err := briefDiff(&out, a, dir, tokendiff.DefaultOptions()); err == nil {
+		t.Error("briefDiff() expected error comparing a file with a directory")
+	}
+}
+
 // TestSpacingFromLibrary verifies CLI uses library's spacing functions correctly
 func TestSpacingFromLibrary(t *testing.T) {
 	// Just verify the library functions are accessible and work
@@ -547,6 +850,168 @@ match-context=3
 	}
 }
 
+func TestLoadConfigInvalidRoleColor(t *testing.T) {
+	configContent := `color=red,green
+delete-color=rad
+`
+	configPath := filepath.Join(t.TempDir(), "testconfig")
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+
+	_, err := loadConfig(configPath)
+	if err == nil {
+		t.Fatal("loadConfig() expected error for invalid delete-color")
+	}
+	if !strings.Contains(err.Error(), "line 2") || !strings.Contains(err.Error(), "rad") {
+		t.Errorf("loadConfig() error = %q, want line number and bad color name", err)
+	}
+}
+
+func TestLoadConfigExpandsEnv(t *testing.T) {
+	t.Setenv("MY_DELIMS", "(){}")
+	t.Setenv("MY_CONTEXT", "4")
+	t.Setenv("MY_IGNORE_CASE", "true")
+	configContent := `delimiters = ${MY_DELIMS}
+match-context=${MY_CONTEXT}
+ignore-case=${MY_IGNORE_CASE}
+start-delete=<${UNSET_TOKENDIFF_VAR}del>
+stop-delete=$]
+start-insert=$MY_CONTEXT
+token-pattern=^\w+$
+`
+	configPath := filepath.Join(t.TempDir(), "testconfig")
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write test config: %v", err)
+	}
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig error: %v", err)
+	}
+	if cfg.delimiters != "(){}" {
+		t.Errorf("delimiters = %q, want %q", cfg.delimiters, "(){}")
+	}
+	if cfg.matchContext != 4 {
+		t.Errorf("matchContext = %d, want 4", cfg.matchContext)
+	}
+	if !cfg.ignoreCase {
+		t.Error("ignoreCase should be true")
+	}
+	if cfg.startDelete != "<del>" {
+		t.Errorf("startDelete = %q, want %q with the unset variable removed", cfg.startDelete, "<del>")
+	}
+	// Only ${VAR} is expanded, so a literal "$" survives
+	if cfg.stopDelete != "$]" {
+		t.Errorf("stopDelete = %q, want %q", cfg.stopDelete, "$]")
+	}
+	if cfg.startInsert != "$MY_CONTEXT" {
+		t.Errorf("startInsert = %q, want %q unexpanded", cfg.startInsert, "$MY_CONTEXT")
+	}
+	if cfg.tokenPattern != `^\w+$` {
+		t.Errorf("tokenPattern = %q, want %q", cfg.tokenPattern, `^\w+$`)
+	}
+}
+
+func TestLoadConfigInclude(t *testing.T) {
+	tmpDir := t.TempDir()
+	base := "delimiters=(){}\nignore-case\nmatch-context=3\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, "base"), []byte(base), 0644); err != nil {
+		t.Fatalf("Failed to write base config: %v", err)
+	}
+	// The include is applied first even after an override
+	derived := "# Derived config\nmatch-context=5\ninclude=./base\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, "derived"), []byte(derived), 0644); err != nil {
+		t.Fatalf("Failed to write derived config: %v", err)
+	}
+
+	cfg, err := loadConfig(filepath.Join(tmpDir, "derived"))
+	if err != nil {
+		t.Fatalf("loadConfig error: %v", err)
+	}
+	if cfg.matchContext != 5 {
+		t.Errorf("matchContext = %d, want 5 from the derived config", cfg.matchContext)
+	}
+	if cfg.delimiters != "(){}" {
+		t.Errorf("delimiters = %q, want %q inherited from the base config", cfg.delimiters, "(){}")
+	}
+	if !cfg.ignoreCase {
+		t.Error("ignoreCase should be inherited from the base config")
+	}
+
+	// A profile name is found as for --profile
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	if err := os.WriteFile(filepath.Join(home, ".tokendiffrc.base"), []byte(base), 0644); err != nil {
+		t.Fatalf("Failed to write base profile: %v", err)
+	}
+	derivedPath := filepath.Join(tmpDir, "derived-profile")
+	if err := os.WriteFile(derivedPath, []byte("include=base\nmatch-context=5\n"), 0644); err != nil {
+		t.Fatalf("Failed to write derived config: %v", err)
+	}
+	cfg, err = loadConfig(derivedPath)
+	if err != nil {
+		t.Fatalf("loadConfig error: %v", err)
+	}
+	if cfg.matchContext != 5 || cfg.delimiters != "(){}" {
+		t.Errorf("profile include: matchContext = %d, delimiters = %q; want 5, %q", cfg.matchContext, cfg.delimiters, "(){}")
+	}
+}
+
+func TestLoadConfigIncludeErrors(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv("HOME", tmpDir)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	files := map[string]string{
+		"a":       "include=./b\n",
+		"b":       "ignore-case\ninclude=./a\n",
+		"self":    "include=./self\n",
+		"missing": "include=nosuchprofile\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		file    string
+		wantErr []string
+	}{
+		{"a", []string{"include cycle", "line 2"}},
+		{"self", []string{"include cycle", "line 1"}},
+		{"missing", []string{"nosuchprofile", "not found"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			_, err := loadConfig(filepath.Join(tmpDir, tt.file))
+			if err == nil {
+				t.Fatal("loadConfig() expected error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("loadConfig() error = %q, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyRoleColors(t *testing.T) {
+	cfg := defaultConfig()
+	del, ins := applyRoleColors(cfg, defaultDeleteColor, defaultInsertColor)
+	if del != defaultDeleteColor || ins != defaultInsertColor {
+		t.Errorf("applyRoleColors() with no role colors = %q, %q; want defaults", del, ins)
+	}
+
+	cfg.deleteColor = tokendiff.ForegroundColors["magenta"]
+	del, ins = applyRoleColors(cfg, defaultDeleteColor, defaultInsertColor)
+	if del != cfg.deleteColor || ins != defaultInsertColor {
+		t.Errorf("applyRoleColors() = %q, %q; want delete override only", del, ins)
+	}
+}
+
 func TestLoadConfigEmpty(t *testing.T) {
 	cfg, err := loadConfig("")
 	if err != nil {
@@ -573,6 +1038,42 @@ func TestApplyConfigOption(t *testing.T) {
 		{"i", "yes", func(cfg config) bool { return cfg.ignoreCase }, false},
 		{"statistics", "", func(cfg config) bool { return cfg.statistics }, false},
 		{"match-context", "5", func(cfg config) bool { return cfg.matchContext == 5 }, false},
+		{"max-tokens", "1000", func(cfg config) bool { return cfg.maxTokens == 1000 }, false},
+		{"less-mode", "", func(cfg config) bool { return cfg.lessMode == "overstrike" }, false},
+		{"less-mode", "ansi", func(cfg config) bool { return cfg.lessMode == "ansi" }, false},
+		{"less-mode", "false", func(cfg config) bool { return cfg.lessMode == "" }, false},
+		{"collapse", "200", func(cfg config) bool { return cfg.collapse == 200 }, false},
+		{"tab-width", "4", func(cfg config) bool { return cfg.tabWidth == 4 }, false},
+		{"newline-note", "true", func(cfg config) bool { return cfg.newlineNote }, false},
+		{"transpositions", "true", func(cfg config) bool { return cfg.transpositions }, false},
+		{"refine-tokens", "true", func(cfg config) bool { return cfg.refineTokens }, false},
+		{"graphemes", "true", func(cfg config) bool { return cfg.graphemes }, false},
+		{"side-by-side", "true", func(cfg config) bool { return cfg.sideBySide }, false},
+		{"detect-moves", "true", func(cfg config) bool { return cfg.detectMoves }, false},
+		{"line-stats", "true", func(cfg config) bool { return cfg.lineStats }, false},
+		{"context-separator", "@@", func(cfg config) bool { return cfg.contextSeparator == "@@" }, false},
+		{"normalize-eol", "true", func(cfg config) bool { return cfg.normalizeEOL }, false},
+		{"change-marker", ">> ", func(cfg config) bool { return cfg.changeMarker == ">> " }, false},
+		{"summary", "true", func(cfg config) bool { return cfg.summary }, false},
+		{"alias-file", "glossary.txt", func(cfg config) bool { return cfg.aliasFile == "glossary.txt" }, false},
+		{"ignore-file", "stamps.txt", func(cfg config) bool { return cfg.ignoreFile == "stamps.txt" }, false},
+		{"algorithm", "auto", func(cfg config) bool { return cfg.algorithm == "auto" }, false},
+		{"algorithm", "optimal", func(cfg config) bool { return cfg.algorithm == "optimal" }, false},
+		{"similarity", "edit", func(cfg config) bool { return cfg.similarity == "edit" }, false},
+		{"token-pattern", `\w+|\S`, func(cfg config) bool { return cfg.tokenPattern == `\w+|\S` }, false},
+		{"token-pattern", "(", nil, true},
+		{"similarity", "fuzzy", nil, true},
+		{"changed-line-numbers", "true", func(cfg config) bool { return cfg.changedLineNumbers }, false},
+		{"line-numbers", "4", func(cfg config) bool { return cfg.lineNumbers == 4 && cfg.lineNumberSide == tokendiff.LineNumbersBoth }, false},
+		{"line-numbers", "new", func(cfg config) bool { return cfg.lineNumbers == 0 && cfg.lineNumberSide == tokendiff.LineNumbersNew }, false},
+		{"unicode-strikethrough", "true", func(cfg config) bool { return cfg.unicodeStrike }, false},
+		{"delete-color", "red", func(cfg config) bool { return cfg.deleteColor == tokendiff.ForegroundColors["red"] }, false},
+		{"insert-color", "green:black", func(cfg config) bool {
+			return cfg.insertColor == tokendiff.ForegroundColors["green"]+tokendiff.BackgroundColors["black"]
+		}, false},
+		{"common-color", "brightblack", func(cfg config) bool { return cfg.commonColor == tokendiff.ForegroundColors["brightblack"] }, false},
+		{"delete-color", "rad", nil, true},
+		{"insert-color", "green:bleck", nil, true},
 		{"unknown-option", "value", nil, true},
 	}
 
@@ -675,6 +1176,41 @@ func TestParseEscapeSequences(t *testing.T) {
 	}
 }
 
+func TestResolveDelimiters(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []string
+		want    string
+		wantErr string
+	}{
+		{"none", []string{""}, "", ""},
+		{"characters", []string{"(){}"}, "(){}", ""},
+		{"escapes", []string{`\t\x2c`}, "\t,", ""},
+		{"accumulated", []string{"()", "{}"}, "(){}", ""},
+		{"code group", []string{"@code"}, "(){}[]<>,.;:", ""},
+		{"group and pipe", []string{"@code", "|"}, "(){}[]<>,.;:|", ""},
+		{"overlapping groups", []string{"@code", "@math"}, "(){}[]<>,.;:+-*/=", ""},
+		{"lone at sign", []string{"@", "@"}, "@", ""},
+		{"at sign and punctuation", []string{"@:#"}, "@:#", ""},
+		{"unknown group", []string{"@rust"}, "", `unknown delimiter group "@rust"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveDelimiters(tt.specs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("resolveDelimiters(%q) error = %v, want %q", tt.specs, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("resolveDelimiters(%q) = %q, %v; want %q", tt.specs, got, err, tt.want)
+			}
+		})
+	}
+}
+
 // Test line-by-line diff detection
 func TestLineByLineDiffDetection(t *testing.T) {
 	text1 := "line1\nline2\nline3"
@@ -915,28 +1451,1464 @@ func TestFindConfigFile(t *testing.T) {
 	})
 }
 
-func TestPercent(t *testing.T) {
+func TestStatisticsJSON(t *testing.T) {
+	data, err := statisticsJSON(tokendiff.DiffStatistics{
+		OldWords:      4,
+		NewWords:      5,
+		DeletedWords:  1,
+		InsertedWords: 2,
+		CommonWords:   3,
+		DeletedChars:  5,
+		InsertedChars: 9,
+		CommonChars:   14,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]int
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("statisticsJSON() = %s, not a JSON object of numbers: %v", data, err)
+	}
+	want := map[string]int{
+		"oldWords":           4,
+		"newWords":           5,
+		"deletedWords":       1,
+		"insertedWords":      2,
+		"commonWords":        3,
+		"deletedChars":       5,
+		"insertedChars":      9,
+		"commonChars":        14,
+		"oldCommonPercent":   75,
+		"oldDeletedPercent":  25,
+		"newCommonPercent":   60,
+		"newInsertedPercent": 40,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("statisticsJSON() = %v, want %v", got, want)
+	}
+}
+
+func TestStatsFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"old.txt": "hello world\n",
+		"new.txt": "hello there\n",
+	})
+	old, new := filepath.Join(dir, "old.txt"), filepath.Join(dir, "new.txt")
+	t.Setenv("NO_COLOR", "1")
+
 	tests := []struct {
-		name     string
-		part     int
-		total    int
-		expected int
+		name string
+		args []string
+		want string
 	}{
-		{"zero total returns zero", 5, 0, 0},
-		{"zero part returns zero", 0, 100, 0},
-		{"50 percent", 50, 100, 50},
-		{"100 percent", 100, 100, 100},
-		{"rounding down", 1, 3, 33},
-		{"small numbers", 1, 10, 10},
-		{"large numbers", 999, 1000, 99},
+		{"text", nil, "old: 2 words  1 50% common  1 50% deleted\n"},
+		{"json", []string{"--stats-format", "json"}, "\"deletedWords\": 1,"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := percent(tt.part, tt.total)
-			if result != tt.expected {
-				t.Errorf("percent(%d, %d) = %d, want %d", tt.part, tt.total, result, tt.expected)
+			statsFile := filepath.Join(t.TempDir(), "stats")
+			args := append([]string{"--stats-file", statsFile}, tt.args...)
+			var stdout, stderr strings.Builder
+			code := Run(append(args, old, new), strings.NewReader(""), &stdout, &stderr)
+			if code != exitDiffer {
+				t.Fatalf("Run() = %d, want %d; stderr: %s", code, exitDiffer, stderr.String())
+			}
+			if stdout.String() != "hello [-world-] {+there+}\n" || stderr.Len() != 0 {
+				t.Errorf("statistics not only in the file: stdout %q, stderr %q", stdout.String(), stderr.String())
+			}
+			data, err := os.ReadFile(statsFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), tt.want) {
+				t.Errorf("stats file = %q, want it to contain %q", data, tt.want)
 			}
 		})
 	}
 }
+
+func TestExplain(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	configPath := filepath.Join(home, ".tokendiffrc")
+	if err := os.WriteFile(configPath, []byte("delimiters=(){}\nmatch-context=3\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := Run([]string{"--explain", "-m", "5", "-i"}, strings.NewReader(""), &stdout, &stderr)
+	if code != exitIdentical {
+		t.Fatalf("Run() = %d, want %d; stderr: %s", code, exitIdentical, stderr.String())
+	}
+	for _, want := range []string{
+		"# config file: " + configPath + "\n",
+		"delimiters=\"(){}\" (config)\n",
+		"match-context=5 (flag)\n",
+		"ignore-case=true (flag)\n",
+		"white-space=\" \\t\\n\\r\" (default)\n",
+		"Options.Delimiters=\"(){}\"\n",
+		"Options.IgnoreCase=true\n",
+		"FormatOptions.MatchContext=5\n",
+		"FormatOptions.StartDelete=\"[-\"\n",
+	} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("--explain output missing %q:\n%s", want, stdout.String())
+		}
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	enc, err := lookupEncoding("--encoding", "latin1")
+	if err != nil {
+		t.Fatalf("lookupEncoding() error: %v", err)
+	}
+	text, err := decodeText(enc, "caf\xe9 ol\xe9")
+	if err != nil {
+		t.Fatalf("decodeText() error: %v", err)
+	}
+	if text != "café olé" {
+		t.Errorf("decodeText() = %q, want %q", text, "café olé")
+	}
+	tokens := tokendiff.Tokenize(text, tokendiff.DefaultOptions())
+	if len(tokens) != 2 || utf8.RuneCountInString(tokens[0]) != 4 {
+		t.Errorf("Tokenize() = %q, want two tokens with é as one rune", tokens)
+	}
+
+	if text, err := decodeText(nil, "caf\xe9"); err != nil || text != "caf\xe9" {
+		t.Errorf("decodeText(nil) = %q, %v; want the input unchanged", text, err)
+	}
+	if _, err := lookupEncoding("--encoding", "klingon"); err == nil {
+		t.Error("lookupEncoding() expected error for an unknown encoding")
+	}
+}
+
+func TestOutputFile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("NO_COLOR", "")
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"old.txt": "hello world\n",
+		"new.txt": "hello there\n",
+	})
+	old, new := filepath.Join(dir, "old.txt"), filepath.Join(dir, "new.txt")
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantFile   string
+		wantStdout string
+		wantStderr string
+	}{
+		{
+			name:     "diff without color",
+			args:     nil,
+			wantFile: "hello [-world-] {+there+}\n",
+		},
+		{
+			name:     "explicit color",
+			args:     []string{"--color"},
+			wantFile: "hello \033[0;31;1mworld\033[0m \033[0;32;1mthere\033[0m\n",
+		},
+		{
+			name:       "statistics stay on stderr",
+			args:       []string{"-s"},
+			wantFile:   "hello [-world-] {+there+}\n",
+			wantStderr: "old: 2 words  1 50% common  1 50% deleted",
+		},
+		{
+			name:       "json statistics stay on stdout",
+			args:       []string{"--stats-format", "json"},
+			wantFile:   "hello [-world-] {+there+}\n",
+			wantStdout: "\"insertedWords\": 1,",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "diff.txt")
+			args := append([]string{"-o", path}, tt.args...)
+			var stdout, stderr strings.Builder
+			if code := Run(append(args, old, new), strings.NewReader(""), &stdout, &stderr); code != exitDiffer {
+				t.Fatalf("Run() = %d, want %d; stderr: %s", code, exitDiffer, stderr.String())
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.wantFile {
+				t.Errorf("output file = %q, want %q", data, tt.wantFile)
+			}
+			if tt.wantStdout == "" && stdout.Len() != 0 || !strings.Contains(stdout.String(), tt.wantStdout) {
+				t.Errorf("stdout = %q, want %q", stdout.String(), tt.wantStdout)
+			}
+			if !strings.Contains(stderr.String(), tt.wantStderr) {
+				t.Errorf("stderr = %q, want it to contain %q", stderr.String(), tt.wantStderr)
+			}
+		})
+	}
+
+	t.Run("unopenable path", func(t *testing.T) {
+		var stdout, stderr strings.Builder
+		code := Run([]string{"-o", filepath.Join(dir, "missing", "diff.txt"), old, new}, strings.NewReader(""), &stdout, &stderr)
+		if code != exitError || !strings.Contains(stderr.String(), "opening output") {
+			t.Errorf("Run() = %d, stderr %q; want %d and an opening output error", code, stderr.String(), exitError)
+		}
+	})
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestOutputEncodingFlushError(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"old.txt": "hello world\n",
+		"new.txt": "hello there\n",
+	})
+
+	// The encoder buffers the diff, so the write fails only when it is
+	// flushed on close
+	var stderr strings.Builder
+	code := Run([]string{"--output-encoding", "latin1", filepath.Join(dir, "old.txt"), filepath.Join(dir, "new.txt")}, strings.NewReader(""), failingWriter{}, &stderr)
+	if code != exitError || !strings.Contains(stderr.String(), "writing output: disk full") {
+		t.Errorf("Run() = %d, stderr %q; want %d and a writing output error", code, stderr.String(), exitError)
+	}
+}
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		name     string
+		part     int
+		total    int
+		expected int
+	}{
+		{"zero total returns zero", 5, 0, 0},
+		{"zero part returns zero", 0, 100, 0},
+		{"50 percent", 50, 100, 50},
+		{"100 percent", 100, 100, 100},
+		{"rounding down", 1, 3, 33},
+		{"small numbers", 1, 10, 10},
+		{"large numbers", 999, 1000, 99},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := percent(tt.part, tt.total)
+			if result != tt.expected {
+				t.Errorf("percent(%d, %d) = %d, want %d", tt.part, tt.total, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDumpTokens(t *testing.T) {
+	opts := tokendiff.Options{Delimiters: "()"}
+
+	t.Run("json", func(t *testing.T) {
+		var out strings.Builder
+		if err := dumpTokens(&out, "json", "foo(bar)", "  baz", opts); err != nil {
+			t.Fatalf("dumpTokens() error = %v", err)
+		}
+
+		var got map[string][]tokenDump
+		if err := json.Unmarshal([]byte(out.String()), &got); err != nil {
+			t.Fatalf("output is not valid JSON: %v\n%s", err, out.String())
+		}
+		wantOld := []tokenDump{
+			{Index: 0, Token: "foo", Start: 0, End: 3},
+			{Index: 1, Token: "(", Start: 3, End: 4},
+			{Index: 2, Token: "bar", Start: 4, End: 7},
+			{Index: 3, Token: ")", Start: 7, End: 8},
+		}
+		wantNew := []tokenDump{{Index: 0, Token: "baz", Start: 2, End: 5}}
+		if !reflect.DeepEqual(got["old"], wantOld) {
+			t.Errorf("old = %+v, want %+v", got["old"], wantOld)
+		}
+		if !reflect.DeepEqual(got["new"], wantNew) {
+			t.Errorf("new = %+v, want %+v", got["new"], wantNew)
+		}
+		for _, key := range []string{`"index"`, `"token"`, `"start"`, `"end"`} {
+			if !strings.Contains(out.String(), key) {
+				t.Errorf("output missing field %s", key)
+			}
+		}
+	})
+
+	t.Run("text", func(t *testing.T) {
+		var out strings.Builder
+		if err := dumpTokens(&out, "text", "foo(bar)", "baz", opts); err != nil {
+			t.Fatalf("dumpTokens() error = %v", err)
+		}
+		for _, want := range []string{"old: 4 tokens", "new: 1 tokens", `3-4  "("`} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("output %q missing %q", out.String(), want)
+			}
+		}
+	})
+
+	t.Run("invalid format", func(t *testing.T) {
+		if err := dumpTokens(io.Discard, "xml", "a", "b", opts); err == nil {
+			t.Error("dumpTokens() expected error for unknown format")
+		}
+	})
+}
+
+func TestPrintChanges(t *testing.T) {
+	tests := []struct {
+		name  string
+		text1 string
+		text2 string
+		want  []tokendiff.Change
+	}{
+		{
+			name:  "identical",
+			text1: "same text",
+			text2: "same text",
+			want:  []tokendiff.Change{},
+		},
+		{
+			name:  "one replacement",
+			text1: "the quick fox",
+			text2: "the slow fox",
+			want: []tokendiff.Change{
+				{ID: "c1-1", Deleted: []string{"quick"}, Inserted: []string{"slow"}, OldStart: 4, OldEnd: 9, NewStart: 4, NewEnd: 8},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := tokendiff.DiffStringsWithPositions(tt.text1, tt.text2, tokendiff.DefaultOptions())
+			var out strings.Builder
+			if err := printChanges(&out, result); err != nil {
+				t.Fatalf("printChanges() error = %v", err)
+			}
+
+			var got []tokendiff.Change
+			if err := json.Unmarshal([]byte(out.String()), &got); err != nil {
+				t.Fatalf("output is not valid JSON: %v\n%s", err, out.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changes = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintTokenStats(t *testing.T) {
+	opts := tokendiff.DefaultOptions()
+	opts.IgnoreCase = true
+	opts.CaseFold = tokendiff.CaseFoldUnicode
+	opts.PreprocessMinTokens = -1
+
+	// Tokens are folded as the diff folds them
+	var out strings.Builder
+	printTokenStats(&out, "Die STRASSE", "die straße", opts)
+	want := "token stats: 2 old and 2 new tokens, threshold 2\n" +
+		"discarded: 0 old and 0 new tokens\n" +
+		"most frequent shared tokens (of 2):\n" +
+		"     1 old      1 new  \"die\"\n" +
+		"     1 old      1 new  \"strasse\"\n"
+	if out.String() != want {
+		t.Errorf("printTokenStats() =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestEmptyBanner(t *testing.T) {
+	opts := tokendiff.Options{Delimiters: "()"}
+
+	tests := []struct {
+		name       string
+		text1      string
+		text2      string
+		wantOK     bool
+		wantBanner string
+		wantStats  tokendiff.DiffStatistics
+	}{
+		{
+			name:       "new file",
+			text1:      "",
+			text2:      "foo(bar)\n",
+			wantOK:     true,
+			wantBanner: "<new file: 4 words>",
+			wantStats:  tokendiff.DiffStatistics{NewWords: 4, InsertedWords: 4, InsertedChars: 8},
+		},
+		{
+			name:       "deleted file",
+			text1:      "one two\n",
+			text2:      "",
+			wantOK:     true,
+			wantBanner: "<deleted file: 2 words>",
+			wantStats:  tokendiff.DiffStatistics{OldWords: 2, DeletedWords: 2, DeletedChars: 6},
+		},
+		{name: "both empty", text1: "", text2: ""},
+		{name: "neither empty", text1: "a", text2: "b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			banner, st, ok := emptyBanner(tt.text1, tt.text2, opts)
+			if ok != tt.wantOK {
+				t.Fatalf("emptyBanner() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if banner != tt.wantBanner {
+				t.Errorf("emptyBanner() banner = %q, want %q", banner, tt.wantBanner)
+			}
+			if st != tt.wantStats {
+				t.Errorf("emptyBanner() stats = %+v, want %+v", st, tt.wantStats)
+			}
+		})
+	}
+}
+
+func TestLoadAliasFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "canonical with variants",
+			content: "# British spellings\ncolor: colour\n\ngray: grey, graye\n",
+			want:    map[string]string{"colour": "color", "grey": "gray", "graye": "gray"},
+		},
+		{
+			name:    "repeated canonical",
+			content: "color: colour\ncolor: colr\n",
+			want:    map[string]string{"colour": "color", "colr": "color"},
+		},
+		{
+			name:    "missing colon",
+			content: "color colour\n",
+			wantErr: ":1: malformed alias line",
+		},
+		{
+			name:    "missing canonical",
+			content: "color: colour\n: grey\n",
+			wantErr: ":2: missing canonical token",
+		},
+		{
+			name:    "no variants",
+			content: "color:\n",
+			wantErr: `no variants for "color"`,
+		},
+		{
+			name:    "empty variant",
+			content: "gray: grey,,\n",
+			wantErr: `empty variant for "gray"`,
+		},
+		{
+			name:    "whitespace in variant",
+			content: "color: col our\n",
+			wantErr: `variant "col our" contains whitespace`,
+		},
+		{
+			name:    "conflicting canonical",
+			content: "color: colour\nhue: colour\n",
+			wantErr: `"colour" is already an alias of "color"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "aliases")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadAliasFile(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadAliasFile() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadAliasFile() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadAliasFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := loadAliasFile(filepath.Join(t.TempDir(), "missing"))
+		var re *readError
+		if !errors.As(err, &re) {
+			t.Errorf("loadAliasFile() error = %v, want *readError", err)
+		}
+	})
+}
+
+func TestLoadIgnoreFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ignore")
+	if err := os.WriteFile(path, []byte("# build stamps\nBUILD=123\n\n  BUILD=456  \n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadIgnoreFile(path)
+	if err != nil {
+		t.Fatalf("loadIgnoreFile() error = %v", err)
+	}
+	if want := []string{"BUILD=123", "BUILD=456"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("loadIgnoreFile() = %q, want %q", got, want)
+	}
+
+	_, err = loadIgnoreFile(filepath.Join(t.TempDir(), "missing"))
+	var re *readError
+	if !errors.As(err, &re) {
+		t.Errorf("loadIgnoreFile() error = %v, want *readError", err)
+	}
+}
+
+func TestLineRangeSlice(t *testing.T) {
+	text := "a\nb\nc\nd\ne\n"
+	tests := []struct {
+		name      string
+		r         lineRange
+		want      string
+		wantStart int
+	}{
+		{"whole input", lineRange{}, text, 0},
+		{"middle lines", lineRange{start: 3, end: 4}, "c\nd", 4},
+		{"from a line", lineRange{start: 4}, "d\ne", 6},
+		{"up to a line", lineRange{end: 2}, "a\nb", 0},
+		{"past the end", lineRange{start: 9}, "", len(text)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, start := tt.r.slice(text)
+			if got != tt.want || start != tt.wantStart {
+				t.Errorf("slice() = %q, %d; want %q, %d", got, start, tt.want, tt.wantStart)
+			}
+		})
+	}
+}
+
+func TestLatestBackup(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"app.conf":            "current",
+		"app.conf.2024-01-01": "oldest",
+		"app.conf.2024-02-01": "newest",
+		"app.conf.2024-03-01": "same time, later name",
+		"app.conf.d/x":        "directory, ignored",
+	})
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	setTime := func(name string, mt time.Time) {
+		t.Helper()
+		if err := os.Chtimes(filepath.Join(dir, name), mt, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setTime("app.conf", base.Add(72*time.Hour))
+	setTime("app.conf.2024-01-01", base)
+	setTime("app.conf.2024-02-01", base.Add(24*time.Hour))
+	setTime("app.conf.2024-03-01", base.Add(24*time.Hour))
+	setTime("app.conf.d", base.Add(96*time.Hour))
+
+	current := filepath.Join(dir, "app.conf")
+
+	t.Run("most recent wins, excluding current file", func(t *testing.T) {
+		got, err := latestBackup(filepath.Join(dir, "app.conf*"), current)
+		if err != nil {
+			t.Fatalf("latestBackup() error = %v", err)
+		}
+		if want := filepath.Join(dir, "app.conf.2024-03-01"); got != want {
+			t.Errorf("latestBackup() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("narrower pattern", func(t *testing.T) {
+		got, err := latestBackup(filepath.Join(dir, "app.conf.2024-01-*"), current)
+		if err != nil {
+			t.Fatalf("latestBackup() error = %v", err)
+		}
+		if want := filepath.Join(dir, "app.conf.2024-01-01"); got != want {
+			t.Errorf("latestBackup() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("no match", func(t *testing.T) {
+		_, err := latestBackup(filepath.Join(dir, "other.*"), current)
+		if err == nil || !strings.Contains(err.Error(), "no backup matches") {
+			t.Errorf("latestBackup() error = %v, want no backup matches", err)
+		}
+	})
+
+	t.Run("only current file matches", func(t *testing.T) {
+		if _, err := latestBackup(current, current); err == nil {
+			t.Error("latestBackup() expected error when only the current file matches")
+		}
+	})
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		if _, err := latestBackup("[", current); err == nil {
+			t.Error("latestBackup() expected error for malformed pattern")
+		}
+	})
+}
+
+func TestRun(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("COLUMNS", "43")
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"old.txt":    "hello world\n",
+		"new.txt":    "hello there\n",
+		"same.txt":   "hello world\n",
+		"corrupt.gz": "not gzip",
+		"moved1.txt": "moved line\nx\n",
+		"upper.txt":  "Hello World\n",
+		"ctx1.txt":   "a\nb\nc\nd\ne\nf\n",
+		"ctx2.txt":   "x\nb\nc\nd\ne\ny\n",
+		"moved2.txt": "x\nmoved line\n",
+		"build1.txt": "release BUILD=123\n",
+		"build2.txt": "release BUILD=456\n",
+		"ignore.txt": "BUILD=123\nBUILD=456\n",
+		"tabbed.txt": "\thello there\n",
+		"crlf.txt":   "hello world\r\n",
+		"binary.bin": "hello\x00world\n",
+		"high.txt":   "héllo wörld 日本語 😀\n",
+		"stat1.txt":  "the quick fox\n",
+		"latin1.txt": "caf\xe9 ol\xe9\n",
+		"stat2.txt":  "the slow brown fox\n",
+		"a.json":     `{"name": "x", "ids": [1, 2]}`,
+		"b.json":     "{\n  \"ids\": [1,\n    2],\n  \"name\": \"x\"\n}\n",
+		"c.json":     `{"ids": [1, 3], "name": "x"}`,
+		"bad.json":   `{"name": }`,
+	})
+	old := filepath.Join(dir, "old.txt")
+	new := filepath.Join(dir, "new.txt")
+	same := filepath.Join(dir, "same.txt")
+	oldGz := filepath.Join(dir, "old.txt.gz")
+	if err := os.WriteFile(oldGz, gzipBytes(t, "hello world\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".tokendiffrc.graphemes"), []byte("graphemes\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		args       []string
+		stdin      string
+		wantCode   int
+		wantStdout string
+		wantStderr string
+	}{
+		{
+			name:       "identical",
+			args:       []string{old, same},
+			wantCode:   exitIdentical,
+			wantStdout: "hello world\n",
+		},
+		{
+			name:       "differ",
+			args:       []string{old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}\n",
+		},
+		{
+			name:       "stdin",
+			args:       []string{"--stdin", new},
+			stdin:      "hello world\n",
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}\n",
+		},
+		{
+			name:       "statistics on stderr",
+			args:       []string{"-s", old, new},
+			wantCode:   exitDiffer,
+			wantStderr: "old: 2 words  1 50% common  1 50% deleted",
+		},
+		{
+			name:       "ignored tokens are not changes",
+			args:       []string{"--ignore-file", filepath.Join(dir, "ignore.txt"), filepath.Join(dir, "build1.txt"), filepath.Join(dir, "build2.txt")},
+			wantCode:   exitIdentical,
+			wantStdout: "release BUILD=456\n",
+		},
+		{
+			name:       "swap",
+			args:       []string{"--swap", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-there-] {+world+}\n",
+		},
+		{
+			name:       "swap flips statistics",
+			args:       []string{"--swap", "-s", old, filepath.Join(dir, "moved1.txt")},
+			wantCode:   exitDiffer,
+			wantStderr: "old: 3 words  0 0% common  3 100% deleted\nnew: 2 words  0 0% common  2 100% inserted",
+		},
+		{
+			name:       "swap with stdin",
+			args:       []string{"--stdin", "--swap", new},
+			stdin:      "hello world\n",
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-there-] {+world+}\n",
+		},
+		{
+			name:       "swap chunked with stdin",
+			args:       []string{"--stdin", "--swap", "--chunked", new},
+			stdin:      "hello world\n",
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-there-] {+world+}\n",
+		},
+		{
+			name:       "changes skip chunking",
+			args:       []string{"--changes", "--chunked", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: `"id": "c1-1"`,
+		},
+		{
+			name:       "changes with line numbers",
+			args:       []string{"--changes", "-L", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: --changes cannot be combined with --format, line mode, line numbers, or --less-mode",
+		},
+		{
+			name:       "changes with json format",
+			args:       []string{"--changes", "--format", "json", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: --changes cannot be combined with --format",
+		},
+		{
+			name:       "chunked with summary",
+			args:       []string{"--chunked", "--summary", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: --chunked cannot be combined with --summary, --token-stats, --newline-note, or --empty-as-banner",
+		},
+		{
+			name:       "chunked with empty as banner",
+			args:       []string{"--chunked", "--empty-as-banner", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: --chunked cannot be combined with",
+		},
+		{
+			name:       "swap with diff input",
+			args:       []string{"--swap", "--diff-input"},
+			wantCode:   exitError,
+			wantStderr: "--swap cannot be combined with --diff-input",
+		},
+		{
+			name:       "diff input keeps prefixes",
+			args:       []string{"--diff-input", "--keep-prefixes"},
+			stdin:      "--- a/f\n+++ b/f\n@@ -1,2 +1,2 @@\n same\n-hello world\n+hello there\n",
+			wantCode:   exitIdentical,
+			wantStdout: "@@ -1,2 +1,2 @@\n same\n-hello [-world-]\n+hello {+there+}\n",
+		},
+		{
+			name:       "keep prefixes without diff input",
+			args:       []string{"--keep-prefixes", old, new},
+			wantCode:   exitError,
+			wantStderr: "--keep-prefixes requires --diff-input",
+		},
+		{
+			name:       "graphemes without refine tokens",
+			args:       []string{"--graphemes", old, new},
+			wantCode:   exitError,
+			wantStderr: "--graphemes requires --refine-tokens",
+		},
+		{
+			name:       "graphemes from config without refine tokens",
+			args:       []string{"--profile", "graphemes", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}\n",
+		},
+		{
+			name:       "diff input emits unified diff",
+			args:       []string{"--diff-input", "--emit-unified", "--color", "red,green"},
+			stdin:      "--- a/f\n+++ b/f\n@@ -1 +1 @@\n-hello world\n\\ No newline at end of file\n+hello there\n",
+			wantCode:   exitIdentical,
+			wantStdout: "@@ -1 +1 @@\n-hello \033[0;31;1mworld\033[0m\n\\ No newline at end of file\n+hello \033[0;32;1mthere\033[0m\n",
+		},
+		{
+			name:       "emit unified without diff input",
+			args:       []string{"--emit-unified", old, new},
+			wantCode:   exitError,
+			wantStderr: "--emit-unified requires --diff-input",
+		},
+		{
+			name:       "git color words",
+			args:       []string{"--git-words", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello \033[31mworld\033[m\033[32mthere\033[m\n",
+		},
+		{
+			name:       "git words without color keeps markers",
+			args:       []string{"--git-words", "--no-color", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-]{+there+}\n",
+		},
+		{
+			name:       "binary input",
+			args:       []string{old, filepath.Join(dir, "binary.bin")},
+			wantCode:   exitError,
+			wantStderr: "binary.bin appears to be binary",
+		},
+		{
+			name:       "binary stdin",
+			args:       []string{"--stdin", new},
+			stdin:      "\x00\x01\x02",
+			wantCode:   exitError,
+			wantStderr: "Error: stdin appears to be binary",
+		},
+		{
+			name:       "binary input chunked",
+			args:       []string{"--chunked", filepath.Join(dir, "binary.bin"), old},
+			wantCode:   exitError,
+			wantStderr: "binary.bin appears to be binary",
+		},
+		{
+			name:       "binary input forced as text",
+			args:       []string{"--text", old, filepath.Join(dir, "binary.bin")},
+			wantCode:   exitDiffer,
+			wantStdout: "{+hello\x00world+}",
+		},
+		{
+			name:       "high code points are not binary",
+			args:       []string{old, filepath.Join(dir, "high.txt")},
+			wantCode:   exitDiffer,
+			wantStdout: "{+héllo wörld 日本語 😀+}",
+		},
+		{
+			name:       "token stats on stderr",
+			args:       []string{"--token-stats", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}",
+			wantStderr: "threshold 2\ndiscarding does not apply: inputs have fewer than 64 tokens\nmost frequent shared tokens (of 1):\n     1 old      1 new  \"hello\"\n",
+		},
+		{
+			name:       "line ranges keep their line numbers",
+			args:       []string{"--range1", "5:6", "--range2", "5:", "-L", filepath.Join(dir, "ctx1.txt"), filepath.Join(dir, "ctx2.txt")},
+			wantCode:   exitDiffer,
+			wantStdout: "   5:5    e\n   6:6    [-f-]\n   7:6    {+y+}\n",
+		},
+		{
+			name:       "line numbers of the new file only",
+			args:       []string{"--range1", "5:6", "--range2", "5:", "--line-numbers=new", filepath.Join(dir, "ctx1.txt"), filepath.Join(dir, "ctx2.txt")},
+			wantCode:   exitDiffer,
+			wantStdout: "   5: e\n    : [-f-]\n   6: {+y+}\n",
+		},
+		{
+			name:       "line numbers of the old file only",
+			args:       []string{"--range1", "5:6", "--range2", "5:", "-L=old", filepath.Join(dir, "ctx1.txt"), filepath.Join(dir, "ctx2.txt")},
+			wantCode:   exitDiffer,
+			wantStdout: "   5: e\n   6: [-f-]\n    : {+y+}\n",
+		},
+		{
+			name:       "invalid line numbers",
+			args:       []string{"--line-numbers=left", old, new},
+			wantCode:   exitError,
+			wantStderr: "want a width or old, new, or both",
+		},
+		{
+			name:       "line ranges without changes",
+			args:       []string{"--range1", "2:3", "--range2", "2:3", filepath.Join(dir, "ctx1.txt"), filepath.Join(dir, "ctx2.txt")},
+			wantCode:   exitIdentical,
+			wantStdout: "b\nc",
+		},
+		{
+			name:       "line range offsets in changes",
+			args:       []string{"--range1", "6:6", "--range2", "6:6", "--changes", filepath.Join(dir, "ctx1.txt"), filepath.Join(dir, "ctx2.txt")},
+			wantCode:   exitDiffer,
+			wantStdout: `"oldStart": 10,`,
+		},
+		{
+			name:       "line range end before start",
+			args:       []string{"--range1", "3:2", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: invalid --range1 \"3:2\" (END is before START)",
+		},
+		{
+			name:       "change counts only",
+			args:       []string{"--stat", filepath.Join(dir, "stat1.txt"), filepath.Join(dir, "stat2.txt")},
+			wantCode:   exitDiffer,
+			wantStdout: filepath.Join(dir, "stat2.txt") + ": +2 -1\n",
+		},
+		{
+			name:       "change counts, chunked",
+			args:       []string{"--stat", "--chunked", filepath.Join(dir, "stat1.txt"), filepath.Join(dir, "stat2.txt")},
+			wantCode:   exitDiffer,
+			wantStdout: filepath.Join(dir, "stat2.txt") + ": +2 -1\n",
+		},
+		{
+			name:       "change counts of identical files",
+			args:       []string{"--stat", old, same},
+			wantCode:   exitIdentical,
+			wantStdout: same + ": +0 -0\n",
+		},
+		{
+			name:       "change counts in line mode",
+			args:       []string{"--stat", "--line-mode", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: --stat applies only to whole-file text mode",
+		},
+		{
+			name:       "latin1 input decoded",
+			args:       []string{"--encoding", "latin1", "--dump-tokens", filepath.Join(dir, "latin1.txt"), filepath.Join(dir, "latin1.txt")},
+			wantCode:   exitIdentical,
+			wantStdout: "     0  0-5  \"café\"\n     1  6-10  \"olé\"\n",
+		},
+		{
+			name:       "output re-encoded",
+			args:       []string{"--encoding", "latin1", "--output-encoding", "latin1", filepath.Join(dir, "latin1.txt"), old},
+			wantCode:   exitDiffer,
+			wantStdout: "[-caf\xe9 ol\xe9-]",
+		},
+		{
+			name:       "unknown encoding",
+			args:       []string{"--encoding", "klingon", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: unknown --encoding \"klingon\"",
+		},
+		{
+			name:       "hyperlinks without recursive",
+			args:       []string{"--hyperlinks", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: --hyperlinks requires --recursive",
+		},
+		{
+			name:       "context regex shows changed blocks",
+			args:       []string{"--context-regex", "^[bf]", filepath.Join(dir, "ctx1.txt"), filepath.Join(dir, "ctx2.txt")},
+			wantCode:   exitDiffer,
+			wantStdout: "{+x+}\n---\n|    6: [-f-]\n",
+		},
+		{
+			name:       "invalid context regex",
+			args:       []string{"--context-regex", "(", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: invalid --context-regex",
+		},
+		{
+			name:       "context regex with context",
+			args:       []string{"--context-regex", "^func ", "-C", "2", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: --context-regex cannot be combined with --context",
+		},
+		{
+			name:       "repeated delimiters",
+			args:       []string{"--stdin", "--dump-tokens", "-d", "@code", "-d", "|", new},
+			stdin:      "a|b(c)\n",
+			wantCode:   exitIdentical,
+			wantStdout: "old: 6 tokens\n     0  0-1  \"a\"\n     1  1-2  \"|\"\n     2  2-3  \"b\"\n     3  3-4  \"(\"",
+		},
+		{
+			name:       "unknown delimiter group",
+			args:       []string{"-d", "@nope", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: unknown delimiter group \"@nope\"",
+		},
+		{
+			name:       "quiet with statistics",
+			args:       []string{"-q", "-s", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: --quiet cannot be combined with --diff-input, --stat, or statistics",
+		},
+		{
+			name:       "statistics count characters",
+			args:       []string{"-s", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}",
+			wantStderr: "chars: 6 common  4 deleted  4 inserted\n",
+		},
+		{
+			name:       "json-aware ignores key order and whitespace",
+			args:       []string{"--json-aware", filepath.Join(dir, "a.json"), filepath.Join(dir, "b.json")},
+			wantCode:   exitIdentical,
+			wantStdout: "\"ids\": [\n    1,\n    2\n  ],\n  \"name\": \"x\"",
+		},
+		{
+			name:       "json-aware shows value changes",
+			args:       []string{"--json-aware", filepath.Join(dir, "a.json"), filepath.Join(dir, "c.json")},
+			wantCode:   exitDiffer,
+			wantStdout: "[-2-]\n    {+3+}",
+		},
+		{
+			name:       "json-aware malformed input",
+			args:       []string{"--json-aware", filepath.Join(dir, "a.json"), filepath.Join(dir, "bad.json")},
+			wantCode:   exitError,
+			wantStderr: "bad.json: invalid JSON",
+		},
+		{
+			name:       "json-aware stdin",
+			args:       []string{"--json-aware", "--stdin", filepath.Join(dir, "b.json")},
+			stdin:      `{"name": "x", "ids": [1, 2]}`,
+			wantCode:   exitIdentical,
+			wantStdout: "\"name\": \"x\"",
+		},
+		{
+			name:       "json-aware malformed stdin",
+			args:       []string{"--json-aware", "--stdin", filepath.Join(dir, "b.json")},
+			stdin:      "{",
+			wantCode:   exitError,
+			wantStderr: "stdin: invalid JSON",
+		},
+		{
+			name:       "json-aware with chunked",
+			args:       []string{"--json-aware", "--chunked", filepath.Join(dir, "a.json"), filepath.Join(dir, "b.json")},
+			wantCode:   exitError,
+			wantStderr: "Error: --json-aware cannot be combined with --diff-input, --brief, --recursive, or --chunked",
+		},
+		{
+			name:       "json-aware with recursive",
+			args:       []string{"--json-aware", "-r", dir, dir},
+			wantCode:   exitError,
+			wantStderr: "Error: --json-aware cannot be combined with --diff-input, --brief, --recursive, or --chunked",
+		},
+		{
+			name:       "overstrike less mode",
+			args:       []string{"-l", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello " + tokendiff.OverstrikeUnderline("world"),
+		},
+		{
+			name:       "ansi less mode keeps color and resets each line",
+			args:       []string{"--stdin", "--less-mode=ansi", new},
+			stdin:      "gone\nold line\nhello there\n",
+			wantCode:   exitDiffer,
+			wantStdout: tokendiff.ANSIDeleteColor + "gone" + tokendiff.ANSIClearEOL + tokendiff.ANSIReset + "\n" + tokendiff.ANSIDeleteColor + "old line" + tokendiff.ANSIReset,
+		},
+		{
+			name:       "invalid less mode",
+			args:       []string{"--less-mode=vivid", old, new},
+			wantCode:   exitError,
+			wantStderr: `invalid --less-mode "vivid"`,
+		},
+		{
+			name:       "tab width expands indentation",
+			args:       []string{"--stdin", "-L=2", "--tab-width", "4", filepath.Join(dir, "tabbed.txt")},
+			stdin:      "\thello world\n",
+			wantCode:   exitDiffer,
+			wantStdout: "  1:1       hello [-world-] {+there+}\n",
+		},
+		{
+			name:       "missing newline ignored",
+			args:       []string{"--stdin", new},
+			stdin:      "hello world",
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}\n",
+		},
+		{
+			name:       "missing newline noted",
+			args:       []string{"--stdin", "--newline-note", new},
+			stdin:      "hello world",
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}\n\\ No newline at end of old file\n",
+		},
+		{
+			name:       "only the newline differs",
+			args:       []string{"--stdin", "--newline-note", same},
+			stdin:      "hello world",
+			wantCode:   exitDiffer,
+			wantStdout: "hello world\n\\ No newline at end of old file\n",
+		},
+		{
+			name:     "only the newline differs without the note",
+			args:     []string{"--stdin", same},
+			stdin:    "hello world",
+			wantCode: exitIdentical,
+		},
+		{
+			name:       "statistics only",
+			args:       []string{"--stats-only", "--stats-format", "json", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "{\n  \"oldWords\": 2,",
+		},
+		{
+			name:       "statistics only, identical",
+			args:       []string{"--stats-only", old, same},
+			wantCode:   exitIdentical,
+			wantStderr: "old: 2 words",
+		},
+		{
+			name:       "statistics only in line mode",
+			args:       []string{"--stats-only", "--line-mode", old, new},
+			wantCode:   exitError,
+			wantStderr: "--stats-only applies only to whole-file text mode",
+		},
+		{
+			name:       "statistics only, chunked",
+			args:       []string{"--stats-only", "--chunked", old, new},
+			wantCode:   exitDiffer,
+			wantStderr: "old: 2 words  1 50% common  1 50% deleted",
+		},
+		{
+			name:       "statistics only with changes",
+			args:       []string{"--stats-only", "--changes", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: --stats-only cannot be combined with --diff-input, --brief, --recursive, --changes, --summary, or --output",
+		},
+		{
+			name:       "statistics only with output file",
+			args:       []string{"--stats-only", "-o", filepath.Join(dir, "out.txt"), old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: --stats-only cannot be combined with",
+		},
+		{
+			name:       "json statistics on stdout",
+			args:       []string{"--stats-format", "json", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}\n{\n  \"oldWords\": 2,",
+		},
+		{
+			name:       "json statistics in line mode",
+			args:       []string{"--stats-format", "json", "--line-mode", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "\"newInsertedPercent\": 50\n}\n",
+		},
+		{
+			name:       "invalid statistics format",
+			args:       []string{"--stats-format", "xml", old, new},
+			wantCode:   exitError,
+			wantStderr: `invalid --stats-format "xml" (use text or json)`,
+		},
+		{
+			name:       "ignore case statistics count case changes as common",
+			args:       []string{"-i", "-s", "--line-mode", filepath.Join(dir, "upper.txt"), old},
+			wantCode:   exitIdentical,
+			wantStderr: "old: 2 words  2 100% common  0 0% deleted",
+		},
+		{
+			name:       "color list includes palette and hex forms",
+			args:       []string{"--color=list"},
+			wantCode:   exitIdentical,
+			wantStdout: "color0 ... color255 (xterm-256 palette)\n  #RRGGBB or #RGB (truecolor)",
+		},
+		{
+			name:       "summary after diff",
+			args:       []string{"--summary", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}\nRenamed: 1 (1 tokens deleted, 1 inserted)\n",
+		},
+		{
+			name:       "summary in line mode",
+			args:       []string{"--summary", "--line-mode", old, same},
+			wantCode:   exitIdentical,
+			wantStdout: "No changes\n",
+		},
+		{
+			name:       "version",
+			args:       []string{"--version"},
+			wantCode:   exitIdentical,
+			wantStdout: "tokendiff version",
+		},
+		{
+			name:       "missing argument prints usage",
+			args:       []string{old},
+			wantCode:   exitError,
+			wantStderr: "Error: requires two file arguments\nUsage:",
+		},
+		{
+			name:       "unknown flag",
+			args:       []string{"--bogus", old, new},
+			wantCode:   exitError,
+			wantStderr: "unknown flag: --bogus",
+		},
+		{
+			name:       "unreadable file",
+			args:       []string{old, filepath.Join(dir, "missing.txt")},
+			wantCode:   exitError,
+			wantStderr: "Error: reading " + filepath.Join(dir, "missing.txt"),
+		},
+		{
+			name:       "invalid algorithm",
+			args:       []string{"-A", "nope", old, new},
+			wantCode:   exitError,
+			wantStderr: `Error: invalid algorithm "nope"`,
+		},
+		{
+			name:       "gzip file",
+			args:       []string{oldGz, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}\n",
+		},
+		{
+			name:       "gzip stdin",
+			args:       []string{"--stdin", new},
+			stdin:      string(gzipBytes(t, "hello world\n")),
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}\n",
+		},
+		{
+			name:       "gzip chunked",
+			args:       []string{"--chunked", oldGz, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}",
+		},
+		{
+			name:       "corrupt gzip",
+			args:       []string{filepath.Join(dir, "corrupt.gz"), new},
+			wantCode:   exitError,
+			wantStderr: "Error: reading " + filepath.Join(dir, "corrupt.gz") + ": decompressing gzip",
+		},
+		{
+			name:       "edit similarity",
+			args:       []string{"--line-mode", "--similarity", "edit", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}",
+		},
+		{
+			name:       "custom change marker",
+			args:       []string{"--line-mode", "--no-color", "--change-marker", ">> ", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: ">>    1: hello [-world-] {+there+}",
+		},
+		{
+			name:       "mixed line endings warn in line mode",
+			args:       []string{"--line-mode", "--no-color", filepath.Join(dir, "crlf.txt"), old},
+			wantCode:   exitIdentical,
+			wantStdout: "|    1: hello world",
+			wantStderr: "Note: inputs mix CRLF and LF line endings; use --normalize-eol",
+		},
+		{
+			name:       "normalized line endings",
+			args:       []string{"--line-mode", "--normalize-eol", filepath.Join(dir, "crlf.txt"), old},
+			wantCode:   exitIdentical,
+			wantStdout: "     1: hello world",
+		},
+		{
+			name:       "auto line pairing",
+			args:       []string{"--line-mode", "-A", "auto", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}",
+		},
+		{
+			name:       "optimal line pairing",
+			args:       []string{"--line-mode", "-A", "optimal", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}",
+		},
+		{
+			name:       "max tokens falls back to line diff",
+			args:       []string{"--max-tokens", "1", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "[-hello world-]{+hello there+}\n",
+			wantStderr: "Note: inputs exceed --max-tokens 1; showing a line-level diff",
+		},
+		{
+			name:       "under max tokens diffs words",
+			args:       []string{"--max-tokens", "2", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}\n",
+		},
+		{
+			name:       "collapse long unchanged text",
+			args:       []string{"--collapse", "3", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "[... 5 chars unchanged ...] [-world-] {+there+}\n",
+		},
+		{
+			name:       "collapse keeps short unchanged text",
+			args:       []string{"--collapse", "5", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-] {+there+}\n",
+		},
+		{
+			name:       "collapse rejected in line mode",
+			args:       []string{"--collapse", "3", "--line-mode", old, new},
+			wantCode:   exitError,
+			wantStderr: "--collapse applies only to whole-file output",
+		},
+		{
+			name:       "token pattern",
+			args:       []string{"--token-pattern", `\w+ \w+`, old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "[-hello world-]{+hello there+}\n",
+		},
+		{
+			name:       "invalid token pattern",
+			args:       []string{"--token-pattern", "(", old, new},
+			wantCode:   exitError,
+			wantStderr: `Error: invalid token pattern "("`,
+		},
+		{
+			name:       "invalid similarity",
+			args:       []string{"--similarity", "fuzzy", old, new},
+			wantCode:   exitError,
+			wantStderr: `Error: invalid similarity "fuzzy"`,
+		},
+		{
+			name:     "json format",
+			args:     []string{"--format", "json", old, new},
+			wantCode: exitDiffer,
+			wantStdout: `{"diffs":[` +
+				`{"type":"equal","token":"hello","oldStart":0,"oldEnd":5,"newStart":0,"newEnd":5},` +
+				`{"type":"delete","token":"world","oldStart":6,"oldEnd":11,"newStart":null,"newEnd":null},` +
+				`{"type":"insert","token":"there","oldStart":null,"oldEnd":null,"newStart":6,"newEnd":11}],` +
+				`"statistics":{"oldWords":2,"newWords":2,"deletedWords":1,"insertedWords":1,"commonWords":1,"deletedChars":4,"insertedChars":4,"commonChars":6}}` + "\n",
+		},
+		{
+			name:       "html format",
+			args:       []string{"--format", "html", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: `<pre class="tokendiff">hello <span class="del">world</span> <span class="ins">there</span></pre>` + "\n",
+		},
+		{
+			name:       "markdown format",
+			args:       []string{"--format", "markdown", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "```diff\n-hello world\n+hello there\n```\n",
+		},
+		{
+			name:       "invalid format",
+			args:       []string{"--format", "xml", old, new},
+			wantCode:   exitError,
+			wantStderr: `Error: invalid format "xml"`,
+		},
+		{
+			name:       "json format with line mode",
+			args:       []string{"--format", "json", "--line-mode", old, new},
+			wantCode:   exitError,
+			wantStderr: "cannot be combined with line mode",
+		},
+		{
+			name:       "json format with empty-as-banner",
+			args:       []string{"--format", "json", "--empty-as-banner", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: --format json cannot be combined with --empty-as-banner or --summary",
+		},
+		{
+			name:       "markdown format with collapse",
+			args:       []string{"--format", "markdown", "--collapse", "10", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: --collapse applies only to text output, not --format markdown",
+		},
+		{
+			name:       "html format with summary",
+			args:       []string{"--format", "html", "--summary", old, new},
+			wantCode:   exitError,
+			wantStderr: "Error: --format html cannot be combined with --empty-as-banner or --summary",
+		},
+		{
+			name:       "side by side",
+			args:       []string{"-S", old, new},
+			wantCode:   exitDiffer,
+			wantStdout: "hello [-world-]      | hello {+there+}\n",
+		},
+		{
+			name:       "default context separator",
+			args:       []string{"-C", "1", filepath.Join(dir, "ctx1.txt"), filepath.Join(dir, "ctx2.txt")},
+			wantCode:   exitDiffer,
+			wantStdout: "     2: b\n---\n     5: e\n",
+		},
+		{
+			name:       "custom context separator",
+			args:       []string{"-C", "1", "--context-separator", "@@", filepath.Join(dir, "ctx1.txt"), filepath.Join(dir, "ctx2.txt")},
+			wantCode:   exitDiffer,
+			wantStdout: "     2: b\n@@\n     5: e\n",
+		},
+		{
+			name:       "empty context separator",
+			args:       []string{"-C", "1", "--context-separator=", filepath.Join(dir, "ctx1.txt"), filepath.Join(dir, "ctx2.txt")},
+			wantCode:   exitDiffer,
+			wantStdout: "     2: b\n     5: e\n",
+		},
+		{
+			name:       "detect moves",
+			args:       []string{"--detect-moves", filepath.Join(dir, "moved1.txt"), filepath.Join(dir, "moved2.txt")},
+			wantCode:   exitDiffer,
+			wantStdout: "~    1: [-moved line-]\n     1: x\n~    2: {+moved line+}\n",
+		},
+		{
+			name:       "line stats",
+			args:       []string{"--line-stats", filepath.Join(dir, "moved1.txt"), filepath.Join(dir, "moved2.txt")},
+			wantCode:   exitDiffer,
+			wantStdout: "|    1: [-moved line-]  (-1 +0)\n     1: x\n|    2: {+moved line+}  (-0 +1)\n",
+		},
+		{
+			name:       "line stats with side by side",
+			args:       []string{"--line-stats", "--side-by-side", old, new},
+			wantCode:   exitError,
+			wantStderr: "--side-by-side cannot be combined with --line-stats",
+		},
+		{
+			name:       "side by side with line numbers",
+			args:       []string{"--side-by-side", "-L", old, new},
+			wantCode:   exitError,
+			wantStderr: "--side-by-side cannot be combined with --line-numbers",
+		},
+		{
+			name:       "missing profile",
+			args:       []string{"--profile", "nope", old, new},
+			wantCode:   exitError,
+			wantStderr: "profile config file not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr strings.Builder
+			code := Run(tt.args, strings.NewReader(tt.stdin), &stdout, &stderr)
+			if code != tt.wantCode {
+				t.Errorf("Run() = %d, want %d (stderr: %q)", code, tt.wantCode, stderr.String())
+			}
+			if tt.wantStdout != "" && !strings.Contains(stdout.String(), tt.wantStdout) {
+				t.Errorf("stdout = %q, want it to contain %q", stdout.String(), tt.wantStdout)
+			}
+			if tt.wantStderr != "" && !strings.Contains(stderr.String(), tt.wantStderr) {
+				t.Errorf("stderr = %q, want it to contain %q", stderr.String(), tt.wantStderr)
+			}
+		})
+	}
+}
+
+func TestRunErrorTypes(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": "a\n"})
+	a := filepath.Join(dir, "a.txt")
+
+	runErr := func(args ...string) error {
+		flags := flag.NewFlagSet("tokendiff", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		_, err := run(flags, args, strings.NewReader(""), io.Discard, io.Discard)
+		return err
+	}
+
+	var ue *usageError
+	if err := runErr(a); !errors.As(err, &ue) {
+		t.Errorf("missing argument: error = %v (%T), want *usageError", err, err)
+	}
+
+	var re *readError
+	if err := runErr(a, filepath.Join(dir, "missing.txt")); !errors.As(err, &re) {
+		t.Errorf("missing file: error = %v (%T), want *readError", err, err)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file: error %v should wrap fs.ErrNotExist", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(home, ".tokendiffrc.bad"), []byte("delete-color=nope\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var ce *configError
+	if err := runErr("--profile", "bad", a, a); !errors.As(err, &ce) {
+		t.Errorf("bad config: error = %v (%T), want *configError", err, err)
+	}
+}
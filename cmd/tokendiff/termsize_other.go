@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "os"
+
+// terminalColumns returns 0: the terminal size is not queried on this
+// platform, so the width comes from $COLUMNS or the default
+func terminalColumns(f *os.File) int {
+	return 0
+}
@@ -0,0 +1,176 @@
+package tokendiff
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/dacharyc/diffx"
+)
+
+// numericHash is shared by every numeric token. Tolerance comparison is not
+// transitive, so near-equal numbers cannot be bucketed by value; a common
+// hash keeps them comparable and leaves the decision to Equal.
+const numericHash uint64 = 0x9e3779b97f4a7c15
+
+// compareElement is a token compared by value when it parses as a number
+// and by comparison text otherwise. It implements diffx.Element for
+// Options.NumericTolerance, Options.TokenAliases, Options.CollapseSpaceForMatch,
+// and Options.KeepStopwords.
+type compareElement struct {
+	key       string // comparison text, normalized per Options and with aliases resolved
+	value     float64
+	isNumber  bool
+	tolerance float64
+}
+
+// Equal reports whether two numbers are within the tolerance of each other,
+// or two non-numeric tokens have the same comparison text.
+func (e compareElement) Equal(other diffx.Element) bool {
+	o, ok := other.(compareElement)
+	if !ok || e.isNumber != o.isNumber {
+		return false
+	}
+	if e.isNumber {
+		return math.Abs(e.value-o.value) <= e.tolerance
+	}
+	return e.key == o.key
+}
+
+// Hash returns numericHash for numbers and a hash of the text otherwise.
+func (e compareElement) Hash() uint64 {
+	if e.isNumber {
+		return numericHash
+	}
+	h := fnv.New64a()
+	h.Write([]byte(e.key))
+	return h.Sum64()
+}
+
+// parseNumber parses token as a finite number using strconv.ParseFloat.
+// Words ParseFloat would accept, such as "inf" and "NaN", are not numbers.
+func parseNumber(token string) (float64, bool) {
+	if token == "" || !strings.ContainsAny(token[:1], "0123456789+-.") {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(token, 64)
+	if err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, false
+	}
+	return v, true
+}
+
+// customCompare returns true if opts compares tokens by more than their
+// text, and so must be diffed with compareElements. KeepStopwords is among
+// them because diffx only filters stopwords it can see as StringElements.
+func (o Options) customCompare() bool {
+	return o.NumericTolerance > 0 || len(o.TokenAliases) > 0 || o.IgnoreWhitespaceChanges || o.CollapseSpaceForMatch || o.KeepStopwords
+}
+
+// whitespaceFunc returns a function reporting whether a rune is whitespace,
+// as defined by opts.Whitespace.
+func whitespaceFunc(opts Options) func(rune) bool {
+	if opts.Whitespace != "" {
+		return func(r rune) bool { return strings.ContainsRune(opts.Whitespace, r) }
+	}
+	return isWhitespace
+}
+
+// isWhitespaceToken returns true if token is a run of whitespace, as defined
+// by opts.Whitespace, such as the gaps PreserveWhitespace keeps as tokens.
+func isWhitespaceToken(token string, opts Options) bool {
+	isWS := whitespaceFunc(opts)
+	return token != "" && strings.IndexFunc(token, func(r rune) bool { return !isWS(r) }) < 0
+}
+
+// collapseWhitespace replaces each run of whitespace in token, as defined by
+// opts.Whitespace, with a single space.
+func collapseWhitespace(token string, opts Options) string {
+	isWS := whitespaceFunc(opts)
+	if strings.IndexFunc(token, isWS) < 0 {
+		return token
+	}
+
+	var sb strings.Builder
+	inRun := false
+	for _, r := range token {
+		if isWS(r) {
+			if !inRun {
+				sb.WriteByte(' ')
+			}
+			inRun = true
+			continue
+		}
+		inRun = false
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// compareElements converts the tokens of both inputs to compareElements
+// using opts.
+func compareElements(tokens1, tokens2 []string, opts Options) ([]diffx.Element, []diffx.Element) {
+	aliases := opts.TokenAliases
+	if opts.IgnoreCase && len(aliases) > 0 {
+		aliases = make(map[string]string, len(opts.TokenAliases))
+		for variant, canonical := range opts.TokenAliases {
+			aliases[opts.CaseFold.Fold(variant)] = opts.CaseFold.Fold(canonical)
+		}
+	}
+
+	convert := func(tokens []string) []diffx.Element {
+		elems := make([]diffx.Element, len(tokens))
+		for i, t := range tokens {
+			e := compareElement{key: t}
+			if opts.CollapseSpaceForMatch && isWhitespaceToken(t, opts) {
+				e.key = " "
+			}
+			if opts.IgnoreWhitespaceChanges {
+				e.key = collapseWhitespace(e.key, opts)
+			}
+			if opts.IgnoreCase {
+				e.key = opts.CaseFold.Fold(e.key)
+			}
+			if canonical, ok := aliases[e.key]; ok {
+				e.key = canonical
+			}
+			if opts.NumericTolerance > 0 {
+				e.value, e.isNumber = parseNumber(t)
+				e.tolerance = opts.NumericTolerance
+			}
+			elems[i] = e
+		}
+		return elems
+	}
+	return convert(tokens1), convert(tokens2)
+}
+
+// diffTokensCompared computes a diff in which tokens are compared as
+// configured by opts.NumericTolerance, opts.TokenAliases,
+// opts.IgnoreWhitespaceChanges, opts.CollapseSpaceForMatch, and
+// opts.IgnoreCase. As with IgnoreCase alone, Equal tokens are taken from
+// tokens2 (the new file).
+func diffTokensCompared(tokens1, tokens2 []string, opts Options) []Diff {
+	elems1, elems2 := compareElements(tokens1, tokens2, opts)
+	ops := diffElementOps(elems1, elems2, opts.DiffAlgorithm)
+
+	var result []Diff
+	for _, op := range ops {
+		switch op.Type {
+		case diffx.Equal:
+			for i := op.BStart; i < op.BEnd; i++ {
+				result = append(result, Diff{Type: Equal, Token: tokens2[i]})
+			}
+		case diffx.Delete:
+			for i := op.AStart; i < op.AEnd; i++ {
+				result = append(result, Diff{Type: Delete, Token: tokens1[i]})
+			}
+		case diffx.Insert:
+			for i := op.BStart; i < op.BEnd; i++ {
+				result = append(result, Diff{Type: Insert, Token: tokens2[i]})
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,432 @@
+package tokendiff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		token  string
+		value  float64
+		number bool
+	}{
+		{"1", 1, true},
+		{"1.00", 1, true},
+		{"-2.5", -2.5, true},
+		{"+3", 3, true},
+		{".5", 0.5, true},
+		{"1e3", 1000, true},
+		{"", 0, false},
+		{"abc", 0, false},
+		{"1.2.3", 0, false},
+		{"inf", 0, false},
+		{"+Inf", 0, false},
+		{"NaN", 0, false},
+		{"1e999", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			value, number := parseNumber(tt.token)
+			if number != tt.number || value != tt.value {
+				t.Errorf("parseNumber(%q) = %v, %v; want %v, %v", tt.token, value, number, tt.value, tt.number)
+			}
+		})
+	}
+}
+
+func TestNumericTolerance(t *testing.T) {
+	tests := []struct {
+		name     string
+		text1    string
+		text2    string
+		opts     Options
+		expected []Diff
+	}{
+		{
+			name:  "trailing zeros",
+			text1: "x = 1.0",
+			text2: "x = 1.00",
+			opts:  Options{NumericTolerance: 1e-9},
+			expected: []Diff{
+				{Equal, "x"},
+				{Equal, "="},
+				{Equal, "1.00"},
+			},
+		},
+		{
+			name:  "tiny delta",
+			text1: "value 1.0 units",
+			text2: "value 1.00000001 units",
+			opts:  Options{NumericTolerance: 1e-6},
+			expected: []Diff{
+				{Equal, "value"},
+				{Equal, "1.00000001"},
+				{Equal, "units"},
+			},
+		},
+		{
+			name:  "delta exceeds tolerance",
+			text1: "value 1.0 units",
+			text2: "value 1.1 units",
+			opts:  Options{NumericTolerance: 1e-6},
+			expected: []Diff{
+				{Equal, "value"},
+				{Delete, "1.0"},
+				{Insert, "1.1"},
+				{Equal, "units"},
+			},
+		},
+		{
+			name:  "zero tolerance compares text",
+			text1: "x = 1.0",
+			text2: "x = 1.00",
+			opts:  Options{},
+			expected: []Diff{
+				{Equal, "x"},
+				{Equal, "="},
+				{Delete, "1.0"},
+				{Insert, "1.00"},
+			},
+		},
+		{
+			name:  "non-numeric tokens compare normally",
+			text1: "one 2 three",
+			text2: "One 2.0 four",
+			opts:  Options{NumericTolerance: 0.5},
+			expected: []Diff{
+				{Delete, "one"},
+				{Insert, "One"},
+				{Equal, "2.0"},
+				{Delete, "three"},
+				{Insert, "four"},
+			},
+		},
+		{
+			name:  "with ignore case",
+			text1: "Total 10",
+			text2: "total 10.0",
+			opts:  Options{NumericTolerance: 0.001, IgnoreCase: true},
+			expected: []Diff{
+				{Equal, "total"},
+				{Equal, "10.0"},
+			},
+		},
+		{
+			name:  "numbers never match words",
+			text1: "count 0",
+			text2: "count zero",
+			opts:  Options{NumericTolerance: 1},
+			expected: []Diff{
+				{Equal, "count"},
+				{Delete, "0"},
+				{Insert, "zero"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DiffStrings(tt.text1, tt.text2, tt.opts); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("DiffStrings() = %v, want %v", got, tt.expected)
+			}
+			if got := DiffStringsWithPreprocessing(tt.text1, tt.text2, tt.opts); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("DiffStringsWithPreprocessing() = %v, want %v", got, tt.expected)
+			}
+			result := DiffStringsWithPositions(tt.text1, tt.text2, tt.opts)
+			if !reflect.DeepEqual(result.Diffs, tt.expected) {
+				t.Errorf("DiffStringsWithPositions() = %v, want %v", result.Diffs, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTokenAliases(t *testing.T) {
+	aliases := map[string]string{"colour": "color", "grey": "gray", "Centre": "center"}
+
+	tests := []struct {
+		name     string
+		text1    string
+		text2    string
+		opts     Options
+		expected []Diff
+	}{
+		{
+			name:  "variant matches canonical",
+			text1: "the colour red",
+			text2: "the color red",
+			opts:  Options{TokenAliases: aliases},
+			expected: []Diff{
+				{Equal, "the"},
+				{Equal, "color"},
+				{Equal, "red"},
+			},
+		},
+		{
+			name:  "canonical matches variant",
+			text1: "gray sky",
+			text2: "grey sky",
+			opts:  Options{TokenAliases: aliases},
+			expected: []Diff{
+				{Equal, "grey"},
+				{Equal, "sky"},
+			},
+		},
+		{
+			name:  "aliases are case-sensitive by default",
+			text1: "Colour",
+			text2: "color",
+			opts:  Options{TokenAliases: aliases},
+			expected: []Diff{
+				{Delete, "Colour"},
+				{Insert, "color"},
+			},
+		},
+		{
+			name:  "ignore case",
+			text1: "Colour centre",
+			text2: "color CENTER",
+			opts:  Options{TokenAliases: aliases, IgnoreCase: true},
+			expected: []Diff{
+				{Equal, "color"},
+				{Equal, "CENTER"},
+			},
+		},
+		{
+			name:  "unrelated tokens still differ",
+			text1: "colour blue",
+			text2: "color green",
+			opts:  Options{TokenAliases: aliases},
+			expected: []Diff{
+				{Equal, "color"},
+				{Delete, "blue"},
+				{Insert, "green"},
+			},
+		},
+		{
+			name:  "combined with numeric tolerance",
+			text1: "grey 1.0",
+			text2: "gray 1.00",
+			opts:  Options{TokenAliases: aliases, NumericTolerance: 1e-9},
+			expected: []Diff{
+				{Equal, "gray"},
+				{Equal, "1.00"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DiffStrings(tt.text1, tt.text2, tt.opts); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("DiffStrings() = %v, want %v", got, tt.expected)
+			}
+			result := DiffStringsWithPositionsAndPreprocessing(tt.text1, tt.text2, tt.opts)
+			if !reflect.DeepEqual(result.Diffs, tt.expected) {
+				t.Errorf("DiffStringsWithPositionsAndPreprocessing() = %v, want %v", result.Diffs, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCollapseWhitespace(t *testing.T) {
+	tests := []struct {
+		token string
+		opts  Options
+		want  string
+	}{
+		{"abc", Options{}, "abc"},
+		{"  ", Options{}, " "},
+		{" \t\n", Options{}, " "},
+		{"a  b\t\tc", Options{}, "a b c"},
+		{"a__b", Options{Whitespace: "_"}, "a b"},
+		{"a  b", Options{Whitespace: "_"}, "a  b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			if got := collapseWhitespace(tt.token, tt.opts); got != tt.want {
+				t.Errorf("collapseWhitespace(%q) = %q, want %q", tt.token, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreWhitespaceChanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		text1    string
+		text2    string
+		opts     Options
+		expected []Diff
+	}{
+		{
+			name:  "whitespace run differs without the mode",
+			text1: "a  b",
+			text2: "a b",
+			opts:  Options{PreserveWhitespace: true},
+			expected: []Diff{
+				{Equal, "a"},
+				{Delete, "  "},
+				{Insert, " "},
+				{Equal, "b"},
+			},
+		},
+		{
+			name:  "whitespace run is equal with the mode",
+			text1: "a  b",
+			text2: "a b",
+			opts:  Options{PreserveWhitespace: true, IgnoreWhitespaceChanges: true},
+			expected: []Diff{
+				{Equal, "a"},
+				{Equal, " "},
+				{Equal, "b"},
+			},
+		},
+		{
+			name:  "tabs and spaces are equal",
+			text1: "x\t \ty",
+			text2: "x y",
+			opts:  Options{PreserveWhitespace: true, IgnoreWhitespaceChanges: true},
+			expected: []Diff{
+				{Equal, "x"},
+				{Equal, " "},
+				{Equal, "y"},
+			},
+		},
+		{
+			name:  "added whitespace still differs",
+			text1: "ab",
+			text2: "a b",
+			opts:  Options{Delimiters: "ab", PreserveWhitespace: true, IgnoreWhitespaceChanges: true},
+			expected: []Diff{
+				{Equal, "a"},
+				{Insert, " "},
+				{Equal, "b"},
+			},
+		},
+		{
+			name:  "combined with ignore case",
+			text1: "A  b",
+			text2: "a b",
+			opts:  Options{PreserveWhitespace: true, IgnoreWhitespaceChanges: true, IgnoreCase: true},
+			expected: []Diff{
+				{Equal, "a"},
+				{Equal, " "},
+				{Equal, "b"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DiffStrings(tt.text1, tt.text2, tt.opts); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("DiffStrings() = %v, want %v", got, tt.expected)
+			}
+			result := DiffStringsWithPositionsAndPreprocessing(tt.text1, tt.text2, tt.opts)
+			if !reflect.DeepEqual(result.Diffs, tt.expected) {
+				t.Errorf("DiffStringsWithPositionsAndPreprocessing() = %v, want %v", result.Diffs, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCollapseSpaceForMatch(t *testing.T) {
+	quoted := `"[^"]*"|\S+|\s+`
+	tests := []struct {
+		name     string
+		text1    string
+		text2    string
+		opts     Options
+		expected []Diff
+	}{
+		{
+			name:  "gap differs without the flag",
+			text1: "a b",
+			text2: "a  b",
+			opts:  Options{PreserveWhitespace: true},
+			expected: []Diff{
+				{Equal, "a"},
+				{Delete, " "},
+				{Insert, "  "},
+				{Equal, "b"},
+			},
+		},
+		{
+			name:  "gap is equal with the flag",
+			text1: "a b",
+			text2: "a  b",
+			opts:  Options{PreserveWhitespace: true, CollapseSpaceForMatch: true},
+			expected: []Diff{
+				{Equal, "a"},
+				{Equal, "  "},
+				{Equal, "b"},
+			},
+		},
+		{
+			name:  "gaps are not tokens without preserve whitespace",
+			text1: "a b",
+			text2: "a  b",
+			opts:  Options{CollapseSpaceForMatch: true},
+			expected: []Diff{
+				{Equal, "a"},
+				{Equal, "b"},
+			},
+		},
+		{
+			name:  "rewrapped line is equal",
+			text1: "one two\nthree",
+			text2: "one\ntwo three",
+			opts:  Options{PreserveWhitespace: true, CollapseSpaceForMatch: true},
+			expected: []Diff{
+				{Equal, "one"},
+				{Equal, "\n"},
+				{Equal, "two"},
+				{Equal, " "},
+				{Equal, "three"},
+			},
+		},
+		{
+			name:  "whitespace inside a token still differs",
+			text1: `say "x y"`,
+			text2: `say  "x  y"`,
+			opts:  Options{TokenPattern: quoted, CollapseSpaceForMatch: true},
+			expected: []Diff{
+				{Equal, "say"},
+				{Equal, "  "},
+				{Delete, `"x y"`},
+				{Insert, `"x  y"`},
+			},
+		},
+		{
+			name:  "ignore whitespace changes collapses inside tokens too",
+			text1: `say "x y"`,
+			text2: `say  "x  y"`,
+			opts:  Options{TokenPattern: quoted, IgnoreWhitespaceChanges: true},
+			expected: []Diff{
+				{Equal, "say"},
+				{Equal, "  "},
+				{Equal, `"x  y"`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DiffStrings(tt.text1, tt.text2, tt.opts); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("DiffStrings() = %v, want %v", got, tt.expected)
+			}
+			result := DiffStringsWithPositionsAndPreprocessing(tt.text1, tt.text2, tt.opts)
+			if !reflect.DeepEqual(result.Diffs, tt.expected) {
+				t.Errorf("DiffStringsWithPositionsAndPreprocessing() = %v, want %v", result.Diffs, tt.expected)
+			}
+		})
+	}
+
+	// Output keeps the new text's whitespace
+	opts := Options{PreserveWhitespace: true, CollapseSpaceForMatch: true}
+	result := DiffStringsWithPositions("one two\nthree", "one\ntwo three", opts)
+	if got, want := FormatDiffResultAdvanced(result, DefaultFormatOptions()), "one\ntwo three"; got != want {
+		t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, want)
+	}
+}
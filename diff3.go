@@ -0,0 +1,229 @@
+package tokendiff
+
+import (
+	"slices"
+	"strings"
+)
+
+// Diff3Type classifies a region of a three-way diff.
+type Diff3Type int
+
+const (
+	// Diff3Unchanged indicates neither side changed the region.
+	Diff3Unchanged Diff3Type = iota
+	// Diff3ChangedA indicates only side A changed the region.
+	Diff3ChangedA
+	// Diff3ChangedB indicates only side B changed the region.
+	Diff3ChangedB
+	// Diff3ChangedBoth indicates both sides made the same change.
+	Diff3ChangedBoth
+	// Diff3Conflict indicates the sides changed the region differently.
+	Diff3Conflict
+)
+
+// String returns a human-readable representation of the region type.
+func (t Diff3Type) String() string {
+	switch t {
+	case Diff3Unchanged:
+		return "Unchanged"
+	case Diff3ChangedA:
+		return "ChangedA"
+	case Diff3ChangedB:
+		return "ChangedB"
+	case Diff3ChangedBoth:
+		return "ChangedBoth"
+	case Diff3Conflict:
+		return "Conflict"
+	default:
+		return "Unknown"
+	}
+}
+
+// Diff3Region is a run of tokens in a three-way diff: the base tokens and
+// what each side has in their place. For an unchanged region all three are
+// the same tokens.
+type Diff3Region struct {
+	Type Diff3Type
+	Base []string
+	A    []string
+	B    []string
+}
+
+// Diff3Result is the result of Diff3: the regions in base order and the
+// number of them that conflict.
+type Diff3Result struct {
+	Regions   []Diff3Region
+	Conflicts int
+}
+
+// Diff3 compares two descendants, a and b, of a common base token by token,
+// for reviewing a merge or rebase. It diffs base against a and base against
+// b with DiffStrings and aligns the two diffs on the base tokens: tokens
+// kept by both sides are unchanged, and each run between them is changed by
+// one side, changed the same way by both, or a conflict. Options apply to
+// both diffs, except MaxTokens, which is ignored because a line-level diff
+// cannot be aligned on tokens.
+func Diff3(base, a, b string, opts Options) Diff3Result {
+	opts.MaxTokens = 0
+	baseTokens := Tokenize(base, opts)
+	sideA := alignOnBase(len(baseTokens), Tokenize(a, opts), DiffStrings(base, a, opts))
+	sideB := alignOnBase(len(baseTokens), Tokenize(b, opts), DiffStrings(base, b, opts))
+
+	var result Diff3Result
+	add := func(region Diff3Region) {
+		if len(region.Base) == 0 && len(region.A) == 0 && len(region.B) == 0 {
+			return
+		}
+		n := len(result.Regions)
+		if region.Type == Diff3Unchanged && n > 0 && result.Regions[n-1].Type == Diff3Unchanged {
+			last := &result.Regions[n-1]
+			last.Base = append(last.Base, region.Base...)
+			last.A = append(last.A, region.A...)
+			last.B = append(last.B, region.B...)
+			return
+		}
+		if region.Type == Diff3Conflict {
+			result.Conflicts++
+		}
+		// Copy, since unchanged regions are appended to and the tokens are
+		// subslices of the inputs
+		region.Base = append([]string(nil), region.Base...)
+		region.A = append([]string(nil), region.A...)
+		region.B = append([]string(nil), region.B...)
+		result.Regions = append(result.Regions, region)
+	}
+
+	// Each base token kept by both sides is unchanged. The tokens between
+	// two such tokens, with those either side inserted before the second,
+	// form a changed region.
+	start := 0
+	for i := 0; i <= len(baseTokens); i++ {
+		if i < len(baseTokens) && !(sideA.kept[i] && sideB.kept[i]) {
+			continue
+		}
+		changed := Diff3Region{
+			Base: baseTokens[start:i],
+			A:    sideA.content(start, i),
+			B:    sideB.content(start, i),
+		}
+		changed.Type = classifyDiff3(changed)
+		add(changed)
+		if i < len(baseTokens) {
+			add(Diff3Region{
+				Type: Diff3Unchanged,
+				Base: baseTokens[i : i+1],
+				A:    []string{sideA.tokens[sideA.index[i]]},
+				B:    []string{sideB.tokens[sideB.index[i]]},
+			})
+		}
+		start = i + 1
+	}
+	return result
+}
+
+// diff3Side is one descendant aligned on the base tokens.
+type diff3Side struct {
+	tokens   []string
+	kept     []bool     // whether each base token is kept
+	index    []int      // index in tokens of each kept base token
+	inserted [][]string // tokens inserted before each base token, and at the end
+}
+
+// alignOnBase aligns a descendant's tokens on n base tokens using their diff.
+func alignOnBase(n int, tokens []string, diffs []Diff) diff3Side {
+	side := diff3Side{
+		tokens:   tokens,
+		kept:     make([]bool, n),
+		index:    make([]int, n),
+		inserted: make([][]string, n+1),
+	}
+	i, j := 0, 0
+	for _, d := range diffs {
+		switch d.Type {
+		case Equal:
+			side.kept[i] = true
+			side.index[i] = j
+			i++
+			j++
+		case Delete:
+			i++
+		case Insert:
+			side.inserted[i] = append(side.inserted[i], tokens[j])
+			j++
+		}
+	}
+	return side
+}
+
+// content returns the side's tokens in place of base tokens [start, end),
+// including those inserted before end.
+func (s diff3Side) content(start, end int) []string {
+	var out []string
+	for i := start; i < end; i++ {
+		out = append(out, s.inserted[i]...)
+		if s.kept[i] {
+			out = append(out, s.tokens[s.index[i]])
+		}
+	}
+	return append(out, s.inserted[end]...)
+}
+
+// classifyDiff3 returns the type of a region between unchanged tokens.
+func classifyDiff3(region Diff3Region) Diff3Type {
+	changedA := !slices.Equal(region.A, region.Base)
+	changedB := !slices.Equal(region.B, region.Base)
+	switch {
+	case changedA && changedB && slices.Equal(region.A, region.B):
+		return Diff3ChangedBoth
+	case changedA && changedB:
+		return Diff3Conflict
+	case changedA:
+		return Diff3ChangedA
+	case changedB:
+		return Diff3ChangedB
+	default:
+		return Diff3Unchanged
+	}
+}
+
+// FormatDiff3 renders a three-way diff as merged text: each region as the
+// side that changed it, and each conflict as both sides between
+// "<<<<<<< labelA", "=======", and ">>>>>>> labelB" marker lines, as git
+// does. Tokens are joined with spaces where FormatDiff would put them.
+func FormatDiff3(result Diff3Result, labelA, labelB string) string {
+	var sb strings.Builder
+	var last string // last token written, for spacing
+	write := func(tokens []string) {
+		for _, token := range tokens {
+			if last != "" && !strings.HasSuffix(sb.String(), "\n") && NeedsSpaceBefore(token) && NeedsSpaceAfter(last) {
+				sb.WriteString(" ")
+			}
+			sb.WriteString(token)
+			last = token
+		}
+	}
+	newline := func() {
+		if sb.Len() > 0 && !strings.HasSuffix(sb.String(), "\n") {
+			sb.WriteString("\n")
+		}
+	}
+
+	for _, region := range result.Regions {
+		switch region.Type {
+		case Diff3ChangedB:
+			write(region.B)
+		case Diff3Conflict:
+			newline()
+			sb.WriteString("<<<<<<< " + labelA + "\n")
+			write(region.A)
+			newline()
+			sb.WriteString("=======\n")
+			write(region.B)
+			newline()
+			sb.WriteString(">>>>>>> " + labelB + "\n")
+		default:
+			write(region.A)
+		}
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
@@ -0,0 +1,139 @@
+package tokendiff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff3(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      string
+		a         string
+		b         string
+		opts      Options
+		regions   []Diff3Region
+		conflicts int
+		merged    string
+	}{
+		{
+			name: "identical",
+			base: "one two three",
+			a:    "one two three",
+			b:    "one two three",
+			regions: []Diff3Region{
+				{Type: Diff3Unchanged, Base: []string{"one", "two", "three"}, A: []string{"one", "two", "three"}, B: []string{"one", "two", "three"}},
+			},
+			merged: "one two three",
+		},
+		{
+			name: "clean merge, only a changed",
+			base: "the quick brown fox",
+			a:    "the quick red fox",
+			b:    "the quick brown fox",
+			regions: []Diff3Region{
+				{Type: Diff3Unchanged, Base: []string{"the", "quick"}, A: []string{"the", "quick"}, B: []string{"the", "quick"}},
+				{Type: Diff3ChangedA, Base: []string{"brown"}, A: []string{"red"}, B: []string{"brown"}},
+				{Type: Diff3Unchanged, Base: []string{"fox"}, A: []string{"fox"}, B: []string{"fox"}},
+			},
+			merged: "the quick red fox",
+		},
+		{
+			name: "clean merge, each side changed a different region",
+			base: "alpha beta gamma delta",
+			a:    "ALPHA beta gamma delta",
+			b:    "alpha beta gamma delta epsilon",
+			regions: []Diff3Region{
+				{Type: Diff3ChangedA, Base: []string{"alpha"}, A: []string{"ALPHA"}, B: []string{"alpha"}},
+				{Type: Diff3Unchanged, Base: []string{"beta", "gamma", "delta"}, A: []string{"beta", "gamma", "delta"}, B: []string{"beta", "gamma", "delta"}},
+				{Type: Diff3ChangedB, Base: nil, A: nil, B: []string{"epsilon"}},
+			},
+			merged: "ALPHA beta gamma delta epsilon",
+		},
+		{
+			name: "same change on both sides",
+			base: "a b c",
+			a:    "a x c",
+			b:    "a x c",
+			regions: []Diff3Region{
+				{Type: Diff3Unchanged, Base: []string{"a"}, A: []string{"a"}, B: []string{"a"}},
+				{Type: Diff3ChangedBoth, Base: []string{"b"}, A: []string{"x"}, B: []string{"x"}},
+				{Type: Diff3Unchanged, Base: []string{"c"}, A: []string{"c"}, B: []string{"c"}},
+			},
+			merged: "a x c",
+		},
+		{
+			name: "conflict",
+			base: "timeout = 30",
+			a:    "timeout = 60",
+			b:    "timeout = 10",
+			regions: []Diff3Region{
+				{Type: Diff3Unchanged, Base: []string{"timeout", "="}, A: []string{"timeout", "="}, B: []string{"timeout", "="}},
+				{Type: Diff3Conflict, Base: []string{"30"}, A: []string{"60"}, B: []string{"10"}},
+			},
+			conflicts: 1,
+			merged:    "timeout =\n<<<<<<< ours\n60\n=======\n10\n>>>>>>> theirs",
+		},
+		{
+			name: "conflict between insertions at the same place",
+			base: "f ( x )",
+			a:    "f ( x , y )",
+			b:    "f ( x , z )",
+			opts: Options{Delimiters: "(),"},
+			regions: []Diff3Region{
+				{Type: Diff3Unchanged, Base: []string{"f", "(", "x"}, A: []string{"f", "(", "x"}, B: []string{"f", "(", "x"}},
+				{Type: Diff3Conflict, Base: nil, A: []string{",", "y"}, B: []string{",", "z"}},
+				{Type: Diff3Unchanged, Base: []string{")"}, A: []string{")"}, B: []string{")"}},
+			},
+			conflicts: 1,
+			merged:    "f(x\n<<<<<<< ours\n, y\n=======\n, z\n>>>>>>> theirs\n)",
+		},
+		{
+			name: "ignore case keeps each side's tokens",
+			base: "Hello world",
+			a:    "hello world",
+			b:    "Hello there",
+			opts: Options{IgnoreCase: true},
+			regions: []Diff3Region{
+				{Type: Diff3Unchanged, Base: []string{"Hello"}, A: []string{"hello"}, B: []string{"Hello"}},
+				{Type: Diff3ChangedB, Base: []string{"world"}, A: []string{"world"}, B: []string{"there"}},
+			},
+			merged: "hello there",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := Diff3(tt.base, tt.a, tt.b, tt.opts)
+			if !reflect.DeepEqual(result.Regions, tt.regions) {
+				t.Errorf("Diff3() regions =\n%+v\nwant\n%+v", result.Regions, tt.regions)
+			}
+			if result.Conflicts != tt.conflicts {
+				t.Errorf("Diff3() conflicts = %d, want %d", result.Conflicts, tt.conflicts)
+			}
+			if got := FormatDiff3(result, "ours", "theirs"); got != tt.merged {
+				t.Errorf("FormatDiff3() =\n%q\nwant\n%q", got, tt.merged)
+			}
+		})
+	}
+}
+
+func TestDiff3TypeString(t *testing.T) {
+	tests := []struct {
+		typ      Diff3Type
+		expected string
+	}{
+		{Diff3Unchanged, "Unchanged"},
+		{Diff3ChangedA, "ChangedA"},
+		{Diff3ChangedB, "ChangedB"},
+		{Diff3ChangedBoth, "ChangedBoth"},
+		{Diff3Conflict, "Conflict"},
+		{Diff3Type(99), "Unknown"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.typ.String(); got != tt.expected {
+			t.Errorf("Diff3Type(%d).String() = %q, want %q", int(tt.typ), got, tt.expected)
+		}
+	}
+}
@@ -4,9 +4,16 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"runtime"
 	"strings"
 )
 
+// MaxParallelism is the number of hunks ProcessUnifiedDiff word-diffs at
+// once. Hunks are independent, so they are diffed concurrently and written
+// in input order; the output is the same for any value. 0 (the default)
+// uses runtime.GOMAXPROCS(0), and 1 diffs hunks one at a time.
+var MaxParallelism = 0
+
 // isGitExtendedHeader returns true if the line is a git extended header.
 func isGitExtendedHeader(line string) bool {
 	prefixes := []string{"diff ", "index ", "new file", "deleted file", "similarity", "rename", "Binary"}
@@ -36,40 +43,298 @@ type diffProcessor struct {
 	oldLines []string
 	newLines []string
 	inHunk   bool
+	parents  int
+	lastKind byte
+
+	// oldPrefixes and newPrefixes hold the prefix columns of the pending
+	// changed lines, for KeepDiffPrefixes.
+	oldPrefixes []string
+	newPrefixes []string
+
+	// noNewlineOld and noNewlineNew record "\ No newline at end of file"
+	// markers seen for the pending changed lines, and noNewlineMarker the
+	// last marker line, for EmitUnified.
+	noNewlineOld    bool
+	noNewlineNew    bool
+	noNewlineMarker string
+
+	// open is true when the last output line's terminator has not been
+	// written yet, and noEOL when that line had no newline in the input.
+	// The terminator is written before the next line, or at the end of
+	// output unless noEOL is set.
+	open  bool
+	noEOL bool
+
+	// commands, when non-nil, receives the output steps in order for the
+	// writer goroutine, and workers bounds the hunks being diffed. When
+	// nil, each step runs at once.
+	commands chan func()
+	workers  chan struct{}
 }
 
-// flushHunk outputs accumulated changes as word-level diff.
-func (p *diffProcessor) flushHunk() {
-	if len(p.oldLines) == 0 && len(p.newLines) == 0 {
+// emit runs f, a step that writes output or changes the output state, after
+// the steps emitted before it.
+func (p *diffProcessor) emit(f func()) {
+	if p.commands == nil {
+		f()
 		return
 	}
+	p.commands <- f
+}
+
+// emitLine writes s as an output line after the output emitted before it.
+func (p *diffProcessor) emitLine(s string) {
+	p.emit(func() { p.writeLine(s) })
+}
+
+// writeLine writes s as an output line.
+func (p *diffProcessor) writeLine(s string) {
+	if p.open {
+		fmt.Fprintln(p.output)
+	}
+	fmt.Fprint(p.output, s)
+	p.open = true
+	p.noEOL = false
+}
+
+// finish writes the last line's terminator unless the input lacked one.
+func (p *diffProcessor) finish() {
+	if p.open && !p.noEOL {
+		fmt.Fprintln(p.output)
+	}
+	p.open = false
+}
+
+// hunkChange is a run of changed lines within a hunk, as collected by
+// processHunkLine, to be word-diffed.
+type hunkChange struct {
+	oldLines        []string
+	newLines        []string
+	oldPrefixes     []string
+	newPrefixes     []string
+	noNewlineOld    bool
+	noNewlineNew    bool
+	noNewlineMarker string
+}
 
-	oldText := strings.Join(p.oldLines, "\n")
-	newText := strings.Join(p.newLines, "\n")
+// hunkOutput is the rendered output of a hunkChange: the lines to write, and
+// whether the last of them lacked a newline in the input.
+type hunkOutput struct {
+	lines []string
+	noEOL bool
+}
 
-	result := DiffWholeFiles(oldText, newText, p.opts, p.fmtOpts)
-	fmt.Fprintln(p.output, result.Formatted)
+// flushHunk outputs accumulated changes as word-level diff, diffing them on
+// a worker when hunks are processed concurrently.
+func (p *diffProcessor) flushHunk() {
+	if len(p.oldLines) == 0 && len(p.newLines) == 0 {
+		return
+	}
 
+	change := hunkChange{
+		oldLines:        p.oldLines,
+		newLines:        p.newLines,
+		oldPrefixes:     p.oldPrefixes,
+		newPrefixes:     p.newPrefixes,
+		noNewlineOld:    p.noNewlineOld,
+		noNewlineNew:    p.noNewlineNew,
+		noNewlineMarker: p.noNewlineMarker,
+	}
 	p.oldLines = nil
 	p.newLines = nil
+	p.oldPrefixes = nil
+	p.newPrefixes = nil
+	p.noNewlineOld = false
+	p.noNewlineNew = false
+
+	if p.commands == nil {
+		p.writeHunk(change.render(p.opts, p.fmtOpts))
+		return
+	}
+	result := make(chan hunkOutput, 1)
+	p.workers <- struct{}{}
+	go func() {
+		result <- change.render(p.opts, p.fmtOpts)
+		<-p.workers
+	}()
+	p.emit(func() { p.writeHunk(<-result) })
+}
+
+// writeHunk writes the rendered output of a hunkChange.
+func (p *diffProcessor) writeHunk(out hunkOutput) {
+	for _, line := range out.lines {
+		p.writeLine(line)
+	}
+	p.noEOL = out.noEOL
+}
+
+// render word-diffs the change and returns its output lines.
+func (c hunkChange) render(opts Options, fmtOpts FormatOptions) hunkOutput {
+	oldText := strings.Join(c.oldLines, "\n")
+	newText := strings.Join(c.newLines, "\n")
+
+	var out hunkOutput
+	switch {
+	case fmtOpts.EmitUnified:
+		// A valid unified diff keeps the markers after each side
+		out.lines = c.prefixedSides(oldText, newText, opts, fmtOpts, true)
+	case fmtOpts.KeepDiffPrefixes:
+		out.lines = c.prefixedSides(oldText, newText, opts, fmtOpts, false)
+
+		// The last line written is a new line, if there are any
+		if len(c.newLines) > 0 {
+			out.noEOL = c.noNewlineNew
+		} else {
+			out.noEOL = c.noNewlineOld
+		}
+	default:
+		result := DiffWholeFiles(oldText, newText, opts, fmtOpts)
+		out.lines = []string{result.Formatted}
+
+		// The merged output lacks a newline only if every side that has
+		// lines here lacks one
+		out.noEOL = (c.noNewlineOld || len(c.oldLines) == 0) && (c.noNewlineNew || len(c.newLines) == 0)
+	}
+	return out
+}
+
+// prefixedSides word-diffs oldText and newText, the change's sides, and
+// returns the old lines after their prefixes, with deleted words marked,
+// then the new lines after theirs, with inserted words marked. With
+// markers, a side that lacked a final newline is followed by the change's
+// noNewlineMarker.
+func (c hunkChange) prefixedSides(oldText, newText string, opts Options, fmtOpts FormatOptions, markers bool) []string {
+	result := DiffStringsWithPositionsAndPreprocessing(oldText, newText, opts)
+	lines := prefixedLines(c.oldPrefixes, renderDiffSide(result, Delete, fmtOpts), Delete, fmtOpts)
+	if markers && c.noNewlineOld {
+		lines = append(lines, c.noNewlineMarker)
+	}
+	lines = append(lines, prefixedLines(c.newPrefixes, renderDiffSide(result, Insert, fmtOpts), Insert, fmtOpts)...)
+	if markers && c.noNewlineNew {
+		lines = append(lines, c.noNewlineMarker)
+	}
+	return lines
+}
+
+// prefixedLines returns the lines of rendered, one side of a change, after
+// their prefixes, colored as op with UseColor unless EmitUnified.
+func prefixedLines(prefixes []string, rendered string, op Operation, fmtOpts FormatOptions) []string {
+	if fmtOpts.EmitUnified {
+		fmtOpts.UseColor = false
+	}
+	return prefixLines(prefixes, rendered, op, fmtOpts)
+}
+
+// prefixLines returns the lines of rendered, one side of a change, each after
+// its prefix, colored as op with UseColor. The last prefix is repeated if
+// there are more lines than prefixes, and there are no lines without
+// prefixes.
+func prefixLines(prefixes []string, rendered string, op Operation, fmtOpts FormatOptions) []string {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	var lines []string
+	for i, line := range strings.Split(rendered, "\n") {
+		prefix := prefixes[min(i, len(prefixes)-1)]
+		if fmtOpts.UseColor {
+			color := fmtOpts.DeleteColor
+			if op == Insert {
+				color = fmtOpts.InsertColor
+			}
+			prefix = color + prefix + fmtOpts.ColorReset
+		}
+		lines = append(lines, prefix+line)
+	}
+	return lines
+}
+
+// renderDiffSide renders one input of result, the old text for Delete or the
+// new text for Insert, with its runs of op tokens marked. Each line of a
+// run is marked separately, so the rendered text splits into the input's
+// lines.
+func renderDiffSide(result DiffResult, op Operation, fmtOpts FormatOptions) string {
+	text, positions := result.Text1, result.Positions1
+	if op == Insert {
+		text, positions = result.Text2, result.Positions2
+	}
+
+	var sb strings.Builder
+	last, idx := 0, 0
+	for i := 0; i < len(result.Diffs); {
+		typ := result.Diffs[i].Type
+		start := i
+		for i < len(result.Diffs) && result.Diffs[i].Type == typ {
+			i++
+		}
+		if typ != Equal && typ != op {
+			continue
+		}
+		n := i - start
+		if idx+n > len(positions) {
+			break
+		}
+
+		runStart, runEnd := positions[idx].Start, positions[idx+n-1].End
+		sb.WriteString(text[last:runStart])
+		run := text[runStart:runEnd]
+		if typ == Equal {
+			sb.WriteString(formatCommonText(run, fmtOpts))
+		} else {
+			for j, piece := range strings.Split(run, "\n") {
+				if j > 0 {
+					sb.WriteString("\n")
+				}
+				if piece != "" {
+					sb.WriteString(formatNonEqualToken(Diff{Type: op, Token: piece}, fmtOpts))
+				}
+			}
+		}
+		last = runEnd
+		idx += n
+	}
+	sb.WriteString(text[last:])
+	return sb.String()
 }
 
 // processHunkLine handles a line inside a hunk.
 func (p *diffProcessor) processHunkLine(line string) {
+	if isNoNewlineMarker(line) {
+		p.noNewlineMarker = line
+		switch p.lastKind {
+		case '-':
+			p.noNewlineOld = true
+		case '+':
+			p.noNewlineNew = true
+		case ' ':
+			if p.fmtOpts.EmitUnified {
+				p.emitLine(line)
+			} else {
+				p.emit(func() { p.noEOL = p.open })
+			}
+		default:
+			p.emit(func() { p.noEOL = p.open })
+		}
+		return
+	}
+
+	kind, text, ok := classifyHunkLine(line, p.parents)
+	p.lastKind = kind
 	switch {
-	case strings.HasPrefix(line, "-"):
-		p.oldLines = append(p.oldLines, line[1:])
-	case strings.HasPrefix(line, "+"):
-		p.newLines = append(p.newLines, line[1:])
-	case strings.HasPrefix(line, " "):
+	case !ok:
 		p.flushHunk()
-		fmt.Fprintln(p.output, line[1:])
-	case line == "":
+		p.emitLine(line)
+	case kind == '-':
+		p.oldLines = append(p.oldLines, text)
+		p.oldPrefixes = append(p.oldPrefixes, line[:len(line)-len(text)])
+	case kind == '+':
+		p.newLines = append(p.newLines, text)
+		p.newPrefixes = append(p.newPrefixes, line[:len(line)-len(text)])
+	case p.fmtOpts.KeepDiffPrefixes, p.fmtOpts.EmitUnified:
 		p.flushHunk()
-		fmt.Fprintln(p.output, line)
+		p.emitLine(line)
 	default:
 		p.flushHunk()
-		fmt.Fprintln(p.output, line)
+		p.emitLine(text)
 	}
 }
 
@@ -79,29 +344,61 @@ func (p *diffProcessor) processLine(line string) {
 	case isDiffHeader(line), isGitExtendedHeader(line):
 		p.flushHunk()
 		p.inHunk = false
-		fmt.Fprintln(p.output, line)
+		p.emitLine(line)
 	case isHunkHeader(line):
 		p.flushHunk()
 		p.inHunk = true
-		fmt.Fprintln(p.output, line)
+		p.parents = hunkParents(line)
+		p.lastKind = 0
+		p.emitLine(line)
 	case p.inHunk:
 		p.processHunkLine(line)
 	default:
-		fmt.Fprintln(p.output, line)
+		p.emitLine(line)
 	}
 }
 
 // ProcessUnifiedDiff reads a unified diff from input and applies word-level
 // diffing to each hunk. The result is written to output with diff headers
 // preserved and hunk content replaced with word-level diff output.
+// With fmtOpts.KeepDiffPrefixes, hunks keep their line structure and
+// prefixes instead, and with fmtOpts.EmitUnified the output is also a valid
+// unified diff. Except with EmitUnified, "\ No newline at end of file"
+// markers are not copied; instead, the output ends without a newline when
+// the diffed file did. Up to MaxParallelism hunks are diffed at once.
 func ProcessUnifiedDiff(input io.Reader, output io.Writer, opts Options, fmtOpts FormatOptions) error {
+	if fmtOpts.ColorReset == "" {
+		fmtOpts.ColorReset = ANSIReset
+	}
 	scanner := bufio.NewScanner(input)
 	p := &diffProcessor{output: output, opts: opts, fmtOpts: fmtOpts}
 
+	workers := MaxParallelism
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	var written chan struct{}
+	if workers > 1 {
+		p.commands = make(chan func(), workers)
+		p.workers = make(chan struct{}, workers)
+		written = make(chan struct{})
+		go func() {
+			for f := range p.commands {
+				f()
+			}
+			close(written)
+		}()
+	}
+
 	for scanner.Scan() {
 		p.processLine(scanner.Text())
 	}
-
 	p.flushHunk()
+
+	if p.commands != nil {
+		close(p.commands)
+		<-written
+	}
+	p.finish()
 	return scanner.Err()
 }
@@ -1,6 +1,9 @@
 package tokendiff
 
 import (
+	"fmt"
+	"io"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -190,3 +193,313 @@ Binary files differ
 		}
 	}
 }
+
+func TestProcessUnifiedDiffCombined(t *testing.T) {
+	input := `diff --cc file.txt
+index 1234567,89abcde..fedcba9
+--- a/file.txt
++++ b/file.txt
+@@@ -1,3 -1,3 +1,3 @@@
+  context line
+- old word here
+++new word here
+  another context
+`
+
+	expected := `diff --cc file.txt
+index 1234567,89abcde..fedcba9
+--- a/file.txt
++++ b/file.txt
+@@@ -1,3 -1,3 +1,3 @@@
+context line
+[-old-]{+new+} word here
+another context
+`
+
+	opts := DefaultOptions()
+	fmtOpts := FormatOptions{
+		StartDelete: "[-",
+		StopDelete:  "-]",
+		StartInsert: "{+",
+		StopInsert:  "+}",
+	}
+
+	var output strings.Builder
+	err := ProcessUnifiedDiff(strings.NewReader(input), &output, opts, fmtOpts)
+	if err != nil {
+		t.Fatalf("ProcessUnifiedDiff error: %v", err)
+	}
+
+	if output.String() != expected {
+		t.Errorf("ProcessUnifiedDiff:\ngot:\n%s\nwant:\n%s", output.String(), expected)
+	}
+}
+
+func TestProcessUnifiedDiffNoNewline(t *testing.T) {
+	header := "--- a/file.txt\n+++ b/file.txt\n@@ -1,2 +1,2 @@\n context\n"
+	marker := "\\ No newline at end of file\n"
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "both sides lack newline",
+			input:    header + "-old end\n" + marker + "+new end\n" + marker,
+			expected: "--- a/file.txt\n+++ b/file.txt\n@@ -1,2 +1,2 @@\ncontext\n[-old-]{+new+} end",
+		},
+		{
+			name:     "newline added",
+			input:    header + "-old end\n" + marker + "+new end\n",
+			expected: "--- a/file.txt\n+++ b/file.txt\n@@ -1,2 +1,2 @@\ncontext\n[-old-]{+new+} end\n",
+		},
+		{
+			name:     "newline removed",
+			input:    header + "-old end\n+new end\n" + marker,
+			expected: "--- a/file.txt\n+++ b/file.txt\n@@ -1,2 +1,2 @@\ncontext\n[-old-]{+new+} end\n",
+		},
+		{
+			name:     "context line lacks newline",
+			input:    "--- a/file.txt\n+++ b/file.txt\n@@ -1,2 +1,2 @@\n-old\n+new\n end\n" + marker,
+			expected: "--- a/file.txt\n+++ b/file.txt\n@@ -1,2 +1,2 @@\n[-old-]{+new+}\nend",
+		},
+		{
+			name: "next file follows",
+			input: header + "-old end\n" + marker + "+new end\n" + marker +
+				"--- a/other.txt\n+++ b/other.txt\n@@ -1 +1 @@\n-x\n+y\n",
+			expected: "--- a/file.txt\n+++ b/file.txt\n@@ -1,2 +1,2 @@\ncontext\n[-old-]{+new+} end\n" +
+				"--- a/other.txt\n+++ b/other.txt\n@@ -1 +1 @@\n[-x-]{+y+}\n",
+		},
+	}
+
+	fmtOpts := FormatOptions{
+		StartDelete: "[-",
+		StopDelete:  "-]",
+		StartInsert: "{+",
+		StopInsert:  "+}",
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output strings.Builder
+			if err := ProcessUnifiedDiff(strings.NewReader(tt.input), &output, DefaultOptions(), fmtOpts); err != nil {
+				t.Fatalf("ProcessUnifiedDiff error: %v", err)
+			}
+			if output.String() != tt.expected {
+				t.Errorf("ProcessUnifiedDiff:\ngot:  %q\nwant: %q", output.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestProcessUnifiedDiffKeepPrefixes(t *testing.T) {
+	markers := FormatOptions{
+		StartDelete:      "[-",
+		StopDelete:       "-]",
+		StartInsert:      "{+",
+		StopInsert:       "+}",
+		KeepDiffPrefixes: true,
+	}
+	colors := FormatOptions{
+		UseColor:         true,
+		DeleteColor:      ANSIDeleteColor,
+		InsertColor:      ANSIInsertColor,
+		KeepDiffPrefixes: true,
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		fmtOpts  FormatOptions
+		expected string
+	}{
+		{
+			name: "markers",
+			input: "--- a/file.txt\n+++ b/file.txt\n@@ -1,4 +1,4 @@\n context line\n" +
+				"-old word here\n-second line\n+new word here\n+second line too\n another context\n",
+			fmtOpts: markers,
+			expected: "--- a/file.txt\n+++ b/file.txt\n@@ -1,4 +1,4 @@\n context line\n" +
+				"-[-old-] word here\n-second line\n+{+new+} word here\n+second line {+too+}\n another context\n",
+		},
+		{
+			name:     "deleted line only",
+			input:    "--- a/file.txt\n+++ b/file.txt\n@@ -1,2 +1,1 @@\n keep\n-gone\n",
+			fmtOpts:  markers,
+			expected: "--- a/file.txt\n+++ b/file.txt\n@@ -1,2 +1,1 @@\n keep\n-[-gone-]\n",
+		},
+		{
+			name:     "combined diff keeps each column",
+			input:    "--- a/file.txt\n+++ b/file.txt\n@@@ -1,2 -1,2 +1,2 @@@\n  context\n- old word\n++new word\n",
+			fmtOpts:  markers,
+			expected: "--- a/file.txt\n+++ b/file.txt\n@@@ -1,2 -1,2 +1,2 @@@\n  context\n- [-old-] word\n++{+new+} word\n",
+		},
+		{
+			name:    "colored prefixes",
+			input:   "@@ -1 +1 @@\n-old word\n+new word\n",
+			fmtOpts: colors,
+			expected: "@@ -1 +1 @@\n" +
+				ANSIDeleteColor + "-" + ANSIReset + ANSIDeleteColor + "old" + ANSIReset + " word\n" +
+				ANSIInsertColor + "+" + ANSIReset + ANSIInsertColor + "new" + ANSIReset + " word\n",
+		},
+		{
+			name:     "no newline at end",
+			input:    "@@ -1 +1 @@\n-old end\n\\ No newline at end of file\n+new end\n\\ No newline at end of file\n",
+			fmtOpts:  markers,
+			expected: "@@ -1 +1 @@\n-[-old-] end\n+{+new+} end",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output strings.Builder
+			if err := ProcessUnifiedDiff(strings.NewReader(tt.input), &output, DefaultOptions(), tt.fmtOpts); err != nil {
+				t.Fatalf("ProcessUnifiedDiff error: %v", err)
+			}
+			if output.String() != tt.expected {
+				t.Errorf("ProcessUnifiedDiff:\ngot:  %q\nwant: %q", output.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestProcessUnifiedDiffEmitUnified(t *testing.T) {
+	input := "diff --git a/file.txt b/file.txt\n--- a/file.txt\n+++ b/file.txt\n" +
+		"@@ -1,4 +1,4 @@\n context line\n-old word here\n-second line\n+new word here\n+second line too\n another context\n" +
+		"@@ -9 +9 @@\n-last line\n\\ No newline at end of file\n+last line!\n\\ No newline at end of file\n"
+	fmtOpts := FormatOptions{
+		StartDelete: "[-",
+		StopDelete:  "-]",
+		StartInsert: "{+",
+		StopInsert:  "+}",
+		EmitUnified: true,
+	}
+
+	var output strings.Builder
+	if err := ProcessUnifiedDiff(strings.NewReader(input), &output, DefaultOptions(), fmtOpts); err != nil {
+		t.Fatalf("ProcessUnifiedDiff error: %v", err)
+	}
+	expected := "diff --git a/file.txt b/file.txt\n--- a/file.txt\n+++ b/file.txt\n" +
+		"@@ -1,4 +1,4 @@\n context line\n-[-old-] word here\n-second line\n+{+new+} word here\n+second line {+too+}\n another context\n" +
+		"@@ -9 +9 @@\n-last [-line-]\n\\ No newline at end of file\n+last {+line!+}\n\\ No newline at end of file\n"
+	if output.String() != expected {
+		t.Fatalf("ProcessUnifiedDiff:\ngot:  %q\nwant: %q", output.String(), expected)
+	}
+
+	// The output parses into the same hunks, with the changed words marked
+	before, err := ParseUnifiedDiff(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := ParseUnifiedDiff(output.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != 1 || len(after) != 1 || len(after[0].Hunks) != len(before[0].Hunks) {
+		t.Fatalf("ParseUnifiedDiff() of output = %+v, want the hunks of %+v", after, before)
+	}
+	for i, want := range before[0].Hunks {
+		got := after[0].Hunks[i]
+		if got.OldStart != want.OldStart || got.OldCount != want.OldCount || got.NewStart != want.NewStart || got.NewCount != want.NewCount {
+			t.Errorf("hunk %d ranges = %+v, want %+v", i, got, want)
+		}
+		if !reflect.DeepEqual(got.ContextBefore, want.ContextBefore) || !reflect.DeepEqual(got.ContextAfter, want.ContextAfter) {
+			t.Errorf("hunk %d context = %q %q, want %q %q", i, got.ContextBefore, got.ContextAfter, want.ContextBefore, want.ContextAfter)
+		}
+		if len(got.OldLines) != len(want.OldLines) || len(got.NewLines) != len(want.NewLines) {
+			t.Errorf("hunk %d lines = %q %q, want as many as %q %q", i, got.OldLines, got.NewLines, want.OldLines, want.NewLines)
+		}
+		if got.NoNewlineOld != want.NoNewlineOld || got.NoNewlineNew != want.NoNewlineNew {
+			t.Errorf("hunk %d no-newline flags = %v %v, want %v %v", i, got.NoNewlineOld, got.NoNewlineNew, want.NoNewlineOld, want.NoNewlineNew)
+		}
+	}
+	if got := after[0].Hunks[0].NewLines[0]; got != "{+new+} word here" {
+		t.Errorf("first new line = %q, want the inserted word marked", got)
+	}
+
+	// With color, the words are colored but the prefixes are not
+	output.Reset()
+	colors := FormatOptions{UseColor: true, DeleteColor: ANSIDeleteColor, InsertColor: ANSIInsertColor, EmitUnified: true}
+	if err := ProcessUnifiedDiff(strings.NewReader("@@ -1 +1 @@\n-old word\n+new word\n"), &output, DefaultOptions(), colors); err != nil {
+		t.Fatalf("ProcessUnifiedDiff error: %v", err)
+	}
+	expected = "@@ -1 +1 @@\n-" + ANSIDeleteColor + "old" + ANSIReset + " word\n+" + ANSIInsertColor + "new" + ANSIReset + " word\n"
+	if output.String() != expected {
+		t.Errorf("ProcessUnifiedDiff with color:\ngot:  %q\nwant: %q", output.String(), expected)
+	}
+}
+
+// manyHunksDiff returns a unified diff of n small hunks, for exercising
+// concurrent hunk processing.
+func manyHunksDiff(n int) string {
+	var sb strings.Builder
+	sb.WriteString("diff --git a/big.txt b/big.txt\n--- a/big.txt\n+++ b/big.txt\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sb, "@@ -%d,3 +%d,3 @@\n", i*10+1, i*10+1)
+		fmt.Fprintf(&sb, " context line %d\n", i)
+		switch i % 3 {
+		case 0:
+			fmt.Fprintf(&sb, "-the value is %d\n+the value was %d\n", i, i*2)
+		case 1:
+			fmt.Fprintf(&sb, "-removed line %d\n-and another\n+added line %d\n", i, i)
+		default:
+			fmt.Fprintf(&sb, "+only added %d\n", i)
+		}
+		sb.WriteString(" trailing context\n")
+	}
+	sb.WriteString("@@ -9999 +9999 @@\n-last line\n\\ No newline at end of file\n+last line!\n\\ No newline at end of file\n")
+	return sb.String()
+}
+
+func TestProcessUnifiedDiffParallel(t *testing.T) {
+	input := manyHunksDiff(500)
+	defer func(saved int) { MaxParallelism = saved }(MaxParallelism)
+
+	for _, mode := range []struct {
+		name   string
+		modify func(*FormatOptions)
+	}{
+		{"word diff", func(*FormatOptions) {}},
+		{"color", func(o *FormatOptions) { o.UseColor = true }},
+		{"keep prefixes", func(o *FormatOptions) { o.KeepDiffPrefixes = true }},
+		{"emit unified", func(o *FormatOptions) { o.EmitUnified = true }},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			fmtOpts := DefaultFormatOptions()
+			mode.modify(&fmtOpts)
+
+			render := func(parallelism int) string {
+				MaxParallelism = parallelism
+				var out strings.Builder
+				if err := ProcessUnifiedDiff(strings.NewReader(input), &out, DefaultOptions(), fmtOpts); err != nil {
+					t.Fatalf("ProcessUnifiedDiff() error = %v", err)
+				}
+				return out.String()
+			}
+
+			serial := render(1)
+			if !strings.Contains(serial, "@@ -4991,3 +4991,3 @@") {
+				t.Fatalf("serial output is missing hunks:\n%s", serial)
+			}
+			for _, parallelism := range []int{0, 2, 8, 64} {
+				if got := render(parallelism); got != serial {
+					t.Errorf("MaxParallelism %d: output differs from serial output", parallelism)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkProcessUnifiedDiff(b *testing.B) {
+	input := manyHunksDiff(2000)
+	defer func(saved int) { MaxParallelism = saved }(MaxParallelism)
+
+	for _, parallelism := range []int{1, 0} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			MaxParallelism = parallelism
+			for i := 0; i < b.N; i++ {
+				ProcessUnifiedDiff(strings.NewReader(input), io.Discard, DefaultOptions(), DefaultFormatOptions())
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package tokendiff
+
+// Differ diffs many pairs of texts with the same Options. The tokenizer the
+// Options describe, with its delimiter and whitespace sets and sorted
+// delimiter sequences, is built once by NewDiffer instead of on every call,
+// which saves allocations for a server or tool diffing many small texts. A
+// Differ is safe for concurrent use if its CustomTokenizer, if any, is.
+type Differ struct {
+	opts      Options
+	tokenizer tokenizer
+}
+
+// NewDiffer returns a Differ for opts. Changes to slices or maps in opts
+// after the call, such as IgnoreTokens, affect later diffs; changes to the
+// delimiters, whitespace, or token pattern do not.
+func NewDiffer(opts Options) *Differ {
+	opts = opts.withTokenPattern()
+	return &Differ{opts: opts, tokenizer: newTokenizer(opts)}
+}
+
+// Options returns the options d diffs with.
+func (d *Differ) Options() Options {
+	return d.opts
+}
+
+// Diff tokenizes and diffs text1 and text2 as DiffStringsWithPositions does.
+func (d *Differ) Diff(text1, text2 string) DiffResult {
+	return diffStringsWithPositions(text1, text2, &d.tokenizer, d.opts)
+}
+
+// Stats returns the statistics of a diff of text1 and text2 as QuickStats
+// does.
+func (d *Differ) Stats(text1, text2 string) DiffStatistics {
+	return quickStats(text1, text2, &d.tokenizer, d.opts)
+}
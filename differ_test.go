@@ -0,0 +1,76 @@
+package tokendiff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffer(t *testing.T) {
+	text1 := "func processData(input []byte, config *Config) (Result, error) {"
+	text2 := "func ProcessData(input []byte, options *Options) (Result, error) {"
+
+	tests := []struct {
+		name   string
+		modify func(*Options)
+	}{
+		{"default", func(*Options) {}},
+		{"delimiters", func(o *Options) { o.Delimiters = "(){}" }},
+		{"punctuation", func(o *Options) { o.UsePunctuation = true }},
+		{"whitespace", func(o *Options) { o.Whitespace = " ," }},
+		{"preserve whitespace", func(o *Options) { o.PreserveWhitespace = true }},
+		{"delimiter sequences", func(o *Options) { o.DelimiterSequences = []string{"[]", ") ("} }},
+		{"token pattern", func(o *Options) { o.TokenPattern = `[A-Za-z]+` }},
+		{"ignore case", func(o *Options) { o.IgnoreCase = true }},
+		{"max tokens", func(o *Options) { o.MaxTokens = 5 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			tt.modify(&opts)
+			d := NewDiffer(opts)
+
+			// Each call gives what the function it replaces gives
+			for i := 0; i < 2; i++ {
+				if got, want := d.Diff(text1, text2), DiffStringsWithPositions(text1, text2, opts); !reflect.DeepEqual(got, want) {
+					t.Errorf("Diff() = %+v, want %+v", got, want)
+				}
+				if got, want := d.Stats(text1, text2), QuickStats(text1, text2, opts); got != want {
+					t.Errorf("Stats() = %+v, want %+v", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDifferAllocations(t *testing.T) {
+	text1, text2 := "the quick brown fox", "the quick red fox"
+	opts := DefaultOptions()
+	d := NewDiffer(opts)
+
+	reused := testing.AllocsPerRun(100, func() { d.Diff(text1, text2) })
+	repeated := testing.AllocsPerRun(100, func() { DiffStringsWithPositions(text1, text2, opts) })
+	if reused >= repeated {
+		t.Errorf("Differ.Diff() allocations = %v, want fewer than DiffStringsWithPositions() = %v", reused, repeated)
+	}
+}
+
+func BenchmarkDiffer(b *testing.B) {
+	text1 := "func processData(input []byte, config *Config) (Result, error) {"
+	text2 := "func processData(input []byte, options *Options) (Result, error) {"
+	opts := DefaultOptions()
+
+	b.Run("Differ.Diff", func(b *testing.B) {
+		d := NewDiffer(opts)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			d.Diff(text1, text2)
+		}
+	})
+	b.Run("DiffStringsWithPositions", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			DiffStringsWithPositions(text1, text2, opts)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package tokendiff
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// FileDiff is the diff of one file in a directory comparison.
+type FileDiff struct {
+	// Path is the file's path relative to the compared directories, using
+	// the OS path separator.
+	Path string
+	// Added is true if the file exists only in the new directory; it is
+	// diffed against empty old text.
+	Added bool
+	// Deleted is true if the file exists only in the old directory; it is
+	// diffed against empty new text.
+	Deleted bool
+	// Binary is true if either side of the file is binary; the file is
+	// compared byte for byte instead of diffed, and Result is empty.
+	Binary bool
+	// Result is the whole-file diff of the file.
+	Result WholeFileDiffResult
+}
+
+// DiffDirectories walks dir1 and dir2, pairs regular files by relative path,
+// and diffs each pair with DiffWholeFiles. It returns the files that differ,
+// sorted by path; files with the same tokens, such as those differing only
+// in whitespace, are omitted. A file present in only one tree is returned
+// as Added or Deleted, diffed against empty text. Symlinks are not followed,
+// and other non-regular files are ignored. Files that look binary, as
+// LooksBinary judges them, are returned as Binary if their bytes differ.
+func DiffDirectories(dir1, dir2 string, opts Options, fmtOpts FormatOptions) ([]FileDiff, error) {
+	return DiffDirectoriesWith(dir1, dir2, readText, opts, fmtOpts)
+}
+
+// DiffDirectoriesWith is DiffDirectories reading each file with read, which
+// returns its text given its path and whether it is binary, so that files
+// can be decoded or decompressed before they are compared, and binary ones
+// judged by the caller.
+func DiffDirectoriesWith(dir1, dir2 string, read func(path string) (text string, binary bool, err error), opts Options, fmtOpts FormatOptions) ([]FileDiff, error) {
+	return walkDirectories(dir1, dir2, read, func(text1, text2 string, paired bool) (WholeFileDiffResult, bool) {
+		result := DiffWholeFiles(text1, text2, opts, fmtOpts)
+		return result, !paired || result.HasChanges
+	})
+}
+
+// CompareDirectoriesWith is DiffDirectoriesWith without the diffs: it
+// returns the same files, but judges paired text files with TextsDiffer,
+// which stops at the first differing token, and leaves each Result empty.
+// It suits callers that only list the files that differ.
+func CompareDirectoriesWith(dir1, dir2 string, read func(path string) (text string, binary bool, err error), opts Options) ([]FileDiff, error) {
+	return walkDirectories(dir1, dir2, read, func(text1, text2 string, paired bool) (WholeFileDiffResult, bool) {
+		return WholeFileDiffResult{}, !paired || TextsDiffer(text1, text2, opts)
+	})
+}
+
+// walkDirectories pairs the regular files of dir1 and dir2 by relative
+// path, reads each with read, and returns those that differ, sorted by
+// path. Files whose bytes differ and that are not binary are passed to
+// diff, with paired false for a file present in only one tree; it returns
+// the file's Result and whether the file differs.
+func walkDirectories(dir1, dir2 string, read func(path string) (text string, binary bool, err error), diff func(text1, text2 string, paired bool) (WholeFileDiffResult, bool)) ([]FileDiff, error) {
+	files1, err := regularFiles(dir1)
+	if err != nil {
+		return nil, err
+	}
+	files2, err := regularFiles(dir2)
+	if err != nil {
+		return nil, err
+	}
+
+	in1 := make(map[string]bool, len(files1))
+	for _, rel := range files1 {
+		in1[rel] = true
+	}
+	in2 := make(map[string]bool, len(files2))
+	for _, rel := range files2 {
+		in2[rel] = true
+	}
+
+	all := files1
+	for _, rel := range files2 {
+		if !in1[rel] {
+			all = append(all, rel)
+		}
+	}
+	sort.Strings(all)
+
+	var diffs []FileDiff
+	for _, rel := range all {
+		var text1, text2 string
+		var binary1, binary2 bool
+		if in1[rel] {
+			if text1, binary1, err = read(filepath.Join(dir1, rel)); err != nil {
+				return nil, err
+			}
+		}
+		if in2[rel] {
+			if text2, binary2, err = read(filepath.Join(dir2, rel)); err != nil {
+				return nil, err
+			}
+		}
+		paired := in1[rel] && in2[rel]
+		if paired && text1 == text2 {
+			continue
+		}
+		if binary1 || binary2 {
+			diffs = append(diffs, FileDiff{
+				Path:    rel,
+				Added:   !in1[rel],
+				Deleted: !in2[rel],
+				Binary:  true,
+			})
+			continue
+		}
+
+		result, differ := diff(text1, text2, paired)
+		if !differ {
+			continue
+		}
+		diffs = append(diffs, FileDiff{
+			Path:    rel,
+			Added:   !in1[rel],
+			Deleted: !in2[rel],
+			Result:  result,
+		})
+	}
+	return diffs, nil
+}
+
+// regularFiles returns the sorted paths, relative to root, of the regular
+// files under root. Symlinks are not followed.
+func regularFiles(root string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// readText reads the file at path as a string, and reports whether it
+// looks binary.
+func readText(path string) (string, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, err
+	}
+	return string(data), LooksBinary(data), nil
+}
@@ -0,0 +1,140 @@
+package tokendiff
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles creates files under root from a map of slash-separated
+// relative path to content.
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for rel, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiffDirectories(t *testing.T) {
+	dir1 := filepath.Join(t.TempDir(), "old")
+	dir2 := filepath.Join(t.TempDir(), "new")
+	writeFiles(t, dir1, map[string]string{
+		"same.txt":       "unchanged content",
+		"changed.txt":    "hello world",
+		"spacing.txt":    "a  b\n",
+		"sub/nested.txt": "foo bar",
+		"only-old.txt":   "gone",
+	})
+	writeFiles(t, dir2, map[string]string{
+		"same.txt":       "unchanged content",
+		"changed.txt":    "hello universe",
+		"spacing.txt":    "a b",
+		"sub/nested.txt": "foo baz",
+		"only-new.txt":   "added",
+	})
+	// Symlinks are not followed, so a link to a changed file is not diffed
+	if err := os.Symlink(filepath.Join(dir2, "changed.txt"), filepath.Join(dir2, "link.txt")); err != nil {
+		t.Logf("symlinks unsupported: %v", err)
+	}
+
+	fmtOpts := FormatOptions{StartDelete: "[-", StopDelete: "-]", StartInsert: "{+", StopInsert: "+}"}
+	diffs, err := DiffDirectories(dir1, dir2, DefaultOptions(), fmtOpts)
+	if err != nil {
+		t.Fatalf("DiffDirectories() error = %v", err)
+	}
+
+	type summary struct {
+		Path           string
+		Added, Deleted bool
+		Formatted      string
+	}
+	var got []summary
+	for _, d := range diffs {
+		got = append(got, summary{d.Path, d.Added, d.Deleted, d.Result.Formatted})
+	}
+	want := []summary{
+		{"changed.txt", false, false, "hello [-world-] {+universe+}"},
+		{"only-new.txt", true, false, "{+added+}"},
+		{"only-old.txt", false, true, "[-gone-]"},
+		{filepath.Join("sub", "nested.txt"), false, false, "foo [-bar-] {+baz+}"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffDirectories() =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestDiffDirectoriesMissing(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := DiffDirectories(dir, filepath.Join(dir, "missing"), DefaultOptions(), FormatOptions{}); err == nil {
+		t.Error("DiffDirectories() expected error for missing directory")
+	}
+}
+
+func TestDiffDirectoriesWith(t *testing.T) {
+	dir1 := filepath.Join(t.TempDir(), "old")
+	dir2 := filepath.Join(t.TempDir(), "new")
+	writeFiles(t, dir1, map[string]string{"a.txt": "HELLO WORLD", "b.txt": "same"})
+	writeFiles(t, dir2, map[string]string{"a.txt": "hello there", "b.txt": "SAME"})
+
+	// Texts are compared as read returns them
+	lower := func(path string) (string, bool, error) {
+		text, binary, err := readText(path)
+		return strings.ToLower(text), binary, err
+	}
+	fmtOpts := FormatOptions{StartDelete: "[-", StopDelete: "-]", StartInsert: "{+", StopInsert: "+}"}
+	diffs, err := DiffDirectoriesWith(dir1, dir2, lower, DefaultOptions(), fmtOpts)
+	if err != nil {
+		t.Fatalf("DiffDirectoriesWith() error = %v", err)
+	}
+	if len(diffs) != 1 || diffs[0].Path != "a.txt" || diffs[0].Result.Formatted != "hello [-world-] {+there+}" {
+		t.Errorf("DiffDirectoriesWith() = %+v, want only a.txt with \"hello [-world-] {+there+}\"", diffs)
+	}
+}
+
+func TestDiffDirectoriesBinary(t *testing.T) {
+	dir1 := filepath.Join(t.TempDir(), "old")
+	dir2 := filepath.Join(t.TempDir(), "new")
+	writeFiles(t, dir1, map[string]string{"same.bin": "a\x00b", "changed.bin": "a\x00b", "text.txt": "hello"})
+	writeFiles(t, dir2, map[string]string{"same.bin": "a\x00b", "changed.bin": "a\x00c", "text.txt": "hello\x00"})
+
+	diffs, err := DiffDirectories(dir1, dir2, DefaultOptions(), FormatOptions{})
+	if err != nil {
+		t.Fatalf("DiffDirectories() error = %v", err)
+	}
+	want := []FileDiff{
+		{Path: "changed.bin", Binary: true},
+		{Path: "text.txt", Binary: true},
+	}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Errorf("DiffDirectories() =\n%+v\nwant\n%+v", diffs, want)
+	}
+}
+
+func TestCompareDirectoriesWith(t *testing.T) {
+	dir1 := filepath.Join(t.TempDir(), "old")
+	dir2 := filepath.Join(t.TempDir(), "new")
+	writeFiles(t, dir1, map[string]string{"changed.txt": "hello world", "spacing.txt": "a  b", "only-old.txt": "gone", "data.bin": "a\x00b"})
+	writeFiles(t, dir2, map[string]string{"changed.txt": "hello there", "spacing.txt": "a b", "only-new.txt": "", "data.bin": "a\x00c"})
+
+	diffs, err := CompareDirectoriesWith(dir1, dir2, readText, DefaultOptions())
+	if err != nil {
+		t.Fatalf("CompareDirectoriesWith() error = %v", err)
+	}
+	want := []FileDiff{
+		{Path: "changed.txt"},
+		{Path: "data.bin", Binary: true},
+		{Path: "only-new.txt", Added: true},
+		{Path: "only-old.txt", Deleted: true},
+	}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Errorf("CompareDirectoriesWith() =\n%+v\nwant\n%+v", diffs, want)
+	}
+}
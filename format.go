@@ -2,7 +2,10 @@ package tokendiff
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // FormatOptions configures diff output formatting.
@@ -23,6 +26,14 @@ type FormatOptions struct {
 	// Default: "+}"
 	StopInsert string
 
+	// StartMove and StopMove mark text that DetectTokenMoves found moved,
+	// where it was deleted and where it was inserted, in
+	// FormatDiffResultAdvanced. If both are empty, moved text is marked as
+	// deleted and inserted text.
+	// Default: "[~" and "~]"
+	StartMove string
+	StopMove  string
+
 	// NoDeleted, when true, suppresses deleted tokens from output.
 	NoDeleted bool
 
@@ -44,6 +55,16 @@ type FormatOptions struct {
 	// Example: "\033[32m" for green
 	InsertColor string
 
+	// MoveColor is the ANSI escape sequence for moved text color, used
+	// instead of StartMove and StopMove with UseColor. Empty colors moved
+	// text as deleted and inserted text.
+	// Default: ANSIMoveColor
+	MoveColor string
+
+	// CommonColor is the ANSI escape sequence for unchanged text color.
+	// Empty (the default) leaves unchanged text uncolored.
+	CommonColor string
+
 	// ColorReset is the ANSI escape sequence to reset colors.
 	// Default: "\033[0m"
 	ColorReset string
@@ -59,27 +80,174 @@ type FormatOptions struct {
 	// AggregateChanges, when true, combines adjacent changes of the same type.
 	AggregateChanges bool
 
+	// AggregateMinRun is the shortest run of same-type diffs that
+	// AggregateChanges combines; shorter runs are kept as individual
+	// tokens. Used by FormatDiffsAdvanced. Default: 1, which combines
+	// every run; values below 1 are treated as 1.
+	AggregateMinRun int
+
 	// LessMode uses overstrike underlining for deleted text (for less -r).
 	LessMode bool
 
+	// LessModeANSI keeps color output for less -R: a colored change that
+	// spans lines is cleared to the end of each line with ClearToEOL and
+	// reset there, then reopened on the next line, so paging does not let
+	// color bleed. It applies with UseColor; LessMode takes precedence.
+	LessModeANSI bool
+
 	// PrinterMode uses overstrike bold for inserted text (for printing).
 	PrinterMode bool
 
+	// UnicodeStrikethrough marks deleted text with a combining long stroke
+	// overlay (U+0336) and inserted text with a combining low line (U+0332)
+	// on each character, instead of markers or colors. Unlike the overstrike
+	// modes, this renders in plain-text contexts such as chat and email.
+	UnicodeStrikethrough bool
+
 	// MatchContext is the minimum number of matching words between changes.
 	// Equal tokens sandwiched between changes with fewer than this many
 	// matches are converted to Delete+Insert pairs. 0 disables this feature.
 	MatchContext int
 
+	// Transpositions, when true, shows two swapped adjacent tokens as a
+	// single change. See DetectTranspositions.
+	Transpositions bool
+
 	// ShowLineNumbers enables dual line number display (old:new format).
 	ShowLineNumbers bool
 
 	// LineNumWidth is the minimum width for line numbers. 0 means auto-calculate.
 	LineNumWidth int
 
+	// LineNumbersOnChangesOnly, with ShowLineNumbers, shows the old:new
+	// prefix only on lines containing changes. Unchanged lines keep only the
+	// ":" separator, padded to the same width, so text stays aligned.
+	LineNumbersOnChangesOnly bool
+
+	// LineNumberSide selects the line numbers ShowLineNumbers shows: old
+	// and new (the default), or only the old or only the new file's, in a
+	// single narrower column.
+	LineNumberSide LineNumberSide
+
 	// HeuristicSpacing uses NeedsSpaceBefore/After heuristics for spacing
 	// when PreserveWhitespace is false. When true, spaces are not tokens and
 	// spacing is determined heuristically.
 	HeuristicSpacing bool
+
+	// RefineTokens, when true, shows a single deleted token replaced by a
+	// single inserted token as a character-level diff (see CharacterDiff),
+	// so "getData" -> "setData" highlights only "g" -> "s". Pairs with no
+	// characters in common are shown whole. Used by FormatDiffResultAdvanced.
+	RefineTokens bool
+
+	// GraphemeMode, with RefineTokens, diffs the replaced tokens by grapheme
+	// cluster (see GraphemeDiff) instead of by rune, so an emoji sequence
+	// such as "👩\u200d💻", or a letter with combining accents, is highlighted
+	// whole or not at all.
+	GraphemeMode bool
+
+	// LowercaseOutput lowercases all emitted tokens, changed and unchanged.
+	// Only the rendered text is affected, not the diff itself, which makes
+	// output stable for hashing or comparison regardless of input casing.
+	LowercaseOutput bool
+
+	// ContextSeparator is the line written between two groups of lines that
+	// are not adjacent, when only changes and their context are shown, as
+	// by FormatWithContext. Empty writes no separator line.
+	// Default: "---"
+	ContextSeparator string
+
+	// ContextPattern, when non-empty, is a regular expression matching the
+	// first line of a block, such as "^func " for Go functions.
+	// FormatWithContext, RenderLineDiff, and RenderLineDiffWithNumbers then
+	// show every block with a change in it, as FilterWithContextRegex
+	// selects, instead of contextLines lines around each change. An invalid
+	// pattern is ignored.
+	ContextPattern string
+
+	// ShowLineStats, when true, appends each changed line's deleted and
+	// inserted word counts from LineDiffResult.Stats, as "(-2 +3)", in
+	// RenderLineDiff and RenderLineDiffWithNumbers.
+	ShowLineStats bool
+
+	// ChangeMarker is the marker column RenderLineDiff writes before each
+	// changed line, colored when UseColor. Empty uses the default.
+	// Default: "| "
+	ChangeMarker string
+
+	// EqualMarker is the marker column RenderLineDiff writes before each
+	// unchanged line. Empty uses spaces as wide as ChangeMarker, so the
+	// line numbers stay aligned.
+	// Default: ""
+	EqualMarker string
+
+	// CollapseContext, when positive, replaces each unchanged stretch of
+	// more than this many characters, measured from the token positions,
+	// with CollapsePlaceholder, so that long unchanged text between changes
+	// is hidden as -C hides unchanged lines in line mode. Used by
+	// FormatDiffResultAdvanced. 0 shows all unchanged text.
+	CollapseContext int
+
+	// CollapsePlaceholder is the text written in place of a stretch
+	// collapsed by CollapseContext. Its first "%d" is replaced with the
+	// number of characters hidden; it is not otherwise a format string, so
+	// other "%" characters are written as they are. Empty uses the default.
+	// Default: "[... %d chars unchanged ...]"
+	CollapsePlaceholder string
+
+	// KeepDiffPrefixes, when true, makes ProcessUnifiedDiff keep the lines
+	// of each hunk: context lines keep their " " prefix, and changed lines
+	// are written as the old lines prefixed "-" with deleted words marked,
+	// then the new lines prefixed "+" with inserted words marked. With
+	// UseColor, the prefixes are colored. Otherwise each change is written
+	// once, as a word diff without prefixes.
+	KeepDiffPrefixes bool
+
+	// EmitUnified, when true, makes ProcessUnifiedDiff write a unified diff
+	// that diff tools can still parse: as with KeepDiffPrefixes, but the
+	// prefixes are never colored and "\ No newline at end of file" markers
+	// are kept, so only the changed words within lines differ from the
+	// input.
+	EmitUnified bool
+
+	// NoNewlineNote, when true, makes DiffWholeFiles end its output with a
+	// "\ No newline at end of old file" line, or "new file", when only the
+	// other text ends with a newline, as diff -u marks the line.
+	NoNewlineNote bool
+
+	// TabWidth, when positive, expands tabs in the leading whitespace of
+	// unchanged text to spaces, to tab stops every TabWidth columns, so
+	// indentation lines up after line-number columns and markers. Tabs in
+	// changed text, and after the first non-whitespace character, are kept.
+	// Used by FormatDiffResultAdvanced and DiffLineByLine. 0 keeps tabs.
+	TabWidth int
+
+	// WrapWidth, when positive, breaks output lines that would be longer
+	// than this many columns at token boundaries. A changed run broken
+	// across lines has its markers or color repeated on each line, as with
+	// RepeatMarkers. Markers count toward the width; color sequences do
+	// not, and wide runes count as VisibleWidth measures them. A single
+	// token wider than WrapWidth is not split. Used by
+	// FormatDiffsAdvanced without line numbers. 0 disables wrapping.
+	WrapWidth int
+
+	// JoinReplacements, when true, writes inserted text directly after the
+	// deleted text it replaces, without the whitespace between them, as
+	// git diff --color-words does: "[-old-]{+new+}" rather than
+	// "[-old-] {+new+}". Whitespace containing a line break is still
+	// written.
+	JoinReplacements bool
+
+	// HighlightTrailingWS, when true with UseColor, writes the trailing
+	// spaces and tabs of each new line that is not also an old line, such
+	// as a line that gained trailing whitespace, between TrailingWSColor
+	// and ColorReset, so they can be seen. Whitespace on lines kept as they
+	// were is not highlighted. Used by FormatDiffResultAdvanced.
+	HighlightTrailingWS bool
+
+	// TrailingWSColor is the ANSI escape sequence for trailing whitespace
+	// with HighlightTrailingWS. Default: "\033[41m" (red background)
+	TrailingWSColor string
 }
 
 // ANSI escape code constants
@@ -88,7 +256,10 @@ const (
 	ANSIClearEOL    = "\033[K"
 	ANSIDeleteColor = "\033[0;31;1m" // bold red
 	ANSIInsertColor = "\033[0;32;1m" // bold green
+	ANSIChangeColor = "\033[0;33;1m" // bold yellow, for changed line markers
+	ANSIMoveColor   = "\033[0;36;1m" // bold cyan, for moved line markers and moved text
 	ANSIBold        = "\033[1m"
+	ANSITrailingWS  = "\033[41m" // red background, for trailing whitespace
 )
 
 // ForegroundColors maps color names to ANSI foreground escape codes.
@@ -131,7 +302,9 @@ var BackgroundColors = map[string]string{
 	"brightwhite":   "\033[107m",
 }
 
-// ColorNames returns a list of all available color names.
+// ColorNames returns a list of all available color names. Besides these,
+// ParseColor and ColorCode accept xterm-256 palette indices as "color0"
+// through "color255" and truecolor hex as "#RRGGBB" or "#RGB".
 func ColorNames() []string {
 	return []string{
 		"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white",
@@ -144,9 +317,14 @@ func ColorNames() []string {
 // The spec can be:
 //   - A single color name: "red" -> foreground red
 //   - Foreground:background: "red:white" -> red text on white background
+//   - Hex RGB colors in either position: "#ff8800" or "#000:#fff", emitted as
+//     24-bit truecolor sequences
+//   - xterm-256 palette indices in either position: "color196" or
+//     "color196:color21"
 //   - Empty string returns empty string (no color)
 //
-// Returns an error if the color name is not recognized.
+// Returns an error if the color name is not recognized, a hex color is
+// malformed, or a palette index is not a number from 0 to 255.
 func ParseColor(spec string) (string, error) {
 	spec = strings.TrimSpace(spec)
 	if spec == "" {
@@ -159,7 +337,10 @@ func ParseColor(spec string) (string, error) {
 	var result string
 
 	if fgName != "" {
-		fg, ok := ForegroundColors[fgName]
+		fg, ok, err := lookupColor(fgName, ForegroundColors, 38)
+		if err != nil {
+			return "", err
+		}
 		if !ok {
 			return "", fmt.Errorf("unknown color: %s", fgName)
 		}
@@ -169,7 +350,10 @@ func ParseColor(spec string) (string, error) {
 	if len(parts) > 1 {
 		bgName := strings.ToLower(strings.TrimSpace(parts[1]))
 		if bgName != "" {
-			bg, ok := BackgroundColors[bgName]
+			bg, ok, err := lookupColor(bgName, BackgroundColors, 48)
+			if err != nil {
+				return "", err
+			}
 			if !ok {
 				return "", fmt.Errorf("unknown background color: %s", bgName)
 			}
@@ -180,6 +364,66 @@ func ParseColor(spec string) (string, error) {
 	return result, nil
 }
 
+// lookupColor resolves a color name, "#" hex spec, or "colorN" palette index
+// to an escape sequence. Names are looked up in table; hex specs and palette
+// indices produce a truecolor or 256-color sequence with the given SGR
+// selector (38 for foreground, 48 for background). The bool is false for an
+// unknown name; the error is set for a malformed hex spec or palette index.
+func lookupColor(name string, table map[string]string, selector int) (string, bool, error) {
+	if strings.HasPrefix(name, "#") {
+		r, g, b, err := parseHexColor(name)
+		if err != nil {
+			return "", false, err
+		}
+		return fmt.Sprintf("\033[%d;2;%d;%d;%dm", selector, r, g, b), true, nil
+	}
+	if strings.HasPrefix(name, "color") {
+		n, err := parsePaletteIndex(name)
+		if err != nil {
+			return "", false, err
+		}
+		return fmt.Sprintf("\033[%d;5;%dm", selector, n), true, nil
+	}
+	code, ok := table[name]
+	return code, ok, nil
+}
+
+// parsePaletteIndex parses "colorN" into the xterm-256 palette index N.
+func parsePaletteIndex(spec string) (uint8, error) {
+	digits := strings.TrimPrefix(spec, "color")
+	n, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid palette color %q: %q is not a number", spec, digits)
+	}
+	if n > 255 {
+		return 0, fmt.Errorf("invalid palette color %q: index must be 0-255", spec)
+	}
+	return uint8(n), nil
+}
+
+// parseHexColor parses "#RRGGBB" or the shorthand "#RGB" into its red,
+// green, and blue components.
+func parseHexColor(spec string) (uint8, uint8, uint8, error) {
+	digits := strings.TrimPrefix(spec, "#")
+	if len(digits) != 3 && len(digits) != 6 {
+		return 0, 0, 0, fmt.Errorf("invalid hex color %q: want #RGB or #RRGGBB", spec)
+	}
+	var rgb [3]uint8
+	width := len(digits) / 3
+	for i := range rgb {
+		part := digits[i*width : (i+1)*width]
+		n, err := strconv.ParseUint(part, 16, 8)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid hex color %q: %q is not hexadecimal", spec, part)
+		}
+		if width == 1 {
+			n *= 0x11
+		}
+		rgb[i] = uint8(n)
+	}
+	return rgb[0], rgb[1], rgb[2], nil
+}
+
 // ParseColorSpec parses a color specification for diff output.
 // The format is: "delete_color,insert_color" where each color can be
 // "fg" or "fg:bg" (e.g., "red,green" or "red:white,green:black").
@@ -209,10 +453,11 @@ func ParseColorSpec(spec string) (deleteColor, insertColor string, err error) {
 }
 
 // ColorCode builds an ANSI escape sequence from component parts.
-// fg is the foreground color name (or empty for default).
-// bg is the background color name (or empty for none).
+// fg is the foreground color name, "colorN", or "#RRGGBB" (or empty for default).
+// bg is the background color name, "colorN", or "#RRGGBB" (or empty for none).
 // bold adds the bold attribute if true.
-// Returns an error if any color name is not recognized.
+// Returns an error if any color name is not recognized, a hex color is
+// malformed, or a palette index is out of range.
 func ColorCode(fg, bg string, bold bool) (string, error) {
 	var result string
 
@@ -221,7 +466,10 @@ func ColorCode(fg, bg string, bold bool) (string, error) {
 	}
 
 	if fg != "" {
-		fgCode, ok := ForegroundColors[strings.ToLower(fg)]
+		fgCode, ok, err := lookupColor(strings.ToLower(fg), ForegroundColors, 38)
+		if err != nil {
+			return "", err
+		}
 		if !ok {
 			return "", fmt.Errorf("unknown foreground color: %s", fg)
 		}
@@ -229,7 +477,10 @@ func ColorCode(fg, bg string, bold bool) (string, error) {
 	}
 
 	if bg != "" {
-		bgCode, ok := BackgroundColors[strings.ToLower(bg)]
+		bgCode, ok, err := lookupColor(strings.ToLower(bg), BackgroundColors, 48)
+		if err != nil {
+			return "", err
+		}
 		if !ok {
 			return "", fmt.Errorf("unknown background color: %s", bg)
 		}
@@ -239,22 +490,60 @@ func ColorCode(fg, bg string, bold bool) (string, error) {
 	return result, nil
 }
 
+// DefaultContextSeparator is the default FormatOptions.ContextSeparator.
+const DefaultContextSeparator = "---"
+
+// DefaultCollapsePlaceholder is the default FormatOptions.CollapsePlaceholder.
+const DefaultCollapsePlaceholder = "[... %d chars unchanged ...]"
+
+// DefaultChangeMarker is the default FormatOptions.ChangeMarker.
+const DefaultChangeMarker = "| "
+
 // DefaultFormatOptions returns FormatOptions with default settings.
 func DefaultFormatOptions() FormatOptions {
 	return FormatOptions{
-		StartDelete:      "[-",
-		StopDelete:       "-]",
-		StartInsert:      "{+",
-		StopInsert:       "+}",
-		ColorReset:       ANSIReset,
-		ClearToEOL:       ANSIClearEOL,
-		DeleteColor:      ANSIDeleteColor,
-		InsertColor:      ANSIInsertColor,
-		AggregateChanges: true,
-		HeuristicSpacing: true,
+		StartDelete:         "[-",
+		StopDelete:          "-]",
+		StartInsert:         "{+",
+		StopInsert:          "+}",
+		StartMove:           "[~",
+		StopMove:            "~]",
+		ColorReset:          ANSIReset,
+		ClearToEOL:          ANSIClearEOL,
+		DeleteColor:         ANSIDeleteColor,
+		InsertColor:         ANSIInsertColor,
+		MoveColor:           ANSIMoveColor,
+		AggregateChanges:    true,
+		AggregateMinRun:     1,
+		HeuristicSpacing:    true,
+		ContextSeparator:    DefaultContextSeparator,
+		CollapsePlaceholder: DefaultCollapsePlaceholder,
+		ChangeMarker:        DefaultChangeMarker,
 	}
 }
 
+// GitColorWords returns FormatOptions that render a diff as
+// git diff --color-words does: no markers, deleted text in red and inserted
+// text in green, whitespace taken from the inputs by
+// FormatDiffResultAdvanced, and the deleted words of each change written
+// whole before its inserted words, with JoinReplacements set so nothing
+// comes between them.
+func GitColorWords() FormatOptions {
+	opts := DefaultFormatOptions()
+	opts.StartDelete, opts.StopDelete = "", ""
+	opts.StartInsert, opts.StopInsert = "", ""
+	opts.UseColor = true
+	opts.DeleteColor = ForegroundColors["red"]
+	opts.InsertColor = ForegroundColors["green"]
+	opts.ColorReset = gitColorReset
+	opts.AggregateChanges = true
+	opts.JoinReplacements = true
+	return opts
+}
+
+// gitColorReset is the reset sequence git writes after colored text.
+const gitColorReset = "\033[m"
+
 // NeedsSpaceBefore returns true if a space should precede this token
 // when formatting diff output. Used internally by FormatDiff.
 func NeedsSpaceBefore(token string) bool {
@@ -284,6 +573,39 @@ func NeedsSpaceAfter(token string) bool {
 	return !strings.ContainsRune("([{<\"'/\\.", last)
 }
 
+// ReconstructOld returns the old text represented by diffs: its Equal and
+// Delete tokens, joined with a space where NeedsSpaceAfter and
+// NeedsSpaceBefore call for one, as FormatDiff joins tokens. Comparing the
+// result, or its tokens, with the input checks that a diff represents it.
+// Other whitespace, such as line breaks, is only kept where the tokens
+// include it.
+func ReconstructOld(diffs []Diff) string {
+	return reconstructText(diffs, Delete)
+}
+
+// ReconstructNew returns the new text represented by diffs: its Equal and
+// Insert tokens, joined as ReconstructOld joins them.
+func ReconstructNew(diffs []Diff) string {
+	return reconstructText(diffs, Insert)
+}
+
+// reconstructText joins the Equal tokens of diffs and those of type side.
+func reconstructText(diffs []Diff, side Operation) string {
+	var sb strings.Builder
+	var prev string
+	for _, d := range diffs {
+		if d.Type != Equal && d.Type != side {
+			continue
+		}
+		if sb.Len() > 0 && NeedsSpaceAfter(prev) && NeedsSpaceBefore(d.Token) {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(d.Token)
+		prev = d.Token
+	}
+	return sb.String()
+}
+
 // FormatDiff returns a human-readable representation of the diff.
 // Deleted tokens are wrapped in [-...-] and inserted tokens in {+...+}.
 func FormatDiff(diffs []Diff) string {
@@ -367,16 +689,17 @@ func FormatDiffWithOptions(diffs []Diff, opts FormatOptions) string {
 			}
 		}
 
+		token := outputCase(d.Token, opts)
 		switch d.Type {
 		case Equal:
-			sb.WriteString(d.Token)
+			sb.WriteString(token)
 		case Delete:
 			sb.WriteString(opts.StartDelete)
-			sb.WriteString(d.Token)
+			sb.WriteString(token)
 			sb.WriteString(opts.StopDelete)
 		case Insert:
 			sb.WriteString(opts.StartInsert)
-			sb.WriteString(d.Token)
+			sb.WriteString(token)
 			sb.WriteString(opts.StopInsert)
 		}
 
@@ -386,8 +709,18 @@ func FormatDiffWithOptions(diffs []Diff, opts FormatOptions) string {
 	return sb.String()
 }
 
+// outputCase returns text as it should be rendered, lowercased when
+// LowercaseOutput is set.
+func outputCase(text string, opts FormatOptions) string {
+	if opts.LowercaseOutput {
+		return strings.ToLower(text)
+	}
+	return text
+}
+
 // formatDeleteToken formats a Delete token with appropriate markers/colors.
 func formatDeleteToken(token string, opts FormatOptions) string {
+	token = outputCase(token, opts)
 	if opts.NoDeleted || token == "\n" {
 		if opts.NoDeleted {
 			return ""
@@ -397,11 +730,16 @@ func formatDeleteToken(token string, opts FormatOptions) string {
 	if opts.LessMode || opts.PrinterMode {
 		return OverstrikeUnderline(token)
 	}
+	if opts.UnicodeStrikethrough {
+		return CombiningStrikethrough(token)
+	}
 	if opts.ShowLineNumbers && opts.UseColor {
 		return token
 	}
 	if opts.UseColor {
-		if opts.RepeatMarkers && strings.Contains(token, "\n") {
+		if opts.LessModeANSI && strings.Contains(token, "\n") {
+			token = strings.ReplaceAll(token, "\n", opts.ClearToEOL+opts.ColorReset+"\n"+opts.DeleteColor)
+		} else if opts.RepeatMarkers && strings.Contains(token, "\n") {
 			token = strings.ReplaceAll(token, "\n", opts.ColorReset+"\n"+opts.DeleteColor)
 		}
 		return opts.DeleteColor + token + opts.ColorReset
@@ -414,6 +752,7 @@ func formatDeleteToken(token string, opts FormatOptions) string {
 
 // formatInsertToken formats an Insert token with appropriate markers/colors.
 func formatInsertToken(token string, opts FormatOptions) string {
+	token = outputCase(token, opts)
 	if opts.NoInserted || token == "\n" {
 		if opts.NoInserted {
 			return ""
@@ -423,11 +762,14 @@ func formatInsertToken(token string, opts FormatOptions) string {
 	if opts.LessMode || opts.PrinterMode {
 		return OverstrikeBold(token)
 	}
+	if opts.UnicodeStrikethrough {
+		return CombiningUnderline(token)
+	}
 	if opts.ShowLineNumbers && opts.UseColor {
 		return token
 	}
 	if opts.UseColor {
-		if opts.RepeatMarkers && strings.Contains(token, "\n") {
+		if (opts.RepeatMarkers || opts.LessModeANSI) && strings.Contains(token, "\n") {
 			token = strings.ReplaceAll(token, "\n", opts.ClearToEOL+opts.ColorReset+"\n"+opts.InsertColor)
 		}
 		return opts.InsertColor + token + opts.ColorReset
@@ -438,6 +780,23 @@ func formatInsertToken(token string, opts FormatOptions) string {
 	return opts.StartInsert + token + opts.StopInsert
 }
 
+// formatCommonText wraps unchanged text in CommonColor when color output is
+// enabled, after applying LowercaseOutput. Each line is wrapped separately
+// so line prefixes stay uncolored.
+func formatCommonText(text string, opts FormatOptions) string {
+	text = outputCase(text, opts)
+	if !opts.UseColor || opts.CommonColor == "" || text == "" {
+		return text
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = opts.CommonColor + line + opts.ColorReset
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
 // formatNonEqualToken formats a non-Equal token with markers and colors.
 func formatNonEqualToken(d Diff, opts FormatOptions) string {
 	switch d.Type {
@@ -457,33 +816,173 @@ type diffFormatter struct {
 	currentLine        strings.Builder
 	colorState         Operation
 	prevLineEndedColor bool
+	lineChanged        bool // current line contains a Delete or Insert
+	lineOld, lineNew   bool // current line contains text of the old or the new side
 	oldLine            int
 	newLine            int
 	lastText1Pos       int
 	lastText2Pos       int
 	idx1               int
 	idx2               int
+	indentCols         int      // columns of leading whitespace on the current line
+	indentDone         bool     // the current line has content past its leading whitespace
+	newTrailingWS      []bool   // by line number in Text2, whether HighlightTrailingWS applies
+	movedOld           [][2]int // token ranges of result.Moves in Text1
+	movedNew           [][2]int // token ranges of result.Moves in Text2
 }
 
 // newDiffFormatter creates a new formatter for the given result and options.
 func newDiffFormatter(result DiffResult, opts FormatOptions) *diffFormatter {
-	return &diffFormatter{
+	f := &diffFormatter{
 		opts:       opts,
 		result:     result,
 		colorState: -1,
 		oldLine:    1,
 		newLine:    1,
 	}
+	if len(result.Moves) > 0 {
+		f.movedOld = movedSpans(result.Moves, Delete)
+		f.movedNew = movedSpans(result.Moves, Insert)
+	}
+	if opts.HighlightTrailingWS && opts.UseColor {
+		f.newTrailingWS = newTrailingWhitespace(result.Text1, result.Text2)
+	}
+	return f
+}
+
+// newTrailingWhitespace returns, indexed by line number in text2, whether
+// the line ends with spaces or tabs and is not also a line of text1.
+func newTrailingWhitespace(text1, text2 string) []bool {
+	oldLines := make(map[string]bool)
+	for _, line := range strings.Split(text1, "\n") {
+		oldLines[line] = true
+	}
+	lines := strings.Split(text2, "\n")
+	flagged := make([]bool, len(lines)+1)
+	for i, line := range lines {
+		trimmed := strings.TrimRight(line, " \t")
+		flagged[i+1] = trimmed != line && !oldLines[line]
+	}
+	return flagged
+}
+
+// highlightTrailingWS wraps the spaces and tabs at the end of the current
+// line in TrailingWSColor and ColorReset, if the line is a new line that
+// HighlightTrailingWS applies to. Called before a line break or the end of
+// the output is written. active is the type of the colored run the line
+// break is part of, whose color is written again after the reset; Equal or
+// -1 if no Delete or Insert color is active.
+func (f *diffFormatter) highlightTrailingWS(active Operation) {
+	if f.newLine >= len(f.newTrailingWS) || !f.newTrailingWS[f.newLine] {
+		return
+	}
+	line := f.currentLine.String()
+	trimmed := strings.TrimRight(line, " \t")
+	if trimmed == line {
+		return
+	}
+	color := f.opts.TrailingWSColor
+	if color == "" {
+		color = ANSITrailingWS
+	}
+	f.currentLine.Reset()
+	f.currentLine.WriteString(trimmed + color + line[len(trimmed):] + f.opts.ColorReset)
+	switch active {
+	case Delete:
+		f.currentLine.WriteString(f.opts.DeleteColor)
+	case Insert:
+		f.currentLine.WriteString(f.opts.InsertColor)
+	}
 }
 
-// linePrefix returns the line number prefix for the current position.
+// linePrefix returns the line number prefix for the line being finished at
+// the current position, and resets the per-line change tracking.
 func (f *diffFormatter) linePrefix() string {
+	changed := f.lineChanged
+	lineType := lineSides(f.lineOld, f.lineNew)
+	f.lineChanged, f.lineOld, f.lineNew = false, false, false
 	if !f.opts.ShowLineNumbers {
 		return ""
 	}
-	oldWidth := f.opts.LineNumWidth + 1
-	newWidth := f.opts.LineNumWidth + 2
-	return fmt.Sprintf("%*d:%-*d", oldWidth, f.oldLine, newWidth, f.newLine)
+	return lineNumberPrefix(f.oldLine, f.newLine, lineType, changed, f.opts)
+}
+
+// lineSides returns the type of a line with text of the old side, the new
+// side, or both: Delete, Insert, or Equal. A line with neither is Equal.
+func lineSides(old, new bool) Operation {
+	switch {
+	case old && !new:
+		return Delete
+	case new && !old:
+		return Insert
+	default:
+		return Equal
+	}
+}
+
+// lineNumberPrefix formats the old:new line number prefix for a line, or
+// with LineNumberSide only one side's number followed by ": ". lineType is
+// Delete for a line only in the old text and Insert for one only in the new
+// text; such a line gets no number for the side it is not on. With
+// LineNumbersOnChangesOnly, unchanged lines get only the separator.
+func lineNumberPrefix(oldLine, newLine int, lineType Operation, changed bool, opts FormatOptions) string {
+	oldWidth := opts.LineNumWidth + 1
+	newWidth := opts.LineNumWidth + 2
+	if opts.LineNumberSide != LineNumbersBoth {
+		line, missing := oldLine, lineType == Insert
+		if opts.LineNumberSide == LineNumbersNew {
+			line, missing = newLine, lineType == Delete
+		}
+		if missing || opts.LineNumbersOnChangesOnly && !changed {
+			return strings.Repeat(" ", oldWidth) + ": "
+		}
+		return fmt.Sprintf("%*d: ", oldWidth, line)
+	}
+	if opts.LineNumbersOnChangesOnly && !changed {
+		return strings.Repeat(" ", oldWidth) + ":" + strings.Repeat(" ", newWidth)
+	}
+	return fmt.Sprintf("%*d:%-*d", oldWidth, oldLine, newWidth, newLine)
+}
+
+// LineNumberSide selects which line numbers FormatOptions.ShowLineNumbers
+// shows.
+type LineNumberSide int
+
+const (
+	// LineNumbersBoth shows old and new line numbers, as "old:new". This
+	// is the default.
+	LineNumbersBoth LineNumberSide = iota
+
+	// LineNumbersOld shows only old line numbers.
+	LineNumbersOld
+
+	// LineNumbersNew shows only new line numbers.
+	LineNumbersNew
+)
+
+// String returns the side's name as accepted by ParseLineNumberSide.
+func (s LineNumberSide) String() string {
+	switch s {
+	case LineNumbersBoth:
+		return "both"
+	case LineNumbersOld:
+		return "old"
+	case LineNumbersNew:
+		return "new"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLineNumberSide returns the LineNumberSide named "both", "old", or
+// "new".
+func ParseLineNumberSide(name string) (LineNumberSide, bool) {
+	for _, s := range []LineNumberSide{LineNumbersBoth, LineNumbersOld, LineNumbersNew} {
+		if s.String() == name {
+			return s, true
+		}
+	}
+	return LineNumbersBoth, false
 }
 
 // writeContent writes content with line number tracking and color state management.
@@ -506,16 +1005,76 @@ func (f *diffFormatter) writeContent(content string, diffType Operation) {
 	}
 
 	for _, r := range content {
+		if diffType != Equal {
+			f.lineChanged = true
+		}
 		if r == '\n' {
 			f.flushLine(diffType)
-		} else {
-			f.currentLine.WriteRune(r)
+			continue
+		}
+		f.lineOld = f.lineOld || diffType != Insert
+		f.lineNew = f.lineNew || diffType != Delete
+		f.writeRune(r, diffType)
+	}
+}
+
+// writeRune writes r, which is not a newline, to the current line. With
+// TabWidth, a tab in the line's leading whitespace is written as spaces to
+// the next tab stop if it is unchanged text.
+func (f *diffFormatter) writeRune(r rune, diffType Operation) {
+	if f.opts.TabWidth > 0 && !f.indentDone {
+		switch {
+		case r == '\t' && diffType == Equal:
+			n := f.opts.TabWidth - f.indentCols%f.opts.TabWidth
+			f.currentLine.WriteString(strings.Repeat(" ", n))
+			f.indentCols += n
+			return
+		case r == ' ' && diffType == Equal:
+			f.indentCols++
+		default:
+			f.indentDone = true
+		}
+	}
+	f.currentLine.WriteRune(r)
+}
+
+// expandLeadingTabs expands the tabs in the leading whitespace of line to
+// spaces, to tab stops every width columns, as FormatOptions.TabWidth does.
+// A width of 0 or less returns line unchanged.
+func expandLeadingTabs(line string, width int) string {
+	if width <= 0 || !strings.Contains(line, "\t") {
+		return line
+	}
+	var sb strings.Builder
+	col := 0
+	for i, r := range line {
+		switch r {
+		case '\t':
+			n := width - col%width
+			sb.WriteString(strings.Repeat(" ", n))
+			col += n
+		case ' ':
+			sb.WriteRune(r)
+			col++
+		default:
+			sb.WriteString(line[i:])
+			return sb.String()
 		}
 	}
+	return sb.String()
+}
+
+// startLine resets the leading whitespace tracking for a new line.
+func (f *diffFormatter) startLine() {
+	f.indentCols = 0
+	f.indentDone = false
 }
 
 // flushLine finishes the current line and advances line numbers.
 func (f *diffFormatter) flushLine(diffType Operation) {
+	if diffType != Delete {
+		f.highlightTrailingWS(diffType)
+	}
 	thisLineEndedColored := false
 	if f.opts.ShowLineNumbers && f.opts.UseColor && f.colorState != -1 {
 		f.currentLine.WriteString(f.opts.ClearToEOL)
@@ -528,6 +1087,7 @@ func (f *diffFormatter) flushLine(diffType Operation) {
 	}
 	f.lines = append(f.lines, prefix+f.currentLine.String())
 	f.currentLine.Reset()
+	f.startLine()
 
 	f.prevLineEndedColor = thisLineEndedColored
 
@@ -559,6 +1119,7 @@ func (f *diffFormatter) skipCommonNewlines(diffs []Diff, runStart, runEnd int) {
 					f.lines = append(f.lines, f.linePrefix()+f.currentLine.String())
 					f.currentLine.Reset()
 				}
+				f.startLine()
 				f.oldLine++
 				f.newLine++
 			}
@@ -574,12 +1135,19 @@ func (f *diffFormatter) writeEqualFromPositions(runTokenCount int) {
 	}
 	endPos := f.result.Positions2[f.idx2+runTokenCount-1].End
 
+	gapStart := startPos
 	if f.lastText2Pos > 0 && startPos > f.lastText2Pos {
-		gap := f.result.Text2[f.lastText2Pos:startPos]
-		f.writeContent(gap, Equal)
+		gapStart = f.lastText2Pos
 	}
 
-	f.writeContent(f.result.Text2[startPos:endPos], Equal)
+	if f.opts.CollapseContext > 0 && utf8.RuneCountInString(f.result.Text2[gapStart:endPos]) > f.opts.CollapseContext {
+		f.writeCollapsed(f.result.Text2[gapStart:endPos])
+	} else {
+		if gapStart < startPos {
+			f.writeContent(f.result.Text2[gapStart:startPos], Equal)
+		}
+		f.writeContent(formatCommonText(f.result.Text2[startPos:endPos], f.opts), Equal)
+	}
 	f.lastText2Pos = endPos
 
 	// Also update lastText1Pos to prevent Delete gaps from re-outputting
@@ -590,6 +1158,19 @@ func (f *diffFormatter) writeEqualFromPositions(runTokenCount int) {
 	}
 }
 
+// writeCollapsed writes the CollapsePlaceholder for unchanged text hidden by
+// CollapseContext. Line numbers skip the hidden lines.
+func (f *diffFormatter) writeCollapsed(text string) {
+	placeholder := f.opts.CollapsePlaceholder
+	if placeholder == "" {
+		placeholder = DefaultCollapsePlaceholder
+	}
+	f.writeContent(strings.Replace(placeholder, "%d", strconv.Itoa(utf8.RuneCountInString(text)), 1), Equal)
+	hidden := strings.Count(text, "\n")
+	f.oldLine += hidden
+	f.newLine += hidden
+}
+
 // writeEqualTokensFallback writes Equal tokens with heuristic spacing.
 func (f *diffFormatter) writeEqualTokensFallback(diffs []Diff, runStart, runEnd int) {
 	for j := runStart; j < runEnd; j++ {
@@ -601,7 +1182,7 @@ func (f *diffFormatter) writeEqualTokensFallback(diffs []Diff, runStart, runEnd
 				f.writeContent(" ", Equal)
 			}
 		}
-		f.writeContent(diffs[j].Token, Equal)
+		f.writeContent(formatCommonText(diffs[j].Token, f.opts), Equal)
 	}
 }
 
@@ -669,13 +1250,14 @@ func (f *diffFormatter) processDeleteGap() {
 			} else {
 				f.currentLine.WriteRune('\n')
 			}
+			f.startLine()
 			f.oldLine++
 		} else {
 			if f.opts.ShowLineNumbers && f.opts.UseColor && f.colorState != -1 {
 				f.currentLine.WriteString(f.opts.ColorReset)
 				f.colorState = -1
 			}
-			f.currentLine.WriteRune(r)
+			f.writeRune(r, Equal)
 		}
 	}
 }
@@ -687,12 +1269,8 @@ func (f *diffFormatter) processDeleteRun(diffs []Diff, runStart, runEnd int) {
 	// Extract original text from text1
 	runLen := runEnd - runStart
 	if f.idx1 < len(f.result.Positions1) && f.idx1+runLen-1 < len(f.result.Positions1) {
-		startPos := f.result.Positions1[f.idx1].Start
-		endPos := f.result.Positions1[f.idx1+runLen-1].End
-		original := f.result.Text1[startPos:endPos]
-		formatted := formatNonEqualToken(Diff{Type: Delete, Token: original}, f.opts)
-		f.writeContent(formatted, Delete)
-		f.lastText1Pos = endPos
+		f.writeChangedText(Delete, f.result.Text1, f.result.Positions1, f.movedOld, f.idx1, runLen)
+		f.lastText1Pos = f.result.Positions1[f.idx1+runLen-1].End
 	} else {
 		for j := runStart; j < runEnd; j++ {
 			if j > runStart && NeedsSpaceAfter(diffs[j-1].Token) && NeedsSpaceBefore(diffs[j].Token) {
@@ -704,8 +1282,44 @@ func (f *diffFormatter) processDeleteRun(diffs []Diff, runStart, runEnd int) {
 	}
 }
 
-// processInsertGap handles the gap before an Insert run.
-func (f *diffFormatter) processInsertGap() {
+// writeChangedText writes tokens [idx, idx+n) of text, with their original
+// spacing, as deleted or inserted text, as op says. The parts of the run in
+// moved, token ranges of moved text in text, are formatted as moved, with
+// the spacing between parts written as is.
+func (f *diffFormatter) writeChangedText(op Operation, text string, positions []TokenPos, moved [][2]int, idx, n int) {
+	end := idx + n
+	for pos := idx; pos < end; {
+		partEnd, isMoved := end, false
+		for _, span := range moved {
+			if span[1] <= pos {
+				continue
+			}
+			if span[0] <= pos {
+				partEnd, isMoved = min(span[1], end), true
+			} else {
+				partEnd = min(span[0], end)
+			}
+			break
+		}
+
+		hidden := (op == Delete && f.opts.NoDeleted) || (op == Insert && f.opts.NoInserted)
+		if pos > idx && !hidden {
+			f.writeContent(text[positions[pos-1].End:positions[pos].Start], op)
+		}
+		part := text[positions[pos].Start:positions[partEnd-1].End]
+		if isMoved {
+			f.writeContent(formatMovedToken(part, op, f.opts), op)
+		} else {
+			f.writeContent(formatNonEqualToken(Diff{Type: op, Token: part}, f.opts), op)
+		}
+		pos = partEnd
+	}
+}
+
+// processInsertGap handles the gap before an Insert run. With
+// JoinReplacements, a gap without a line break after a Delete run is
+// skipped.
+func (f *diffFormatter) processInsertGap(afterDelete bool) {
 	if f.idx2 >= len(f.result.Positions2) {
 		return
 	}
@@ -726,8 +1340,13 @@ func (f *diffFormatter) processInsertGap() {
 	}
 
 	gap := f.result.Text2[gapStart:insStart]
+	if afterDelete && f.opts.JoinReplacements && !strings.Contains(gap, "\n") {
+		f.lastText2Pos = insStart
+		return
+	}
 	for _, r := range gap {
 		if r == '\n' {
+			f.highlightTrailingWS(f.colorState)
 			if f.opts.ShowLineNumbers {
 				thisLineEndedColored := false
 				if f.opts.UseColor && f.colorState != -1 {
@@ -751,30 +1370,27 @@ func (f *diffFormatter) processInsertGap() {
 			} else {
 				f.currentLine.WriteRune('\n')
 			}
+			f.startLine()
 			f.newLine++
 		} else {
 			if f.opts.ShowLineNumbers && f.opts.UseColor && f.colorState != -1 {
 				f.currentLine.WriteString(f.opts.ColorReset)
 				f.colorState = -1
 			}
-			f.currentLine.WriteRune(r)
+			f.writeRune(r, Equal)
 		}
 	}
 }
 
 // processInsertRun handles a run of consecutive Insert diffs.
 func (f *diffFormatter) processInsertRun(diffs []Diff, runStart, runEnd int) {
-	f.processInsertGap()
+	f.processInsertGap(runStart > 0 && diffs[runStart-1].Type == Delete)
 
 	// Extract original text from text2
 	runLen := runEnd - runStart
 	if f.idx2 < len(f.result.Positions2) && f.idx2+runLen-1 < len(f.result.Positions2) {
-		startPos := f.result.Positions2[f.idx2].Start
-		endPos := f.result.Positions2[f.idx2+runLen-1].End
-		original := f.result.Text2[startPos:endPos]
-		formatted := formatNonEqualToken(Diff{Type: Insert, Token: original}, f.opts)
-		f.writeContent(formatted, Insert)
-		f.lastText2Pos = endPos
+		f.writeChangedText(Insert, f.result.Text2, f.result.Positions2, f.movedNew, f.idx2, runLen)
+		f.lastText2Pos = f.result.Positions2[f.idx2+runLen-1].End
 	} else {
 		for j := runStart; j < runEnd; j++ {
 			if j > runStart && NeedsSpaceAfter(diffs[j-1].Token) && NeedsSpaceBefore(diffs[j].Token) {
@@ -786,8 +1402,48 @@ func (f *diffFormatter) processInsertRun(diffs []Diff, runStart, runEnd int) {
 	}
 }
 
+// processRefinedPair writes a lone Delete at diffs[i] followed by a lone
+// Insert as a character-level diff, in place of the two whole tokens.
+// Returns false, writing nothing, if the pair is part of a larger change,
+// lacks positions, has a line break between the tokens in either text, or
+// has no characters in common.
+func (f *diffFormatter) processRefinedPair(diffs []Diff, i int) bool {
+	if i+1 >= len(diffs) || diffs[i+1].Type != Insert {
+		return false
+	}
+	if (i > 0 && diffs[i-1].Type != Equal) || (i+2 < len(diffs) && diffs[i+2].Type != Equal) {
+		return false
+	}
+	if f.idx1 >= len(f.result.Positions1) || f.idx2 >= len(f.result.Positions2) {
+		return false
+	}
+	pos1, pos2 := f.result.Positions1[f.idx1], f.result.Positions2[f.idx2]
+	if strings.Contains(f.result.Text1[min(f.lastText1Pos, pos1.Start):pos1.Start], "\n") ||
+		strings.Contains(f.result.Text2[min(f.lastText2Pos, pos2.Start):pos2.Start], "\n") {
+		return false
+	}
+	runs, ok := refinable(f.result.Text1[pos1.Start:pos1.End], f.result.Text2[pos2.Start:pos2.End], f.opts.GraphemeMode)
+	if !ok {
+		return false
+	}
+
+	f.processDeleteGap()
+	for _, d := range runs {
+		if d.Type == Equal {
+			f.writeContent(formatCommonText(d.Token, f.opts), Equal)
+		} else {
+			f.writeContent(formatNonEqualToken(d, f.opts), d.Type)
+		}
+	}
+	f.lastText1Pos = pos1.End
+	f.lastText2Pos = pos2.End
+	return true
+}
+
 // finalize completes the formatting and returns the result string.
 func (f *diffFormatter) finalize() string {
+	f.highlightTrailingWS(f.colorState)
+
 	// Reset color at end if still active
 	if f.opts.UseColor && f.colorState != -1 {
 		f.currentLine.WriteString(f.opts.ColorReset)
@@ -832,6 +1488,46 @@ func OverstrikeBold(text string) string {
 	return sb.String()
 }
 
+// CombiningStrikethrough returns text with a combining long stroke overlay
+// (U+0336) after each character, so it renders struck through in plain text.
+func CombiningStrikethrough(text string) string {
+	return addCombiningMark(text, '\u0336')
+}
+
+// CombiningUnderline returns text with a combining low line (U+0332) after
+// each character, so it renders underlined in plain text.
+func CombiningUnderline(text string) string {
+	return addCombiningMark(text, '\u0332')
+}
+
+// OSC8Link returns label as an OSC 8 terminal hyperlink to url, which
+// terminals that support it show as clickable text and others show as
+// plain label. VisibleWidth gives it the width of label.
+func OSC8Link(url, label string) string {
+	return "\033]8;;" + url + "\033\\" + label + "\033]8;;\033\\"
+}
+
+// addCombiningMark appends mark to each character of text. The mark follows
+// any combining marks already attached to a character, so accented letters
+// keep their accents, and control characters such as newlines are left bare.
+func addCombiningMark(text string, mark rune) string {
+	var sb strings.Builder
+	sb.Grow(len(text) * 3)
+	runes := []rune(text)
+	for i, r := range runes {
+		sb.WriteRune(r)
+		if unicode.IsControl(r) {
+			continue
+		}
+		if i+1 < len(runes) && unicode.Is(unicode.Mn, runes[i+1]) {
+			// Mark after the last combining mark of this character
+			continue
+		}
+		sb.WriteRune(mark)
+	}
+	return sb.String()
+}
+
 // formatToken formats a single diff token with markers and colors.
 func formatToken(d Diff, opts FormatOptions) string {
 	switch d.Type {
@@ -839,7 +1535,7 @@ func formatToken(d Diff, opts FormatOptions) string {
 		if opts.NoCommon {
 			return ""
 		}
-		return d.Token
+		return formatCommonText(d.Token, opts)
 	case Delete, Insert:
 		return formatNonEqualToken(d, opts)
 	}
@@ -862,14 +1558,27 @@ func needsHeuristicSpace(prevToken string, prevType Operation, d Diff) bool {
 	return NeedsSpaceAfter(prevToken) && NeedsSpaceBefore(d.Token)
 }
 
+// spaceBetween returns true if HeuristicSpacing calls for a space before d,
+// which JoinReplacements suppresses between a Delete and an Insert.
+func spaceBetween(prevToken string, prevType Operation, d Diff, opts FormatOptions) bool {
+	if !opts.HeuristicSpacing || (opts.JoinReplacements && prevType == Delete && d.Type == Insert) {
+		return false
+	}
+	return needsHeuristicSpace(prevToken, prevType, d)
+}
+
 // formatDiffsSimple formats diffs without line numbers.
 func formatDiffsSimple(diffs []Diff, opts FormatOptions) string {
+	if opts.WrapWidth > 0 {
+		return formatDiffsWrapped(diffs, opts)
+	}
+
 	var sb strings.Builder
 	var prevToken string
 	var prevType Operation = -1
 
 	for _, d := range diffs {
-		if opts.HeuristicSpacing && needsHeuristicSpace(prevToken, prevType, d) {
+		if spaceBetween(prevToken, prevType, d, opts) {
 			sb.WriteString(" ")
 		}
 		sb.WriteString(formatToken(d, opts))
@@ -879,39 +1588,149 @@ func formatDiffsSimple(diffs []Diff, opts FormatOptions) string {
 	return sb.String()
 }
 
+// formatDiffsWrapped formats diffs like formatDiffsSimple, breaking lines at
+// token boundaries to fit opts.WrapWidth. Spaces between tokens are held
+// back until the next token is placed, so a line never ends with the space
+// a break replaced. Words within a changed token (such as an aggregated run)
+// are also break points; the line break is inserted into the token before
+// formatting, and RepeatMarkers closes and reopens its markers around it.
+func formatDiffsWrapped(diffs []Diff, opts FormatOptions) string {
+	tokenOpts := opts
+	tokenOpts.RepeatMarkers = true
+
+	var sb strings.Builder
+	var prevToken string
+	var prevType Operation = -1
+	var pending string // whitespace to write before the next token
+	col := 0
+
+	for _, d := range diffs {
+		if spaceBetween(prevToken, prevType, d, opts) {
+			pending += " "
+		}
+		prevToken = d.Token
+		prevType = d.Type
+
+		// Whitespace tokens become break opportunities
+		if d.Type == Equal && d.Token != "" && strings.Trim(d.Token, " \t") == "" {
+			pending += d.Token
+			continue
+		}
+
+		if formatToken(d, opts) == "" {
+			continue
+		}
+
+		open, stop := markerWidths(d.Type, opts)
+		words := []string{d.Token}
+		if d.Type != Equal && !strings.Contains(d.Token, "\n") {
+			words = strings.Split(d.Token, " ")
+		}
+
+		// Break before the token if its first word does not fit
+		first := VisibleWidth(words[0])
+		if col > 0 && col+VisibleWidth(pending)+open+first+stop > opts.WrapWidth {
+			sb.WriteString("\n")
+			col = 0
+		} else {
+			sb.WriteString(pending)
+			col += VisibleWidth(pending)
+		}
+		pending = ""
+
+		// Break between the token's words where they do not fit
+		var token strings.Builder
+		token.WriteString(words[0])
+		col += open + first
+		for _, w := range words[1:] {
+			n := VisibleWidth(w)
+			if col+1+n+stop > opts.WrapWidth {
+				token.WriteString("\n")
+				col = open + n
+			} else {
+				token.WriteString(" ")
+				col += 1 + n
+			}
+			token.WriteString(w)
+		}
+		col += stop
+
+		if text := token.String(); text != d.Token {
+			sb.WriteString(formatToken(Diff{Type: d.Type, Token: text}, tokenOpts))
+		} else {
+			sb.WriteString(formatToken(d, opts))
+		}
+
+		// A token with its own line breaks was not split; measure its last line
+		if i := strings.LastIndex(d.Token, "\n"); i >= 0 {
+			col = open + VisibleWidth(d.Token[i+1:]) + stop
+		}
+	}
+	sb.WriteString(pending)
+	return sb.String()
+}
+
+// markerWidths returns the columns taken by the markers that open and close
+// a token of type op. Colors and overstrike modes take none.
+func markerWidths(op Operation, opts FormatOptions) (open, stop int) {
+	if opts.UseColor || opts.LessMode || opts.PrinterMode || opts.UnicodeStrikethrough {
+		return 0, 0
+	}
+	switch op {
+	case Delete:
+		return utf8.RuneCountInString(opts.StartDelete), utf8.RuneCountInString(opts.StopDelete)
+	case Insert:
+		return utf8.RuneCountInString(opts.StartInsert), utf8.RuneCountInString(opts.StopInsert)
+	}
+	return 0, 0
+}
+
 // formatDiffsWithLineNumbers formats diffs with line number tracking.
 func formatDiffsWithLineNumbers(diffs []Diff, opts FormatOptions) string {
 	var lines []string
 	var currentLine strings.Builder
 	oldLine := 1
 	newLine := 1
-	width := opts.LineNumWidth
+	lineChanged := false
+	lineOld, lineNew := false, false
 
-	linePrefix := func() string {
-		oldWidth := width + 1
-		newWidth := width + 2
-		return fmt.Sprintf("%*d:%-*d", oldWidth, oldLine, newWidth, newLine)
+	// The prefix is added when a line is finished, once it is known
+	// whether the line contains changes and text of which sides
+	finishLine := func() {
+		lines = append(lines, lineNumberPrefix(oldLine, newLine, lineSides(lineOld, lineNew), lineChanged, opts)+currentLine.String())
+		currentLine.Reset()
+		lineChanged, lineOld, lineNew = false, false, false
+	}
+	markSides := func(op Operation) {
+		lineOld = lineOld || op != Insert
+		lineNew = lineNew || op != Delete
 	}
-
-	currentLine.WriteString(linePrefix())
 
 	var prevToken string
 	var prevType Operation = -1
 
 	for _, d := range diffs {
-		if opts.HeuristicSpacing && needsHeuristicSpace(prevToken, prevType, d) {
+		if spaceBetween(prevToken, prevType, d, opts) {
 			currentLine.WriteString(" ")
 		}
 		formatted := formatToken(d, opts)
+		if d.Type != Equal && formatted != "" {
+			lineChanged = true
+		}
 
 		// Handle newlines within the formatted token
 		if strings.Contains(formatted, "\n") {
 			parts := strings.Split(formatted, "\n")
 			for j, part := range parts {
 				currentLine.WriteString(part)
+				if part != "" {
+					markSides(d.Type)
+				}
 				if j < len(parts)-1 {
-					lines = append(lines, currentLine.String())
-					currentLine.Reset()
+					finishLine()
+					if d.Type != Equal && parts[j+1] != "" {
+						lineChanged = true
+					}
 
 					switch d.Type {
 					case Equal:
@@ -922,20 +1741,19 @@ func formatDiffsWithLineNumbers(diffs []Diff, opts FormatOptions) string {
 					case Insert:
 						newLine++
 					}
-
-					currentLine.WriteString(linePrefix())
 				}
 			}
 		} else {
 			currentLine.WriteString(formatted)
+			if formatted != "" {
+				markSides(d.Type)
+			}
 		}
 		prevToken = d.Token
 		prevType = d.Type
 	}
 
-	if currentLine.Len() > 0 {
-		lines = append(lines, currentLine.String())
-	}
+	finishLine()
 
 	return strings.Join(lines, "\n")
 }
@@ -957,9 +1775,13 @@ func FormatDiffsAdvanced(diffs []Diff, opts FormatOptions) string {
 		diffs = ApplyMatchContext(diffs, opts.MatchContext)
 	}
 
+	if opts.Transpositions {
+		diffs = DetectTranspositions(diffs)
+	}
+
 	// Apply aggregation if requested
 	if opts.AggregateChanges {
-		diffs = AggregateDiffs(diffs)
+		diffs = AggregateDiffsMinRun(diffs, opts.AggregateMinRun)
 	}
 
 	if opts.ShowLineNumbers {
@@ -995,6 +1817,10 @@ func FormatDiffResultAdvanced(result DiffResult, opts FormatOptions) string {
 		diffs = ApplyMatchContext(diffs, opts.MatchContext)
 	}
 
+	if opts.Transpositions {
+		diffs = DetectTranspositions(diffs)
+	}
+
 	// Create formatter and process diffs
 	f := newDiffFormatter(result, opts)
 
@@ -1014,6 +1840,13 @@ func FormatDiffResultAdvanced(result DiffResult, opts FormatOptions) string {
 			f.idx2 += i - runStart
 
 		case Delete:
+			if opts.RefineTokens && f.processRefinedPair(diffs, i) {
+				i += 2
+				f.idx1++
+				f.idx2++
+				continue
+			}
+
 			// Find consecutive Delete tokens
 			runStart := i
 			for i < len(diffs) && diffs[i].Type == Delete {
@@ -1035,3 +1868,75 @@ func FormatDiffResultAdvanced(result DiffResult, opts FormatOptions) string {
 
 	return f.finalize()
 }
+
+// segment is a run of output text rendered with a single style.
+type segment struct {
+	text string
+	op   Operation
+}
+
+// diffSegments walks the diff using token positions, like
+// FormatDiffResultAdvanced, and returns the text to render, for output
+// formats such as SVG and HTML that style text themselves. Whitespace
+// between tokens is taken from the text the token came from and is
+// unstyled.
+func diffSegments(result DiffResult, opts FormatOptions) []segment {
+	var segs []segment
+	add := func(text string, op Operation) {
+		if text != "" {
+			segs = append(segs, segment{text: text, op: op})
+		}
+	}
+
+	idx1, idx2 := 0, 0
+	last1, last2 := 0, 0
+	for _, d := range result.Diffs {
+		switch d.Type {
+		case Equal:
+			if idx2 < len(result.Positions2) {
+				end := result.Positions2[idx2].End
+				if opts.NoCommon {
+					add(strings.Repeat("\n", strings.Count(result.Text2[last2:end], "\n")), Equal)
+				} else {
+					add(result.Text2[last2:end], Equal)
+				}
+				last2 = end
+			} else if !opts.NoCommon {
+				add(d.Token, Equal)
+			}
+			if idx1 < len(result.Positions1) {
+				last1 = result.Positions1[idx1].End
+			}
+			idx1++
+			idx2++
+
+		case Delete:
+			if idx1 < len(result.Positions1) {
+				pos := result.Positions1[idx1]
+				if !opts.NoDeleted {
+					add(result.Text1[last1:pos.Start], Equal)
+					add(result.Text1[pos.Start:pos.End], Delete)
+				}
+				last1 = pos.End
+			} else if !opts.NoDeleted {
+				add(d.Token, Delete)
+			}
+			idx1++
+
+		case Insert:
+			if idx2 < len(result.Positions2) {
+				pos := result.Positions2[idx2]
+				if !opts.NoInserted {
+					add(result.Text2[last2:pos.Start], Equal)
+					add(result.Text2[pos.Start:pos.End], Insert)
+				}
+				last2 = pos.End
+			} else if !opts.NoInserted {
+				add(d.Token, Insert)
+			}
+			idx2++
+		}
+	}
+
+	return segs
+}
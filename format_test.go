@@ -1,6 +1,7 @@
 package tokendiff
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -104,6 +105,74 @@ func TestNeedsSpaceAfter(t *testing.T) {
 	}
 }
 
+func TestReconstruct(t *testing.T) {
+	tests := []struct {
+		name    string
+		text1   string
+		text2   string
+		opts    Options
+		wantOld string
+		wantNew string
+	}{
+		{
+			name:    "motivating example",
+			text1:   "void someFunction(SomeType var)",
+			text2:   "void someFunction(SomeOtherType var)",
+			opts:    DefaultOptions(),
+			wantOld: "void someFunction(SomeType var)",
+			wantNew: "void someFunction(SomeOtherType var)",
+		},
+		{
+			name:    "code delimiters",
+			text1:   "void someFunction(SomeType var)",
+			text2:   "void someFunction(SomeOtherType var)",
+			opts:    Options{Delimiters: "()"},
+			wantOld: "void someFunction(SomeType var)",
+			wantNew: "void someFunction(SomeOtherType var)",
+		},
+		{
+			// No space is added after ".", but the tokens are the same
+			name:    "spacing heuristics",
+			text1:   "Hello, world. Bye!",
+			text2:   "Hello there, world!",
+			opts:    Options{Delimiters: ",.!"},
+			wantOld: "Hello, world.Bye!",
+			wantNew: "Hello there, world!",
+		},
+		{
+			name:    "only deletions",
+			text1:   "one two three",
+			opts:    DefaultOptions(),
+			wantOld: "one two three",
+		},
+		{
+			name:    "only insertions",
+			text2:   "one two three",
+			opts:    DefaultOptions(),
+			wantNew: "one two three",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs := DiffStrings(tt.text1, tt.text2, tt.opts)
+			gotOld, gotNew := ReconstructOld(diffs), ReconstructNew(diffs)
+			if gotOld != tt.wantOld {
+				t.Errorf("ReconstructOld() = %q, want %q", gotOld, tt.wantOld)
+			}
+			if gotNew != tt.wantNew {
+				t.Errorf("ReconstructNew() = %q, want %q", gotNew, tt.wantNew)
+			}
+			if got, want := Tokenize(gotOld, tt.opts), Tokenize(tt.text1, tt.opts); !reflect.DeepEqual(got, want) {
+				t.Errorf("Tokenize(ReconstructOld()) = %q, want %q", got, want)
+			}
+			if got, want := Tokenize(gotNew, tt.opts), Tokenize(tt.text2, tt.opts); !reflect.DeepEqual(got, want) {
+				t.Errorf("Tokenize(ReconstructNew()) = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
 func TestFormatDiffWithOptions(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -287,6 +356,147 @@ func TestParseColor(t *testing.T) {
 	}
 }
 
+func TestParseColorHex(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "foreground",
+			spec: "#ff8800",
+			want: "\033[38;2;255;136;0m",
+		},
+		{
+			name: "uppercase digits",
+			spec: "#FF8800",
+			want: "\033[38;2;255;136;0m",
+		},
+		{
+			name: "shorthand foreground and background",
+			spec: "#000:#fff",
+			want: "\033[38;2;0;0;0m\033[48;2;255;255;255m",
+		},
+		{
+			name: "named foreground with hex background",
+			spec: "red:#102030",
+			want: "\033[31m\033[48;2;16;32;48m",
+		},
+		{
+			name: "background only",
+			spec: ":#0a0b0c",
+			want: "\033[48;2;10;11;12m",
+		},
+		{
+			name:    "non-hex digits",
+			spec:    "#xyz",
+			wantErr: `invalid hex color "#xyz": "x" is not hexadecimal`,
+		},
+		{
+			name:    "wrong length",
+			spec:    "#ff88",
+			wantErr: `invalid hex color "#ff88": want #RGB or #RRGGBB`,
+		},
+		{
+			name:    "invalid background",
+			spec:    "red:#12345g",
+			wantErr: `invalid hex color "#12345g": "5g" is not hexadecimal`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseColor(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("ParseColor(%q) error = %v, want %q", tt.spec, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseColor(%q) unexpected error: %v", tt.spec, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseColor(%q) = %q, want %q", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseColorPalette(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "lowest index",
+			spec: "color0",
+			want: "\033[38;5;0m",
+		},
+		{
+			name: "highest index",
+			spec: "color255",
+			want: "\033[38;5;255m",
+		},
+		{
+			name: "foreground and background",
+			spec: "color196:color21",
+			want: "\033[38;5;196m\033[48;5;21m",
+		},
+		{
+			name: "background lowest and highest",
+			spec: "color255:color0",
+			want: "\033[38;5;255m\033[48;5;0m",
+		},
+		{
+			name: "case insensitive",
+			spec: "Color42",
+			want: "\033[38;5;42m",
+		},
+		{
+			name:    "out of range",
+			spec:    "color256",
+			wantErr: `invalid palette color "color256": index must be 0-255`,
+		},
+		{
+			name:    "non-numeric suffix",
+			spec:    "color1x",
+			wantErr: `invalid palette color "color1x": "1x" is not a number`,
+		},
+		{
+			name:    "missing index",
+			spec:    "red:color",
+			wantErr: `invalid palette color "color": "" is not a number`,
+		},
+		{
+			name:    "signed index",
+			spec:    "color-1",
+			wantErr: `invalid palette color "color-1": "-1" is not a number`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseColor(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("ParseColor(%q) error = %v, want %q", tt.spec, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseColor(%q) unexpected error: %v", tt.spec, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseColor(%q) = %q, want %q", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
 func TestParseColorSpec(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -318,6 +528,11 @@ func TestParseColorSpec(t *testing.T) {
 			spec:    "red,notacolor",
 			wantErr: true,
 		},
+		{
+			name:    "hex colors",
+			spec:    "#ff0000,#00ff00:#000",
+			wantErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -392,6 +607,41 @@ func TestColorCode(t *testing.T) {
 			bold:    false,
 			wantErr: true,
 		},
+		{
+			name:    "hex foreground and background",
+			fg:      "#ff8800",
+			bg:      "#000",
+			bold:    true,
+			wantErr: false,
+		},
+		{
+			name:    "invalid hex foreground",
+			fg:      "#xyz",
+			bg:      "",
+			bold:    false,
+			wantErr: true,
+		},
+		{
+			name:    "invalid hex background",
+			fg:      "",
+			bg:      "#12",
+			bold:    false,
+			wantErr: true,
+		},
+		{
+			name:    "palette foreground and background",
+			fg:      "color196",
+			bg:      "color21",
+			bold:    false,
+			wantErr: false,
+		},
+		{
+			name:    "palette index out of range",
+			fg:      "color300",
+			bg:      "",
+			bold:    false,
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -472,6 +722,64 @@ func TestOverstrikeBold(t *testing.T) {
 	}
 }
 
+func TestCombiningStrikethrough(t *testing.T) {
+	const s = "\u0336"
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"ascii", "ab", "a" + s + "b" + s},
+		{"empty", "", ""},
+		{"multi-byte", "日本", "日" + s + "本" + s},
+		{"precomposed accent", "café", "c" + s + "a" + s + "f" + s + "é" + s},
+		{"decomposed accent", "e\u0301x", "e\u0301" + s + "x" + s},
+		{"emoji", "🙂", "🙂" + s},
+		{"newline left bare", "a\nb", "a" + s + "\nb" + s},
+		{"space is struck", "a b", "a" + s + " " + s + "b" + s},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := CombiningStrikethrough(tt.input)
+			if result != tt.expected {
+				t.Errorf("CombiningStrikethrough(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCombiningUnderline(t *testing.T) {
+	const u = "\u0332"
+	if got, want := CombiningUnderline("ñá"), "ñ"+u+"á"+u; got != want {
+		t.Errorf("CombiningUnderline() = %q, want %q", got, want)
+	}
+}
+
+func TestOSC8Link(t *testing.T) {
+	got := OSC8Link("file:///tmp/new/a.txt", "new/a.txt")
+	want := "\033]8;;file:///tmp/new/a.txt\033\\new/a.txt\033]8;;\033\\"
+	if got != want {
+		t.Errorf("OSC8Link() = %q, want %q", got, want)
+	}
+}
+
+func TestFormatUnicodeStrikethrough(t *testing.T) {
+	opts := FormatOptions{
+		StartDelete:          "[-",
+		StopDelete:           "-]",
+		StartInsert:          "{+",
+		StopInsert:           "+}",
+		UnicodeStrikethrough: true,
+	}
+	result := DiffStringsWithPositions("naïve café", "naïve thé", DefaultOptions())
+	got := FormatDiffResultAdvanced(result, opts)
+	want := "naïve " + CombiningStrikethrough("café") + " " + CombiningUnderline("thé")
+	if got != want {
+		t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, want)
+	}
+}
+
 func TestFormatDiffsAdvanced(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -601,6 +909,35 @@ func TestFormatDiffsAdvanced(t *testing.T) {
 	}
 }
 
+func TestFormatDiffsAdvancedAggregateMinRun(t *testing.T) {
+	diffs := []Diff{
+		{Type: Equal, Token: "keep"},
+		{Type: Delete, Token: "a"},
+		{Type: Delete, Token: "b"},
+		{Type: Equal, Token: "mid"},
+		{Type: Delete, Token: "c"},
+		{Type: Delete, Token: "d"},
+		{Type: Delete, Token: "e"},
+		{Type: Delete, Token: "f"},
+	}
+
+	tests := []struct {
+		minRun int
+		want   string
+	}{
+		{1, "keep [-a b-] mid [-c d e f-]"},
+		{3, "keep [-a-] [-b-] mid [-c d e f-]"},
+	}
+
+	for _, tt := range tests {
+		opts := DefaultFormatOptions()
+		opts.AggregateMinRun = tt.minRun
+		if got := FormatDiffsAdvanced(diffs, opts); got != tt.want {
+			t.Errorf("AggregateMinRun %d: FormatDiffsAdvanced() = %q, want %q", tt.minRun, got, tt.want)
+		}
+	}
+}
+
 func TestFormatDiffsAdvancedWithLineNumbers(t *testing.T) {
 	diffs := []Diff{
 		{Type: Equal, Token: "line1"},
@@ -1751,3 +2088,588 @@ func TestMultipleEqualBeforeDeleteNotDuplicated(t *testing.T) {
 		}
 	}
 }
+
+func TestLineNumbersOnChangesOnly(t *testing.T) {
+	opts := FormatOptions{
+		StartDelete:              "[-",
+		StopDelete:               "-]",
+		StartInsert:              "{+",
+		StopInsert:               "+}",
+		ShowLineNumbers:          true,
+		LineNumWidth:             2,
+		LineNumbersOnChangesOnly: true,
+	}
+	blank := "   :    "
+
+	t.Run("whole-file formatter", func(t *testing.T) {
+		result := DiffStringsWithPositions("a\nb\nc", "a\nX\nc", DefaultOptions())
+		got := FormatDiffResultAdvanced(result, opts)
+		want := blank + "a\n  2:1   [-b-]\n  2:2   {+X+}\n" + blank + "c"
+		if got != want {
+			t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("simple formatter", func(t *testing.T) {
+		diffs := []Diff{
+			{Type: Equal, Token: "a\n"},
+			{Type: Delete, Token: "b\n"},
+			{Type: Insert, Token: "X\n"},
+			{Type: Equal, Token: "c"},
+		}
+		got := FormatDiffsAdvanced(diffs, opts)
+		// The closing marker makes the last line a changed line
+		want := blank + "a\n  2:2   [-b\n  3:2   -]{+X\n  3:3   +}c"
+		if got != want {
+			t.Errorf("FormatDiffsAdvanced() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("all lines numbered by default", func(t *testing.T) {
+		opts := opts
+		opts.LineNumbersOnChangesOnly = false
+		result := DiffStringsWithPositions("a\nb", "a\nb", DefaultOptions())
+		if got, want := FormatDiffResultAdvanced(result, opts), "  1:1   a\n  2:2   b"; got != want {
+			t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestLineNumberSide(t *testing.T) {
+	opts := FormatOptions{
+		StartDelete:     "[-",
+		StopDelete:      "-]",
+		StartInsert:     "{+",
+		StopInsert:      "+}",
+		ShowLineNumbers: true,
+		LineNumWidth:    2,
+	}
+	result := DiffStringsWithPositions("a\nb\nc\nd", "a\nX\nc\nY\nd", DefaultOptions())
+
+	tests := []struct {
+		side LineNumberSide
+		want string
+	}{
+		{LineNumbersBoth, "  1:1   a\n  2:1   [-b-]\n  2:2   {+X+}\n  3:3   c\n  3:4   {+Y+}\n  4:5   d"},
+		{LineNumbersOld, "  1: a\n  2: [-b-]\n   : {+X+}\n  3: c\n   : {+Y+}\n  4: d"},
+		{LineNumbersNew, "  1: a\n   : [-b-]\n  2: {+X+}\n  3: c\n  4: {+Y+}\n  5: d"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.side.String(), func(t *testing.T) {
+			opts := opts
+			opts.LineNumberSide = tt.side
+			if got := FormatDiffResultAdvanced(result, opts); got != tt.want {
+				t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Diffs without positions number lines the same way
+	wsOpts := DefaultOptions()
+	wsOpts.PreserveWhitespace = true
+	opts.LineNumberSide = LineNumbersOld
+	want := "  1: a\n  2: [-b-]{+X+}\n  3: c\n   : {+Y+}\n  4: d"
+	if got := FormatDiffsAdvanced(DiffStrings("a\nb\nc\nd", "a\nX\nc\nY\nd", wsOpts), opts); got != want {
+		t.Errorf("FormatDiffsAdvanced() = %q, want %q", got, want)
+	}
+}
+
+func TestParseLineNumberSide(t *testing.T) {
+	tests := []struct {
+		name string
+		side LineNumberSide
+		ok   bool
+	}{
+		{"both", LineNumbersBoth, true},
+		{"old", LineNumbersOld, true},
+		{"new", LineNumbersNew, true},
+		{"left", LineNumbersBoth, false},
+		{"", LineNumbersBoth, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			side, ok := ParseLineNumberSide(tt.name)
+			if side != tt.side || ok != tt.ok {
+				t.Errorf("ParseLineNumberSide(%q) = %v, %v; want %v, %v", tt.name, side, ok, tt.side, tt.ok)
+			}
+		})
+	}
+}
+
+func TestFormatLowercaseOutput(t *testing.T) {
+	opts := FormatOptions{
+		StartDelete:     "[-",
+		StopDelete:      "-]",
+		StartInsert:     "{+",
+		StopInsert:      "+}",
+		LowercaseOutput: true,
+	}
+
+	t.Run("whole-file formatter", func(t *testing.T) {
+		result := DiffStringsWithPositions("Hello OLD\nWorld", "Hello NEW\nWorld", DefaultOptions())
+		got := FormatDiffResultAdvanced(result, opts)
+		want := "hello [-old-] {+new+}\nworld"
+		if got != want {
+			t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("ignore case keeps diff", func(t *testing.T) {
+		// Case-only changes are still Equal; only the rendering is lowered.
+		result := DiffStringsWithPositions("Foo BAR", "foo Bar", Options{IgnoreCase: true})
+		if HasChanges(result.Diffs) {
+			t.Fatalf("expected no changes with IgnoreCase, got %v", result.Diffs)
+		}
+		if got := FormatDiffResultAdvanced(result, opts); got != "foo bar" {
+			t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, "foo bar")
+		}
+	})
+
+	t.Run("simple formatters", func(t *testing.T) {
+		diffs := []Diff{{Type: Equal, Token: "Same"}, {Type: Delete, Token: "OLD"}, {Type: Insert, Token: "New"}}
+		if got, want := FormatDiffsAdvanced(diffs, opts), "same[-old-]{+new+}"; got != want {
+			t.Errorf("FormatDiffsAdvanced() = %q, want %q", got, want)
+		}
+		if got, want := FormatDiffWithOptions(diffs, opts), "same [-old-]{+new+}"; got != want {
+			t.Errorf("FormatDiffWithOptions() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		diffs := []Diff{{Type: Equal, Token: "Same"}}
+		if got := FormatDiffsAdvanced(diffs, FormatOptions{}); got != "Same" {
+			t.Errorf("FormatDiffsAdvanced() = %q, want %q", got, "Same")
+		}
+	})
+}
+
+func TestFormatDiffResultAdvancedCommonColor(t *testing.T) {
+	result := DiffStringsWithPositions("hello old\nworld", "hello new\nworld", DefaultOptions())
+	cyan := ForegroundColors["cyan"]
+
+	t.Run("common text is colored per line", func(t *testing.T) {
+		output := FormatDiffResultAdvanced(result, FormatOptions{
+			UseColor:    true,
+			DeleteColor: ANSIDeleteColor,
+			InsertColor: ANSIInsertColor,
+			CommonColor: cyan,
+		})
+		for _, want := range []string{cyan + "hello" + ANSIReset, cyan + "world" + ANSIReset} {
+			if !strings.Contains(output, want) {
+				t.Errorf("output %q missing %q", output, want)
+			}
+		}
+		if strings.Contains(output, cyan+"\n") {
+			t.Errorf("output %q colors across a line break", output)
+		}
+	})
+
+	t.Run("ignored without color", func(t *testing.T) {
+		output := FormatDiffResultAdvanced(result, FormatOptions{
+			StartDelete: "[-",
+			StopDelete:  "-]",
+			StartInsert: "{+",
+			StopInsert:  "+}",
+			CommonColor: cyan,
+		})
+		if strings.Contains(output, cyan) {
+			t.Errorf("output %q should not contain common color without UseColor", output)
+		}
+	})
+
+	t.Run("simple formatter", func(t *testing.T) {
+		diffs := []Diff{{Type: Equal, Token: "same"}, {Type: Delete, Token: "old"}}
+		output := FormatDiffsAdvanced(diffs, FormatOptions{
+			UseColor:    true,
+			DeleteColor: ANSIDeleteColor,
+			CommonColor: cyan,
+		})
+		if !strings.HasPrefix(output, cyan+"same"+ANSIReset) {
+			t.Errorf("FormatDiffsAdvanced() = %q, want common color on %q", output, "same")
+		}
+	})
+}
+
+func TestFormatDiffsAdvancedWrapWidth(t *testing.T) {
+	markers := FormatOptions{StartDelete: "[-", StopDelete: "-]", StartInsert: "{+", StopInsert: "+}", HeuristicSpacing: true, WrapWidth: 20}
+	colors := FormatOptions{UseColor: true, DeleteColor: ANSIDeleteColor, InsertColor: ANSIInsertColor, ColorReset: ANSIReset, HeuristicSpacing: true, WrapWidth: 20}
+	insertRun := DiffStrings("", "one two three four five six seven eight", DefaultOptions())
+
+	tests := []struct {
+		name     string
+		diffs    []Diff
+		opts     FormatOptions
+		expected string
+	}{
+		{
+			name:     "aggregated insert run wraps across three lines",
+			diffs:    AggregateDiffs(insertRun),
+			opts:     markers,
+			expected: "{+one two three+}\n{+four five six+}\n{+seven eight+}",
+		},
+		{
+			name:     "insert tokens wrap across four lines",
+			diffs:    insertRun,
+			opts:     markers,
+			expected: "{+one+} {+two+}\n{+three+} {+four+}\n{+five+} {+six+}\n{+seven+} {+eight+}",
+		},
+		{
+			name:     "colors take no columns",
+			diffs:    AggregateDiffs(insertRun),
+			opts:     colors,
+			expected: ANSIInsertColor + "one two three four\033[K" + ANSIReset + "\n" + ANSIInsertColor + "five six seven eight" + ANSIReset,
+		},
+		{
+			name: "break falls between equal and changed tokens",
+			diffs: []Diff{
+				{Equal, "the quick"}, {Delete, "brown"}, {Insert, "red"}, {Equal, "fox"},
+			},
+			opts:     markers,
+			expected: "the quick [-brown-]\n{+red+} fox",
+		},
+		{
+			name:     "long token is not split",
+			diffs:    []Diff{{Equal, "a"}, {Insert, "abcdefghijklmnopqrstuvwxyz"}, {Equal, "b"}},
+			opts:     markers,
+			expected: "a\n{+abcdefghijklmnopqrstuvwxyz+}\nb",
+		},
+		{
+			name:     "disabled",
+			diffs:    AggregateDiffs(insertRun),
+			opts:     FormatOptions{StartInsert: "{+", StopInsert: "+}"},
+			expected: "{+one two three four five six seven eight+}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FormatDiffsAdvanced(tt.diffs, tt.opts); got != tt.expected {
+				t.Errorf("FormatDiffsAdvanced() =\n%q\nwant\n%q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFormatDiffResultAdvancedCollapseContext(t *testing.T) {
+	middle := strings.TrimSpace(strings.Repeat("word ", 100))
+	result := DiffStringsWithPositions("the alpha "+middle+" omega end", "the beta "+middle+" gamma end", DefaultOptions())
+
+	tests := []struct {
+		name     string
+		collapse int
+		format   string
+		expected string
+	}{
+		{
+			name:     "disabled",
+			expected: "the [-alpha-] {+beta+} " + middle + " [-omega-] {+gamma+} end",
+		},
+		{
+			name:     "long unchanged middle is collapsed",
+			collapse: 80,
+			expected: "the [-alpha-] {+beta+}[... 500 chars unchanged ...] [-omega-] {+gamma+} end",
+		},
+		{
+			name:     "custom placeholder",
+			collapse: 80,
+			format:   "<%d>",
+			expected: "the [-alpha-] {+beta+}<500> [-omega-] {+gamma+} end",
+		},
+		{
+			name:     "placeholder without a count",
+			collapse: 80,
+			format:   "<snip>",
+			expected: "the [-alpha-] {+beta+}<snip> [-omega-] {+gamma+} end",
+		},
+		{
+			name:     "placeholder with a literal percent",
+			collapse: 80,
+			format:   "<%d chars, 100% unchanged>",
+			expected: "the [-alpha-] {+beta+}<500 chars, 100% unchanged> [-omega-] {+gamma+} end",
+		},
+		{
+			name:     "run at the limit is kept",
+			collapse: 500,
+			expected: "the [-alpha-] {+beta+} " + middle + " [-omega-] {+gamma+} end",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultFormatOptions()
+			opts.CollapseContext = tt.collapse
+			if tt.format != "" {
+				opts.CollapsePlaceholder = tt.format
+			}
+			if got := FormatDiffResultAdvanced(result, opts); got != tt.expected {
+				t.Errorf("FormatDiffResultAdvanced() =\n%q\nwant\n%q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFormatDiffResultAdvancedLessModeANSI(t *testing.T) {
+	result := DiffStringsWithPositions("keep\nold one\nold two\nend", "keep\nend", DefaultOptions())
+	opts := DefaultFormatOptions()
+	opts.UseColor = true
+
+	t.Run("without less mode the color spans lines", func(t *testing.T) {
+		want := "keep\n" + ANSIDeleteColor + "old one\nold two" + ANSIReset + "\nend"
+		if got := FormatDiffResultAdvanced(result, opts); got != want {
+			t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("ansi less mode resets each line", func(t *testing.T) {
+		opts := opts
+		opts.LessModeANSI = true
+		want := "keep\n" +
+			ANSIDeleteColor + "old one" + ANSIClearEOL + ANSIReset + "\n" +
+			ANSIDeleteColor + "old two" + ANSIReset + "\nend"
+		got := FormatDiffResultAdvanced(result, opts)
+		if got != want {
+			t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, want)
+		}
+		for _, line := range strings.Split(got, "\n") {
+			if strings.Contains(line, ANSIDeleteColor) && !strings.HasSuffix(line, ANSIReset) {
+				t.Errorf("line %q is not reset at its end", line)
+			}
+		}
+	})
+
+	t.Run("inserted lines", func(t *testing.T) {
+		opts := opts
+		opts.LessModeANSI = true
+		inserted := DiffStringsWithPositions("a\nz", "a\nnew one\nnew two\nz", DefaultOptions())
+		want := "a\n" +
+			ANSIInsertColor + "new one" + ANSIClearEOL + ANSIReset + "\n" +
+			ANSIInsertColor + "new two" + ANSIReset + "\nz"
+		if got := FormatDiffResultAdvanced(inserted, opts); got != want {
+			t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestFormatDiffResultAdvancedTabWidth(t *testing.T) {
+	result := DiffStringsWithPositions(
+		"func f() {\n\treturn old\n\t\tx := 1\n}",
+		"func f() {\n\treturn new\n\t\tx := 1\n}",
+		DefaultOptions(),
+	)
+	opts := DefaultFormatOptions()
+	opts.ShowLineNumbers = true
+	opts.LineNumWidth = 2
+
+	t.Run("tabs kept by default", func(t *testing.T) {
+		got := FormatDiffResultAdvanced(result, opts)
+		if !strings.Contains(got, "\treturn") {
+			t.Errorf("FormatDiffResultAdvanced() = %q, want tabs kept", got)
+		}
+	})
+
+	t.Run("leading tabs expanded", func(t *testing.T) {
+		opts := opts
+		opts.TabWidth = 4
+		got := FormatDiffResultAdvanced(result, opts)
+		want := "  1:1   func f() {\n" +
+			"  2:2       return [-old-] {+new+}\n" +
+			"  3:3           x := 1\n" +
+			"  4:4   }"
+		if got != want {
+			t.Errorf("FormatDiffResultAdvanced() =\n%q\nwant\n%q", got, want)
+		}
+
+		// The separator is in the same column on every row
+		for _, line := range strings.Split(got, "\n") {
+			if strings.Index(line, ":") != 3 {
+				t.Errorf("line %q has its separator at %d, want 3", line, strings.Index(line, ":"))
+			}
+		}
+	})
+
+	t.Run("tabs in changed text kept", func(t *testing.T) {
+		opts := opts
+		opts.TabWidth = 4
+		deleted := DiffStringsWithPositions("a\n\told\tline\nb", "a\nb", Options{PreserveWhitespace: true})
+		want := "  1:1   a[-\n  2:1   \told\tline-]\n  3:2   b"
+		if got := FormatDiffResultAdvanced(deleted, opts); got != want {
+			t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestFormatDiffResultAdvancedHighlightTrailingWS(t *testing.T) {
+	result := DiffStringsWithPositions(
+		"keep  \nfoo\nbar baz",
+		"keep  \nfoo   \nbar qux",
+		DefaultOptions(),
+	)
+	hl := "\033[41m   " + ANSIReset
+	change := "bar " + ANSIDeleteColor + "baz" + ANSIReset + " " + ANSIInsertColor + "qux" + ANSIReset
+
+	tests := []struct {
+		name  string
+		setup func(*FormatOptions)
+		want  string
+	}{
+		{
+			name:  "off by default",
+			setup: func(o *FormatOptions) { o.HighlightTrailingWS = false },
+			want:  "keep  \nfoo   \n" + change,
+		},
+		{
+			name:  "gained trailing spaces highlighted",
+			setup: func(o *FormatOptions) {},
+			want:  "keep  \nfoo" + hl + "\n" + change,
+		},
+		{
+			name:  "custom color",
+			setup: func(o *FormatOptions) { o.TrailingWSColor = "\033[44m" },
+			want:  "keep  \nfoo\033[44m   " + ANSIReset + "\n" + change,
+		},
+		{
+			name: "with line numbers",
+			setup: func(o *FormatOptions) {
+				o.ShowLineNumbers = true
+				o.LineNumWidth = 2
+			},
+			want: "  1:1   keep  \n  2:2   foo" + hl + "\n  3:3   " + change,
+		},
+		{
+			name:  "not highlighted without color",
+			setup: func(o *FormatOptions) { o.UseColor = false },
+			want:  "keep  \nfoo   \nbar [-baz-] {+qux+}",
+		},
+		{
+			name: "not highlighted without color with line numbers",
+			setup: func(o *FormatOptions) {
+				o.UseColor = false
+				o.ShowLineNumbers = true
+				o.LineNumWidth = 2
+			},
+			want: "  1:1   keep  \n  2:2   foo   \n  3:3   bar [-baz-] {+qux+}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultFormatOptions()
+			opts.UseColor = true
+			opts.HighlightTrailingWS = true
+			tt.setup(&opts)
+			if got := FormatDiffResultAdvanced(result, opts); got != tt.want {
+				t.Errorf("FormatDiffResultAdvanced() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatDiffResultAdvancedHighlightTrailingWSInInsert(t *testing.T) {
+	// The insertion spans the highlighted line, so its color must resume
+	// after the highlight for the rest of the inserted text
+	result := DiffStringsWithPositions("a\n", "a\nnew line   \nb\n", DefaultOptions())
+	hl := "\033[41m   " + ANSIReset + ANSIInsertColor
+
+	tests := []struct {
+		name  string
+		setup func(*FormatOptions)
+		want  string
+	}{
+		{
+			name:  "without line numbers",
+			setup: func(o *FormatOptions) {},
+			want:  "a\n" + ANSIInsertColor + "new line" + hl + "\nb" + ANSIReset,
+		},
+		{
+			name: "with line numbers",
+			setup: func(o *FormatOptions) {
+				o.ShowLineNumbers = true
+				o.LineNumWidth = 2
+			},
+			want: "  1:1   a\n  1:2   " + ANSIInsertColor + "new line" + hl + ANSIClearEOL + "\n  1:3   " + ANSIInsertColor + "b" + ANSIReset,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultFormatOptions()
+			opts.UseColor = true
+			opts.HighlightTrailingWS = true
+			tt.setup(&opts)
+			if got := FormatDiffResultAdvanced(result, opts); got != tt.want {
+				t.Errorf("FormatDiffResultAdvanced() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandLeadingTabs(t *testing.T) {
+	tests := []struct {
+		line     string
+		width    int
+		expected string
+	}{
+		{"\tx", 0, "\tx"},
+		{"\tx", 4, "    x"},
+		{"\t\tx\ty", 4, "        x\ty"},
+		{"  \tx", 4, "    x"},
+		{"    \tx", 4, "        x"},
+		{"no tabs", 4, "no tabs"},
+		{"\t", 2, "  "},
+	}
+
+	for _, tt := range tests {
+		if got := expandLeadingTabs(tt.line, tt.width); got != tt.expected {
+			t.Errorf("expandLeadingTabs(%q, %d) = %q, want %q", tt.line, tt.width, got, tt.expected)
+		}
+	}
+}
+
+func TestJoinReplacements(t *testing.T) {
+	tests := []struct {
+		name  string
+		text1 string
+		text2 string
+		want  string
+	}{
+		{"replacement", "the quick brown fox", "the quick red fox", "the quick [-brown-]{+red+} fox"},
+		{"deletion only", "the quick brown fox", "the quick fox", "the quick [-brown-] fox"},
+		{"insertion only", "the quick fox", "the quick red fox", "the quick {+red+} fox"},
+		{"line break kept", "old line\n", "new text\n", "[-old line-]{+new text+}"},
+		{"line break between", "one\n", "\ntwo\n", "[-one-]\n{+two+}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultFormatOptions()
+			opts.JoinReplacements = true
+			result := DiffStringsWithPositions(tt.text1, tt.text2, DefaultOptions())
+			if got := FormatDiffResultAdvanced(result, opts); got != tt.want {
+				t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Without positions, heuristic spacing is suppressed the same way
+	diffs := []Diff{{Equal, "a"}, {Delete, "b"}, {Insert, "c"}, {Equal, "d"}}
+	opts := DefaultFormatOptions()
+	opts.JoinReplacements = true
+	if got, want := FormatDiffsAdvanced(diffs, opts), "a [-b-]{+c+} d"; got != want {
+		t.Errorf("FormatDiffsAdvanced() = %q, want %q", got, want)
+	}
+}
+
+func TestGitColorWords(t *testing.T) {
+	// Output of git diff --color-words for the same change, without the
+	// diff header and the hunk's trailing newline
+	text1 := "the quick brown fox\njumps over the lazy dog"
+	text2 := "the quick red fox\njumps under the sleepy cat"
+	want := "the quick \033[31mbrown\033[m\033[32mred\033[m fox\n" +
+		"jumps \033[31mover\033[m\033[32munder\033[m the \033[31mlazy dog\033[m\033[32msleepy cat\033[m"
+
+	if got := DiffAndFormat(text1, text2, DefaultOptions(), GitColorWords()); got != want {
+		t.Errorf("DiffAndFormat() with GitColorWords() =\n%q\nwant\n%q", got, want)
+	}
+}
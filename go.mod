@@ -7,3 +7,5 @@ toolchain go1.24.6
 require github.com/spf13/pflag v1.0.10
 
 require github.com/dacharyc/diffx v0.1.0
+
+require golang.org/x/text v0.22.0
@@ -0,0 +1,62 @@
+package tokendiff
+
+import (
+	"html"
+	"strings"
+)
+
+// Default CSS classes used by FormatDiffHTML.
+const (
+	DefaultHTMLDeleteClass = "del"
+	DefaultHTMLInsertClass = "ins"
+)
+
+// HTMLOptions configures FormatDiffHTML.
+type HTMLOptions struct {
+	// DeleteClass is the CSS class of spans around deleted text.
+	// Default: "del"
+	DeleteClass string
+
+	// InsertClass is the CSS class of spans around inserted text.
+	// Default: "ins"
+	InsertClass string
+
+	// Wrap, when true, wraps the output in <pre class="tokendiff"> so it
+	// can be embedded directly in a page with whitespace preserved.
+	Wrap bool
+}
+
+// FormatDiffHTML renders a diff result as HTML. Deleted text becomes
+// <span class="del">...</span> and inserted text <span class="ins">...</span>,
+// using the classes from opts. Unchanged text, including the original
+// whitespace between tokens, is copied from the inputs. All text is
+// HTML-escaped.
+func FormatDiffHTML(result DiffResult, opts HTMLOptions) string {
+	if opts.DeleteClass == "" {
+		opts.DeleteClass = DefaultHTMLDeleteClass
+	}
+	if opts.InsertClass == "" {
+		opts.InsertClass = DefaultHTMLInsertClass
+	}
+
+	var sb strings.Builder
+	if opts.Wrap {
+		sb.WriteString(`<pre class="tokendiff">`)
+	}
+	for _, seg := range diffSegments(result, FormatOptions{}) {
+		text := html.EscapeString(seg.text)
+		switch seg.op {
+		case Delete:
+			sb.WriteString(`<span class="` + html.EscapeString(opts.DeleteClass) + `">` + text + `</span>`)
+		case Insert:
+			sb.WriteString(`<span class="` + html.EscapeString(opts.InsertClass) + `">` + text + `</span>`)
+		default:
+			sb.WriteString(text)
+		}
+	}
+	if opts.Wrap {
+		sb.WriteString("</pre>")
+	}
+
+	return sb.String()
+}
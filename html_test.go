@@ -0,0 +1,61 @@
+package tokendiff
+
+import "testing"
+
+func TestFormatDiffHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		text1    string
+		text2    string
+		opts     HTMLOptions
+		expected string
+	}{
+		{
+			name:     "escapes angle brackets in changed token",
+			text1:    "a <b> c",
+			text2:    "a <i> c",
+			expected: `a <span class="del">&lt;b&gt;</span> <span class="ins">&lt;i&gt;</span> c`,
+		},
+		{
+			name:     "escapes unchanged text",
+			text1:    "a <b> c",
+			text2:    "a <b> d",
+			expected: `a &lt;b&gt; <span class="del">c</span> <span class="ins">d</span>`,
+		},
+		{
+			name:     "preserves original whitespace",
+			text1:    "one\n  two three",
+			text2:    "one\n  two four",
+			expected: "one\n  two <span class=\"del\">three</span> <span class=\"ins\">four</span>",
+		},
+		{
+			name:     "custom classes and wrap",
+			text1:    "x & y",
+			text2:    "x & z",
+			opts:     HTMLOptions{DeleteClass: "removed", InsertClass: "added", Wrap: true},
+			expected: `<pre class="tokendiff">x &amp; <span class="removed">y</span> <span class="added">z</span></pre>`,
+		},
+		{
+			name:     "class is escaped",
+			text1:    "a",
+			text2:    "b",
+			opts:     HTMLOptions{DeleteClass: `x"y`},
+			expected: `<span class="x&#34;y">a</span><span class="ins">b</span>`,
+		},
+		{
+			name:     "identical",
+			text1:    "same & same",
+			text2:    "same & same",
+			expected: "same &amp; same",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := DiffStringsWithPositions(tt.text1, tt.text2, DefaultOptions())
+			if got := FormatDiffHTML(result, tt.opts); got != tt.expected {
+				t.Errorf("FormatDiffHTML() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
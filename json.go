@@ -0,0 +1,86 @@
+package tokendiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// jsonDiff is a single token in FormatDiffJSON output. Positions a token
+// does not have, such as the old position of an inserted token, are nil and
+// serialize as null.
+type jsonDiff struct {
+	Type     string `json:"type"`
+	Token    string `json:"token"`
+	OldStart *int   `json:"oldStart"`
+	OldEnd   *int   `json:"oldEnd"`
+	NewStart *int   `json:"newStart"`
+	NewEnd   *int   `json:"newEnd"`
+}
+
+// FormatDiffJSON renders a diff result as a JSON array with one object per
+// token:
+//
+//	{"type":"delete","token":"old","oldStart":4,"oldEnd":7,"newStart":null,"newEnd":null}
+//
+// type is "equal", "delete", or "insert". Offsets are byte offsets into
+// Text1 (old) and Text2 (new) from the result's positions; Equal tokens
+// have both, Delete tokens only old, and Insert tokens only new. Offsets
+// are null when the result has no positions.
+func FormatDiffJSON(result DiffResult) ([]byte, error) {
+	diffs := make([]jsonDiff, 0, len(result.Diffs))
+	idx1, idx2 := 0, 0
+
+	for _, d := range result.Diffs {
+		jd := jsonDiff{Type: strings.ToLower(d.Type.String()), Token: d.Token}
+		if d.Type != Insert {
+			if idx1 < len(result.Positions1) {
+				pos := result.Positions1[idx1]
+				jd.OldStart, jd.OldEnd = &pos.Start, &pos.End
+			}
+			idx1++
+		}
+		if d.Type != Delete {
+			if idx2 < len(result.Positions2) {
+				pos := result.Positions2[idx2]
+				jd.NewStart, jd.NewEnd = &pos.Start, &pos.End
+			}
+			idx2++
+		}
+		diffs = append(diffs, jd)
+	}
+
+	return json.Marshal(diffs)
+}
+
+// CanonicalizeJSON parses s as a single JSON value and returns it
+// re-serialized with object keys sorted and two-space indentation, ending
+// with a newline, so two documents that differ only in key order and
+// formatting canonicalize to the same text. Numbers keep their original
+// spelling, and "<", ">", and "&" in strings are not escaped. It returns an
+// error if s is not valid JSON or holds more than one value.
+func CanonicalizeJSON(s string) (string, error) {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err == io.EOF {
+		return "", errors.New("invalid JSON: no value")
+	} else if err != nil {
+		return "", fmt.Errorf("invalid JSON: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return "", errors.New("invalid JSON: data after the top-level value")
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
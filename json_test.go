@@ -0,0 +1,103 @@
+package tokendiff
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFormatDiffJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   DiffResult
+		expected string
+	}{
+		{
+			name:   "positions from result",
+			result: DiffStringsWithPositions("hello old world", "hello  new world", DefaultOptions()),
+			expected: `[` +
+				`{"type":"equal","token":"hello","oldStart":0,"oldEnd":5,"newStart":0,"newEnd":5},` +
+				`{"type":"delete","token":"old","oldStart":6,"oldEnd":9,"newStart":null,"newEnd":null},` +
+				`{"type":"insert","token":"new","oldStart":null,"oldEnd":null,"newStart":7,"newEnd":10},` +
+				`{"type":"equal","token":"world","oldStart":10,"oldEnd":15,"newStart":11,"newEnd":16}` +
+				`]`,
+		},
+		{
+			name:     "no positions",
+			result:   DiffResult{Diffs: []Diff{{Equal, "a"}, {Insert, "b"}}},
+			expected: `[{"type":"equal","token":"a","oldStart":null,"oldEnd":null,"newStart":null,"newEnd":null},{"type":"insert","token":"b","oldStart":null,"oldEnd":null,"newStart":null,"newEnd":null}]`,
+		},
+		{
+			name:     "empty",
+			result:   DiffResult{},
+			expected: `[]`,
+		},
+		{
+			name:     "special characters escaped",
+			result:   DiffStringsWithPositions(`say "hi"`, `say "hi"`, DefaultOptions()),
+			expected: `[{"type":"equal","token":"say","oldStart":0,"oldEnd":3,"newStart":0,"newEnd":3},{"type":"equal","token":"\"hi\"","oldStart":4,"oldEnd":8,"newStart":4,"newEnd":8}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FormatDiffJSON(tt.result)
+			if err != nil {
+				t.Fatalf("FormatDiffJSON() error = %v", err)
+			}
+			if string(got) != tt.expected {
+				t.Errorf("FormatDiffJSON() =\n%s\nwant\n%s", got, tt.expected)
+			}
+			if !json.Valid(got) {
+				t.Errorf("FormatDiffJSON() output is not valid JSON")
+			}
+		})
+	}
+}
+
+func TestCanonicalizeJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		wantErr  bool
+	}{
+		{"sorts keys", `{"b": 1, "a": {"d": [1, 2], "c": null}}`, "{\n  \"a\": {\n    \"c\": null,\n    \"d\": [\n      1,\n      2\n    ]\n  },\n  \"b\": 1\n}\n", false},
+		{"keeps number spelling", `[1.50, 1e3, 12345678901234567890]`, "[\n  1.50,\n  1e3,\n  12345678901234567890\n]\n", false},
+		{"no HTML escaping", `"<a & b>"`, "\"<a & b>\"\n", false},
+		{"surrounding whitespace", "\n  true  \n", "true\n", false},
+		{"malformed", `{"a": 1,}`, "", true},
+		{"trailing data", `{} {}`, "", true},
+		{"empty", "  ", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CanonicalizeJSON(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CanonicalizeJSON() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.expected {
+				t.Errorf("CanonicalizeJSON() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCanonicalizeJSONDiff(t *testing.T) {
+	text1 := `{"name": "tokendiff", "tags": ["diff", "cli"], "meta": {"stars": 10, "fork": false}}`
+	text2 := "{\n\t\"meta\": {\"fork\": false,\n\t\t\"stars\": 10},\n\t\"tags\": [\"diff\", \"cli\"],\n\t\"name\": \"tokendiff\"\n}\n"
+
+	canon1, err := CanonicalizeJSON(text1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canon2, err := CanonicalizeJSON(text2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range DiffStrings(canon1, canon2, DefaultOptions()) {
+		if d.Type != Equal {
+			t.Fatalf("DiffStrings() of canonical forms has %v %q, want no changes", d.Type, d.Token)
+		}
+	}
+}
@@ -1,6 +1,13 @@
 package tokendiff
 
-import "strings"
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
 
 // LinePairing represents a pairing between a deleted line and an inserted line.
 type LinePairing struct {
@@ -29,42 +36,344 @@ func FindPositionalPairings(deletes, inserts []string) []LinePairing {
 	return pairings
 }
 
-// FindSimilarityPairings pairs deleted and inserted lines by content similarity.
-// Uses a greedy algorithm: for each deleted line, find the most similar unmatched
-// inserted line. Lines with similarity below threshold are left unpaired.
-func FindSimilarityPairings(deletes, inserts []string, opts Options, threshold float64) []LinePairing {
+// SimilarityFunc scores the similarity of two lines from 0.0 (unrelated) to
+// 1.0 (identical). ComputeTokenSimilarity and ComputeEditSimilarity are
+// SimilarityFuncs.
+type SimilarityFunc func(text1, text2 string, opts Options) float64
+
+// FindSimilarityPairings pairs deleted and inserted lines by content similarity
+// as scored by similarity, or ComputeTokenSimilarity if it is nil.
+// Uses a greedy algorithm over all candidate pairs: the most similar unmatched
+// pair is taken first, and lines with similarity at or below threshold are
+// left unpaired.
+//
+// The result is deterministic and does not depend on map iteration or the
+// order in which candidates are examined. Candidates with equal similarity are
+// ordered by lowest insert index, then by lowest delete index. Pairings are
+// returned sorted by DeleteIndex.
+func FindSimilarityPairings(deletes, inserts []string, opts Options, threshold float64, similarity SimilarityFunc) []LinePairing {
+	candidates := similarityCandidates(deletes, inserts, opts, threshold, similarity)
+
 	var pairings []LinePairing
+	usedDeletes := make([]bool, len(deletes))
 	usedInserts := make([]bool, len(inserts))
+	for _, c := range candidates {
+		if usedDeletes[c.DeleteIndex] || usedInserts[c.InsertIndex] {
+			continue
+		}
+		usedDeletes[c.DeleteIndex] = true
+		usedInserts[c.InsertIndex] = true
+		pairings = append(pairings, c)
+	}
+
+	sortPairings(pairings)
+	return pairings
+}
+
+// similarityCandidates returns every pair of a deleted and an inserted line
+// scored above threshold, most similar first, in the order
+// FindSimilarityPairings takes them.
+func similarityCandidates(deletes, inserts []string, opts Options, threshold float64, similarity SimilarityFunc) []LinePairing {
+	similarity = pairingSimilarity(similarity, opts)
 
+	var candidates []LinePairing
 	for i, del := range deletes {
-		bestJ, bestSim := -1, threshold
 		for j, ins := range inserts {
-			if usedInserts[j] {
+			sim := similarity(del, ins, opts)
+			if sim > threshold {
+				candidates = append(candidates, LinePairing{
+					DeleteIndex: i,
+					InsertIndex: j,
+					Similarity:  sim,
+				})
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(a, b int) bool {
+		ca, cb := candidates[a], candidates[b]
+		if ca.Similarity != cb.Similarity {
+			return ca.Similarity > cb.Similarity
+		}
+		if ca.InsertIndex != cb.InsertIndex {
+			return ca.InsertIndex < cb.InsertIndex
+		}
+		return ca.DeleteIndex < cb.DeleteIndex
+	})
+	return candidates
+}
+
+// ShortLineTokens is the token count below which Options.ShortLineSmoothing
+// blends a line's character-level similarity into its pairing score.
+const ShortLineTokens = 4
+
+// pairingSimilarity returns the SimilarityFunc lines are paired with:
+// similarity, or ComputeTokenSimilarity if it is nil, smoothed for short
+// lines with opts.ShortLineSmoothing.
+func pairingSimilarity(similarity SimilarityFunc, opts Options) SimilarityFunc {
+	if similarity == nil {
+		similarity = ComputeTokenSimilarity
+	}
+	if !opts.ShortLineSmoothing {
+		return similarity
+	}
+	return func(text1, text2 string, opts Options) float64 {
+		sim := similarity(text1, text2, opts)
+		if max(len(Tokenize(text1, opts)), len(Tokenize(text2, opts))) >= ShortLineTokens {
+			return sim
+		}
+		return (sim + characterSimilarity(text1, text2, opts)) / 2
+	}
+}
+
+// characterSimilarity scores two lines by the characters their
+// CharacterDiff keeps: twice the number of Equal runes divided by the
+// total number of runes in both, ignoring surrounding whitespace and, with
+// opts.IgnoreCase, case.
+func characterSimilarity(text1, text2 string, opts Options) float64 {
+	text1, text2 = strings.TrimSpace(text1), strings.TrimSpace(text2)
+	if opts.IgnoreCase {
+		text1, text2 = opts.CaseFold.Fold(text1), opts.CaseFold.Fold(text2)
+	}
+	total := utf8.RuneCountInString(text1) + utf8.RuneCountInString(text2)
+	if total == 0 {
+		return 1.0
+	}
+	equal := 0
+	for _, d := range CharacterDiff(text1, text2) {
+		if d.Type == Equal {
+			equal += utf8.RuneCountInString(d.Token)
+		}
+	}
+	return float64(2*equal) / float64(total)
+}
+
+// sortPairings sorts pairings by DeleteIndex.
+func sortPairings(pairings []LinePairing) {
+	sort.Slice(pairings, func(a, b int) bool {
+		return pairings[a].DeleteIndex < pairings[b].DeleteIndex
+	})
+}
+
+// autoThresholds are the thresholds FindAutoPairings tries, highest first.
+// The lowest is DefaultLineThreshold.
+var autoThresholds = []float64{0.9, 0.8, 0.7, 0.6, 0.5, 0.4, 0.3, 0.2, 0.1}
+
+// FindAutoPairings pairs deleted and inserted lines like
+// FindSimilarityPairings, scoring them with opts.LineSimilarity, but picks
+// the threshold itself. It starts at 0.9 and lowers the threshold by 0.1 at
+// a time down to DefaultLineThreshold. Once some lines are paired, it stops
+// at the first step that pairs no more: that is the knee, below which any
+// further pairings are between lines that only share a token or two. It
+// also stops once every line on the shorter side is paired.
+//
+// Lowering the threshold only adds pairings, since the greedy pairing takes
+// the most similar pairs first, so the result is the FindSimilarityPairings
+// result at the chosen threshold. Like it, the result is deterministic and
+// sorted by DeleteIndex.
+func FindAutoPairings(deletes, inserts []string, opts Options) []LinePairing {
+	floor := autoThresholds[len(autoThresholds)-1]
+	candidates := similarityCandidates(deletes, inserts, opts, floor, opts.LineSimilarity)
+	maxPairings := min(len(deletes), len(inserts))
+
+	var pairings []LinePairing
+	usedDeletes := make([]bool, len(deletes))
+	usedInserts := make([]bool, len(inserts))
+	next := 0
+	for _, threshold := range autoThresholds {
+		before := len(pairings)
+		for next < len(candidates) && candidates[next].Similarity > threshold {
+			c := candidates[next]
+			next++
+			if usedDeletes[c.DeleteIndex] || usedInserts[c.InsertIndex] {
 				continue
 			}
-			sim := ComputeTokenSimilarity(del, ins, opts)
-			if sim > bestSim {
-				bestJ, bestSim = j, sim
+			usedDeletes[c.DeleteIndex] = true
+			usedInserts[c.InsertIndex] = true
+			pairings = append(pairings, c)
+		}
+		if len(pairings) == maxPairings || (before > 0 && len(pairings) == before) {
+			break
+		}
+	}
+
+	sortPairings(pairings)
+	return pairings
+}
+
+// FindOptimalPairings pairs deleted and inserted lines by content similarity
+// as scored by opts.LineSimilarity, like FindSimilarityPairings, but with a
+// maximum-weight matching (the Hungarian algorithm) instead of a greedy one:
+// the pairings maximize the total similarity, so a line is not paired with
+// its most similar partner when that would leave another line worse off by
+// more. Each line is paired at most once, and lines with similarity at or
+// below threshold are left unpaired.
+//
+// Scoring every pair is O(n*m) similarity calls and the matching
+// O(n^2*m), for n and m lines with n <= m, so a block with more than
+// MaxOptimalPairingLines deleted or inserted lines is paired greedily, as
+// FindSimilarityPairings pairs it, instead. The result is deterministic and
+// sorted by DeleteIndex.
+func FindOptimalPairings(deletes, inserts []string, opts Options, threshold float64) []LinePairing {
+	if max(len(deletes), len(inserts)) > MaxOptimalPairingLines {
+		return FindSimilarityPairings(deletes, inserts, opts, threshold, opts.LineSimilarity)
+	}
+	similarity := pairingSimilarity(opts.LineSimilarity, opts)
+
+	// Pairs at or below the threshold weigh nothing, so they add nothing
+	// to the total and are dropped from the matching
+	weights := make([][]float64, len(deletes))
+	for i, del := range deletes {
+		weights[i] = make([]float64, len(inserts))
+		for j, ins := range inserts {
+			if sim := similarity(del, ins, opts); sim > threshold {
+				weights[i][j] = sim
 			}
 		}
-		if bestJ >= 0 {
-			usedInserts[bestJ] = true
+	}
+
+	var pairings []LinePairing
+	for i, j := range maxWeightAssignment(weights) {
+		if j >= 0 && weights[i][j] > 0 {
 			pairings = append(pairings, LinePairing{
 				DeleteIndex: i,
-				InsertIndex: bestJ,
-				Similarity:  bestSim,
+				InsertIndex: j,
+				Similarity:  weights[i][j],
 			})
 		}
 	}
 	return pairings
 }
 
+// MaxOptimalPairingLines is the most deleted or inserted lines in a block
+// that FindOptimalPairings pairs with a maximum-weight matching.
+const MaxOptimalPairingLines = 500
+
+// maxWeightAssignment returns the column assigned to each row of weights,
+// or -1, so that no column is assigned twice and the total weight is the
+// largest possible. Every row is assigned when there are at least as many
+// columns as rows.
+func maxWeightAssignment(weights [][]float64) []int {
+	rows := len(weights)
+	if rows == 0 || len(weights[0]) == 0 {
+		assign := make([]int, rows)
+		for i := range assign {
+			assign[i] = -1
+		}
+		return assign
+	}
+	cols := len(weights[0])
+	if rows > cols {
+		transposed := make([][]float64, cols)
+		for j := range transposed {
+			transposed[j] = make([]float64, rows)
+			for i := range weights {
+				transposed[j][i] = weights[i][j]
+			}
+		}
+		assign := make([]int, rows)
+		for i := range assign {
+			assign[i] = -1
+		}
+		for j, i := range maxWeightAssignment(transposed) {
+			assign[i] = j
+		}
+		return assign
+	}
+
+	// The Hungarian algorithm with row and column potentials u and v,
+	// minimizing the negated weights. Rows and columns are numbered from 1,
+	// and column 0 is a sentinel; match[j] is the row assigned to column j.
+	u := make([]float64, rows+1)
+	v := make([]float64, cols+1)
+	match := make([]int, cols+1)
+	way := make([]int, cols+1)
+	for i := 1; i <= rows; i++ {
+		match[0] = i
+		j0 := 0
+		minv := make([]float64, cols+1)
+		for j := range minv {
+			minv[j] = math.Inf(1)
+		}
+		used := make([]bool, cols+1)
+		for match[j0] != 0 {
+			used[j0] = true
+			i0, delta, j1 := match[j0], math.Inf(1), 0
+			for j := 1; j <= cols; j++ {
+				if used[j] {
+					continue
+				}
+				if cur := -weights[i0-1][j-1] - u[i0] - v[j]; cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= cols; j++ {
+				if used[j] {
+					u[match[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+		}
+		// Augment along the path to the free column found
+		for j0 != 0 {
+			j1 := way[j0]
+			match[j0] = match[j1]
+			j0 = j1
+		}
+	}
+
+	assign := make([]int, rows)
+	for i := range assign {
+		assign[i] = -1
+	}
+	for j := 1; j <= cols; j++ {
+		if match[j] > 0 {
+			assign[match[j]-1] = j - 1
+		}
+	}
+	return assign
+}
+
 // LineDiffResult holds diff results for a single line in line-by-line mode.
 type LineDiffResult struct {
 	OldLineNum int    // line number in old file
 	NewLineNum int    // line number in new file
 	HasChanges bool   // true if this line contains changes
 	Output     string // formatted output for this line
+
+	// Type is Delete for a line only in the old file, Insert for a line
+	// only in the new file, and Equal for a line in both, changed or not.
+	Type Operation
+	// OldOutput and NewOutput are the old and new sides of the line,
+	// formatted like Output but with only deleted or only inserted tokens
+	// marked. Used by FormatSideBySide.
+	OldOutput string
+	NewOutput string
+	// OldText and NewText are the unformatted old and new lines, empty for
+	// the side a Delete or Insert line lacks.
+	OldText string
+	NewText string
+
+	// Moved is set by DetectMovedLines on a Delete line whose text was
+	// inserted elsewhere, and on that Insert line. MovePartner is the
+	// partner's line number: the NewLineNum of the Insert line for a moved
+	// Delete line, and the OldLineNum of the Delete line for a moved Insert
+	// line. It is 0 for lines that did not move.
+	Moved       bool
+	MovePartner int
+
+	// Stats holds the word counts for this line alone: both sides for a
+	// paired changed line, and only the old or new side for an unpaired
+	// Delete or Insert line. It is zero for unchanged lines.
+	Stats DiffStatistics
 }
 
 // WholeFileDiffResult holds the result of a whole-file diff operation.
@@ -73,6 +382,11 @@ type WholeFileDiffResult struct {
 	Formatted  string         // formatted output
 	HasChanges bool           // true if there are any differences
 	Statistics DiffStatistics // statistics about the diff
+
+	// TrailingNewlineDiff is true when only one of the texts ends with a
+	// newline. That newline is left out of the diff, so it is not shown as
+	// a change; FormatOptions.NoNewlineNote reports it instead.
+	TrailingNewlineDiff bool
 }
 
 // LineDiffOutput holds the results of a line-by-line diff operation.
@@ -82,21 +396,85 @@ type LineDiffOutput struct {
 	Statistics DiffStatistics   // aggregate statistics
 }
 
+// DiffAndFormat diffs two strings word by word and returns the diff
+// formatted per fmtOpts, ready to print. It is the recommended entry point
+// for most uses, and is shorthand for calling
+// DiffStringsWithPositionsAndPreprocessing and FormatDiffResultAdvanced.
+// Use DiffWholeFiles to also get statistics and the diffs themselves.
+func DiffAndFormat(text1, text2 string, opts Options, fmtOpts FormatOptions) string {
+	return FormatDiffResultAdvanced(DiffStringsWithPositionsAndPreprocessing(text1, text2, opts), fmtOpts)
+}
+
 // DiffWholeFiles performs a whole-file word-level diff and returns structured results.
-// This is the main API for comparing two complete texts.
+// This is the main API for comparing two complete texts. When only one text
+// ends with a newline, the texts are compared without it, and the result's
+// TrailingNewlineDiff is set.
 func DiffWholeFiles(text1, text2 string, opts Options, fmtOpts FormatOptions) WholeFileDiffResult {
+	text1, text2, newline1, newline2 := trimUnpairedNewline(text1, text2)
+	trailingNewlineDiff := newline1 != newline2
+
 	result := DiffStringsWithPositionsAndPreprocessing(text1, text2, opts)
 	st := ComputeStatistics(text1, text2, result.Diffs, opts)
 	formatted := FormatDiffResultAdvanced(result, fmtOpts)
+	if trailingNewlineDiff && fmtOpts.NoNewlineNote {
+		side := "new"
+		if newline2 {
+			side = "old"
+		}
+		if formatted != "" && !strings.HasSuffix(formatted, "\n") {
+			formatted += "\n"
+		}
+		formatted += "\\ No newline at end of " + side + " file"
+	}
 
 	return WholeFileDiffResult{
-		Result:     result,
-		Formatted:  formatted,
-		HasChanges: HasChanges(result.Diffs),
-		Statistics: st,
+		Result:              result,
+		Formatted:           formatted,
+		HasChanges:          HasChanges(result.Diffs),
+		Statistics:          st,
+		TrailingNewlineDiff: trailingNewlineDiff,
 	}
 }
 
+// trimUnpairedNewline removes the trailing newline of text1 or text2 when
+// only one of them ends with a newline, as DiffWholeFiles ignores that
+// difference. It also reports whether each text ended with a newline.
+func trimUnpairedNewline(text1, text2 string) (trimmed1, trimmed2 string, newline1, newline2 bool) {
+	newline1, newline2 = strings.HasSuffix(text1, "\n"), strings.HasSuffix(text2, "\n")
+	if newline1 != newline2 {
+		text1 = strings.TrimSuffix(text1, "\n")
+		text2 = strings.TrimSuffix(text2, "\n")
+	}
+	return text1, text2, newline1, newline2
+}
+
+// QuickStats returns the statistics DiffWholeFiles would report for the
+// texts, doing only the work they need: each text is tokenized once,
+// without positions, and nothing is formatted.
+func QuickStats(text1, text2 string, opts Options) DiffStatistics {
+	t := newTokenizer(opts)
+	return quickStats(text1, text2, &t, opts)
+}
+
+// quickStats implements QuickStats, tokenizing with t.
+func quickStats(text1, text2 string, t *tokenizer, opts Options) DiffStatistics {
+	text1, text2, _, _ = trimUnpairedNewline(text1, text2)
+	tokens1 := t.tokenize(text1)
+	tokens2 := t.tokenize(text2)
+
+	var diffs []Diff
+	if opts.overTokenLimit(len(tokens1), len(tokens2)) {
+		diffs = DiffStringsWithPositions(text1, text2, opts).Diffs
+	} else {
+		diffs = diffTokensWithOptions(tokens1, tokens2, opts)
+	}
+	return computeStatistics(len(tokens1), len(tokens2), diffs, opts)
+}
+
+// DefaultLineThreshold is the default minimum similarity for pairing a
+// deleted line with an inserted line under the "best" algorithm.
+const DefaultLineThreshold = 0.1
+
 // DiffLineByLine compares files line by line with proper line-level diff tracking.
 // This correctly tracks dual line numbers:
 // - For equal lines: both old and new line numbers increment
@@ -104,24 +482,128 @@ func DiffWholeFiles(text1, text2 string, opts Options, fmtOpts FormatOptions) Wh
 // - For inserted lines: only new line number increments
 //
 // The algorithm parameter controls how deleted and inserted lines are paired:
-// - "best": similarity-based matching (pairs lines with highest token overlap)
+// - "best": similarity-based matching (pairs lines scored most similar by opts.LineSimilarity)
+// - "auto": similarity-based matching with the threshold chosen by FindAutoPairings
+// - "optimal": similarity-based matching maximizing total similarity (FindOptimalPairings)
 // - "normal" or "fast": positional matching (pairs lines by position)
 func DiffLineByLine(text1, text2 string, opts Options, fmtOpts FormatOptions, algorithm string, threshold float64) LineDiffOutput {
+	var results []LineDiffResult
+	st, anyChanges := streamLineByLine(text1, text2, opts, fmtOpts, algorithm, threshold, func(r LineDiffResult) {
+		results = append(results, r)
+	})
+
+	return LineDiffOutput{
+		Lines:      results,
+		HasChanges: anyChanges,
+		Statistics: st,
+	}
+}
+
+// StreamLineByLine compares files line by line like DiffLineByLine, but calls
+// emit with each line result as soon as it is formatted instead of collecting
+// them. The line-level diff still needs both inputs in full, but no result
+// slice is built, so output can be written while later lines are diffed.
+func StreamLineByLine(text1, text2 string, opts Options, fmtOpts FormatOptions, algorithm string, threshold float64, emit func(LineDiffResult)) {
+	streamLineByLine(text1, text2, opts, fmtOpts, algorithm, threshold, emit)
+}
+
+// streamLineByLine implements DiffLineByLine and StreamLineByLine. Returns the
+// aggregate statistics and whether any line changed.
+func streamLineByLine(text1, text2 string, opts Options, fmtOpts FormatOptions, algorithm string, threshold float64, emit func(LineDiffResult)) (DiffStatistics, bool) {
 	lines1 := strings.Split(text1, "\n")
 	lines2 := strings.Split(text2, "\n")
+	return streamLines(lines1, lines2, 1, 1, opts, fmtOpts, algorithm, threshold, emit)
+}
+
+// diffLines diffs lines1 against lines2 as whole lines. With
+// opts.NormalizeEOL, a trailing "\r" is ignored in the comparison, but the
+// diffs still hold the original lines, the old line for Equal.
+func diffLines(lines1, lines2 []string, opts Options) []Diff {
+	if !opts.NormalizeEOL {
+		return DiffTokens(lines1, lines2)
+	}
+
+	diffs := DiffTokens(trimCRs(lines1), trimCRs(lines2))
+	i1, i2 := 0, 0
+	for k, d := range diffs {
+		switch d.Type {
+		case Equal:
+			diffs[k].Token = lines1[i1]
+			i1++
+			i2++
+		case Delete:
+			diffs[k].Token = lines1[i1]
+			i1++
+		case Insert:
+			diffs[k].Token = lines2[i2]
+			i2++
+		}
+	}
+	return diffs
+}
 
+// trimCRs returns lines with a trailing "\r" removed from each.
+func trimCRs(lines []string) []string {
+	trimmed := make([]string, len(lines))
+	for i, line := range lines {
+		trimmed[i] = strings.TrimSuffix(line, "\r")
+	}
+	return trimmed
+}
+
+// SliceLines returns lines start through end of text, numbered from 1,
+// with their line endings. Bounds outside the text are clamped to it: a
+// start below 1 is the first line, and an end of 0 or past the last line
+// is the last line. Returns "" if start is past the last line or end is
+// before start.
+func SliceLines(text string, start, end int) string {
+	pos, line := 0, 1
+	next := func() {
+		if nl := strings.IndexByte(text[pos:], '\n'); nl >= 0 {
+			pos += nl + 1
+		} else {
+			pos = len(text)
+		}
+		line++
+	}
+	for line < start && pos < len(text) {
+		next()
+	}
+	begin := pos
+	if end <= 0 {
+		return text[begin:]
+	}
+	for line <= end && pos < len(text) {
+		next()
+	}
+	return text[begin:pos]
+}
+
+// streamLines diffs lines1 against lines2 as streamLineByLine does, numbering
+// them from oldStart and newStart.
+func streamLines(lines1, lines2 []string, oldStart, newStart int, opts Options, fmtOpts FormatOptions, algorithm string, threshold float64, emit func(LineDiffResult)) (DiffStatistics, bool) {
 	// Create format options for per-line formatting (no line numbers here)
 	lineFmtOpts := fmtOpts
 	lineFmtOpts.ShowLineNumbers = false
+	// Every line is tokenized, so compile a token pattern only once
+	opts = opts.withTokenPattern()
+
+	// With SquashBlankLines, each run of blank lines is one unit of the
+	// line-level diff, and runs1 and runs2 hold the lines of each unit.
+	var runs1, runs2 [][]string
+	if opts.SquashBlankLines {
+		lines1, runs1 = squashBlankLines(lines1)
+		lines2, runs2 = squashBlankLines(lines2)
+	}
 
 	// First, do a line-level diff to find corresponding lines
-	lineDiffs := DiffTokens(lines1, lines2)
+	lineDiffs := diffLines(lines1, lines2, opts)
 
-	var results []LineDiffResult
 	var anyChanges bool
 	var totalStats DiffStatistics
-	oldLineNum := 1
-	newLineNum := 1
+	oldLineNum := oldStart
+	newLineNum := newStart
+	u1, u2 := 0, 0 // indices into lines1 and lines2
 
 	i := 0
 	for i < len(lineDiffs) {
@@ -129,14 +611,40 @@ func DiffLineByLine(text1, text2 string, opts Options, fmtOpts FormatOptions, al
 
 		switch ld.Type {
 		case Equal:
-			results = append(results, LineDiffResult{
-				OldLineNum: oldLineNum,
-				NewLineNum: newLineNum,
-				HasChanges: false,
-				Output:     ld.Token,
-			})
-			oldLineNum++
-			newLineNum++
+			// Runs of blank lines of different lengths are Equal units:
+			// the lines both have are unchanged, and the rest is one row
+			n1, n2 := runLen(runs1, u1), runLen(runs2, u2)
+			for k := 0; k < min(n1, n2); k++ {
+				oldText, newText := ld.Token, lines2[u2]
+				if runs1 != nil {
+					oldText, newText = runs1[u1][k], runs2[u2][k]
+				}
+				output := expandLeadingTabs(oldText, fmtOpts.TabWidth)
+				emit(LineDiffResult{
+					OldLineNum: oldLineNum,
+					NewLineNum: newLineNum,
+					HasChanges: false,
+					Output:     output,
+					Type:       Equal,
+					OldOutput:  output,
+					NewOutput:  output,
+					OldText:    oldText,
+					NewText:    newText,
+				})
+				oldLineNum++
+				newLineNum++
+			}
+			if n1 > n2 {
+				anyChanges = true
+				emit(blankRunResult(Delete, runs1[u1][n2:], oldLineNum, newLineNum, lineFmtOpts))
+				oldLineNum += n1 - n2
+			} else if n2 > n1 {
+				anyChanges = true
+				emit(blankRunResult(Insert, runs2[u2][n1:], oldLineNum, newLineNum, lineFmtOpts))
+				newLineNum += n2 - n1
+			}
+			u1++
+			u2++
 			i++
 
 		case Delete:
@@ -154,16 +662,26 @@ func DiffLineByLine(text1, text2 string, opts Options, fmtOpts FormatOptions, al
 				i++
 			}
 
+			del0, ins0 := u1, u2
+			u1 += len(deletes)
+			u2 += len(inserts)
+
 			// Any deletes or inserts mean we have changes
 			anyChanges = true
 
 			// Get pairings based on selected algorithm
 			var pairings []LinePairing
-			switch algorithm {
-			case "best":
-				pairings = FindSimilarityPairings(deletes, inserts, opts, threshold)
-			default:
-				pairings = FindPositionalPairings(deletes, inserts)
+			if runs1 == nil {
+				pairings = pairLines(deletes, inserts, opts, algorithm, threshold)
+			} else {
+				// A run of blank lines is a row of its own, so only single
+				// lines are paired
+				dels := singleLines(runs1[del0 : del0+len(deletes)])
+				ins := singleLines(runs2[ins0 : ins0+len(inserts)])
+				pairings = pairLines(pick(deletes, dels), pick(inserts, ins), opts, algorithm, threshold)
+				for k, p := range pairings {
+					pairings[k].DeleteIndex, pairings[k].InsertIndex = dels[p.DeleteIndex], ins[p.InsertIndex]
+				}
 			}
 
 			// Build sets of which indices are paired
@@ -185,19 +703,27 @@ func DiffLineByLine(text1, text2 string, opts Options, fmtOpts FormatOptions, al
 						if !outputInserts[j] {
 							if _, isPaired := pairedInserts[j]; !isPaired {
 								outputInserts[j] = true
+								if n := runLen(runs2, ins0+j); n > 1 {
+									emit(blankRunResult(Insert, runs2[ins0+j], oldLineNum, newLineNum, lineFmtOpts))
+									newLineNum += n
+									continue
+								}
 
 								insertDiffs := []Diff{{Type: Insert, Token: inserts[j]}}
 								lineSt := ComputeStatistics("", inserts[j], insertDiffs, opts)
-								totalStats.NewWords += lineSt.NewWords
-								totalStats.InsertedWords += lineSt.InsertedWords
+								totalStats.Add(lineSt)
 
 								output := FormatDiffsAdvanced(insertDiffs, lineFmtOpts)
 
-								results = append(results, LineDiffResult{
+								emit(LineDiffResult{
 									OldLineNum: oldLineNum,
 									NewLineNum: newLineNum,
 									HasChanges: true,
 									Output:     output,
+									Type:       Insert,
+									NewOutput:  output,
+									NewText:    inserts[j],
+									Stats:      lineSt,
 								})
 								newLineNum++
 							}
@@ -212,36 +738,45 @@ func DiffLineByLine(text1, text2 string, opts Options, fmtOpts FormatOptions, al
 					wordResult := DiffStringsWithPositionsAndPreprocessing(oldLine, newLine, opts)
 
 					lineSt := ComputeStatistics(oldLine, newLine, wordResult.Diffs, opts)
-					totalStats.OldWords += lineSt.OldWords
-					totalStats.NewWords += lineSt.NewWords
-					totalStats.DeletedWords += lineSt.DeletedWords
-					totalStats.InsertedWords += lineSt.InsertedWords
-					totalStats.CommonWords += lineSt.CommonWords
+					totalStats.Add(lineSt)
 
 					output := FormatDiffResultAdvanced(wordResult, lineFmtOpts)
+					oldOutput, newOutput := formatLineSides(wordResult, lineFmtOpts)
 
-					results = append(results, LineDiffResult{
+					emit(LineDiffResult{
 						OldLineNum: oldLineNum,
 						NewLineNum: newLineNum,
 						HasChanges: true,
 						Output:     output,
+						Type:       Equal,
+						OldOutput:  oldOutput,
+						NewOutput:  newOutput,
+						OldText:    oldLine,
+						NewText:    newLine,
+						Stats:      lineSt,
 					})
 					oldLineNum++
 					newLineNum++
+				} else if n := runLen(runs1, del0+delIdx); n > 1 {
+					emit(blankRunResult(Delete, runs1[del0+delIdx], oldLineNum, newLineNum, lineFmtOpts))
+					oldLineNum += n
 				} else {
 					// Unpaired delete
 					deleteDiffs := []Diff{{Type: Delete, Token: deletes[delIdx]}}
 					lineSt := ComputeStatistics(deletes[delIdx], "", deleteDiffs, opts)
-					totalStats.OldWords += lineSt.OldWords
-					totalStats.DeletedWords += lineSt.DeletedWords
+					totalStats.Add(lineSt)
 
 					output := FormatDiffsAdvanced(deleteDiffs, lineFmtOpts)
 
-					results = append(results, LineDiffResult{
+					emit(LineDiffResult{
 						OldLineNum: oldLineNum,
 						NewLineNum: newLineNum,
 						HasChanges: true,
 						Output:     output,
+						Type:       Delete,
+						OldOutput:  output,
+						OldText:    deletes[delIdx],
+						Stats:      lineSt,
 					})
 					oldLineNum++
 				}
@@ -250,18 +785,26 @@ func DiffLineByLine(text1, text2 string, opts Options, fmtOpts FormatOptions, al
 			// Output any remaining unpaired inserts
 			for j := 0; j < len(inserts); j++ {
 				if !outputInserts[j] {
+					if n := runLen(runs2, ins0+j); n > 1 {
+						emit(blankRunResult(Insert, runs2[ins0+j], oldLineNum, newLineNum, lineFmtOpts))
+						newLineNum += n
+						continue
+					}
 					insertDiffs := []Diff{{Type: Insert, Token: inserts[j]}}
 					lineSt := ComputeStatistics("", inserts[j], insertDiffs, opts)
-					totalStats.NewWords += lineSt.NewWords
-					totalStats.InsertedWords += lineSt.InsertedWords
+					totalStats.Add(lineSt)
 
 					output := FormatDiffsAdvanced(insertDiffs, lineFmtOpts)
 
-					results = append(results, LineDiffResult{
+					emit(LineDiffResult{
 						OldLineNum: oldLineNum,
 						NewLineNum: newLineNum,
 						HasChanges: true,
 						Output:     output,
+						Type:       Insert,
+						NewOutput:  output,
+						NewText:    inserts[j],
+						Stats:      lineSt,
 					})
 					newLineNum++
 				}
@@ -270,30 +813,360 @@ func DiffLineByLine(text1, text2 string, opts Options, fmtOpts FormatOptions, al
 		case Insert:
 			// Pure insertion
 			anyChanges = true
+			if n := runLen(runs2, u2); n > 1 {
+				emit(blankRunResult(Insert, runs2[u2], oldLineNum, newLineNum, lineFmtOpts))
+				newLineNum += n
+				u2++
+				i++
+				break
+			}
 
 			insertDiffs := []Diff{{Type: Insert, Token: ld.Token}}
 			lineSt := ComputeStatistics("", ld.Token, insertDiffs, opts)
-			totalStats.NewWords += lineSt.NewWords
-			totalStats.InsertedWords += lineSt.InsertedWords
+			totalStats.Add(lineSt)
 
 			output := FormatDiffsAdvanced(insertDiffs, lineFmtOpts)
 
-			results = append(results, LineDiffResult{
+			emit(LineDiffResult{
 				OldLineNum: oldLineNum,
 				NewLineNum: newLineNum,
 				HasChanges: true,
 				Output:     output,
+				Type:       Insert,
+				NewOutput:  output,
+				NewText:    ld.Token,
+				Stats:      lineSt,
 			})
 			newLineNum++
+			u2++
 			i++
 		}
 	}
 
-	return LineDiffOutput{
-		Lines:      results,
-		HasChanges: anyChanges,
-		Statistics: totalStats,
+	return totalStats, anyChanges
+}
+
+// pairLines pairs deleted and inserted lines with the named algorithm, as
+// DiffLineByLine does.
+func pairLines(deletes, inserts []string, opts Options, algorithm string, threshold float64) []LinePairing {
+	switch algorithm {
+	case "best":
+		return FindSimilarityPairings(deletes, inserts, opts, threshold, opts.LineSimilarity)
+	case "auto":
+		return FindAutoPairings(deletes, inserts, opts)
+	case "optimal":
+		return FindOptimalPairings(deletes, inserts, opts, threshold)
+	default:
+		return FindPositionalPairings(deletes, inserts)
+	}
+}
+
+// singleLines returns the indices of the runs that are a single line.
+func singleLines(runs [][]string) []int {
+	var indices []int
+	for i, run := range runs {
+		if len(run) == 1 {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// pick returns the lines at indices.
+func pick(lines []string, indices []int) []string {
+	picked := make([]string, len(indices))
+	for k, i := range indices {
+		picked[k] = lines[i]
+	}
+	return picked
+}
+
+// squashBlankLines returns lines with each run of blank lines, lines of
+// only whitespace, replaced by its first line, and the lines each returned
+// line stands for.
+func squashBlankLines(lines []string) ([]string, [][]string) {
+	var squashed []string
+	var runs [][]string
+	for i := 0; i < len(lines); {
+		j := i + 1
+		if strings.TrimSpace(lines[i]) == "" {
+			for j < len(lines) && strings.TrimSpace(lines[j]) == "" {
+				j++
+			}
+		}
+		squashed = append(squashed, lines[i])
+		runs = append(runs, lines[i:j])
+		i = j
+	}
+	return squashed, runs
+}
+
+// runLen returns the number of lines unit i of a line-level diff stands
+// for: the length of runs[i], or 1 without SquashBlankLines.
+func runLen(runs [][]string, i int) int {
+	if runs == nil {
+		return 1
+	}
+	return len(runs[i])
+}
+
+// blankRunResult returns the row for a run of blank lines that only the old
+// (op Delete) or the new (op Insert) text has under SquashBlankLines. Its
+// output is an annotation with the number of lines, such as
+// "{+<2 blank lines>+}"; its text is the lines themselves.
+func blankRunResult(op Operation, run []string, oldLineNum, newLineNum int, fmtOpts FormatOptions) LineDiffResult {
+	note := fmt.Sprintf("<%d blank lines>", len(run))
+	if len(run) == 1 {
+		note = "<1 blank line>"
+	}
+	output := FormatDiffsAdvanced([]Diff{{Type: op, Token: note}}, fmtOpts)
+	result := LineDiffResult{
+		OldLineNum: oldLineNum,
+		NewLineNum: newLineNum,
+		HasChanges: true,
+		Output:     output,
+		Type:       op,
+	}
+	if op == Delete {
+		result.OldOutput, result.OldText = output, strings.Join(run, "\n")
+	} else {
+		result.NewOutput, result.NewText = output, strings.Join(run, "\n")
+	}
+	return result
+}
+
+// MoveSimilarityThreshold is the minimum ComputeTokenSimilarity score, under
+// DefaultOptions, for DetectMovedLines to treat a deleted line and an
+// inserted line as the same line moved.
+const MoveSimilarityThreshold = 0.8
+
+// DetectMovedLines finds lines that DiffLineByLine reported as deleted in one
+// place and inserted in another, and marks each such pair as Moved with its
+// MovePartner. A Delete line and an Insert line pair when their similarity is
+// at least MoveSimilarityThreshold; blank lines never pair. Pairing is
+// one-to-one: the most similar pairs are taken first, with ties broken by
+// line order. Lines are otherwise unchanged, and output is not modified.
+func DetectMovedLines(output LineDiffOutput) LineDiffOutput {
+	var deletes, inserts []int
+	for i, line := range output.Lines {
+		switch {
+		case line.Type == Delete && strings.TrimSpace(line.OldText) != "":
+			deletes = append(deletes, i)
+		case line.Type == Insert && strings.TrimSpace(line.NewText) != "":
+			inserts = append(inserts, i)
+		}
+	}
+
+	type candidate struct {
+		del, ins   int // indices into output.Lines
+		similarity float64
+	}
+	var candidates []candidate
+	opts := DefaultOptions()
+	for _, d := range deletes {
+		for _, n := range inserts {
+			sim := ComputeTokenSimilarity(output.Lines[d].OldText, output.Lines[n].NewText, opts)
+			if sim >= MoveSimilarityThreshold {
+				candidates = append(candidates, candidate{d, n, sim})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].similarity > candidates[j].similarity
+	})
+
+	lines := make([]LineDiffResult, len(output.Lines))
+	copy(lines, output.Lines)
+	for _, c := range candidates {
+		if lines[c.del].Moved || lines[c.ins].Moved {
+			continue
+		}
+		lines[c.del].Moved = true
+		lines[c.del].MovePartner = lines[c.ins].NewLineNum
+		lines[c.ins].Moved = true
+		lines[c.ins].MovePartner = lines[c.del].OldLineNum
+	}
+
+	output.Lines = lines
+	return output
+}
+
+// formatLineSides formats the old and new sides of a changed line: the old
+// side without inserted tokens and the new side without deleted tokens.
+func formatLineSides(result DiffResult, fmtOpts FormatOptions) (string, string) {
+	return formatLineSide(result, Delete, fmtOpts), formatLineSide(result, Insert, fmtOpts)
+}
+
+// formatLineSide formats one side of a changed line: the old text with its
+// deleted tokens marked for Delete, or the new text with its inserted tokens
+// marked for Insert. Spacing is copied from that side's text alone, so no
+// gap is left where the other side's tokens were.
+func formatLineSide(result DiffResult, side Operation, fmtOpts FormatOptions) string {
+	text, positions := result.Text1, result.Positions1
+	suppressed := fmtOpts.NoDeleted
+	if side == Insert {
+		text, positions = result.Text2, result.Positions2
+		suppressed = fmtOpts.NoInserted
+	}
+
+	var kept []Diff
+	for _, d := range result.Diffs {
+		if d.Type == Equal || d.Type == side {
+			kept = append(kept, d)
+		}
+	}
+	if len(kept) != len(positions) {
+		// Without positions, fall back to suppressing the other side
+		if side == Delete {
+			fmtOpts.NoInserted = true
+		} else {
+			fmtOpts.NoDeleted = true
+		}
+		return FormatDiffResultAdvanced(result, fmtOpts)
+	}
+
+	var sb strings.Builder
+	last := 0
+	for i := 0; i < len(kept); {
+		runStart := i
+		for i < len(kept) && kept[i].Type == kept[runStart].Type {
+			i++
+		}
+		start, end := positions[runStart].Start, positions[i-1].End
+		gap := text[last:start]
+		last = end
+
+		if kept[runStart].Type == Equal {
+			if !fmtOpts.NoCommon {
+				sb.WriteString(gap)
+				sb.WriteString(formatCommonText(text[start:end], fmtOpts))
+			}
+			continue
+		}
+		sb.WriteString(gap)
+		if !suppressed {
+			sb.WriteString(formatNonEqualToken(Diff{Type: side, Token: text[start:end]}, fmtOpts))
+		}
+	}
+	return sb.String()
+}
+
+// FormatSideBySide renders a line-by-line diff in two columns: the old side
+// of each line on the left and the new side on the right, each truncated to
+// width columns. The columns are separated by " | " for changed lines and
+// by spaces for equal lines. A line only in the old file has an empty right
+// column and a line only in the new file an empty left column. Columns are
+// measured with VisibleWidth, and tabs expand to stops every
+// fmtOpts.TabWidth columns, or 8 if it is 0.
+func FormatSideBySide(output LineDiffOutput, width int, fmtOpts FormatOptions) string {
+	if width < 1 {
+		width = 1
+	}
+	tabWidth := fmtOpts.TabWidth
+	if tabWidth < 1 {
+		tabWidth = 8
+	}
+
+	rows := make([]string, len(output.Lines))
+	for i, line := range output.Lines {
+		var left, right string
+		if line.Type != Insert {
+			left = line.OldOutput
+		}
+		if line.Type != Delete {
+			right = line.NewOutput
+		}
+
+		gutter := "   "
+		if line.Moved {
+			gutter = " ~ "
+		} else if line.HasChanges {
+			gutter = " | "
+		}
+
+		left, leftWidth := fitColumn(left, width, tabWidth)
+		right, _ = fitColumn(right, width, tabWidth)
+		row := left + strings.Repeat(" ", width-leftWidth) + gutter + right
+		if right == "" {
+			row = strings.TrimRight(row, " ")
+		}
+		rows[i] = row
+	}
+	return strings.Join(rows, "\n")
+}
+
+// fitColumn truncates s to at most width visible columns and returns it with
+// its visible width, measured as VisibleWidth does except that tabs expand
+// to stops every tabWidth columns. Escape sequences are kept and take no
+// columns; if s is cut while a color is active, a reset is appended.
+func fitColumn(s string, width, tabWidth int) (string, int) {
+	var sb strings.Builder
+	col := 0
+	colored := false
+	joined := false
+	for i := 0; i < len(s); {
+		if s[i] == '\033' {
+			end := escapeEnd(s, i)
+			seq := s[i:end]
+			sb.WriteString(seq)
+			if strings.HasSuffix(seq, "m") {
+				colored = seq != ANSIReset && seq != "\033[m"
+			}
+			i = end
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		w := runeWidth(r)
+		switch {
+		case joined:
+			w = 0
+		case r == '\t':
+			w = tabWidth - col%tabWidth
+		}
+		joined = r == zeroWidthJoiner
+		if col+w > width {
+			if colored {
+				sb.WriteString(ANSIReset)
+			}
+			return sb.String(), col
+		}
+		if r == '\t' {
+			sb.WriteString(strings.Repeat(" ", w))
+		} else {
+			sb.WriteString(s[i : i+size])
+		}
+		col += w
+		i += size
+	}
+	return sb.String(), col
+}
+
+// escapeEnd returns the index just past the escape sequence starting at
+// s[i]. CSI sequences ("\033[" ... final byte) and OSC sequences, such as
+// OSC8Link's ("\033]" ... "\033\\" or BEL), are consumed whole; any other
+// escape covers the ESC byte and the one after it.
+func escapeEnd(s string, i int) int {
+	if i+1 < len(s) && s[i+1] == '[' {
+		for j := i + 2; j < len(s); j++ {
+			if s[j] >= 0x40 && s[j] <= 0x7e {
+				return j + 1
+			}
+		}
+		return len(s)
+	}
+	if i+1 < len(s) && s[i+1] == ']' {
+		for j := i + 2; j < len(s); j++ {
+			switch {
+			case s[j] == '\a':
+				return j + 1
+			case s[j] == '\033' && j+1 < len(s) && s[j+1] == '\\':
+				return j + 2
+			}
+		}
+		return len(s)
 	}
+	return min(i+2, len(s))
 }
 
 // FilterWithContext returns only the lines that are changes or within contextLines
@@ -302,24 +1175,71 @@ func FilterWithContext(lines []LineDiffResult, contextLines int) []LineDiffResul
 	if contextLines <= 0 {
 		return lines
 	}
+	return selectedLines(lines, contextSelection(lines, contextLines))
+}
 
+// FilterWithContextRegex returns only the lines in the blocks that contain
+// changes, for showing whole functions rather than a fixed number of lines
+// around a change. A block starts at a line matching pattern, such as
+// "^func " for Go, and runs up to the next one; the lines before the first
+// match form a block too. Lines are matched by their new text, or old text
+// for a deleted line. Returns an error if pattern is not a valid regular
+// expression.
+func FilterWithContextRegex(lines []LineDiffResult, pattern string) ([]LineDiffResult, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid context pattern %q: %w", pattern, err)
+	}
+	return selectedLines(lines, blockSelection(lines, re)), nil
+}
+
+// contextSelection reports, for each line, whether it is a change or within
+// contextLines of one. contextLines of 0 or less selects every line.
+func contextSelection(lines []LineDiffResult, contextLines int) []bool {
 	toPrint := make([]bool, len(lines))
 	for i, r := range lines {
-		if r.HasChanges {
-			start := i - contextLines
-			if start < 0 {
-				start = 0
-			}
-			end := i + contextLines + 1
-			if end > len(lines) {
-				end = len(lines)
-			}
-			for j := start; j < end; j++ {
+		if contextLines <= 0 {
+			toPrint[i] = true
+		} else if r.HasChanges {
+			for j := max(0, i-contextLines); j < min(len(lines), i+contextLines+1); j++ {
 				toPrint[j] = true
 			}
 		}
 	}
+	return toPrint
+}
+
+// blockSelection reports, for each line, whether it is in a block with a
+// change, blocks being as described for FilterWithContextRegex.
+func blockSelection(lines []LineDiffResult, re *regexp.Regexp) []bool {
+	toPrint := make([]bool, len(lines))
+	start, changed := 0, false
+	for i := 0; i <= len(lines); i++ {
+		if i < len(lines) && (i == start || !re.MatchString(lineText(lines[i]))) {
+			changed = changed || lines[i].HasChanges
+			continue
+		}
+		for j := start; changed && j < i; j++ {
+			toPrint[j] = true
+		}
+		if i < len(lines) {
+			start, changed = i, lines[i].HasChanges
+		}
+	}
+	return toPrint
+}
 
+// lineText returns the text of a line as it reads after the change: its new
+// text, or its old text if it was deleted.
+func lineText(r LineDiffResult) string {
+	if r.Type == Delete {
+		return r.OldText
+	}
+	return r.NewText
+}
+
+// selectedLines returns the lines whose toPrint entry is set.
+func selectedLines(lines []LineDiffResult, toPrint []bool) []LineDiffResult {
 	var result []LineDiffResult
 	for i, r := range lines {
 		if toPrint[i] {
@@ -328,3 +1248,152 @@ func FilterWithContext(lines []LineDiffResult, contextLines int) []LineDiffResul
 	}
 	return result
 }
+
+// FormatWithContext renders the changed lines and the contextLines lines
+// around each change, one per line, with fmtOpts.ContextSeparator on its own
+// line between groups that are not adjacent. With fmtOpts.ShowLineNumbers,
+// each line is prefixed with its old:new line numbers. contextLines of 0 or
+// less shows every line.
+func FormatWithContext(lines []LineDiffResult, contextLines int, fmtOpts FormatOptions) string {
+	out := renderContextLines(lines, contextLines, fmtOpts, func(r LineDiffResult) string {
+		if fmtOpts.ShowLineNumbers {
+			return lineNumberPrefix(r.OldLineNum, r.NewLineNum, r.Type, r.HasChanges, fmtOpts) + r.Output
+		}
+		return r.Output
+	})
+	return strings.Join(out, "\n")
+}
+
+// RenderLineDiff renders a line-by-line diff as the tokendiff command prints
+// it without line numbers: each line is prefixed with a marker column
+// (fmtOpts.ChangeMarker, "| " by default, for a changed line, "~" padded
+// to its width for a moved one, and fmtOpts.EqualMarker otherwise, colored
+// when fmtOpts.UseColor) and its line number, new if it has one and old
+// otherwise, right-aligned in four columns. With contextLines greater than
+// 0, only changes and that many lines around them are rendered, with
+// fmtOpts.ContextSeparator between groups that are not adjacent. Every line,
+// including the last, ends in a newline.
+func RenderLineDiff(output LineDiffOutput, contextLines int, fmtOpts FormatOptions) string {
+	changeMarker := fmtOpts.ChangeMarker
+	if changeMarker == "" {
+		changeMarker = DefaultChangeMarker
+	}
+	width := utf8.RuneCountInString(changeMarker)
+	equalMarker := fmtOpts.EqualMarker
+	if equalMarker == "" {
+		equalMarker = strings.Repeat(" ", width)
+	}
+	moveMarker := "~" + strings.Repeat(" ", max(width-1, 0))
+	out := renderContextLines(output.Lines, contextLines, fmtOpts, func(r LineDiffResult) string {
+		prefix := equalMarker
+		if r.Moved {
+			prefix = moveMarker
+			if fmtOpts.UseColor {
+				prefix = ANSIMoveColor + moveMarker + ANSIReset
+			}
+		} else if r.HasChanges {
+			prefix = changeMarker
+			if fmtOpts.UseColor {
+				prefix = ANSIChangeColor + changeMarker + ANSIReset
+			}
+		}
+		lineNum := r.NewLineNum
+		if lineNum == 0 {
+			lineNum = r.OldLineNum
+		}
+		return fmt.Sprintf("%s%4d: %s", prefix, lineNum, r.Output) + lineStatsSuffix(r, fmtOpts)
+	})
+	return joinLines(out)
+}
+
+// RenderLineDiffWithNumbers renders a line-by-line diff as the tokendiff
+// command prints it with line numbers: old and new line numbers in columns
+// of fmtOpts.LineNumWidth plus one and plus two, separated by ":" ("~" for
+// a moved line), then the line. A zero line number, and with
+// fmtOpts.LineNumbersOnChangesOnly any number on an unchanged line, is left
+// blank. With fmtOpts.LineNumberSide, only the old or only the new number is
+// shown, in a column of LineNumWidth plus one followed by ": ", and left
+// blank on lines only the other file has. Context and separators are
+// handled as by RenderLineDiff.
+func RenderLineDiffWithNumbers(output LineDiffOutput, contextLines int, fmtOpts FormatOptions) string {
+	oldWidth := fmtOpts.LineNumWidth + 1
+	newWidth := fmtOpts.LineNumWidth + 2
+	out := renderContextLines(output.Lines, contextLines, fmtOpts, func(r LineDiffResult) string {
+		oldStr := fmt.Sprintf("%*d", oldWidth, r.OldLineNum)
+		newStr := fmt.Sprintf("%-*d", newWidth, r.NewLineNum)
+		unnumbered := fmtOpts.LineNumbersOnChangesOnly && !r.HasChanges
+		if r.OldLineNum == 0 || unnumbered {
+			oldStr = strings.Repeat(" ", oldWidth)
+		}
+		if r.NewLineNum == 0 || unnumbered {
+			newStr = strings.Repeat(" ", newWidth)
+		}
+		sep := ":"
+		if r.Moved {
+			sep = "~"
+		}
+		switch fmtOpts.LineNumberSide {
+		case LineNumbersOld:
+			if r.Type == Insert {
+				oldStr = strings.Repeat(" ", oldWidth)
+			}
+			return oldStr + sep + " " + r.Output + lineStatsSuffix(r, fmtOpts)
+		case LineNumbersNew:
+			newStr = fmt.Sprintf("%*d", oldWidth, r.NewLineNum)
+			if r.NewLineNum == 0 || unnumbered || r.Type == Delete {
+				newStr = strings.Repeat(" ", oldWidth)
+			}
+			return newStr + sep + " " + r.Output + lineStatsSuffix(r, fmtOpts)
+		}
+		return oldStr + sep + newStr + r.Output + lineStatsSuffix(r, fmtOpts)
+	})
+	return joinLines(out)
+}
+
+// lineStatsSuffix returns the deleted and inserted word counts to show
+// after a changed line with fmtOpts.ShowLineStats, or "".
+func lineStatsSuffix(r LineDiffResult, fmtOpts FormatOptions) string {
+	if !fmtOpts.ShowLineStats || !r.HasChanges {
+		return ""
+	}
+	return fmt.Sprintf("  (-%d +%d)", r.Stats.DeletedWords, r.Stats.InsertedWords)
+}
+
+// renderContextLines renders the lines selected by contextLines, as for
+// FilterWithContext, or by fmtOpts.ContextPattern if it is a valid pattern,
+// as for FilterWithContextRegex, with fmtOpts.ContextSeparator between
+// groups that are not adjacent unless it is empty. contextLines of 0 or less
+// selects every line.
+func renderContextLines(lines []LineDiffResult, contextLines int, fmtOpts FormatOptions, render func(LineDiffResult) string) []string {
+	separator := fmtOpts.ContextSeparator
+	toPrint := contextSelection(lines, contextLines)
+	if fmtOpts.ContextPattern != "" {
+		if re, err := regexp.Compile(fmtOpts.ContextPattern); err == nil {
+			toPrint = blockSelection(lines, re)
+		}
+	}
+
+	var out []string
+	lastPrinted := -1
+	for i, r := range lines {
+		if !toPrint[i] {
+			continue
+		}
+		if lastPrinted >= 0 && i > lastPrinted+1 && separator != "" {
+			out = append(out, separator)
+		}
+		out = append(out, render(r))
+		lastPrinted = i
+	}
+	return out
+}
+
+// joinLines joins lines with a newline after each, including the last.
+func joinLines(lines []string) string {
+	var sb strings.Builder
+	for _, line := range lines {
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
@@ -1,6 +1,9 @@
 package tokendiff
 
 import (
+	"fmt"
+	"math"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -102,7 +105,7 @@ func TestFindSimilarityPairings(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			pairings := FindSimilarityPairings(tt.deletes, tt.inserts, opts, tt.threshold)
+			pairings := FindSimilarityPairings(tt.deletes, tt.inserts, opts, tt.threshold, nil)
 			if len(pairings) != tt.wantPairs {
 				t.Errorf("FindSimilarityPairings() returned %d pairings, want %d",
 					len(pairings), tt.wantPairs)
@@ -111,6 +114,321 @@ func TestFindSimilarityPairings(t *testing.T) {
 	}
 }
 
+func TestFindSimilarityPairingsDeterministic(t *testing.T) {
+	opts := Options{Delimiters: "()"}
+	inserts := []string{
+		"func loadConfig(path string)",
+		"func saveConfig(path string, cfg Config)",
+		"return nil",
+	}
+	deletes := []string{
+		"func loadConfig(name string)",
+		"func saveConfig(name string, cfg Config)",
+		"return err",
+	}
+
+	// pairText maps each delete's text to its paired insert's text, which
+	// should not depend on the order deletes are listed in.
+	pairText := func(deletes []string) map[string]string {
+		m := make(map[string]string)
+		for _, p := range FindSimilarityPairings(deletes, inserts, opts, 0.1, nil) {
+			m[deletes[p.DeleteIndex]] = inserts[p.InsertIndex]
+		}
+		return m
+	}
+
+	want := pairText(deletes)
+	if len(want) != 3 {
+		t.Fatalf("expected 3 pairings, got %v", want)
+	}
+
+	shuffled := []string{deletes[2], deletes[0], deletes[1]}
+	if got := pairText(shuffled); !reflect.DeepEqual(got, want) {
+		t.Errorf("pairings changed after shuffling deletes:\ngot:  %v\nwant: %v", got, want)
+	}
+
+	// Repeated calls produce identical results
+	first := FindSimilarityPairings(deletes, inserts, opts, 0.1, nil)
+	for i := 0; i < 10; i++ {
+		if got := FindSimilarityPairings(deletes, inserts, opts, 0.1, nil); !reflect.DeepEqual(got, first) {
+			t.Fatalf("FindSimilarityPairings() not stable: got %v, want %v", got, first)
+		}
+	}
+}
+
+func TestFindSimilarityPairingsTieBreaking(t *testing.T) {
+	opts := DefaultOptions()
+	// Every delete is equally similar to every insert
+	deletes := []string{"a x", "a y"}
+	inserts := []string{"a p", "a q"}
+
+	got := FindSimilarityPairings(deletes, inserts, opts, 0.1, nil)
+	if len(got) != 2 {
+		t.Fatalf("FindSimilarityPairings() = %v, want 2 pairings", got)
+	}
+	want := []LinePairing{
+		{DeleteIndex: 0, InsertIndex: 0, Similarity: got[0].Similarity},
+		{DeleteIndex: 1, InsertIndex: 1, Similarity: got[1].Similarity},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindSimilarityPairings() = %v, want %v", got, want)
+	}
+}
+
+func TestFindSimilarityPairingsSimilarityFunc(t *testing.T) {
+	deletes := []string{"alpha beta gamma delta"}
+	inserts := []string{"beta alpha gamma delta", "alpha beta gamma zeta"}
+
+	tests := []struct {
+		name       string
+		similarity SimilarityFunc
+		wantInsert int
+	}{
+		// Both inserts score 0.6; the tie goes to the lower insert index
+		{"token (nil)", nil, 0},
+		{"token", ComputeTokenSimilarity, 0},
+		// The swap costs two edits, the replaced word one
+		{"edit", ComputeEditSimilarity, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := FindSimilarityPairings(deletes, inserts, DefaultOptions(), 0.1, tt.similarity)
+			if len(got) != 1 || got[0].InsertIndex != tt.wantInsert {
+				t.Errorf("FindSimilarityPairings() = %v, want delete 0 paired with insert %d", got, tt.wantInsert)
+			}
+		})
+	}
+}
+
+func TestFindSimilarityPairingsShortLineSmoothing(t *testing.T) {
+	tests := []struct {
+		name     string
+		deletes  []string
+		inserts  []string
+		want     []LinePairing
+		unsmooth bool // whether the lines pair without smoothing
+	}{
+		{
+			name:    "renamed identifier",
+			deletes: []string{"foo"},
+			inserts: []string{"fooBar"},
+			want:    []LinePairing{{DeleteIndex: 0, InsertIndex: 0, Similarity: 1.0 / 3}},
+		},
+		{
+			name:    "unrelated words",
+			deletes: []string{"foo"},
+			inserts: []string{"bar"},
+			want:    nil,
+		},
+		{
+			name:     "long lines are not smoothed",
+			deletes:  []string{"one two three foo"},
+			inserts:  []string{"one two three fooBar"},
+			want:     []LinePairing{{DeleteIndex: 0, InsertIndex: 0, Similarity: 0.6}},
+			unsmooth: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			if got := FindSimilarityPairings(tt.deletes, tt.inserts, opts, 0.2, nil); (got != nil) != tt.unsmooth {
+				t.Errorf("FindSimilarityPairings() without smoothing = %v, want pairings %v", got, tt.unsmooth)
+			}
+
+			opts.ShortLineSmoothing = true
+			got := FindSimilarityPairings(tt.deletes, tt.inserts, opts, 0.2, nil)
+			if len(got) != len(tt.want) {
+				t.Fatalf("FindSimilarityPairings() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].DeleteIndex != tt.want[i].DeleteIndex || got[i].InsertIndex != tt.want[i].InsertIndex ||
+					math.Abs(got[i].Similarity-tt.want[i].Similarity) > 1e-9 {
+					t.Errorf("FindSimilarityPairings() = %v, want %v", got, tt.want)
+				}
+			}
+			if got := FindOptimalPairings(tt.deletes, tt.inserts, opts, 0.2); len(got) != len(tt.want) {
+				t.Errorf("FindOptimalPairings() = %v, want %d pairings", got, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestFindAutoPairings(t *testing.T) {
+	// Three renamed functions, and a comment replaced by an unrelated line
+	// that shares one token with it
+	deletes := []string{
+		"func computeTotal(items []Item) int {",
+		"func parseHeader(line string) (Header, error) {",
+		"func writeReport(w io.Writer, r Report) error {",
+		"// legacy: uses out io.Writer",
+	}
+	inserts := []string{
+		"func calculateTotal(items []Item) int {",
+		"func readHeader(line string) (Header, error) {",
+		"func emitReport(w io.Writer, r Report) error {",
+		"var out = os.Stdout",
+	}
+	opts := DefaultOptions()
+	renames := []int{0, 1, 2}
+
+	pairedDeletes := func(pairings []LinePairing) []int {
+		var got []int
+		for _, p := range pairings {
+			if p.DeleteIndex != p.InsertIndex {
+				t.Errorf("delete %d paired with insert %d", p.DeleteIndex, p.InsertIndex)
+			}
+			got = append(got, p.DeleteIndex)
+		}
+		return got
+	}
+
+	// A high fixed threshold misses the renames, and the default one also
+	// pairs the unrelated lines
+	if got := pairedDeletes(FindSimilarityPairings(deletes, inserts, opts, 0.8, nil)); got != nil {
+		t.Errorf("threshold 0.8 paired deletes %v, want none", got)
+	}
+	if got := pairedDeletes(FindSimilarityPairings(deletes, inserts, opts, DefaultLineThreshold, nil)); !reflect.DeepEqual(got, []int{0, 1, 2, 3}) {
+		t.Errorf("threshold %v paired deletes %v, want all four", DefaultLineThreshold, got)
+	}
+
+	auto := FindAutoPairings(deletes, inserts, opts)
+	if got := pairedDeletes(auto); !reflect.DeepEqual(got, renames) {
+		t.Errorf("FindAutoPairings() paired deletes %v, want %v", got, renames)
+	}
+	if want := FindSimilarityPairings(deletes, inserts, opts, 0.5, nil); !reflect.DeepEqual(auto, want) {
+		t.Errorf("FindAutoPairings() = %v, want %v", auto, want)
+	}
+
+	// Nothing similar pairs nothing
+	if got := FindAutoPairings([]string{"alpha beta"}, []string{"gamma delta"}, opts); got != nil {
+		t.Errorf("FindAutoPairings() of unrelated lines = %v, want none", got)
+	}
+
+	// In line mode, the comment and its replacement stay a delete and an
+	// insert
+	result := DiffLineByLine(strings.Join(deletes, "\n"), strings.Join(inserts, "\n"), opts, DefaultFormatOptions(), "auto", 0)
+	var types []Operation
+	for _, line := range result.Lines {
+		types = append(types, line.Type)
+	}
+	if want := []Operation{Equal, Equal, Equal, Delete, Insert}; !reflect.DeepEqual(types, want) {
+		t.Errorf("DiffLineByLine() line types = %v, want %v", types, want)
+	}
+}
+
+func TestFindOptimalPairings(t *testing.T) {
+	// Greedy pairing takes d0-i0 first, leaving d1 nothing similar; the
+	// optimal pairing gives i0 to d1 and d0 its second choice
+	deletes := []string{"d0", "d1", "d2"}
+	inserts := []string{"i0", "i1", "i2"}
+	scores := map[string]float64{
+		"d0 i0": 0.9, "d0 i1": 0.8,
+		"d1 i0": 0.85,
+		"d2 i2": 0.5,
+	}
+	opts := DefaultOptions()
+	opts.LineSimilarity = func(text1, text2 string, _ Options) float64 {
+		return scores[text1+" "+text2]
+	}
+	total := func(pairings []LinePairing) float64 {
+		var sum float64
+		for _, p := range pairings {
+			sum += p.Similarity
+		}
+		return sum
+	}
+
+	greedy := FindSimilarityPairings(deletes, inserts, opts, 0.1, opts.LineSimilarity)
+	optimal := FindOptimalPairings(deletes, inserts, opts, 0.1)
+	want := []LinePairing{
+		{DeleteIndex: 0, InsertIndex: 1, Similarity: 0.8},
+		{DeleteIndex: 1, InsertIndex: 0, Similarity: 0.85},
+		{DeleteIndex: 2, InsertIndex: 2, Similarity: 0.5},
+	}
+	if !reflect.DeepEqual(optimal, want) {
+		t.Errorf("FindOptimalPairings() = %v, want %v", optimal, want)
+	}
+	if total(optimal) <= total(greedy) {
+		t.Errorf("optimal total %v, want more than greedy total %v", total(optimal), total(greedy))
+	}
+
+	// A block past the size limit is paired greedily
+	padded := append(append([]string{}, deletes...), make([]string, MaxOptimalPairingLines)...)
+	if got := FindOptimalPairings(padded, inserts, opts, 0.1); !reflect.DeepEqual(got, greedy) {
+		t.Errorf("FindOptimalPairings() past the size limit = %v, want the greedy %v", got, greedy)
+	}
+
+	tests := []struct {
+		name      string
+		deletes   []string
+		inserts   []string
+		threshold float64
+		want      []LinePairing
+	}{
+		{
+			name:      "threshold leaves weak pairs unpaired",
+			deletes:   deletes,
+			inserts:   inserts,
+			threshold: 0.82,
+			want:      []LinePairing{{DeleteIndex: 0, InsertIndex: 0, Similarity: 0.9}},
+		},
+		{
+			name:      "more deletes than inserts",
+			deletes:   deletes,
+			inserts:   []string{"i0", "i1"},
+			threshold: 0.1,
+			want:      want[:2],
+		},
+		{
+			name:      "more inserts than deletes",
+			deletes:   []string{"d1", "d2"},
+			inserts:   inserts,
+			threshold: 0.1,
+			want: []LinePairing{
+				{DeleteIndex: 0, InsertIndex: 0, Similarity: 0.85},
+				{DeleteIndex: 1, InsertIndex: 2, Similarity: 0.5},
+			},
+		},
+		{
+			name:      "no inserts",
+			deletes:   deletes,
+			threshold: 0.1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FindOptimalPairings(tt.deletes, tt.inserts, opts, tt.threshold); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FindOptimalPairings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffAndFormat(t *testing.T) {
+	text1 := "the quick brown fox"
+	text2 := "the quick red fox"
+	opts := DefaultOptions()
+
+	for _, useColor := range []bool{false, true} {
+		fmtOpts := DefaultFormatOptions()
+		fmtOpts.UseColor = useColor
+
+		want := FormatDiffResultAdvanced(DiffStringsWithPositionsAndPreprocessing(text1, text2, opts), fmtOpts)
+		got := DiffAndFormat(text1, text2, opts, fmtOpts)
+		if got != want {
+			t.Errorf("UseColor=%v: DiffAndFormat() = %q, want %q", useColor, got, want)
+		}
+	}
+
+	want := "the quick [-brown-] {+red+} fox"
+	if got := DiffAndFormat(text1, text2, opts, DefaultFormatOptions()); got != want {
+		t.Errorf("DiffAndFormat() = %q, want %q", got, want)
+	}
+}
+
 func TestDiffWholeFiles(t *testing.T) {
 	text1 := "hello world\nfoo bar"
 	text2 := "hello universe\nfoo bar"
@@ -137,6 +455,144 @@ func TestDiffWholeFiles(t *testing.T) {
 	}
 }
 
+func TestQuickStats(t *testing.T) {
+	ignoreCase := DefaultOptions()
+	ignoreCase.IgnoreCase = true
+	preserve := DefaultOptions()
+	preserve.PreserveWhitespace = true
+
+	tests := []struct {
+		name         string
+		text1, text2 string
+		opts         Options
+	}{
+		{"identical", "same words here", "same words here", DefaultOptions()},
+		{"changed", "the quick brown fox\njumps", "the slow brown fox\nleaps high", DefaultOptions()},
+		{"ignore case", "Hello World", "hello there", ignoreCase},
+		{"trailing newline", "one two\n", "one three", DefaultOptions()},
+		{"trailing newline preserving whitespace", "one two\n", "one two", preserve},
+		{"large", largeStatsText(0), largeStatsText(50), DefaultOptions()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := DiffWholeFiles(tt.text1, tt.text2, tt.opts, DefaultFormatOptions()).Statistics
+			if got := QuickStats(tt.text1, tt.text2, tt.opts); got != want {
+				t.Errorf("QuickStats() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+// largeStatsText returns a few thousand lines of text, with every nth line
+// changed when n is positive
+func largeStatsText(n int) string {
+	var sb strings.Builder
+	for i := 0; i < 5000; i++ {
+		if n > 0 && i%n == 0 {
+			fmt.Fprintf(&sb, "line %d has been rewritten entirely\n", i)
+			continue
+		}
+		fmt.Fprintf(&sb, "line %d of the report: value=%d, status ok\n", i, i*3)
+	}
+	return sb.String()
+}
+
+// Benchmark statistics alone against a full whole-file diff of a large input
+func BenchmarkQuickStats(b *testing.B) {
+	text1, text2 := largeStatsText(0), largeStatsText(50)
+	opts := DefaultOptions()
+	fmtOpts := DefaultFormatOptions()
+
+	b.Run("QuickStats", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			QuickStats(text1, text2, opts)
+		}
+	})
+	b.Run("DiffWholeFiles", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			DiffWholeFiles(text1, text2, opts, fmtOpts)
+		}
+	})
+}
+
+func TestDiffWholeFilesTrailingNewline(t *testing.T) {
+	preserve := Options{PreserveWhitespace: true}
+
+	tests := []struct {
+		name        string
+		text1       string
+		text2       string
+		opts        Options
+		note        bool
+		wantDiff    bool
+		wantChanges bool
+		expected    string
+	}{
+		{
+			name:     "both end with a newline",
+			text1:    "hello world\n",
+			text2:    "hello world\n",
+			opts:     preserve,
+			note:     true,
+			expected: "hello world\n",
+		},
+		{
+			name:     "newline only, suppressed",
+			text1:    "hello world\n",
+			text2:    "hello world",
+			opts:     preserve,
+			wantDiff: true,
+			expected: "hello world",
+		},
+		{
+			name:     "newline only, noted",
+			text1:    "hello world\n",
+			text2:    "hello world",
+			opts:     preserve,
+			note:     true,
+			wantDiff: true,
+			expected: "hello world\n\\ No newline at end of new file",
+		},
+		{
+			name:     "newline added, noted",
+			text1:    "hello world",
+			text2:    "hello world\n",
+			opts:     DefaultOptions(),
+			note:     true,
+			wantDiff: true,
+			expected: "hello world\n\\ No newline at end of old file",
+		},
+		{
+			name:        "newline plus content, noted",
+			text1:       "hello world",
+			text2:       "hello there\n",
+			opts:        preserve,
+			note:        true,
+			wantDiff:    true,
+			wantChanges: true,
+			expected:    "hello [-world-]{+there+}\n\\ No newline at end of old file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fmtOpts := DefaultFormatOptions()
+			fmtOpts.NoNewlineNote = tt.note
+			result := DiffWholeFiles(tt.text1, tt.text2, tt.opts, fmtOpts)
+			if result.TrailingNewlineDiff != tt.wantDiff {
+				t.Errorf("TrailingNewlineDiff = %v, want %v", result.TrailingNewlineDiff, tt.wantDiff)
+			}
+			if result.HasChanges != tt.wantChanges {
+				t.Errorf("HasChanges = %v, want %v: %+v", result.HasChanges, tt.wantChanges, result.Result.Diffs)
+			}
+			if result.Formatted != tt.expected {
+				t.Errorf("Formatted = %q, want %q", result.Formatted, tt.expected)
+			}
+		})
+	}
+}
+
 func TestDiffLineByLine(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -244,6 +700,560 @@ func TestFilterWithContext(t *testing.T) {
 	}
 }
 
+func TestFilterWithContextRegex(t *testing.T) {
+	text1 := `package main
+
+func one() {
+	a := 1
+	return
+}
+
+func two() {
+	b := 2
+	c := 3
+	return
+}
+
+func three() {
+	return
+}
+`
+	text2 := strings.Replace(text1, "c := 3", "c := 4", 1)
+	output := DiffLineByLine(text1, text2, DefaultOptions(), FormatOptions{}, "best", DefaultLineThreshold)
+
+	got, err := FilterWithContextRegex(output.Lines, "^func ")
+	if err != nil {
+		t.Fatalf("FilterWithContextRegex() error: %v", err)
+	}
+	var nums []int
+	for _, r := range got {
+		nums = append(nums, r.NewLineNum)
+	}
+	// The whole of two(), up to the line before three()
+	if want := []int{8, 9, 10, 11, 12, 13}; !reflect.DeepEqual(nums, want) {
+		t.Errorf("FilterWithContextRegex() lines = %v, want %v", nums, want)
+	}
+
+	// Lines before the first match form a block
+	got, _ = FilterWithContextRegex(output.Lines, "^never")
+	if len(got) != len(output.Lines) {
+		t.Errorf("FilterWithContextRegex() with no match = %d lines, want all %d", len(got), len(output.Lines))
+	}
+
+	if _, err := FilterWithContextRegex(output.Lines, "("); err == nil {
+		t.Error("FilterWithContextRegex() with an invalid pattern: want an error")
+	}
+
+	// The renderers select the same lines, with separators between blocks
+	text2 = strings.Replace(text1, "a := 1", "a := 0", 1)
+	text2 = strings.Replace(text2, "three() {\n\treturn", "three() {\n\treturn nil", 1)
+	fmtOpts := DefaultFormatOptions()
+	fmtOpts.ContextPattern = "^func "
+	output = DiffLineByLine(text1, text2, DefaultOptions(), fmtOpts, "best", DefaultLineThreshold)
+	rendered := FormatWithContext(output.Lines, 0, fmtOpts)
+	want := "func one() {\n\ta := [-1-] {+0+}\n\treturn\n}\n\n---\nfunc three() {\n\treturn {+nil+}\n}\n"
+	if rendered != want {
+		t.Errorf("FormatWithContext() with ContextPattern =\n%q\nwant\n%q", rendered, want)
+	}
+}
+
+func TestFormatWithContext(t *testing.T) {
+	text1 := "a\nb\nc\nd\ne\nf"
+	text2 := "x\nb\nc\nd\ne\ny"
+
+	tests := []struct {
+		name      string
+		context   int
+		separator string
+		numbers   bool
+		expected  string
+	}{
+		{
+			name:      "custom separator between gapped regions",
+			context:   1,
+			separator: "@@",
+			expected:  "[-a-]{+x+}\nb\n@@\ne\n[-f-]{+y+}",
+		},
+		{
+			name:      "empty separator",
+			context:   1,
+			separator: "",
+			expected:  "[-a-]{+x+}\nb\ne\n[-f-]{+y+}",
+		},
+		{
+			name:      "adjacent regions have no separator",
+			context:   2,
+			separator: "---",
+			expected:  "[-a-]{+x+}\nb\nc\nd\ne\n[-f-]{+y+}",
+		},
+		{
+			name:      "line numbers",
+			context:   1,
+			separator: "---",
+			numbers:   true,
+			expected:  " 1:1  [-a-]{+x+}\n 2:2  b\n---\n 5:5  e\n 6:6  [-f-]{+y+}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fmtOpts := DefaultFormatOptions()
+			fmtOpts.ContextSeparator = tt.separator
+			fmtOpts.ShowLineNumbers = tt.numbers
+			fmtOpts.LineNumWidth = 1
+			output := DiffLineByLine(text1, text2, DefaultOptions(), fmtOpts, "normal", 0.5)
+			if got := FormatWithContext(output.Lines, tt.context, fmtOpts); got != tt.expected {
+				t.Errorf("FormatWithContext() =\n%q\nwant\n%q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func renderTestOutput() LineDiffOutput {
+	return LineDiffOutput{Lines: []LineDiffResult{
+		{OldLineNum: 1, NewLineNum: 1, Output: "same"},
+		{OldLineNum: 2, NewLineNum: 2, HasChanges: true, Output: "[-a-]{+b+}"},
+		{OldLineNum: 3, NewLineNum: 3, Output: "three"},
+		{OldLineNum: 4, NewLineNum: 4, Output: "four"},
+		{OldLineNum: 5, NewLineNum: 5, Output: "five"},
+		{OldLineNum: 6, NewLineNum: 0, HasChanges: true, Output: "[-gone-]"},
+		{OldLineNum: 0, NewLineNum: 6, HasChanges: true, Output: "{+added+}"},
+		{OldLineNum: 7, NewLineNum: 9, HasChanges: true, Moved: true, MovePartner: 9, Output: "[-moved-]"},
+	}, HasChanges: true}
+}
+
+func TestRenderLineDiff(t *testing.T) {
+	tests := []struct {
+		name         string
+		context      int
+		color        bool
+		changeMarker string
+		equalMarker  string
+		expected     string
+	}{
+		{
+			name:    "all lines",
+			context: 0,
+			expected: "     1: same\n" +
+				"|    2: [-a-]{+b+}\n" +
+				"     3: three\n" +
+				"     4: four\n" +
+				"     5: five\n" +
+				"|    6: [-gone-]\n" +
+				"|    6: {+added+}\n" +
+				"~    9: [-moved-]\n",
+		},
+		{
+			name:    "context with separator",
+			context: 1,
+			expected: "     1: same\n" +
+				"|    2: [-a-]{+b+}\n" +
+				"     3: three\n" +
+				"---\n" +
+				"     5: five\n" +
+				"|    6: [-gone-]\n" +
+				"|    6: {+added+}\n" +
+				"~    9: [-moved-]\n",
+		},
+		{
+			name:    "color markers",
+			context: 0,
+			color:   true,
+			expected: "     1: same\n" +
+				ANSIChangeColor + "| " + ANSIReset + "   2: [-a-]{+b+}\n" +
+				"     3: three\n" +
+				"     4: four\n" +
+				"     5: five\n" +
+				ANSIChangeColor + "| " + ANSIReset + "   6: [-gone-]\n" +
+				ANSIChangeColor + "| " + ANSIReset + "   6: {+added+}\n" +
+				ANSIMoveColor + "~ " + ANSIReset + "   9: [-moved-]\n",
+		},
+		{
+			name:         "custom change marker on changed lines only",
+			context:      1,
+			changeMarker: ">> ",
+			expected: "      1: same\n" +
+				">>    2: [-a-]{+b+}\n" +
+				"      3: three\n" +
+				"---\n" +
+				"      5: five\n" +
+				">>    6: [-gone-]\n" +
+				">>    6: {+added+}\n" +
+				"~     9: [-moved-]\n",
+		},
+		{
+			name:         "custom equal marker",
+			context:      1,
+			changeMarker: "* ",
+			equalMarker:  ". ",
+			expected: ".    1: same\n" +
+				"*    2: [-a-]{+b+}\n" +
+				".    3: three\n" +
+				"---\n" +
+				".    5: five\n" +
+				"*    6: [-gone-]\n" +
+				"*    6: {+added+}\n" +
+				"~    9: [-moved-]\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fmtOpts := DefaultFormatOptions()
+			fmtOpts.UseColor = tt.color
+			if tt.changeMarker != "" {
+				fmtOpts.ChangeMarker = tt.changeMarker
+			}
+			if tt.equalMarker != "" {
+				fmtOpts.EqualMarker = tt.equalMarker
+			}
+			if got := RenderLineDiff(renderTestOutput(), tt.context, fmtOpts); got != tt.expected {
+				t.Errorf("RenderLineDiff() =\n%q\nwant\n%q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRenderLineDiffWithNumbers(t *testing.T) {
+	tests := []struct {
+		name        string
+		context     int
+		separator   string
+		changedOnly bool
+		side        LineNumberSide
+		expected    string
+	}{
+		{
+			name:      "all lines",
+			context:   0,
+			separator: "---",
+			expected: "   1:1    same\n" +
+				"   2:2    [-a-]{+b+}\n" +
+				"   3:3    three\n" +
+				"   4:4    four\n" +
+				"   5:5    five\n" +
+				"   6:     [-gone-]\n" +
+				"    :6    {+added+}\n" +
+				"   7~9    [-moved-]\n",
+		},
+		{
+			name:      "context with custom separator",
+			context:   1,
+			separator: "@@",
+			expected: "   1:1    same\n" +
+				"   2:2    [-a-]{+b+}\n" +
+				"   3:3    three\n" +
+				"@@\n" +
+				"   5:5    five\n" +
+				"   6:     [-gone-]\n" +
+				"    :6    {+added+}\n" +
+				"   7~9    [-moved-]\n",
+		},
+		{
+			name:      "context with empty separator",
+			context:   1,
+			separator: "",
+			expected: "   1:1    same\n" +
+				"   2:2    [-a-]{+b+}\n" +
+				"   3:3    three\n" +
+				"   5:5    five\n" +
+				"   6:     [-gone-]\n" +
+				"    :6    {+added+}\n" +
+				"   7~9    [-moved-]\n",
+		},
+		{
+			name:        "numbers on changes only",
+			context:     0,
+			separator:   "---",
+			changedOnly: true,
+			expected: "    :     same\n" +
+				"   2:2    [-a-]{+b+}\n" +
+				"    :     three\n" +
+				"    :     four\n" +
+				"    :     five\n" +
+				"   6:     [-gone-]\n" +
+				"    :6    {+added+}\n" +
+				"   7~9    [-moved-]\n",
+		},
+		{
+			name:      "old numbers only",
+			context:   0,
+			separator: "---",
+			side:      LineNumbersOld,
+			expected: "   1: same\n" +
+				"   2: [-a-]{+b+}\n" +
+				"   3: three\n" +
+				"   4: four\n" +
+				"   5: five\n" +
+				"   6: [-gone-]\n" +
+				"    : {+added+}\n" +
+				"   7~ [-moved-]\n",
+		},
+		{
+			name:      "new numbers only",
+			context:   0,
+			separator: "---",
+			side:      LineNumbersNew,
+			expected: "   1: same\n" +
+				"   2: [-a-]{+b+}\n" +
+				"   3: three\n" +
+				"   4: four\n" +
+				"   5: five\n" +
+				"    : [-gone-]\n" +
+				"   6: {+added+}\n" +
+				"   9~ [-moved-]\n",
+		},
+		{
+			name:        "new numbers on changes only",
+			context:     0,
+			separator:   "---",
+			changedOnly: true,
+			side:        LineNumbersNew,
+			expected: "    : same\n" +
+				"   2: [-a-]{+b+}\n" +
+				"    : three\n" +
+				"    : four\n" +
+				"    : five\n" +
+				"    : [-gone-]\n" +
+				"   6: {+added+}\n" +
+				"   9~ [-moved-]\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fmtOpts := DefaultFormatOptions()
+			fmtOpts.ShowLineNumbers = true
+			fmtOpts.LineNumWidth = 3
+			fmtOpts.ContextSeparator = tt.separator
+			fmtOpts.LineNumbersOnChangesOnly = tt.changedOnly
+			fmtOpts.LineNumberSide = tt.side
+			if got := RenderLineDiffWithNumbers(renderTestOutput(), tt.context, fmtOpts); got != tt.expected {
+				t.Errorf("RenderLineDiffWithNumbers() =\n%q\nwant\n%q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDiffLineByLineLineStats(t *testing.T) {
+	text1 := "keep this\nthe quick brown fox\nold line here"
+	text2 := "keep this\nthe slow red fox\nadded"
+
+	output := DiffLineByLine(text1, text2, DefaultOptions(), DefaultFormatOptions(), "normal", 0)
+
+	want := []DiffStatistics{
+		{},
+		{OldWords: 4, NewWords: 4, DeletedWords: 2, InsertedWords: 2, CommonWords: 2, DeletedChars: 10, InsertedChars: 7, CommonChars: 6},
+		{OldWords: 3, NewWords: 1, DeletedWords: 3, InsertedWords: 1, DeletedChars: 11, InsertedChars: 5},
+	}
+	if len(output.Lines) != len(want) {
+		t.Fatalf("got %d lines, want %d: %+v", len(output.Lines), len(want), output.Lines)
+	}
+	for i, line := range output.Lines {
+		if line.Stats != want[i] {
+			t.Errorf("line %d Stats = %+v, want %+v", i+1, line.Stats, want[i])
+		}
+	}
+
+	// Unpaired lines carry only their own side
+	output = DiffLineByLine("a b\n", "a b\nc d e\n", DefaultOptions(), DefaultFormatOptions(), "normal", 0)
+	inserted := output.Lines[1]
+	if st := inserted.Stats; inserted.Type != Insert || st.NewWords != 3 || st.InsertedWords == 0 || st.OldWords != 0 || st.DeletedWords != 0 {
+		t.Errorf("inserted line = %+v, want Insert with only new-side stats", inserted)
+	}
+	output = DiffLineByLine("a b\nc d e\n", "a b\n", DefaultOptions(), DefaultFormatOptions(), "normal", 0)
+	deleted := output.Lines[1]
+	if st := deleted.Stats; deleted.Type != Delete || st.OldWords != 3 || st.DeletedWords == 0 || st.NewWords != 0 || st.InsertedWords != 0 {
+		t.Errorf("deleted line = %+v, want Delete with only old-side stats", deleted)
+	}
+}
+
+func TestDiffLineByLineTabWidth(t *testing.T) {
+	text1 := "func f() {\n\treturn old\n}"
+	text2 := "func f() {\n\treturn new\n}"
+	fmtOpts := DefaultFormatOptions()
+	fmtOpts.TabWidth = 4
+	fmtOpts.ShowLineNumbers = true
+	fmtOpts.LineNumWidth = 2
+
+	output := DiffLineByLine(text1, text2, DefaultOptions(), fmtOpts, "normal", 0)
+	got := RenderLineDiffWithNumbers(output, 0, fmtOpts)
+	want := "  1:1   func f() {\n" +
+		"  2:2       return [-old-] {+new+}\n" +
+		"  3:3   }\n"
+	if got != want {
+		t.Errorf("RenderLineDiffWithNumbers() =\n%q\nwant\n%q", got, want)
+	}
+	if output.Lines[1].NewText != "\treturn new" {
+		t.Errorf("NewText = %q, want the line as is", output.Lines[1].NewText)
+	}
+
+	output = DiffLineByLine("\tsame\nold", "\tsame\nnew", DefaultOptions(), fmtOpts, "normal", 0)
+	if got := output.Lines[0].Output; got != "    same" {
+		t.Errorf("unchanged line Output = %q, want %q", got, "    same")
+	}
+}
+
+func TestDiffLineByLineNormalizeEOL(t *testing.T) {
+	text1, text2 := "a\r\nb", "a\nb"
+	fmtOpts := DefaultFormatOptions()
+
+	opts := DefaultOptions()
+	if result := DiffLineByLine(text1, text2, opts, fmtOpts, "best", DefaultLineThreshold); !result.HasChanges {
+		t.Error("DiffLineByLine() without NormalizeEOL reported no changes")
+	}
+
+	opts.NormalizeEOL = true
+	result := DiffLineByLine(text1, text2, opts, fmtOpts, "best", DefaultLineThreshold)
+	if result.HasChanges {
+		t.Errorf("DiffLineByLine() with NormalizeEOL = %+v, want no changes", result.Lines)
+	}
+	// The original lines are kept
+	if first := result.Lines[0]; first.OldText != "a\r" || first.NewText != "a" || first.Output != "a\r" {
+		t.Errorf("first line = %+v, want the old and new texts unchanged", first)
+	}
+}
+
+func TestDiffLineByLineSquashBlankLines(t *testing.T) {
+	tests := []struct {
+		name         string
+		text1, text2 string
+		want         string
+	}{
+		{
+			name:  "two blank lines added",
+			text1: "a\nb\n",
+			text2: "a\n\n\nb\n",
+			want:  "  1:1   a\n  2:2   {+<2 blank lines>+}\n  2:4   b\n  3:5   \n",
+		},
+		{
+			name:  "blank run lengthened",
+			text1: "a\n\nb",
+			text2: "a\n\n\n \nb",
+			want:  "  1:1   a\n  2:2   \n  3:3   {+<2 blank lines>+}\n  3:5   b\n",
+		},
+		{
+			name:  "blank run removed with a changed line",
+			text1: "a\n\n\nold",
+			text2: "a\nnew",
+			want:  "  1:1   a\n  2:2   [-<2 blank lines>-]\n  4:2   [-old-]{+new+}\n",
+		},
+		{
+			name:  "single blank line",
+			text1: "a\nb",
+			text2: "a\n\nb",
+			want:  "  1:1   a\n  2:2   {++}\n  2:3   b\n",
+		},
+	}
+
+	fmtOpts := DefaultFormatOptions()
+	fmtOpts.ShowLineNumbers = true
+	fmtOpts.LineNumWidth = 2
+	opts := DefaultOptions()
+	opts.SquashBlankLines = true
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := DiffLineByLine(tt.text1, tt.text2, opts, fmtOpts, "normal", 0)
+			if got := RenderLineDiffWithNumbers(output, 0, fmtOpts); got != tt.want {
+				t.Errorf("RenderLineDiffWithNumbers() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+
+	// Without SquashBlankLines, each added blank line is a change of its own
+	text1, text2 := tests[0].text1, tests[0].text2
+	count := func(output LineDiffOutput) int {
+		n := 0
+		for _, line := range output.Lines {
+			if line.HasChanges {
+				n++
+			}
+		}
+		return n
+	}
+	if n := count(DiffLineByLine(text1, text2, DefaultOptions(), fmtOpts, "best", DefaultLineThreshold)); n != 2 {
+		t.Errorf("without SquashBlankLines: %d changed lines, want 2", n)
+	}
+	output := DiffLineByLine(text1, text2, opts, fmtOpts, "best", DefaultLineThreshold)
+	if n := count(output); n != 1 {
+		t.Errorf("with SquashBlankLines: %d changed lines, want 1", n)
+	}
+	if line := output.Lines[1]; line.Type != Insert || line.NewText != "\n" {
+		t.Errorf("blank run = %+v, want an Insert of the two lines", line)
+	}
+}
+
+func TestRenderLineDiffLineStats(t *testing.T) {
+	output := DiffLineByLine("same\nthe quick fox", "same\nthe slow red fox", DefaultOptions(), DefaultFormatOptions(), "normal", 0)
+	fmtOpts := DefaultFormatOptions()
+	fmtOpts.ShowLineStats = true
+
+	want := "     1: same\n" +
+		"|    2: the [-quick-] {+slow red+} fox  (-1 +2)\n"
+	if got := RenderLineDiff(output, 0, fmtOpts); got != want {
+		t.Errorf("RenderLineDiff() =\n%q\nwant\n%q", got, want)
+	}
+
+	fmtOpts.ShowLineNumbers = true
+	fmtOpts.LineNumWidth = 1
+	want = " 1:1  same\n" +
+		" 2:2  the [-quick-] {+slow red+} fox  (-1 +2)\n"
+	if got := RenderLineDiffWithNumbers(output, 0, fmtOpts); got != want {
+		t.Errorf("RenderLineDiffWithNumbers() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestStreamLineByLine(t *testing.T) {
+	text1 := "keep\nfunc old(a)\nremoved line\nsame"
+	text2 := "added first\nkeep\nfunc old(b)\nsame\nadded last"
+	opts := Options{Delimiters: "()"}
+	fmtOpts := DefaultFormatOptions()
+
+	for _, algorithm := range []string{"best", "normal"} {
+		t.Run(algorithm, func(t *testing.T) {
+			var streamed []LineDiffResult
+			StreamLineByLine(text1, text2, opts, fmtOpts, algorithm, 0.3, func(r LineDiffResult) {
+				streamed = append(streamed, r)
+			})
+
+			want := DiffLineByLine(text1, text2, opts, fmtOpts, algorithm, 0.3).Lines
+			if !reflect.DeepEqual(streamed, want) {
+				t.Errorf("StreamLineByLine() emitted %+v, want %+v", streamed, want)
+			}
+		})
+	}
+}
+
+func TestSliceLines(t *testing.T) {
+	text := "one\ntwo\nthree\nfour\n"
+	tests := []struct {
+		name       string
+		text       string
+		start, end int
+		want       string
+	}{
+		{"middle lines", text, 2, 3, "two\nthree\n"},
+		{"single line", text, 3, 3, "three\n"},
+		{"whole text", text, 1, 4, text},
+		{"end 0 runs to the end", text, 3, 0, "three\nfour\n"},
+		{"end past the last line", text, 3, 10, "three\nfour\n"},
+		{"start below 1", text, -5, 1, "one\n"},
+		{"start past the last line", text, 5, 10, ""},
+		{"end before start", text, 3, 2, ""},
+		{"no trailing newline", "one\ntwo", 2, 2, "two"},
+		{"CRLF endings kept", "one\r\ntwo\r\n", 1, 1, "one\r\n"},
+		{"empty text", "", 1, 1, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SliceLines(tt.text, tt.start, tt.end); got != tt.want {
+				t.Errorf("SliceLines(%q, %d, %d) = %q, want %q", tt.text, tt.start, tt.end, got, tt.want)
+			}
+		})
+	}
+}
+
 func TestDiffLineByLineWithPairing(t *testing.T) {
 	// Test that line pairing works correctly for changed blocks
 	text1 := "func old1()\nfunc old2()"
@@ -270,3 +1280,220 @@ func TestDiffLineByLineWithPairing(t *testing.T) {
 		}
 	}
 }
+
+// Benchmark line mode on many short lines, where each changed line pair is
+// diffed separately and too short to benefit from preprocessing
+func BenchmarkDiffLineByLineShortLines(b *testing.B) {
+	var lines1, lines2 []string
+	for i := 0; i < 1000; i++ {
+		lines1 = append(lines1, fmt.Sprintf("Item %d: The value is %d", i, i))
+		lines2 = append(lines2, fmt.Sprintf("item %d: the value was %d", i, i*2))
+	}
+	text1, text2 := strings.Join(lines1, "\n"), strings.Join(lines2, "\n")
+	opts := DefaultOptions()
+	opts.IgnoreCase = true
+	fmtOpts := DefaultFormatOptions()
+
+	for _, bench := range []struct {
+		name      string
+		threshold int
+	}{
+		{"threshold", 0},
+		{"always", -1},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			opts.PreprocessMinTokens = bench.threshold
+			for i := 0; i < b.N; i++ {
+				DiffLineByLine(text1, text2, opts, fmtOpts, "normal", 0)
+			}
+		})
+	}
+}
+
+func TestFormatSideBySide(t *testing.T) {
+	tests := []struct {
+		name     string
+		text1    string
+		text2    string
+		width    int
+		tabWidth int
+		expected string
+	}{
+		{
+			name:     "changed line",
+			text1:    "same\nold line",
+			text2:    "same\nnew line",
+			width:    12,
+			expected: "same           same\n[-old-] line | {+new+} line",
+		},
+		{
+			name:     "deleted line has empty right column",
+			text1:    "a\ngone\nb",
+			text2:    "a\nb",
+			width:    8,
+			expected: "a          a\n[-gone-] |\nb          b",
+		},
+		{
+			name:     "inserted line has empty left column",
+			text1:    "a\nb",
+			text2:    "a\nadded\nb",
+			width:    9,
+			expected: "a           a\n          | {+added+}\nb           b",
+		},
+		{
+			name:     "sides keep their own spacing",
+			text1:    "keep a b",
+			text2:    "keep b",
+			width:    12,
+			expected: "keep [-a-] b | keep b",
+		},
+		{
+			name:     "long lines are truncated",
+			text1:    "the quick brown fox",
+			text2:    "the quick brown fox",
+			width:    9,
+			expected: "the quick   the quick",
+		},
+		{
+			name:     "tabs expand",
+			text1:    "\tx",
+			text2:    "\tx",
+			width:    10,
+			expected: "        x            x",
+		},
+		{
+			name:     "tabs expand to the tab width",
+			text1:    "\tx",
+			text2:    "\tx",
+			width:    10,
+			tabWidth: 4,
+			expected: "    x            x",
+		},
+		{
+			name:     "moved lines use a tilde gutter",
+			text1:    "m\na\nb",
+			text2:    "a\nb\nm",
+			width:    5,
+			expected: "[-m-] ~\na       a\nb       b\n      ~ {+m+}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := DetectMovedLines(DiffLineByLine(tt.text1, tt.text2, DefaultOptions(), DefaultFormatOptions(), "normal", 0.5))
+			fmtOpts := DefaultFormatOptions()
+			fmtOpts.TabWidth = tt.tabWidth
+			if got := FormatSideBySide(output, tt.width, fmtOpts); got != tt.expected {
+				t.Errorf("FormatSideBySide() =\n%q\nwant\n%q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDetectMovedLines(t *testing.T) {
+	// move describes one line in the output: its type, text, and, if moved,
+	// its partner's line number.
+	type move struct {
+		typ     Operation
+		text    string
+		moved   bool
+		partner int
+	}
+
+	tests := []struct {
+		name  string
+		text1 string
+		text2 string
+		want  []move
+	}{
+		{
+			name:  "lines 2-3 move to the end",
+			text1: "one\nalpha beta gamma\ndelta epsilon zeta\nfour\nfive",
+			text2: "one\nfour\nfive\nalpha beta gamma\ndelta epsilon zeta",
+			want: []move{
+				{Equal, "one", false, 0},
+				{Delete, "alpha beta gamma", true, 4},
+				{Delete, "delta epsilon zeta", true, 5},
+				{Equal, "four", false, 0},
+				{Equal, "five", false, 0},
+				{Insert, "alpha beta gamma", true, 2},
+				{Insert, "delta epsilon zeta", true, 3},
+			},
+		},
+		{
+			name:  "pairing is one-to-one",
+			text1: "a b c d e\nx\ny",
+			text2: "x\na b c d e\ny\na b c d e",
+			want: []move{
+				{Delete, "a b c d e", true, 2},
+				{Equal, "x", false, 0},
+				{Insert, "a b c d e", true, 1},
+				{Equal, "y", false, 0},
+				{Insert, "a b c d e", false, 0},
+			},
+		},
+		{
+			name:  "dissimilar lines are not moves",
+			text1: "gone line here\nx\ny",
+			text2: "x\ny\nnew text there",
+			want: []move{
+				{Delete, "gone line here", false, 0},
+				{Equal, "x", false, 0},
+				{Equal, "y", false, 0},
+				{Insert, "new text there", false, 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := DetectMovedLines(DiffLineByLine(tt.text1, tt.text2, DefaultOptions(), DefaultFormatOptions(), "best", 0.5))
+			var got []move
+			for _, line := range output.Lines {
+				text := line.NewText
+				if line.Type == Delete {
+					text = line.OldText
+				}
+				got = append(got, move{line.Type, text, line.Moved, line.MovePartner})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DetectMovedLines() =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFitColumn(t *testing.T) {
+	red := "\033[31m"
+	tests := []struct {
+		name      string
+		input     string
+		width     int
+		expected  string
+		wantWidth int
+	}{
+		{"fits", "abc", 5, "abc", 3},
+		{"truncated", "abcdef", 4, "abcd", 4},
+		{"multibyte", "héllo", 3, "hél", 3},
+		{"color does not count", red + "ab" + ANSIReset + "cd", 4, red + "ab" + ANSIReset + "cd", 4},
+		{"reset added when cut inside color", red + "abcdef" + ANSIReset, 3, red + "abc" + ANSIReset, 3},
+		{"tab past width is dropped", "ab\tc", 5, "ab", 2},
+		{"wide runes take two columns", "世界abc", 5, "世界a", 5},
+		{"wide rune past width is dropped", "a世界", 4, "a世", 3},
+		{"combining mark takes no column", "e\u0301ab", 2, "e\u0301a", 2},
+		{"tab expands to the next stop", "ab\tc", 10, "ab      c", 9},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, width := fitColumn(tt.input, tt.width, 8)
+			if got != tt.expected || width != tt.wantWidth {
+				t.Errorf("fitColumn(%q, %d) = %q, %d; want %q, %d", tt.input, tt.width, got, width, tt.expected, tt.wantWidth)
+			}
+		})
+	}
+	// Tab stops follow the tab width
+	if got, width := fitColumn("ab\tc", 10, 4); got != "ab  c" || width != 5 {
+		t.Errorf("fitColumn(%q, 10, 4) = %q, %d; want %q, 5", "ab\tc", got, width, "ab  c")
+	}
+}
@@ -0,0 +1,177 @@
+package tokendiff
+
+import (
+	"strings"
+)
+
+// FormatMarkdown renders a diff result as a GitHub-flavored markdown fenced
+// code block with the diff language, for posting in code review comments.
+// Lines whose tokens are all unchanged are context lines, prefixed with a
+// space. A changed line appears twice: its old text prefixed with "-" and
+// its new text prefixed with "+", so GitHub highlights the removed and added
+// lines. The result should come from one of the *WithPositions functions;
+// without positions the whole old text is shown as removed and the whole new
+// text as added. The fence is made longer than any run of backticks in the
+// text, so backticks in tokens cannot close the block early.
+func FormatMarkdown(result DiffResult) string {
+	oldLines := markdownLines(result.Text1)
+	newLines := markdownLines(result.Text2)
+
+	var body []string
+	context := func(lines []string) {
+		for _, line := range lines {
+			body = append(body, " "+line)
+		}
+	}
+	// gap adds the old and new lines between two unchanged lines, keeping
+	// identical leading and trailing lines, such as blank lines, as context
+	gap := func(old, new []string) {
+		for len(old) > 0 && len(new) > 0 && old[0] == new[0] {
+			context(old[:1])
+			old, new = old[1:], new[1:]
+		}
+		var tail []string
+		for len(old) > 0 && len(new) > 0 && old[len(old)-1] == new[len(new)-1] {
+			tail = append([]string{old[len(old)-1]}, tail...)
+			old, new = old[:len(old)-1], new[:len(new)-1]
+		}
+		for _, line := range old {
+			body = append(body, "-"+line)
+		}
+		for _, line := range new {
+			body = append(body, "+"+line)
+		}
+		context(tail)
+	}
+
+	nextOld, nextNew := 0, 0
+	for _, p := range unchangedLinePairs(result) {
+		gap(oldLines[nextOld:p[0]], newLines[nextNew:p[1]])
+		context(newLines[p[1] : p[1]+1])
+		nextOld, nextNew = p[0]+1, p[1]+1
+	}
+	gap(oldLines[nextOld:], newLines[nextNew:])
+
+	text := strings.Join(body, "\n")
+	fence := strings.Repeat("`", max(3, longestBacktickRun(text)+1))
+	if text == "" {
+		return fence + "diff\n" + fence
+	}
+	return fence + "diff\n" + text + "\n" + fence
+}
+
+// markdownLines splits text into lines, ignoring one trailing newline.
+func markdownLines(text string) []string {
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// unchangedLinePairs returns the (old, new) line indices of the lines that
+// are unchanged in result: every token on the old line is Equal to a token
+// on the same new line and vice versa. Pairs are in increasing order.
+func unchangedLinePairs(result DiffResult) [][2]int {
+	oldLine := tokenLineIndices(result.Text1, result.Positions1)
+	newLine := tokenLineIndices(result.Text2, result.Positions2)
+
+	var oldCount, newCount int
+	for _, d := range result.Diffs {
+		if d.Type != Insert {
+			oldCount++
+		}
+		if d.Type != Delete {
+			newCount++
+		}
+	}
+	if len(oldLine) != oldCount || len(newLine) != newCount {
+		return nil
+	}
+
+	// For each line, the tokens on it, how many are Equal, and the line on
+	// the other side those Equal tokens are on (-1 for none yet, -2 for
+	// more than one)
+	type lineInfo struct {
+		tokens, equal, partner int
+	}
+	info := func(lines []int) map[int]*lineInfo {
+		m := make(map[int]*lineInfo)
+		for _, line := range lines {
+			if m[line] == nil {
+				m[line] = &lineInfo{partner: -1}
+			}
+			m[line].tokens++
+		}
+		return m
+	}
+	oldInfo, newInfo := info(oldLine), info(newLine)
+	link := func(li *lineInfo, other int) {
+		li.equal++
+		if li.partner == -1 {
+			li.partner = other
+		} else if li.partner != other {
+			li.partner = -2
+		}
+	}
+
+	i1, i2 := 0, 0
+	for _, d := range result.Diffs {
+		switch d.Type {
+		case Equal:
+			a, b := oldLine[i1], newLine[i2]
+			link(oldInfo[a], b)
+			link(newInfo[b], a)
+			i1++
+			i2++
+		case Delete:
+			i1++
+		case Insert:
+			i2++
+		}
+	}
+
+	var pairs [][2]int
+	last := -1
+	for _, a := range oldLine {
+		if a == last {
+			continue
+		}
+		last = a
+		o := oldInfo[a]
+		if o.equal != o.tokens || o.partner < 0 {
+			continue
+		}
+		if n := newInfo[o.partner]; n.equal == n.tokens && n.partner == a {
+			pairs = append(pairs, [2]int{a, o.partner})
+		}
+	}
+	return pairs
+}
+
+// tokenLineIndices returns the 0-based line of text on which each token
+// position starts.
+func tokenLineIndices(text string, positions []TokenPos) []int {
+	lines := make([]int, len(positions))
+	line, cursor := 0, 0
+	for i, pos := range positions {
+		line += strings.Count(text[cursor:pos.Start], "\n")
+		cursor = pos.Start
+		lines[i] = line
+	}
+	return lines
+}
+
+// longestBacktickRun returns the length of the longest run of backticks in s.
+func longestBacktickRun(s string) int {
+	longest, run := 0, 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	return longest
+}
@@ -0,0 +1,82 @@
+package tokendiff
+
+import "testing"
+
+func TestFormatMarkdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		text1    string
+		text2    string
+		expected string
+	}{
+		{
+			name:     "single-line change",
+			text1:    "hello world\n",
+			text2:    "hello there\n",
+			expected: "```diff\n-hello world\n+hello there\n```",
+		},
+		{
+			name:     "unchanged lines are context",
+			text1:    "one\ntwo\nthree",
+			text2:    "one\n2\nthree",
+			expected: "```diff\n one\n-two\n+2\n three\n```",
+		},
+		{
+			name:     "inserted and deleted lines",
+			text1:    "keep\ngone",
+			text2:    "added\nkeep",
+			expected: "```diff\n+added\n keep\n-gone\n```",
+		},
+		{
+			name:     "blank lines stay context",
+			text1:    "a b\n\nc",
+			text2:    "a x\n\nc",
+			expected: "```diff\n-a b\n+a x\n \n c\n```",
+		},
+		{
+			name:     "line split is a change",
+			text1:    "a b",
+			text2:    "a\nb",
+			expected: "```diff\n-a b\n+a\n+b\n```",
+		},
+		{
+			name:     "identical texts",
+			text1:    "same\n",
+			text2:    "same\n",
+			expected: "```diff\n same\n```",
+		},
+		{
+			name:     "backticks lengthen the fence",
+			text1:    "use ```go fences",
+			text2:    "use ````go fences",
+			expected: "`````diff\n-use ```go fences\n+use ````go fences\n`````",
+		},
+		{
+			name:     "empty inputs",
+			text1:    "",
+			text2:    "",
+			expected: "```diff\n```",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := DiffStringsWithPositions(tt.text1, tt.text2, DefaultOptions())
+			if got := FormatMarkdown(result); got != tt.expected {
+				t.Errorf("FormatMarkdown() =\n%s\nwant\n%s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFormatMarkdownWithoutPositions(t *testing.T) {
+	result := DiffResult{
+		Diffs: DiffStrings("a\nb", "a\nc", DefaultOptions()),
+		Text1: "a\nb",
+		Text2: "a\nc",
+	}
+	expected := "```diff\n a\n-b\n+c\n```"
+	if got := FormatMarkdown(result); got != expected {
+		t.Errorf("FormatMarkdown() =\n%s\nwant\n%s", got, expected)
+	}
+}
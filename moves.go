@@ -0,0 +1,172 @@
+package tokendiff
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// TokenMove is a run of tokens that DetectTokenMoves found deleted in one
+// place and inserted, unchanged, in another. OldStart and NewStart are token
+// indices, into Positions1 and Positions2, of the run in the old and the
+// new text. Chars is the number of characters (runes) in the run's tokens.
+type TokenMove struct {
+	OldStart int
+	NewStart int
+	Length   int
+	Chars    int
+}
+
+// tokenRun is a run of Delete or Insert diffs: their tokens and the token
+// index of the first in its text.
+type tokenRun struct {
+	tokens []string
+	start  int
+}
+
+// DetectTokenMoves finds text that was moved in a whole-file diff, such as
+// a reordered paragraph, which the diff reports as a deletion in one place
+// and an insertion in another. Each run of Delete diffs is matched with the
+// run of Insert diffs that shares the longest sequence of identical tokens
+// with it, and if that sequence is at least minRun tokens long, it is
+// added to the returned result's Moves. Each run takes part in at most one
+// move. The diffs themselves are unchanged: FormatDiffResultAdvanced shows
+// moved text with FormatOptions.StartMove and StopMove, or MoveColor, and
+// MoveStatistics counts it once instead of as deleted and inserted words.
+// minRun below 1 is treated as 1.
+func DetectTokenMoves(result DiffResult, minRun int) DiffResult {
+	minRun = max(minRun, 1)
+
+	var deletes, inserts []tokenRun
+	idx1, idx2 := 0, 0
+	for i := 0; i < len(result.Diffs); {
+		op := result.Diffs[i].Type
+		run := tokenRun{}
+		for ; i < len(result.Diffs) && result.Diffs[i].Type == op; i++ {
+			run.tokens = append(run.tokens, result.Diffs[i].Token)
+		}
+		switch op {
+		case Equal:
+			idx1 += len(run.tokens)
+			idx2 += len(run.tokens)
+		case Delete:
+			run.start = idx1
+			deletes = append(deletes, run)
+			idx1 += len(run.tokens)
+		case Insert:
+			run.start = idx2
+			inserts = append(inserts, run)
+			idx2 += len(run.tokens)
+		}
+	}
+
+	var moves []TokenMove
+	used := make([]bool, len(inserts))
+	for _, del := range deletes {
+		best, bestIns := TokenMove{}, -1
+		var bestRun []string
+		for j, ins := range inserts {
+			if used[j] || len(ins.tokens) < minRun {
+				continue
+			}
+			i1, i2, n := longestCommonRun(del.tokens, ins.tokens)
+			if n > best.Length {
+				best = TokenMove{OldStart: del.start + i1, NewStart: ins.start + i2, Length: n}
+				bestIns = j
+				bestRun = del.tokens[i1 : i1+n]
+			}
+		}
+		if best.Length >= minRun {
+			for _, t := range bestRun {
+				best.Chars += utf8.RuneCountInString(t)
+			}
+			used[bestIns] = true
+			moves = append(moves, best)
+		}
+	}
+
+	result.Moves = moves
+	return result
+}
+
+// longestCommonRun returns the start in a and in b, and the length, of the
+// longest sequence of tokens both contain. Ties go to the earliest in a,
+// then in b.
+func longestCommonRun(a, b []string) (int, int, int) {
+	start1, start2, length := 0, 0, 0
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] != b[j-1] {
+				curr[j] = 0
+				continue
+			}
+			curr[j] = prev[j-1] + 1
+			if curr[j] > length {
+				start1, start2, length = i-curr[j], j-curr[j], curr[j]
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return start1, start2, length
+}
+
+// MoveStatistics returns st, computed for a diff, with the tokens of moves
+// found in it counted once as MovedWords instead of as both DeletedWords
+// and InsertedWords, and their characters once as MovedChars instead of as
+// both DeletedChars and InsertedChars.
+func MoveStatistics(st DiffStatistics, moves []TokenMove) DiffStatistics {
+	for _, m := range moves {
+		st.MovedWords += m.Length
+		st.DeletedWords -= m.Length
+		st.InsertedWords -= m.Length
+		st.MovedChars += m.Chars
+		st.DeletedChars -= m.Chars
+		st.InsertedChars -= m.Chars
+	}
+	return st
+}
+
+// movedSpans returns the token index ranges [start, end) on one side of
+// moves, in order: the old side for Delete and the new side for Insert.
+func movedSpans(moves []TokenMove, op Operation) [][2]int {
+	spans := make([][2]int, 0, len(moves))
+	for _, m := range moves {
+		start := m.NewStart
+		if op == Delete {
+			start = m.OldStart
+		}
+		spans = append(spans, [2]int{start, start + m.Length})
+	}
+	sort.Slice(spans, func(a, b int) bool { return spans[a][0] < spans[b][0] })
+	return spans
+}
+
+// formatMovedToken formats moved text on the side op: between StartMove and
+// StopMove, or in MoveColor with UseColor. It is formatted as deleted or
+// inserted text if neither is set, and in the output modes that have no
+// way to show a move: LessMode, PrinterMode, UnicodeStrikethrough, and
+// colored output with line numbers.
+func formatMovedToken(token string, op Operation, opts FormatOptions) string {
+	plain := opts.LessMode || opts.PrinterMode || opts.UnicodeStrikethrough || (opts.ShowLineNumbers && opts.UseColor)
+	if plain || (opts.UseColor && opts.MoveColor == "") || (!opts.UseColor && opts.StartMove == "" && opts.StopMove == "") {
+		return formatNonEqualToken(Diff{Type: op, Token: token}, opts)
+	}
+	if (op == Delete && opts.NoDeleted) || (op == Insert && opts.NoInserted) {
+		return ""
+	}
+	token = outputCase(token, opts)
+	if opts.UseColor {
+		if opts.LessModeANSI && strings.Contains(token, "\n") {
+			token = strings.ReplaceAll(token, "\n", opts.ClearToEOL+opts.ColorReset+"\n"+opts.MoveColor)
+		} else if opts.RepeatMarkers && strings.Contains(token, "\n") {
+			token = strings.ReplaceAll(token, "\n", opts.ColorReset+"\n"+opts.MoveColor)
+		}
+		return opts.MoveColor + token + opts.ColorReset
+	}
+	if opts.RepeatMarkers && strings.Contains(token, "\n") {
+		token = strings.ReplaceAll(token, "\n", opts.StopMove+"\n"+opts.StartMove)
+	}
+	return opts.StartMove + token + opts.StopMove
+}
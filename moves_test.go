@@ -0,0 +1,121 @@
+package tokendiff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDetectTokenMoves(t *testing.T) {
+	tests := []struct {
+		name   string
+		text1  string
+		text2  string
+		minRun int
+		moves  []TokenMove
+	}{
+		{
+			name:   "phrase moved from start to end",
+			text1:  "alpha beta gamma delta epsilon one two three four five six",
+			text2:  "one two three four five six alpha beta gamma delta epsilon",
+			minRun: 5,
+			moves:  []TokenMove{{OldStart: 0, NewStart: 6, Length: 5, Chars: 26}},
+		},
+		{
+			name:   "shorter than minRun",
+			text1:  "alpha beta gamma delta epsilon one two three four five six",
+			text2:  "one two three four five six alpha beta gamma delta epsilon",
+			minRun: 6,
+			moves:  nil,
+		},
+		{
+			name:   "moved part of a changed run",
+			text1:  "x y z a b c d e f g h i j",
+			text2:  "a b c d e f g h i j w x y z",
+			minRun: 3,
+			moves:  []TokenMove{{OldStart: 0, NewStart: 11, Length: 3, Chars: 3}},
+		},
+		{
+			name:   "replacement is not a move",
+			text1:  "one two three four",
+			text2:  "one two five four",
+			minRun: 1,
+			moves:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := DiffStringsWithPositions(tt.text1, tt.text2, DefaultOptions())
+			got := DetectTokenMoves(result, tt.minRun)
+			if !reflect.DeepEqual(got.Moves, tt.moves) {
+				t.Errorf("DetectTokenMoves() moves = %+v, want %+v (diffs %v)", got.Moves, tt.moves, result.Diffs)
+			}
+			if !reflect.DeepEqual(got.Diffs, result.Diffs) {
+				t.Errorf("DetectTokenMoves() changed the diffs: %v, want %v", got.Diffs, result.Diffs)
+			}
+		})
+	}
+}
+
+func TestFormatTokenMoves(t *testing.T) {
+	text1 := "alpha beta gamma delta epsilon one two three four five six"
+	text2 := "one two three four five six alpha beta gamma delta epsilon"
+	result := DetectTokenMoves(DiffStringsWithPositions(text1, text2, DefaultOptions()), 5)
+
+	tests := []struct {
+		name     string
+		opts     FormatOptions
+		expected string
+	}{
+		{
+			name:     "markers",
+			opts:     DefaultFormatOptions(),
+			expected: "[~alpha beta gamma delta epsilon~]one two three four five six [~alpha beta gamma delta epsilon~]",
+		},
+		{
+			name: "color",
+			opts: FormatOptions{UseColor: true, DeleteColor: "<d>", InsertColor: "<i>", MoveColor: "<m>", ColorReset: "</>"},
+			expected: "<m>alpha beta gamma delta epsilon</>one two three four five six " +
+				"<m>alpha beta gamma delta epsilon</>",
+		},
+		{
+			name:     "no move markers",
+			opts:     FormatOptions{StartDelete: "[-", StopDelete: "-]", StartInsert: "{+", StopInsert: "+}"},
+			expected: "[-alpha beta gamma delta epsilon-]one two three four five six {+alpha beta gamma delta epsilon+}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FormatDiffResultAdvanced(result, tt.opts); got != tt.expected {
+				t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+
+	// Only the moved part of a run is marked as moved
+	partial := DetectTokenMoves(DiffStringsWithPositions("x y z a b c d", "a b c d w x y z", DefaultOptions()), 3)
+	want := "[~x y z~]a b c d {+w+} [~x y z~]"
+	if got := FormatDiffResultAdvanced(partial, DefaultFormatOptions()); got != want {
+		t.Errorf("FormatDiffResultAdvanced() partial move = %q, want %q", got, want)
+	}
+}
+
+func TestMoveStatistics(t *testing.T) {
+	text1 := "alpha beta gamma delta epsilon one two three four five six"
+	text2 := "one two three four five six alpha beta gamma delta epsilon"
+	result := DetectTokenMoves(DiffStringsWithPositions(text1, text2, DefaultOptions()), 5)
+
+	st := ComputeStatistics(text1, text2, result.Diffs, DefaultOptions())
+	got := MoveStatistics(st, result.Moves)
+	want := DiffStatistics{OldWords: 11, NewWords: 11, CommonWords: 6, MovedWords: 5, CommonChars: 22, MovedChars: 26}
+	if got != want {
+		t.Errorf("MoveStatistics() = %+v, want %+v", got, want)
+	}
+	if got.OldWords != got.CommonWords+got.DeletedWords+got.MovedWords {
+		t.Errorf("MoveStatistics() = %+v: moved words counted more than once", got)
+	}
+	if st.DeletedChars != got.DeletedChars+got.MovedChars {
+		t.Errorf("MoveStatistics() = %+v: moved characters counted more than once", got)
+	}
+}
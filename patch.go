@@ -0,0 +1,103 @@
+package tokendiff
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// PatchOp is one edit of a patch script: Delete removes Text, which starts
+// at byte offset Pos of the old text, and Insert writes Text at Pos.
+type PatchOp struct {
+	Op   Operation // Delete or Insert
+	Pos  int       // byte offset in the old text
+	Text string
+}
+
+// BuildPatch returns the edits that turn result.Text1 into result.Text2, in
+// order of Pos, with a deletion before the insertion at the same offset.
+// Tokens Equal in both texts with the same bytes anchor the patch; the text
+// between two anchors, whitespace included, is replaced where it differs,
+// keeping any common prefix and suffix, so applying the patch with
+// ApplyPatch reproduces Text2 exactly. Equal tokens that differ in bytes,
+// as under IgnoreCase, are replaced too. Without positions, the patch
+// replaces the whole text.
+func BuildPatch(result DiffResult) []PatchOp {
+	var ops []PatchOp
+	last1, last2 := 0, 0 // ends of the last anchor
+	replace := func(end1, end2 int) {
+		ops = appendReplacement(ops, last1, result.Text1[last1:end1], result.Text2[last2:end2])
+	}
+
+	idx1, idx2 := 0, 0
+	for _, d := range result.Diffs {
+		switch d.Type {
+		case Equal:
+			if idx1 < len(result.Positions1) && idx2 < len(result.Positions2) {
+				pos1, pos2 := result.Positions1[idx1], result.Positions2[idx2]
+				if result.Text1[pos1.Start:pos1.End] == result.Text2[pos2.Start:pos2.End] {
+					replace(pos1.Start, pos2.Start)
+					last1, last2 = pos1.End, pos2.End
+				}
+			}
+			idx1++
+			idx2++
+		case Delete:
+			idx1++
+		case Insert:
+			idx2++
+		}
+	}
+	replace(len(result.Text1), len(result.Text2))
+	return ops
+}
+
+// appendReplacement appends the edits that replace old, at byte offset pos
+// of the old text, with new, leaving out the runes they start and end with
+// in common.
+func appendReplacement(ops []PatchOp, pos int, old, new string) []PatchOp {
+	for len(old) > 0 && len(new) > 0 {
+		_, size := utf8.DecodeRuneInString(old)
+		if !strings.HasPrefix(new, old[:size]) {
+			break
+		}
+		old, new = old[size:], new[size:]
+		pos += size
+	}
+	for len(old) > 0 && len(new) > 0 {
+		_, size := utf8.DecodeLastRuneInString(old)
+		if !strings.HasSuffix(new, old[len(old)-size:]) {
+			break
+		}
+		old, new = old[:len(old)-size], new[:len(new)-size]
+	}
+
+	if old != "" {
+		ops = append(ops, PatchOp{Op: Delete, Pos: pos, Text: old})
+	}
+	if new != "" {
+		ops = append(ops, PatchOp{Op: Insert, Pos: pos, Text: new})
+	}
+	return ops
+}
+
+// ApplyPatch applies ops, as returned by BuildPatch for a diff of text1, to
+// text1 and returns the result. Ops must be in order of Pos; a Delete
+// removes len(Text) bytes at Pos without checking that they match Text.
+func ApplyPatch(text1 string, ops []PatchOp) string {
+	var sb strings.Builder
+	sb.Grow(len(text1))
+	cursor := 0
+	for _, op := range ops {
+		pos := min(max(op.Pos, cursor), len(text1))
+		sb.WriteString(text1[cursor:pos])
+		cursor = pos
+		switch op.Op {
+		case Delete:
+			cursor = min(pos+len(op.Text), len(text1))
+		case Insert:
+			sb.WriteString(op.Text)
+		}
+	}
+	sb.WriteString(text1[cursor:])
+	return sb.String()
+}
@@ -0,0 +1,100 @@
+package tokendiff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		text1    string
+		text2    string
+		opts     Options
+		expected []PatchOp
+	}{
+		{
+			name:     "identical",
+			text1:    "same text",
+			text2:    "same text",
+			expected: nil,
+		},
+		{
+			name:  "word replaced",
+			text1: "the quick brown fox",
+			text2: "the quick red fox",
+			expected: []PatchOp{
+				{Op: Delete, Pos: 10, Text: "brown"},
+				{Op: Insert, Pos: 10, Text: "red"},
+			},
+		},
+		{
+			name:     "word inserted",
+			text1:    "hello world",
+			text2:    "hello big world",
+			expected: []PatchOp{{Op: Insert, Pos: 6, Text: "big "}},
+		},
+		{
+			name:     "whitespace changed",
+			text1:    "a b",
+			text2:    "a\n\nb",
+			expected: []PatchOp{{Op: Delete, Pos: 1, Text: " "}, {Op: Insert, Pos: 1, Text: "\n\n"}},
+		},
+		{
+			name:  "ignore case replaces equal tokens that differ",
+			text1: "Hello world",
+			text2: "hello world",
+			opts:  Options{IgnoreCase: true},
+			expected: []PatchOp{
+				{Op: Delete, Pos: 0, Text: "H"},
+				{Op: Insert, Pos: 0, Text: "h"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := DiffStringsWithPositions(tt.text1, tt.text2, tt.opts)
+			got := BuildPatch(result)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("BuildPatch() = %+v, want %+v", got, tt.expected)
+			}
+			if applied := ApplyPatch(tt.text1, got); applied != tt.text2 {
+				t.Errorf("ApplyPatch() = %q, want %q", applied, tt.text2)
+			}
+		})
+	}
+}
+
+func TestBuildPatchRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		text1 string
+		text2 string
+		opts  Options
+	}{
+		{"empty to text", "", "new text\n", DefaultOptions()},
+		{"text to empty", "old text\n", "", DefaultOptions()},
+		{"code", "x = getData(a, b);\nreturn x\n", "y := getData(b, a)\n\treturn y, nil\n", DefaultOptions()},
+		{"reordered lines", "one\ntwo\nthree\n", "three\none\ntwo\n", DefaultOptions()},
+		{"multi-byte runes", "le café noir", "la cafés noire", DefaultOptions()},
+		{"preserve whitespace", "a  b\tc", "a b  c d", Options{PreserveWhitespace: true}},
+		{"line-level fallback", "a b c\nd e f\n", "a b c\nd x f\ng\n", Options{MaxTokens: 2}},
+		{"ignore case", "Hello World", "hello there WORLD", Options{IgnoreCase: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := BuildPatch(DiffStringsWithPositions(tt.text1, tt.text2, tt.opts))
+			if got := ApplyPatch(tt.text1, ops); got != tt.text2 {
+				t.Errorf("ApplyPatch(BuildPatch()) = %q, want %q (ops %+v)", got, tt.text2, ops)
+			}
+		})
+	}
+
+	// Without positions the whole text is replaced
+	result := DiffResult{Diffs: DiffStrings("a b", "a c", DefaultOptions()), Text1: "a b", Text2: "a c"}
+	if got := ApplyPatch("a b", BuildPatch(result)); got != "a c" {
+		t.Errorf("ApplyPatch(BuildPatch()) without positions = %q, want %q", got, "a c")
+	}
+}
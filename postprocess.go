@@ -1,12 +1,23 @@
 package tokendiff
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+)
 
 // AggregateDiffs combines adjacent diffs of the same type into single tokens.
 // For example, consecutive Delete operations are merged into one Delete
 // with tokens joined appropriately (spaces between words, no spaces between
 // punctuation/delimiters).
 func AggregateDiffs(diffs []Diff) []Diff {
+	return AggregateDiffsMinRun(diffs, 1)
+}
+
+// AggregateDiffsMinRun is like AggregateDiffs, but only combines runs of at
+// least minRun diffs of the same type; shorter runs are kept as individual
+// diffs, so single-token changes stay separate from large blocks. A minRun
+// below 1 is treated as 1, which combines every run.
+func AggregateDiffsMinRun(diffs []Diff, minRun int) []Diff {
 	if len(diffs) == 0 {
 		return diffs
 	}
@@ -17,6 +28,13 @@ func AggregateDiffs(diffs []Diff) []Diff {
 
 	flush := func() {
 		if len(currentTokens) > 0 && currentType >= 0 {
+			if len(currentTokens) < minRun {
+				for _, token := range currentTokens {
+					result = append(result, Diff{Type: currentType, Token: token})
+				}
+				currentTokens = nil
+				return
+			}
 			// Join tokens using spacing heuristics
 			var sb strings.Builder
 			for i, token := range currentTokens {
@@ -114,6 +132,58 @@ func InterleaveDiffs(diffs []Diff) []Diff {
 	return result
 }
 
+// NormalizeDiffs returns diffs with each change between Equal tokens
+// reordered as all its Deletes followed by all its Inserts, keeping their
+// order within each type, and with diffs of empty tokens dropped. This
+// undoes the fragmentation of InterleaveDiffs and ApplyMatchContext, so
+// each change is at most one Delete run and one Insert run. Unlike
+// AggregateDiffs, tokens are not joined, so the result is for analysis
+// rather than display; see RunLengths.
+func NormalizeDiffs(diffs []Diff) []Diff {
+	result := make([]Diff, 0, len(diffs))
+	var inserts []Diff
+
+	for _, d := range diffs {
+		if d.Token == "" {
+			continue
+		}
+		switch d.Type {
+		case Equal:
+			result = append(result, inserts...)
+			inserts = inserts[:0]
+			result = append(result, d)
+		case Delete:
+			result = append(result, d)
+		case Insert:
+			inserts = append(inserts, d)
+		}
+	}
+	return append(result, inserts...)
+}
+
+// DiffRun is a run of consecutive diffs of the same type: Length diffs
+// starting at index Start.
+type DiffRun struct {
+	Type   Operation
+	Start  int
+	Length int
+}
+
+// RunLengths returns the runs of consecutive same-type diffs in diffs, in
+// order. Call NormalizeDiffs first to count each change as one Delete run
+// and one Insert run.
+func RunLengths(diffs []Diff) []DiffRun {
+	var runs []DiffRun
+	for i, d := range diffs {
+		if n := len(runs); n > 0 && runs[n-1].Type == d.Type {
+			runs[n-1].Length++
+			continue
+		}
+		runs = append(runs, DiffRun{Type: d.Type, Start: i, Length: 1})
+	}
+	return runs
+}
+
 // ApplyMatchContext processes diffs to require minimum context between changes.
 // Equal tokens that appear between changes with fewer than minContext matches
 // are converted to both Delete and Insert operations. This reduces noise from
@@ -200,6 +270,25 @@ var stopwords = map[string]bool{
 // Insert run, so they merge together during formatting instead of appearing
 // as separate `[---] {+-+}` markers.
 func EliminateStopwordAnchors(diffs []Diff) []Diff {
+	return eliminateStopwordAnchors(diffs, stopwords)
+}
+
+// mergeStopwords returns the package stopwords together with extra, in a
+// new map so the package set is left unchanged.
+func mergeStopwords(extra []string) map[string]bool {
+	merged := make(map[string]bool, len(stopwords)+len(extra))
+	for w := range stopwords {
+		merged[w] = true
+	}
+	for _, w := range extra {
+		merged[w] = true
+	}
+	return merged
+}
+
+// eliminateStopwordAnchors is EliminateStopwordAnchors with the stopword
+// set given.
+func eliminateStopwordAnchors(diffs []Diff, stopwords map[string]bool) []Diff {
 	if len(diffs) == 0 {
 		return diffs
 	}
@@ -273,9 +362,177 @@ func EliminateStopwordAnchors(diffs []Diff) []Diff {
 	return result
 }
 
+// DetectTranspositions coalesces two adjacent tokens that swapped places into
+// a single compact change. A swap such as "the quick" -> "quick the" is
+// usually diffed as a deleted and re-inserted word around an unchanged one:
+//
+//	Delete[the] Equal[quick] Insert[the]
+//
+// which renders as two separate changes. This rewrites the pattern (and its
+// Insert-first mirror) as Delete[the quick] Insert[quick the], so the swap
+// reads as one replacement. Already coalesced swaps are left unchanged. The
+// tokens of each side keep their original order, so the result can still be
+// formatted with position information.
+func DetectTranspositions(diffs []Diff) []Diff {
+	if len(diffs) < 3 {
+		return diffs
+	}
+
+	result := make([]Diff, 0, len(diffs)+1)
+	i := 0
+	for i < len(diffs) {
+		if a, b, ok := transposedAt(diffs, i); ok {
+			result = append(result,
+				Diff{Type: Delete, Token: a},
+				Diff{Type: Delete, Token: b},
+				Diff{Type: Insert, Token: b},
+				Diff{Type: Insert, Token: a},
+			)
+			i += 3
+			continue
+		}
+		result = append(result, diffs[i])
+		i++
+	}
+
+	return result
+}
+
+// transposedAt reports whether diffs[i:i+3] is a single changed token moved
+// across one unchanged token, with no other change on either side. Returns
+// the old-order tokens a and b, where the old text reads "a b" and the new
+// text reads "b a".
+func transposedAt(diffs []Diff, i int) (a, b string, ok bool) {
+	if i+3 > len(diffs) {
+		return "", "", false
+	}
+	first, mid, last := diffs[i], diffs[i+1], diffs[i+2]
+	if mid.Type != Equal || first.Token != last.Token || first.Token == mid.Token {
+		return "", "", false
+	}
+	// The swap must be isolated, or it is part of a larger change
+	if i > 0 && diffs[i-1].Type != Equal {
+		return "", "", false
+	}
+	if i+3 < len(diffs) && diffs[i+3].Type != Equal {
+		return "", "", false
+	}
+
+	switch {
+	case first.Type == Delete && last.Type == Insert:
+		// Old: a b, new: b a
+		return first.Token, mid.Token, true
+	case first.Type == Insert && last.Type == Delete:
+		// Old: b a, new: a b
+		return mid.Token, first.Token, true
+	}
+	return "", "", false
+}
+
+// ChangeSummary counts the changes in a diff by kind, as classified by
+// ClassifyChanges. Each change is a run of adjacent Delete and Insert
+// diffs, as returned by Changes, and is counted in exactly one category.
+type ChangeSummary struct {
+	Renamed    int // one token replaced by another
+	Replaced   int // several tokens replaced by one or more others
+	Moved      int // a deleted run inserted unchanged elsewhere (counted once)
+	Transposed int // two adjacent tokens swapped
+	Deleted    int // runs of deleted tokens only
+	Inserted   int // runs of inserted tokens only
+
+	DeletedTokens  int // total tokens deleted, including moved ones
+	InsertedTokens int // total tokens inserted, including moved ones
+}
+
+// String formats the summary as "Renamed: 3, Deleted: 5, Inserted: 2"
+// followed by the raw token counts, omitting categories with no changes.
+// Returns "No changes" for an empty summary.
+func (s ChangeSummary) String() string {
+	var parts []string
+	for _, c := range []struct {
+		name  string
+		count int
+	}{
+		{"Renamed", s.Renamed},
+		{"Replaced", s.Replaced},
+		{"Moved", s.Moved},
+		{"Transposed", s.Transposed},
+		{"Deleted", s.Deleted},
+		{"Inserted", s.Inserted},
+	} {
+		if c.count > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %d", c.name, c.count))
+		}
+	}
+	if len(parts) == 0 {
+		return "No changes"
+	}
+	return fmt.Sprintf("%s (%d tokens deleted, %d inserted)",
+		strings.Join(parts, ", "), s.DeletedTokens, s.InsertedTokens)
+}
+
+// ClassifyChanges groups diffs into changes and counts them by kind. Swapped
+// tokens are found with DetectTranspositions; a run of deleted tokens that
+// is inserted unchanged elsewhere is a move; a one-for-one token
+// replacement is a rename. The counts depend only on diffs, so the same
+// diff always yields the same summary.
+func ClassifyChanges(diffs []Diff) ChangeSummary {
+	var s ChangeSummary
+	changes := Changes(DiffResult{Diffs: DetectTranspositions(diffs)})
+
+	// Pair pure deletions with identical pure insertions as moves, in order
+	inserted := make(map[string][]int)
+	for i, c := range changes {
+		if len(c.Deleted) == 0 {
+			key := strings.Join(c.Inserted, "\x00")
+			inserted[key] = append(inserted[key], i)
+		}
+	}
+	moved := make(map[int]bool)
+	for i, c := range changes {
+		if len(c.Inserted) > 0 {
+			continue
+		}
+		key := strings.Join(c.Deleted, "\x00")
+		if targets := inserted[key]; len(targets) > 0 {
+			moved[i], moved[targets[0]] = true, true
+			inserted[key] = targets[1:]
+			s.Moved++
+		}
+	}
+
+	for i, c := range changes {
+		s.DeletedTokens += len(c.Deleted)
+		s.InsertedTokens += len(c.Inserted)
+		switch {
+		case moved[i]:
+		case isTransposition(c):
+			s.Transposed++
+		case len(c.Inserted) == 0:
+			s.Deleted++
+		case len(c.Deleted) == 0:
+			s.Inserted++
+		case len(c.Deleted) == 1 && len(c.Inserted) == 1:
+			s.Renamed++
+		default:
+			s.Replaced++
+		}
+	}
+
+	return s
+}
+
+// isTransposition returns true if c replaces "a b" with "b a".
+func isTransposition(c Change) bool {
+	return len(c.Deleted) == 2 && len(c.Inserted) == 2 &&
+		c.Deleted[0] != c.Deleted[1] &&
+		c.Deleted[0] == c.Inserted[1] && c.Deleted[1] == c.Inserted[0]
+}
+
 // ComputeTokenSimilarity calculates similarity between two strings based on shared tokens.
 // Returns a value between 0.0 (no similarity) and 1.0 (identical).
 // Similarity is computed as the ratio of Equal tokens to total diff operations.
+// Tokens are compared case-insensitively with opts.IgnoreCase.
 func ComputeTokenSimilarity(text1, text2 string, opts Options) float64 {
 	// Handle edge cases
 	if text1 == text2 {
@@ -293,7 +550,12 @@ func ComputeTokenSimilarity(text1, text2 string, opts Options) float64 {
 		return 0.0
 	}
 
-	diffs := DiffTokens(tokens1, tokens2)
+	var diffs []Diff
+	if opts.IgnoreCase {
+		diffs = diffTokensIgnoreCase(tokens1, tokens2, opts.CaseFold, AlgoHistogram)
+	} else {
+		diffs = DiffTokens(tokens1, tokens2)
+	}
 
 	var equalCount, totalCount int
 	for _, d := range diffs {
@@ -310,6 +572,54 @@ func ComputeTokenSimilarity(text1, text2 string, opts Options) float64 {
 	return float64(equalCount) / float64(totalCount)
 }
 
+// ComputeEditSimilarity calculates similarity between two strings from the
+// token-level Levenshtein distance: 1 minus the number of token insertions,
+// deletions, and substitutions needed to turn one into the other, divided by
+// the larger token count. Returns a value between 0.0 (no similarity) and
+// 1.0 (identical). Unlike ComputeTokenSimilarity, a replaced token costs one
+// edit rather than a Delete and an Insert, so lines with the same shape and
+// a few changed words score higher. Tokens are compared case-insensitively
+// with opts.IgnoreCase.
+func ComputeEditSimilarity(text1, text2 string, opts Options) float64 {
+	if text1 == text2 {
+		return 1.0
+	}
+
+	tokens1 := Tokenize(text1, opts)
+	tokens2 := Tokenize(text2, opts)
+	longest := max(len(tokens1), len(tokens2))
+	if len(tokens1) == 0 || len(tokens2) == 0 {
+		return 0.0
+	}
+
+	equal := func(a, b string) bool {
+		if opts.IgnoreCase {
+			return opts.CaseFold.equal(a, b)
+		}
+		return a == b
+	}
+
+	// Two-row dynamic programming over tokens2
+	prev := make([]int, len(tokens2)+1)
+	curr := make([]int, len(tokens2)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(tokens1); i++ {
+		curr[0] = i
+		for j := 1; j <= len(tokens2); j++ {
+			cost := 1
+			if equal(tokens1[i-1], tokens2[j-1]) {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return 1.0 - float64(prev[len(tokens2)])/float64(longest)
+}
+
 // collectTokensOfType collects consecutive tokens of a given type starting at index.
 // Returns the tokens and the new index after the run.
 func collectTokensOfType(diffs []Diff, start int, tokenType Operation) ([]string, int) {
@@ -1,6 +1,7 @@
 package tokendiff
 
 import (
+	"math"
 	"reflect"
 	"testing"
 )
@@ -81,6 +82,61 @@ func TestAggregateDiffs(t *testing.T) {
 	}
 }
 
+func TestAggregateDiffsMinRun(t *testing.T) {
+	input := []Diff{
+		{Type: Equal, Token: "keep"},
+		{Type: Delete, Token: "a"},
+		{Type: Delete, Token: "b"},
+		{Type: Equal, Token: "mid"},
+		{Type: Delete, Token: "c"},
+		{Type: Delete, Token: "d"},
+		{Type: Delete, Token: "e"},
+		{Type: Delete, Token: "f"},
+	}
+
+	tests := []struct {
+		name     string
+		minRun   int
+		expected []Diff
+	}{
+		{
+			name:   "min run 3 splits two-token delete, merges four-token delete",
+			minRun: 3,
+			expected: []Diff{
+				{Type: Equal, Token: "keep"},
+				{Type: Delete, Token: "a"},
+				{Type: Delete, Token: "b"},
+				{Type: Equal, Token: "mid"},
+				{Type: Delete, Token: "c d e f"},
+			},
+		},
+		{
+			name:     "min run 1 matches AggregateDiffs",
+			minRun:   1,
+			expected: AggregateDiffs(input),
+		},
+		{
+			name:     "min run 0 treated as 1",
+			minRun:   0,
+			expected: AggregateDiffs(input),
+		},
+		{
+			name:     "min run above every run keeps all tokens",
+			minRun:   5,
+			expected: input,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := AggregateDiffsMinRun(input, tt.minRun)
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("AggregateDiffsMinRun(%d) = %v, want %v", tt.minRun, result, tt.expected)
+			}
+		})
+	}
+}
+
 func TestApplyMatchContext(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -230,6 +286,22 @@ func TestComputeTokenSimilarity(t *testing.T) {
 			minSim: 0.3, // At least some similarity
 			maxSim: 0.6, // But not too much
 		},
+		{
+			name:   "case differences with ignore case",
+			text1:  "Hello World",
+			text2:  "hello world",
+			opts:   Options{Delimiters: DefaultDelimiters, IgnoreCase: true},
+			minSim: 1.0,
+			maxSim: 1.0,
+		},
+		{
+			name:   "case differences without ignore case",
+			text1:  "Hello World",
+			text2:  "hello world",
+			opts:   DefaultOptions(),
+			minSim: 0.0,
+			maxSim: 0.0,
+		},
 		{
 			name:   "empty text1",
 			text1:  "",
@@ -283,6 +355,59 @@ func TestComputeTokenSimilarity(t *testing.T) {
 	}
 }
 
+func TestComputeEditSimilarity(t *testing.T) {
+	tests := []struct {
+		name     string
+		text1    string
+		text2    string
+		opts     Options
+		expected float64
+	}{
+		{"identical", "hello world", "hello world", DefaultOptions(), 1.0},
+		{"completely different", "hello world", "foo bar", DefaultOptions(), 0.0},
+		{"one substitution", "the cat sat", "the dog sat", DefaultOptions(), 1 - 1.0/3},
+		{"insertions", "a b c", "a b c d e f", DefaultOptions(), 0.5},
+		{"empty", "", "a", DefaultOptions(), 0.0},
+		{"ignore case", "Hello World", "hello world", Options{IgnoreCase: true}, 1.0},
+		{"case differs", "Hello World", "hello world", DefaultOptions(), 0.0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ComputeEditSimilarity(tt.text1, tt.text2, tt.opts); math.Abs(got-tt.expected) > 1e-9 {
+				t.Errorf("ComputeEditSimilarity(%q, %q) = %v, want %v", tt.text1, tt.text2, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSimilarityFuncsDisagree(t *testing.T) {
+	// Token similarity counts a replaced token as a Delete and an Insert,
+	// so it favors reordered lines; edit similarity counts a substitution
+	// as one edit and a reordering as several.
+	tests := []struct {
+		name      string
+		text1     string
+		text2     string
+		wantToken float64
+		wantEdit  float64
+	}{
+		{"swapped words", "alpha beta gamma delta", "beta alpha gamma delta", 0.6, 0.5},
+		{"reversed", "a b c d", "d c b a", 1.0 / 7, 0.0},
+		{"replaced word", "the cat sat", "the dog sat", 0.5, 1 - 1.0/3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := ComputeTokenSimilarity(tt.text1, tt.text2, DefaultOptions())
+			edit := ComputeEditSimilarity(tt.text1, tt.text2, DefaultOptions())
+			if math.Abs(token-tt.wantToken) > 1e-9 || math.Abs(edit-tt.wantEdit) > 1e-9 {
+				t.Errorf("token, edit similarity = %v, %v; want %v, %v", token, edit, tt.wantToken, tt.wantEdit)
+			}
+		})
+	}
+}
+
 func TestShiftBoundaries(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -496,6 +621,113 @@ func TestInterleaveDiffs(t *testing.T) {
 	}
 }
 
+func TestNormalizeDiffs(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []Diff
+		expected []Diff
+		runs     []DiffRun
+	}{
+		{
+			name:     "empty input",
+			input:    nil,
+			expected: []Diff{},
+			runs:     nil,
+		},
+		{
+			name: "consecutive equals stay separate tokens in one run",
+			input: []Diff{
+				{Type: Equal, Token: "a"},
+				{Type: Equal, Token: "b"},
+				{Type: Equal, Token: "c"},
+			},
+			expected: []Diff{
+				{Type: Equal, Token: "a"},
+				{Type: Equal, Token: "b"},
+				{Type: Equal, Token: "c"},
+			},
+			runs: []DiffRun{{Type: Equal, Start: 0, Length: 3}},
+		},
+		{
+			name: "interleaved change regrouped",
+			input: []Diff{
+				{Type: Equal, Token: "the"},
+				{Type: Delete, Token: "old1"},
+				{Type: Insert, Token: "new1"},
+				{Type: Delete, Token: "old2"},
+				{Type: Insert, Token: "new2"},
+				{Type: Equal, Token: "end"},
+			},
+			expected: []Diff{
+				{Type: Equal, Token: "the"},
+				{Type: Delete, Token: "old1"},
+				{Type: Delete, Token: "old2"},
+				{Type: Insert, Token: "new1"},
+				{Type: Insert, Token: "new2"},
+				{Type: Equal, Token: "end"},
+			},
+			runs: []DiffRun{
+				{Type: Equal, Start: 0, Length: 1},
+				{Type: Delete, Start: 1, Length: 2},
+				{Type: Insert, Start: 3, Length: 2},
+				{Type: Equal, Start: 5, Length: 1},
+			},
+		},
+		{
+			name: "trailing inserts and empty tokens",
+			input: []Diff{
+				{Type: Insert, Token: "x"},
+				{Type: Equal, Token: ""},
+				{Type: Delete, Token: "a"},
+			},
+			expected: []Diff{
+				{Type: Delete, Token: "a"},
+				{Type: Insert, Token: "x"},
+			},
+			runs: []DiffRun{
+				{Type: Delete, Start: 0, Length: 1},
+				{Type: Insert, Start: 1, Length: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NormalizeDiffs(tt.input)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("NormalizeDiffs() = %v, want %v", got, tt.expected)
+			}
+			if runs := RunLengths(got); !reflect.DeepEqual(runs, tt.runs) {
+				t.Errorf("RunLengths() = %+v, want %+v", runs, tt.runs)
+			}
+		})
+	}
+}
+
+func TestNormalizeDiffsAfterMatchContext(t *testing.T) {
+	diffs := []Diff{
+		{Type: Delete, Token: "a"},
+		{Type: Insert, Token: "x"},
+		{Type: Equal, Token: "the"},
+		{Type: Delete, Token: "b"},
+		{Type: Insert, Token: "y"},
+	}
+	// ApplyMatchContext turns "the" into a Delete and an Insert, leaving
+	// six single-token runs
+	fragmented := ApplyMatchContext(diffs, 2)
+	if n := len(RunLengths(fragmented)); n != 6 {
+		t.Fatalf("RunLengths(ApplyMatchContext()) has %d runs, want 6", n)
+	}
+
+	want := []DiffRun{
+		{Type: Delete, Start: 0, Length: 3},
+		{Type: Insert, Start: 3, Length: 3},
+	}
+	if runs := RunLengths(NormalizeDiffs(fragmented)); !reflect.DeepEqual(runs, want) {
+		t.Errorf("RunLengths(NormalizeDiffs()) = %+v, want %+v", runs, want)
+	}
+}
+
 func TestEliminateStopwordAnchors(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -601,3 +833,191 @@ func TestEliminateStopwordAnchors(t *testing.T) {
 		})
 	}
 }
+
+func TestDetectTranspositions(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []Diff
+		expected []Diff
+	}{
+		{
+			name:     "empty input",
+			input:    []Diff{},
+			expected: []Diff{},
+		},
+		{
+			name: "delete first swap",
+			input: []Diff{
+				{Type: Delete, Token: "the"},
+				{Type: Equal, Token: "quick"},
+				{Type: Insert, Token: "the"},
+				{Type: Equal, Token: "brown"},
+			},
+			expected: []Diff{
+				{Type: Delete, Token: "the"},
+				{Type: Delete, Token: "quick"},
+				{Type: Insert, Token: "quick"},
+				{Type: Insert, Token: "the"},
+				{Type: Equal, Token: "brown"},
+			},
+		},
+		{
+			name: "insert first swap",
+			input: []Diff{
+				{Type: Equal, Token: "a"},
+				{Type: Insert, Token: "quick"},
+				{Type: Equal, Token: "the"},
+				{Type: Delete, Token: "quick"},
+			},
+			expected: []Diff{
+				{Type: Equal, Token: "a"},
+				{Type: Delete, Token: "the"},
+				{Type: Delete, Token: "quick"},
+				{Type: Insert, Token: "quick"},
+				{Type: Insert, Token: "the"},
+			},
+		},
+		{
+			name: "already coalesced swap unchanged",
+			input: []Diff{
+				{Type: Delete, Token: "the"},
+				{Type: Delete, Token: "quick"},
+				{Type: Insert, Token: "quick"},
+				{Type: Insert, Token: "the"},
+			},
+			expected: []Diff{
+				{Type: Delete, Token: "the"},
+				{Type: Delete, Token: "quick"},
+				{Type: Insert, Token: "quick"},
+				{Type: Insert, Token: "the"},
+			},
+		},
+		{
+			name: "different tokens not a swap",
+			input: []Diff{
+				{Type: Delete, Token: "old"},
+				{Type: Equal, Token: "quick"},
+				{Type: Insert, Token: "new"},
+			},
+			expected: []Diff{
+				{Type: Delete, Token: "old"},
+				{Type: Equal, Token: "quick"},
+				{Type: Insert, Token: "new"},
+			},
+		},
+		{
+			name: "part of a larger change",
+			input: []Diff{
+				{Type: Delete, Token: "x"},
+				{Type: Delete, Token: "the"},
+				{Type: Equal, Token: "quick"},
+				{Type: Insert, Token: "the"},
+			},
+			expected: []Diff{
+				{Type: Delete, Token: "x"},
+				{Type: Delete, Token: "the"},
+				{Type: Equal, Token: "quick"},
+				{Type: Insert, Token: "the"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := DetectTranspositions(tt.input)
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("DetectTranspositions() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFormatTranspositions(t *testing.T) {
+	result := DiffStringsWithPositions("the quick brown fox", "quick the brown fox", DefaultOptions())
+	opts := FormatOptions{
+		StartDelete:    "[-",
+		StopDelete:     "-]",
+		StartInsert:    "{+",
+		StopInsert:     "+}",
+		Transpositions: true,
+	}
+
+	got := FormatDiffResultAdvanced(result, opts)
+	want := "[-the quick-]{+quick the+} brown fox"
+	if got != want {
+		t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, want)
+	}
+}
+
+func TestClassifyChanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		diffs    []Diff
+		expected ChangeSummary
+		str      string
+	}{
+		{
+			name:     "no changes",
+			diffs:    []Diff{{Equal, "a"}, {Equal, "b"}},
+			expected: ChangeSummary{},
+			str:      "No changes",
+		},
+		{
+			name:     "rename",
+			diffs:    []Diff{{Equal, "let"}, {Delete, "foo"}, {Insert, "bar"}, {Equal, "="}},
+			expected: ChangeSummary{Renamed: 1, DeletedTokens: 1, InsertedTokens: 1},
+			str:      "Renamed: 1 (1 tokens deleted, 1 inserted)",
+		},
+		{
+			name:     "replacement of several tokens",
+			diffs:    []Diff{{Equal, "a"}, {Delete, "b"}, {Delete, "c"}, {Insert, "d"}},
+			expected: ChangeSummary{Replaced: 1, DeletedTokens: 2, InsertedTokens: 1},
+			str:      "Replaced: 1 (2 tokens deleted, 1 inserted)",
+		},
+		{
+			name: "deletions and insertions",
+			diffs: []Diff{
+				{Delete, "a"}, {Equal, "b"}, {Insert, "c"}, {Insert, "d"},
+				{Equal, "e"}, {Delete, "f"}, {Equal, "g"}, {Insert, "h"},
+			},
+			expected: ChangeSummary{Deleted: 2, Inserted: 2, DeletedTokens: 2, InsertedTokens: 3},
+			str:      "Deleted: 2, Inserted: 2 (2 tokens deleted, 3 inserted)",
+		},
+		{
+			name:     "transposition",
+			diffs:    []Diff{{Equal, "x"}, {Delete, "the"}, {Equal, "quick"}, {Insert, "the"}, {Equal, "fox"}},
+			expected: ChangeSummary{Transposed: 1, DeletedTokens: 2, InsertedTokens: 2},
+			str:      "Transposed: 1 (2 tokens deleted, 2 inserted)",
+		},
+		{
+			name: "move",
+			diffs: []Diff{
+				{Delete, "one"}, {Delete, "two"}, {Equal, "a"}, {Equal, "b"},
+				{Equal, "c"}, {Insert, "one"}, {Insert, "two"},
+			},
+			expected: ChangeSummary{Moved: 1, DeletedTokens: 2, InsertedTokens: 2},
+			str:      "Moved: 1 (2 tokens deleted, 2 inserted)",
+		},
+		{
+			name: "move pairs only once",
+			diffs: []Diff{
+				{Delete, "x"}, {Equal, "a"}, {Delete, "x"}, {Equal, "b"},
+				{Equal, "c"}, {Insert, "x"},
+			},
+			expected: ChangeSummary{Moved: 1, Deleted: 1, DeletedTokens: 2, InsertedTokens: 1},
+			str:      "Moved: 1, Deleted: 1 (2 tokens deleted, 1 inserted)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ClassifyChanges(tt.diffs)
+			if got != tt.expected {
+				t.Errorf("ClassifyChanges() = %+v, want %+v", got, tt.expected)
+			}
+			if s := got.String(); s != tt.str {
+				t.Errorf("String() = %q, want %q", s, tt.str)
+			}
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package tokendiff
 
+import "sort"
+
 // Discard status constants for token filtering
 const (
 	discardKeep        = 0 // Token should be used for matching
@@ -25,29 +27,22 @@ const (
 // Note: Filtered tokens are still included in the final diff output - they're
 // just excluded from the LCS matching to prevent spurious anchoring.
 func DiscardConfusingTokens(tokens1, tokens2 []string) (filtered1, filtered2 []string, map1, map2 []int) {
-	// Count occurrences of each token in each file separately
-	counts1 := make(map[string]int)
-	for _, t := range tokens1 {
-		counts1[t]++
-	}
-	counts2 := make(map[string]int)
-	for _, t := range tokens2 {
-		counts2[t]++
-	}
+	return discardConfusingTokens(tokens1, tokens2, nil)
+}
 
-	// Threshold: tokens appearing more than √(total) times are "confusing"
-	// Minimum of 2 to avoid filtering everything in small files
-	total := len(tokens1) + len(tokens2)
-	many := int(sqrt(float64(total)))
-	if many < 2 {
-		many = 2
-	}
+// discardConfusingTokens implements DiscardConfusingTokens, never
+// discarding the tokens in anchors (Options.AnchorTokens).
+func discardConfusingTokens(tokens1, tokens2 []string, anchors map[string]bool) (filtered1, filtered2 []string, map1, map2 []int) {
+	// Count occurrences of each token in each file separately
+	counts1 := countTokens(tokens1)
+	counts2 := countTokens(tokens2)
+	many := discardThreshold(len(tokens1) + len(tokens2))
 
 	// Mark each token in file1 based on its occurrences in file2
-	discard1 := markTokensForDiscard(tokens1, counts2, many)
+	discard1 := markTokensForDiscard(tokens1, counts2, many, anchors)
 
 	// Mark each token in file2 based on its occurrences in file1
-	discard2 := markTokensForDiscard(tokens2, counts1, many)
+	discard2 := markTokensForDiscard(tokens2, counts1, many, anchors)
 
 	// Apply provisional discard rules to refine the discard decisions
 	applyProvisionalRules(discard1)
@@ -75,17 +70,214 @@ func DiscardConfusingTokens(tokens1, tokens2 []string) (filtered1, filtered2 []s
 	return filtered1, filtered2, map1, map2
 }
 
+// countTokens returns the number of occurrences of each token.
+func countTokens(tokens []string) map[string]int {
+	counts := make(map[string]int)
+	for _, t := range tokens {
+		counts[t]++
+	}
+	return counts
+}
+
+// discardThreshold returns the number of occurrences in the other file
+// above which DiscardConfusingTokens finds a token confusing: √(total), but
+// at least 2 to avoid filtering everything in small files.
+func discardThreshold(total int) int {
+	return max(int(sqrt(float64(total))), 2)
+}
+
+// TokenFrequency is the number of occurrences of a token in each input.
+type TokenFrequency struct {
+	Token string
+	Old   int
+	New   int
+}
+
+// FrequencyReport describes the decisions DiscardConfusingTokens makes for
+// two token lists, to explain why a diff anchors where it does.
+type FrequencyReport struct {
+	// Threshold is the number of occurrences in the other input above which
+	// a token is provisionally discarded.
+	Threshold int
+
+	// Shared lists the tokens found in both inputs, most frequent first by
+	// their occurrences in both, then in token order.
+	Shared []TokenFrequency
+
+	// Provisional lists, in order, the tokens provisionally discarded for
+	// occurring more than Threshold times in the other input, whether or
+	// not the provisional rules then kept them.
+	Provisional []string
+
+	// Discarded lists, in order, the tokens of which at least one
+	// occurrence was excluded from matching after the provisional rules.
+	Discarded []string
+
+	// DiscardedOld and DiscardedNew are the numbers of token occurrences
+	// excluded from matching in each input.
+	DiscardedOld int
+	DiscardedNew int
+}
+
+// TokenFrequencyReport returns the FrequencyReport of the decisions
+// DiscardConfusingTokens makes for tokens1 and tokens2. The diff functions
+// pass it case-folded tokens when Options.IgnoreCase is set, so pass the
+// same to see their decisions.
+func TokenFrequencyReport(tokens1, tokens2 []string) FrequencyReport {
+	counts1 := countTokens(tokens1)
+	counts2 := countTokens(tokens2)
+	report := FrequencyReport{Threshold: discardThreshold(len(tokens1) + len(tokens2))}
+
+	for t, n := range counts1 {
+		if m := counts2[t]; m > 0 {
+			report.Shared = append(report.Shared, TokenFrequency{Token: t, Old: n, New: m})
+		}
+	}
+	sort.Slice(report.Shared, func(i, j int) bool {
+		a, b := report.Shared[i], report.Shared[j]
+		if a.Old+a.New != b.Old+b.New {
+			return a.Old+a.New > b.Old+b.New
+		}
+		return a.Token < b.Token
+	})
+
+	provisional := make(map[string]bool)
+	discarded := make(map[string]bool)
+	side := func(tokens []string, otherCounts map[string]int) int {
+		discard := markTokensForDiscard(tokens, otherCounts, report.Threshold, nil)
+		for i, d := range discard {
+			if d == discardProvisional {
+				provisional[tokens[i]] = true
+			}
+		}
+		applyProvisionalRules(discard)
+		n := 0
+		for i, d := range discard {
+			if d != discardKeep {
+				discarded[tokens[i]] = true
+				n++
+			}
+		}
+		return n
+	}
+	report.DiscardedOld = side(tokens1, counts2)
+	report.DiscardedNew = side(tokens2, counts1)
+	report.Provisional = sortedKeys(provisional)
+	report.Discarded = sortedKeys(discarded)
+	return report
+}
+
+// sortedKeys returns the keys of set in order, or nil if it is empty.
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diffTokensIgnoring diffs tokens1 and tokens2 with opts.IgnoreTokens
+// excluded from matching. Like DiscardConfusingTokens, it filters the ignored
+// tokens out, diffs what remains as configured by opts, and maps the result
+// back to the original tokens with index maps. Ignored tokens between the
+// same two matched tokens then pair in order as Equal, taking the new
+// token; any left over on one side are deleted or inserted.
+func diffTokensIgnoring(tokens1, tokens2 []string, opts Options) []Diff {
+	ignored := make(map[string]bool, len(opts.IgnoreTokens))
+	for _, t := range opts.IgnoreTokens {
+		ignored[t] = true
+	}
+	filtered1, map1 := filterIgnoredTokens(tokens1, ignored)
+	filtered2, map2 := filterIgnoredTokens(tokens2, ignored)
+
+	var filteredDiffs []Diff
+	switch {
+	case opts.customCompare():
+		filteredDiffs = diffTokensCompared(filtered1, filtered2, opts)
+	case opts.IgnoreCase:
+		filteredDiffs = diffTokensIgnoreCase(filtered1, filtered2, opts.CaseFold, opts.DiffAlgorithm)
+	default:
+		filteredDiffs = diffTokensWithDiffx(filtered1, filtered2, opts.DiffAlgorithm)
+	}
+	return expandIgnoredDiffs(filteredDiffs, tokens1, tokens2, map1, map2, ignored)
+}
+
+// filterIgnoredTokens returns the tokens not in ignored and the index of
+// each in tokens.
+func filterIgnoredTokens(tokens []string, ignored map[string]bool) (filtered []string, indexMap []int) {
+	filtered = make([]string, 0, len(tokens))
+	indexMap = make([]int, 0, len(tokens))
+	for i, t := range tokens {
+		if !ignored[t] {
+			filtered = append(filtered, t)
+			indexMap = append(indexMap, i)
+		}
+	}
+	return filtered, indexMap
+}
+
+// expandIgnoredDiffs expands a diff of the filtered tokens back to the
+// original tokens, pairing the ignored tokens in each gap between Equal
+// tokens as described for diffTokensIgnoring.
+func expandIgnoredDiffs(filteredDiffs []Diff, tokens1, tokens2 []string, map1, map2 []int, ignored map[string]bool) []Diff {
+	result := make([]Diff, 0, len(tokens1)+len(tokens2))
+	origIdx1, origIdx2 := 0, 0
+	filtIdx1, filtIdx2 := 0, 0
+
+	// gap emits the original tokens up to end1 and end2. Tokens that are not
+	// ignored there are all deleted or inserted, since they did not match.
+	gap := func(end1, end2 int) {
+		for origIdx1 < end1 || origIdx2 < end2 {
+			ignored1 := origIdx1 < end1 && ignored[tokens1[origIdx1]]
+			ignored2 := origIdx2 < end2 && ignored[tokens2[origIdx2]]
+			switch {
+			case ignored1 && ignored2:
+				result = append(result, Diff{Type: Equal, Token: tokens2[origIdx2]})
+				origIdx1++
+				origIdx2++
+			case origIdx1 < end1 && !ignored1, origIdx1 < end1 && origIdx2 == end2:
+				result = append(result, Diff{Type: Delete, Token: tokens1[origIdx1]})
+				origIdx1++
+			default:
+				result = append(result, Diff{Type: Insert, Token: tokens2[origIdx2]})
+				origIdx2++
+			}
+		}
+	}
+
+	for _, d := range filteredDiffs {
+		switch d.Type {
+		case Equal:
+			gap(map1[filtIdx1], map2[filtIdx2])
+			result = append(result, d)
+			origIdx1++
+			origIdx2++
+			filtIdx1++
+			filtIdx2++
+		case Delete:
+			filtIdx1++
+		case Insert:
+			filtIdx2++
+		}
+	}
+	gap(len(tokens1), len(tokens2))
+
+	return result
+}
+
 // markTokensForDiscard marks each token based on its occurrence count in the other file.
 // Returns a slice of discard status values (discardKeep, discardDefinitely, discardProvisional).
 //
 // Note: We do NOT discard tokens with zero count in the other file.
 // Those tokens can only be delete/insert anyway (not matches), and removing them from
 // the filtered list can cause the diff algorithm to find different anchor points.
-func markTokensForDiscard(tokens []string, otherCounts map[string]int, threshold int) []int {
+// Tokens in anchors are always kept, however often they occur.
+func markTokensForDiscard(tokens []string, otherCounts map[string]int, threshold int, anchors map[string]bool) []int {
 	discard := make([]int, len(tokens))
 	for i, t := range tokens {
 		equivCount := otherCounts[t]
-		if equivCount > threshold {
+		if equivCount > threshold && !anchors[t] {
 			// Token appears too many times in the other file - provisionally discard
 			discard[i] = discardProvisional
 		} else {
@@ -1,6 +1,9 @@
 package tokendiff
 
 import (
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -117,3 +120,224 @@ func TestDiscardConfusingTokens(t *testing.T) {
 		})
 	}
 }
+
+func TestTokenFrequencyReport(t *testing.T) {
+	tests := []struct {
+		name    string
+		tokens1 []string
+		tokens2 []string
+		want    FrequencyReport
+	}{
+		{
+			name:    "empty inputs",
+			tokens1: nil,
+			tokens2: nil,
+			want:    FrequencyReport{Threshold: 2},
+		},
+		{
+			name:    "common words kept in diff scenario",
+			tokens1: []string{"@@", "-117,6", "+117,34", "@@", "#", "Remove", "-", "essential", "for", "integration"},
+			tokens2: []string{"@@", "-7,6", "+7,8", "@@", "##", "Features", "-", "Display", "HTML", "from", "files"},
+			// Total = 21, threshold = 4; "@@" appears twice in each file
+			want: FrequencyReport{
+				Threshold: 4,
+				Shared: []TokenFrequency{
+					{Token: "@@", Old: 2, New: 2},
+					{Token: "-", Old: 1, New: 1},
+				},
+			},
+		},
+		{
+			name:    "leading run discarded",
+			tokens1: []string{"-", "-", "-", "a"},
+			tokens2: []string{"-", "-", "-", "-", "-", "b"},
+			// Total = 10, threshold = 3. Each "-" in tokens1 has 5 matches, so
+			// is provisional, and the run has no kept token before it. Each
+			// "-" in tokens2 has only 3 matches, so is kept.
+			want: FrequencyReport{
+				Threshold:    3,
+				Shared:       []TokenFrequency{{Token: "-", Old: 3, New: 5}},
+				Provisional:  []string{"-"},
+				Discarded:    []string{"-"},
+				DiscardedOld: 3,
+			},
+		},
+		{
+			name:    "provisional tokens restored",
+			tokens1: []string{"a", "-", "b", "-", "c", "-", "d", "-", "e"},
+			tokens2: []string{"-", "x", "-", "y", "-", "z", "-", "w", "-"},
+			want: FrequencyReport{
+				Threshold:   4,
+				Shared:      []TokenFrequency{{Token: "-", Old: 4, New: 5}},
+				Provisional: []string{"-"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := TokenFrequencyReport(tt.tokens1, tt.tokens2)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TokenFrequencyReport() = %+v, want %+v", got, tt.want)
+			}
+
+			filtered1, filtered2, _, _ := DiscardConfusingTokens(tt.tokens1, tt.tokens2)
+			if len(tt.tokens1)-len(filtered1) != got.DiscardedOld || len(tt.tokens2)-len(filtered2) != got.DiscardedNew {
+				t.Errorf("discarded %d and %d tokens, DiscardConfusingTokens() discards %d and %d",
+					got.DiscardedOld, got.DiscardedNew, len(tt.tokens1)-len(filtered1), len(tt.tokens2)-len(filtered2))
+			}
+		})
+	}
+}
+
+func TestAnchorTokens(t *testing.T) {
+	text1 := "add = green\nadd = gray"
+	text2 := "add = red\nadd = green\nadd = gray\nadd = red\nadd = red\nadd = green"
+
+	// The frequent "=" at the start of a text is discarded, so the
+	// values it separates from their keys are matched apart from them
+	opts := DefaultOptions()
+	tokens1, tokens2 := Tokenize(text1, opts), Tokenize(text2, opts)
+	if filtered1, _, _, _ := DiscardConfusingTokens(tokens1, tokens2); slices.Contains(filtered1[:2], "=") {
+		t.Fatalf("DiscardConfusingTokens() = %v, want the first \"=\" discarded", filtered1)
+	}
+	filtered1, filtered2, _, _ := discardConfusingTokens(tokens1, tokens2, map[string]bool{"=": true})
+	if countToken(filtered1, "=") != 2 || countToken(filtered2, "=") != 6 {
+		t.Errorf("discardConfusingTokens() with \"=\" as an anchor = %v, %v; want every \"=\" kept", filtered1, filtered2)
+	}
+
+	aligned := "= green add = gray"
+	for _, ignoreCase := range []bool{false, true} {
+		opts := DefaultOptions()
+		opts.IgnoreCase = ignoreCase
+		opts.PreprocessMinTokens = -1
+		if ignoreCase {
+			// Without anchors, only IgnoreCase discards confusing tokens
+			if got := FormatDiff(DiffStringsWithPreprocessing(text1, text2, opts)); strings.Contains(got, aligned) {
+				t.Errorf("IgnoreCase without anchors = %q, want the values apart from their keys", got)
+			}
+		}
+
+		opts.AnchorTokens = []string{"="}
+		if got := FormatDiff(DiffStringsWithPreprocessing(text1, text2, opts)); !strings.Contains(got, aligned) {
+			t.Errorf("IgnoreCase %v with \"=\" as an anchor = %q, want %q unchanged", ignoreCase, got, aligned)
+		}
+	}
+
+	// An anchor the inputs do not share leaves the diff as it is without one
+	opts = DefaultOptions()
+	opts.PreprocessMinTokens = -1
+	want := DiffStringsWithPreprocessing(text1, text2, opts)
+	opts.AnchorTokens = []string{"blue"}
+	if got := DiffStringsWithPreprocessing(text1, text2, opts); !slices.Equal(got, want) {
+		t.Errorf("unshared anchor = %q, want %q", FormatDiff(got), FormatDiff(want))
+	}
+}
+
+// countToken returns the number of occurrences of token in tokens.
+func countToken(tokens []string, token string) int {
+	n := 0
+	for _, t := range tokens {
+		if t == token {
+			n++
+		}
+	}
+	return n
+}
+
+func TestIgnoreTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		text1    string
+		text2    string
+		opts     Options
+		expected []Diff
+	}{
+		{
+			name:  "ignored build stamp is not a change",
+			text1: "version 2.0 BUILD=123 ok",
+			text2: "version 2.0 BUILD=456 ok",
+			opts:  Options{IgnoreTokens: []string{"BUILD=123", "BUILD=456"}},
+			expected: []Diff{
+				{Equal, "version"}, {Equal, "2.0"}, {Equal, "BUILD=456"}, {Equal, "ok"},
+			},
+		},
+		{
+			name:  "ignored values after a delimiter",
+			text1: "BUILD=123",
+			text2: "BUILD=456",
+			opts:  Options{Delimiters: "=", IgnoreTokens: []string{"123", "456"}},
+			expected: []Diff{
+				{Equal, "BUILD"}, {Equal, "="}, {Equal, "456"},
+			},
+		},
+		{
+			name:  "other changes are still reported",
+			text1: "built BUILD=123 by alice",
+			text2: "built BUILD=456 by bob",
+			opts:  Options{IgnoreTokens: []string{"BUILD=123", "BUILD=456"}},
+			expected: []Diff{
+				{Equal, "built"}, {Equal, "BUILD=456"}, {Equal, "by"}, {Delete, "alice"}, {Insert, "bob"},
+			},
+		},
+		{
+			name:  "ignored token without a counterpart is deleted",
+			text1: "a BUILD=123 b",
+			text2: "a b",
+			opts:  Options{IgnoreTokens: []string{"BUILD=123"}},
+			expected: []Diff{
+				{Equal, "a"}, {Delete, "BUILD=123"}, {Equal, "b"},
+			},
+		},
+		{
+			name:  "ignored tokens do not anchor the diff",
+			text1: "x STAMP y",
+			text2: "z STAMP w",
+			opts:  Options{IgnoreTokens: []string{"STAMP"}},
+			expected: []Diff{
+				{Delete, "x"}, {Insert, "z"}, {Equal, "STAMP"}, {Delete, "y"}, {Insert, "w"},
+			},
+		},
+		{
+			name:  "with ignore case",
+			text1: "Hello 123",
+			text2: "hello 456",
+			opts:  Options{IgnoreCase: true, IgnoreTokens: []string{"123", "456"}},
+			expected: []Diff{
+				{Equal, "hello"}, {Equal, "456"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DiffStrings(tt.text1, tt.text2, tt.opts); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("DiffStrings() = %v, want %v", got, tt.expected)
+			}
+			if got := DiffStringsWithPreprocessing(tt.text1, tt.text2, tt.opts); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("DiffStringsWithPreprocessing() = %v, want %v", got, tt.expected)
+			}
+			if got := DiffStringsWithPositions(tt.text1, tt.text2, tt.opts).Diffs; !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("DiffStringsWithPositions() = %v, want %v", got, tt.expected)
+			}
+			if got := DiffStringsWithPositionsAndPreprocessing(tt.text1, tt.text2, tt.opts).Diffs; !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("DiffStringsWithPositionsAndPreprocessing() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestIgnoreTokensFormatted(t *testing.T) {
+	opts := Options{IgnoreTokens: []string{"BUILD=123", "BUILD=456"}}
+	result := DiffWholeFiles("release BUILD=123\nnotes", "release BUILD=456\nnotes", opts, DefaultFormatOptions())
+
+	if result.HasChanges {
+		t.Errorf("HasChanges = true, want false")
+	}
+	if want := "release BUILD=456\nnotes"; result.Formatted != want {
+		t.Errorf("Formatted = %q, want %q", result.Formatted, want)
+	}
+	if st := result.Statistics; st.DeletedWords != 0 || st.InsertedWords != 0 || st.CommonWords != 3 {
+		t.Errorf("Statistics = %+v, want 3 common words and no changes", st)
+	}
+}
@@ -0,0 +1,141 @@
+package tokendiff
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// SVG layout and colors used by FormatSVG.
+const (
+	svgFontSize    = 14
+	svgLineHeight  = 18
+	svgCharWidth   = 8.4 // approximate advance of a 14px monospace glyph
+	svgPadding     = 8
+	svgTabWidth    = 4
+	svgDeleteFill  = "#b31d28"
+	svgInsertFill  = "#22863a"
+	svgBackground  = "#ffffff"
+	svgForeground  = "#24292e"
+	svgDefaultCols = 80
+)
+
+// FormatSVG renders a diff result as a self-contained SVG image, for
+// embedding in documentation. Deleted text is drawn red and struck through,
+// inserted text green and underlined, using <tspan fill="..."> elements.
+// Lines longer than width characters are wrapped; a width of 0 or less uses
+// 80. NoDeleted, NoInserted, and NoCommon are honored; other FormatOptions
+// such as markers and ANSI colors do not apply to SVG output.
+func FormatSVG(result DiffResult, opts FormatOptions, width int) string {
+	if width <= 0 {
+		width = svgDefaultCols
+	}
+
+	var rows [][]segment
+	for _, line := range svgLines(diffSegments(result, opts)) {
+		rows = append(rows, wrapSVGLine(line, width)...)
+	}
+
+	cols := 0
+	for _, row := range rows {
+		n := 0
+		for _, seg := range row {
+			n += utf8.RuneCountInString(seg.text)
+		}
+		cols = max(cols, n)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="monospace" font-size="%d">`+"\n",
+		int(float64(cols)*svgCharWidth)+2*svgPadding, len(rows)*svgLineHeight+2*svgPadding, svgFontSize)
+	fmt.Fprintf(&sb, `<rect width="100%%" height="100%%" fill="%s"/>`+"\n", svgBackground)
+	for i, row := range rows {
+		fmt.Fprintf(&sb, `<text x="%d" y="%d" fill="%s" xml:space="preserve">`,
+			svgPadding, svgPadding+i*svgLineHeight+svgFontSize, svgForeground)
+		for _, seg := range row {
+			switch seg.op {
+			case Delete:
+				fmt.Fprintf(&sb, `<tspan fill="%s" text-decoration="line-through">`, svgDeleteFill)
+			case Insert:
+				fmt.Fprintf(&sb, `<tspan fill="%s" text-decoration="underline">`, svgInsertFill)
+			}
+			_ = xml.EscapeText(&sb, []byte(seg.text))
+			if seg.op != Equal {
+				sb.WriteString("</tspan>")
+			}
+		}
+		sb.WriteString("</text>\n")
+	}
+	sb.WriteString("</svg>\n")
+
+	return sb.String()
+}
+
+// svgLines splits segments into lines at newlines and expands tabs.
+func svgLines(segs []segment) [][]segment {
+	lines := [][]segment{nil}
+	col := 0
+	for _, seg := range segs {
+		for i, part := range strings.Split(seg.text, "\n") {
+			if i > 0 {
+				lines = append(lines, nil)
+				col = 0
+			}
+			part, col = expandTabs(part, col)
+			if part != "" {
+				lines[len(lines)-1] = append(lines[len(lines)-1], segment{text: part, op: seg.op})
+			}
+		}
+	}
+	return lines
+}
+
+// expandTabs replaces tabs in text with spaces up to the next tab stop, given
+// the column text starts at. Returns the expanded text and the column after it.
+func expandTabs(text string, col int) (string, int) {
+	if !strings.Contains(text, "\t") {
+		return text, col + utf8.RuneCountInString(text)
+	}
+	var sb strings.Builder
+	for _, r := range text {
+		if r == '\t' {
+			n := svgTabWidth - col%svgTabWidth
+			sb.WriteString(strings.Repeat(" ", n))
+			col += n
+			continue
+		}
+		sb.WriteRune(r)
+		col++
+	}
+	return sb.String(), col
+}
+
+// wrapSVGLine breaks a line into rows of at most width characters, splitting
+// segments where needed.
+func wrapSVGLine(line []segment, width int) [][]segment {
+	rows := [][]segment{nil}
+	col := 0
+	for _, seg := range line {
+		text := seg.text
+		for text != "" {
+			if col == width {
+				rows = append(rows, nil)
+				col = 0
+			}
+			// Take as many runes as fit in the current row
+			n, cut := 0, len(text)
+			for i := range text {
+				if n == width-col {
+					cut = i
+					break
+				}
+				n++
+			}
+			rows[len(rows)-1] = append(rows[len(rows)-1], segment{text: text[:cut], op: seg.op})
+			col += n
+			text = text[cut:]
+		}
+	}
+	return rows
+}
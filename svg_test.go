@@ -0,0 +1,122 @@
+package tokendiff
+
+import (
+	"encoding/xml"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFormatSVG(t *testing.T) {
+	result := DiffStringsWithPositions("if a < b {\n\treturn old\n}", "if a < b {\n\treturn new\n}", DefaultOptions())
+	svg := FormatSVG(result, FormatOptions{}, 0)
+
+	// The output must be well-formed XML
+	dec := xml.NewDecoder(strings.NewReader(svg))
+	for {
+		if _, err := dec.Token(); err != nil {
+			if err != io.EOF {
+				t.Fatalf("FormatSVG() produced invalid XML: %v\n%s", err, svg)
+			}
+			break
+		}
+	}
+
+	for _, want := range []string{
+		`<svg xmlns="http://www.w3.org/2000/svg"`,
+		`if a &lt; b {`,
+		`<tspan fill="` + svgDeleteFill + `" text-decoration="line-through">old</tspan>`,
+		`<tspan fill="` + svgInsertFill + `" text-decoration="underline">new</tspan>`,
+		`>    return `,
+	} {
+		if !strings.Contains(svg, want) {
+			t.Errorf("FormatSVG() output missing %q:\n%s", want, svg)
+		}
+	}
+	if got := strings.Count(svg, "<text "); got != 3 {
+		t.Errorf("FormatSVG() drew %d lines, want 3", got)
+	}
+}
+
+func TestFormatSVGSuppression(t *testing.T) {
+	result := DiffStringsWithPositions("keep old", "keep new", DefaultOptions())
+	svg := FormatSVG(result, FormatOptions{NoDeleted: true}, 0)
+	if strings.Contains(svg, "old") {
+		t.Errorf("FormatSVG() with NoDeleted contains deleted text:\n%s", svg)
+	}
+	if !strings.Contains(svg, ">new</tspan>") {
+		t.Errorf("FormatSVG() with NoDeleted missing inserted text:\n%s", svg)
+	}
+}
+
+func TestWrapSVGLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  []segment
+		width int
+		want  [][]segment
+	}{
+		{
+			name:  "fits",
+			line:  []segment{{"abc", Equal}},
+			width: 5,
+			want:  [][]segment{{{"abc", Equal}}},
+		},
+		{
+			name:  "splits segment across rows",
+			line:  []segment{{"ab", Equal}, {"cdef", Insert}},
+			width: 3,
+			want: [][]segment{
+				{{"ab", Equal}, {"c", Insert}},
+				{{"def", Insert}},
+			},
+		},
+		{
+			name:  "counts runes not bytes",
+			line:  []segment{{"héllo", Delete}},
+			width: 2,
+			want: [][]segment{
+				{{"hé", Delete}},
+				{{"ll", Delete}},
+				{{"o", Delete}},
+			},
+		},
+		{
+			name:  "empty line",
+			line:  nil,
+			width: 4,
+			want:  [][]segment{nil},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := wrapSVGLine(tt.line, tt.width)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("wrapSVGLine() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandTabs(t *testing.T) {
+	tests := []struct {
+		text    string
+		col     int
+		want    string
+		wantCol int
+	}{
+		{"abc", 0, "abc", 3},
+		{"\tx", 0, "    x", 5},
+		{"a\tb", 0, "a   b", 5},
+		{"\t", 2, "  ", 4},
+	}
+
+	for _, tt := range tests {
+		got, col := expandTabs(tt.text, tt.col)
+		if got != tt.want || col != tt.wantCol {
+			t.Errorf("expandTabs(%q, %d) = %q, %d, want %q, %d", tt.text, tt.col, got, col, tt.want, tt.wantCol)
+		}
+	}
+}
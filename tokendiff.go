@@ -18,7 +18,10 @@
 package tokendiff
 
 import (
+	"regexp"
+	"slices"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/dacharyc/diffx"
 )
@@ -72,6 +75,13 @@ type Options struct {
 	// This is ignored if UsePunctuation is true.
 	Delimiters string
 
+	// DelimiterSequences are multi-character strings, such as "==", "!=",
+	// and "->", to treat as single tokens. They are matched before
+	// single-character delimiters and whitespace, longest first, wherever
+	// they occur, including inside words. This applies with UsePunctuation
+	// too.
+	DelimiterSequences []string
+
 	// Whitespace is the set of characters to treat as whitespace (word separators).
 	// If empty, DefaultWhitespace is used.
 	Whitespace string
@@ -81,14 +91,199 @@ type Options struct {
 	// -P/--punctuation flag behavior.
 	UsePunctuation bool
 
-	// PreserveWhitespace, when true, includes whitespace as separate tokens.
-	// When false (default), whitespace is used only to separate words and
-	// is not included in the diff output.
+	// PreserveWhitespace, when true, includes whitespace as separate tokens,
+	// one token per maximal run of whitespace. When false (default),
+	// whitespace is used only to separate words and is not included in the
+	// diff output.
 	PreserveWhitespace bool
 
+	// TokenPattern, when non-empty, is a regular expression (Go regexp
+	// syntax) whose non-overlapping, non-empty matches are the tokens,
+	// e.g. `@\w+|\w+|\S` to keep "@handles" together. Text between
+	// matches is not tokenized. It overrides Delimiters,
+	// DelimiterSequences, UsePunctuation, Whitespace, and
+	// PreserveWhitespace. Tokenize ignores an invalid pattern; TokenizeE
+	// reports it.
+	TokenPattern string
+
+	// CustomTokenizer, when non-nil, splits text into tokens for all the
+	// Tokenize and DiffStrings* functions, in place of the built-in
+	// tokenization, e.g. a lexer for a domain-specific language. It
+	// overrides TokenPattern and the other tokenization fields.
+	// DefaultTokenizer wraps the built-in tokenization.
+	CustomTokenizer Tokenizer
+
 	// IgnoreCase, when true, performs case-insensitive comparison.
 	// The original case is preserved in the output.
 	IgnoreCase bool
+
+	// CaseFold selects how IgnoreCase compares tokens: CaseFoldNone (the
+	// default) lowercases them, CaseFoldSimple applies Unicode simple case
+	// folding, and CaseFoldUnicode full case folding, under which "STRASSE"
+	// and "straße" are equal. It has no effect without IgnoreCase.
+	CaseFold CaseFold
+
+	// IgnoreWhitespaceChanges, when true, compares tokens with each run of
+	// whitespace inside them collapsed to a single space, like diff -b. It
+	// matters when tokens contain whitespace, as with PreserveWhitespace,
+	// where "  " and " " then compare equal. The original tokens are kept
+	// in the output. As with NumericTolerance, the *WithPreprocessing
+	// functions do not preprocess when this is set.
+	IgnoreWhitespaceChanges bool
+
+	// CollapseSpaceForMatch, when true, compares every token that is a run
+	// of whitespace, as PreserveWhitespace keeps the gaps between words, as
+	// equal to every other, so "a b" matches "a  b" and a line rewrapped
+	// with "\n" in place of " " is unchanged. Unlike
+	// IgnoreWhitespaceChanges, tokens that only contain whitespace among
+	// other characters are compared as they are. Output keeps the original
+	// whitespace. Without PreserveWhitespace the gaps are not tokens, and
+	// so are already ignored.
+	CollapseSpaceForMatch bool
+
+	// NormalizeEOL, when true, ignores a trailing "\r" on each line where
+	// whole lines are compared: by DiffLineByLine, StreamLineByLine, and
+	// DiffReaders, and by ApplyWordDiff on hunk lines. A file with CRLF line
+	// endings then matches the same file with LF endings line by line. The
+	// original lines are kept in the output.
+	NormalizeEOL bool
+
+	// KeepStopwords, when true, lets common words such as "the" and "for"
+	// anchor the diff like any other token, instead of being filtered from
+	// the histogram algorithm's anchor selection, so a change around a
+	// shared "the" is split there. The tokens are then compared opaquely,
+	// without diffx's punctuation and blank-line boundary heuristics, and
+	// ExtraStopwords has no effect.
+	KeepStopwords bool
+
+	// ExtraStopwords extends the stopwords that the *WithPreprocessing
+	// functions keep from anchoring a change. When non-empty, each single
+	// Equal token between changes that is one of them, or one of the
+	// package's built-in stopwords, is converted to a Delete and an Insert
+	// as EliminateStopwordAnchors does.
+	ExtraStopwords []string
+
+	// PreprocessMinTokens is the combined token count of both inputs below
+	// which the *WithPreprocessing functions skip DiscardConfusingTokens and
+	// diff directly. On short inputs, such as the single lines diffed by
+	// DiffLineByLine, discarding frequent tokens costs time and can change
+	// the result without improving it. 0 uses DefaultPreprocessMinTokens;
+	// a negative value always preprocesses.
+	PreprocessMinTokens int
+
+	// IgnoreTokens lists tokens, such as timestamps or build hashes, that
+	// never register as changes. They are matched exactly and excluded from
+	// matching, as DiscardConfusingTokens excludes frequent tokens, so they
+	// cannot anchor the diff. Afterwards, the ignored tokens between the same
+	// two matched tokens pair up in order and are reported Equal, with the
+	// new token; an ignored token with no counterpart there is still deleted
+	// or inserted. The *WithPreprocessing functions do not preprocess when
+	// this is set.
+	IgnoreTokens []string
+
+	// AnchorTokens lists tokens, such as the "=" or ":" between keys and
+	// values in a configuration file, that the *WithPreprocessing functions
+	// always keep as candidate anchors: DiscardConfusingTokens, which
+	// excludes tokens that occur too often from matching, never excludes
+	// them. When an anchor occurs in both inputs, those functions filter
+	// with DiscardConfusingTokens themselves, as they do with IgnoreCase,
+	// where the tokens are matched case-folded; inputs sharing no anchor are
+	// diffed as if AnchorTokens were empty. It has no effect with
+	// IgnoreTokens, KeepStopwords, NumericTolerance, TokenAliases,
+	// IgnoreWhitespaceChanges, or CollapseSpaceForMatch, under which those
+	// functions do not preprocess.
+	AnchorTokens []string
+
+	// NumericTolerance, when greater than 0, treats tokens that parse as
+	// numbers as equal when their values differ by at most this amount, so
+	// "1.0", "1.00", and "1.00000001" match with a tolerance of 1e-6.
+	// Non-numeric tokens compare normally. Numbers containing a delimiter,
+	// such as "." with UsePunctuation, are split before comparison. The
+	// *WithPreprocessing functions do not preprocess when this is set.
+	NumericTolerance float64
+
+	// TokenAliases maps variant tokens to a canonical token, so that each
+	// variant compares equal to the canonical token and to the other
+	// variants, e.g. {"colour": "color", "grey": "gray"}. With IgnoreCase,
+	// aliases match regardless of case. As with NumericTolerance, the
+	// *WithPreprocessing functions do not preprocess when this is set.
+	TokenAliases map[string]string
+
+	// DiffAlgorithm selects the algorithm used to compare token sequences:
+	// AlgoHistogram (the default, diffx.DiffHistogram), AlgoMyers
+	// (diffx.Diff), or AlgoPatience. It applies to all the DiffStrings*
+	// functions, including the IgnoreCase, NumericTolerance, and
+	// TokenAliases paths.
+	DiffAlgorithm DiffAlgorithm
+
+	// LineSimilarity scores deleted and inserted lines for pairing by
+	// DiffLineByLine with the "best" algorithm. nil uses
+	// ComputeTokenSimilarity; ComputeEditSimilarity is the alternative.
+	LineSimilarity SimilarityFunc
+
+	// ShortLineSmoothing, when true, steadies the pairing scores of short
+	// lines, where one changed token swings LineSimilarity from 1 to 0:
+	// lines with fewer than ShortLineTokens tokens are scored as the mean of
+	// LineSimilarity and their character-level similarity, so a renamed
+	// identifier such as "foo" to "fooBar" still pairs. Used by
+	// FindSimilarityPairings, FindAutoPairings, and FindOptimalPairings.
+	ShortLineSmoothing bool
+
+	// SquashBlankLines, when true, makes DiffLineByLine compare each run of
+	// consecutive blank lines, lines of only whitespace, as a single line,
+	// so blank lines added or removed together are one row rather than a
+	// row each. The row is annotated with the number of lines, as in
+	// "{+<2 blank lines>+}"; blank lines both texts have are still shown
+	// one per row.
+	SquashBlankLines bool
+
+	// MaxTokens, when greater than 0, bounds the work done by the
+	// DiffStrings* functions: if either input has more tokens than this,
+	// the inputs are compared line by line instead, so a changed line is
+	// reported as a whole deleted line and a whole inserted line rather
+	// than word by word. The result's Truncated field reports when this
+	// fast path was taken. 0 means no limit.
+	MaxTokens int
+
+	// LineAnchored, when true, makes the DiffStrings* functions diff the
+	// lines of the inputs first, as DiffLineByLine does, and then word by
+	// word only within each run of changed lines, returning the result as
+	// one diff. Unchanged lines stay Equal, and no token is matched across
+	// them, which keeps large files from producing noisy matches between
+	// distant lines. MaxTokens takes precedence.
+	LineAnchored bool
+
+	// tokenRegexp is TokenPattern compiled by withTokenPattern, so the
+	// many tokenizers line mode derives from one Options share it.
+	tokenRegexp *regexp.Regexp
+}
+
+// withTokenPattern returns o with its TokenPattern compiled, so that
+// tokenizers derived from it do not each compile the pattern again. An
+// invalid pattern is left uncompiled, as Tokenize ignores it.
+func (o Options) withTokenPattern() Options {
+	o.tokenRegexp, _ = compileTokenPattern(o.TokenPattern)
+	return o
+}
+
+// DefaultPreprocessMinTokens is the PreprocessMinTokens used when the option
+// is 0. Inputs with fewer tokens than this are diffed without preprocessing.
+const DefaultPreprocessMinTokens = 64
+
+// skipPreprocessing returns true if inputs with n tokens in total are below
+// the preprocessing threshold.
+func (o Options) skipPreprocessing(n int) bool {
+	threshold := o.PreprocessMinTokens
+	if threshold == 0 {
+		threshold = DefaultPreprocessMinTokens
+	}
+	return n < threshold
+}
+
+// overTokenLimit returns true if inputs with n1 and n2 tokens exceed
+// MaxTokens and should be diffed line by line.
+func (o Options) overTokenLimit(n1, n2 int) bool {
+	return o.MaxTokens > 0 && (n1 > o.MaxTokens || n2 > o.MaxTokens)
 }
 
 // DefaultOptions returns Options with default settings.
@@ -103,23 +298,25 @@ func DefaultOptions() Options {
 // needed to reconstruct original spacing for Equal content.
 type DiffResult struct {
 	Diffs      []Diff
-	Text1      string     // original old text
-	Text2      string     // original new text
-	Positions1 []TokenPos // token positions in text1
-	Positions2 []TokenPos // token positions in text2
+	Text1      string      // original old text
+	Text2      string      // original new text
+	Positions1 []TokenPos  // token positions in text1
+	Positions2 []TokenPos  // token positions in text2
+	Truncated  bool        // true if Options.MaxTokens forced a line-level diff
+	Moves      []TokenMove // moved runs, as found by DetectTokenMoves
 }
 
 // DiffTokens computes the diff between two token slices.
 // It uses the Myers diff algorithm via diffx.
 func DiffTokens(tokens1, tokens2 []string) []Diff {
-	return diffTokensWithDiffx(tokens1, tokens2)
+	return diffTokensWithDiffx(tokens1, tokens2, AlgoHistogram)
 }
 
-// diffTokensWithDiffx uses the diffx library for diffing.
-// Uses histogram-style diff which produces cleaner output by avoiding
-// spurious matches on common words like "the", "for", "in".
-func diffTokensWithDiffx(tokens1, tokens2 []string) []Diff {
-	ops := diffx.DiffHistogram(tokens1, tokens2)
+// diffTokensWithDiffx uses the diffx library for diffing with the given
+// algorithm. The default, histogram-style diff, produces cleaner output by
+// avoiding spurious matches on common words like "the", "for", "in".
+func diffTokensWithDiffx(tokens1, tokens2 []string, algo DiffAlgorithm) []Diff {
+	ops := diffStringOps(tokens1, tokens2, algo)
 	return diffxOpsToDiffs(ops, tokens1, tokens2)
 }
 
@@ -147,10 +344,42 @@ func diffxOpsToDiffs(ops []diffx.DiffOp, tokens1, tokens2 []string) []Diff {
 	return result
 }
 
+// Range describes a run of tokens sharing one operation as half-open index
+// ranges into the old (A) and new (B) token slices. For Delete ranges B1 == B2
+// and for Insert ranges A1 == A2, marking where the run falls in the other
+// slice.
+type Range struct {
+	Type   Operation
+	A1, A2 int // token range [A1, A2) in tokens1
+	B1, B2 int // token range [B1, B2) in tokens2
+}
+
+// DiffTokenRanges computes the diff between two token slices as ranges
+// rather than per-token Diffs. It uses the same algorithm as DiffTokens but
+// avoids allocating a Diff for every token, which matters for large, mostly
+// equal inputs. Use DiffTokens when per-token results are more convenient.
+func DiffTokenRanges(tokens1, tokens2 []string) []Range {
+	ops := diffx.DiffHistogram(tokens1, tokens2)
+	ranges := make([]Range, 0, len(ops))
+	for _, op := range ops {
+		r := Range{A1: op.AStart, A2: op.AEnd, B1: op.BStart, B2: op.BEnd}
+		switch op.Type {
+		case diffx.Equal:
+			r.Type = Equal
+		case diffx.Delete:
+			r.Type = Delete
+		case diffx.Insert:
+			r.Type = Insert
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
 // DiffTokensRaw computes the diff without semantic cleanup.
 // Use this when you need the raw Myers diff output.
 func DiffTokensRaw(tokens1, tokens2 []string) []Diff {
-	return diffTokensWithDiffx(tokens1, tokens2)
+	return diffTokensWithDiffx(tokens1, tokens2, AlgoHistogram)
 }
 
 // DiffStrings tokenizes both strings and computes their diff.
@@ -158,27 +387,49 @@ func DiffStrings(text1, text2 string, opts Options) []Diff {
 	tokens1 := Tokenize(text1, opts)
 	tokens2 := Tokenize(text2, opts)
 
+	if opts.overTokenLimit(len(tokens1), len(tokens2)) || opts.LineAnchored {
+		return DiffStringsWithPositions(text1, text2, opts).Diffs
+	}
+	return diffTokensDirect(tokens1, tokens2, opts)
+}
+
+// diffTokensDirect diffs tokens as DiffStrings does, honoring the
+// comparison options, once the MaxTokens limit is checked.
+func diffTokensDirect(tokens1, tokens2 []string, opts Options) []Diff {
+	if len(opts.IgnoreTokens) > 0 {
+		return diffTokensIgnoring(tokens1, tokens2, opts)
+	}
+	if opts.customCompare() {
+		return diffTokensCompared(tokens1, tokens2, opts)
+	}
 	if opts.IgnoreCase {
-		return diffTokensIgnoreCase(tokens1, tokens2)
+		return diffTokensIgnoreCase(tokens1, tokens2, opts.CaseFold, opts.DiffAlgorithm)
 	}
-	return DiffTokens(tokens1, tokens2)
+	return diffTokensWithDiffx(tokens1, tokens2, opts.DiffAlgorithm)
 }
 
 // DiffStringsWithPositions tokenizes and diffs strings, returning position info.
 // This allows formatters to preserve original spacing for Equal content.
 func DiffStringsWithPositions(text1, text2 string, opts Options) DiffResult {
-	tokens1, pos1 := TokenizeWithPositions(text1, opts)
-	tokens2, pos2 := TokenizeWithPositions(text2, opts)
+	t := newTokenizer(opts)
+	return diffStringsWithPositions(text1, text2, &t, opts)
+}
 
-	var diffs []Diff
-	if opts.IgnoreCase {
-		diffs = diffTokensIgnoreCase(tokens1, tokens2)
-	} else {
-		diffs = DiffTokens(tokens1, tokens2)
+// diffStringsWithPositions implements DiffStringsWithPositions, tokenizing
+// with t.
+func diffStringsWithPositions(text1, text2 string, t *tokenizer, opts Options) DiffResult {
+	tokens1, pos1 := t.tokenizeWithPositions(text1)
+	tokens2, pos2 := t.tokenizeWithPositions(text2)
+
+	if opts.overTokenLimit(len(tokens1), len(tokens2)) {
+		return diffLinesOnly(text1, text2, tokens1, tokens2, pos1, pos2, opts)
+	}
+	if opts.LineAnchored {
+		return diffLineAnchored(text1, text2, tokens1, tokens2, pos1, pos2, opts, diffTokensDirect)
 	}
 
 	return DiffResult{
-		Diffs:      diffs,
+		Diffs:      diffTokensDirect(tokens1, tokens2, opts),
 		Text1:      text1,
 		Text2:      text2,
 		Positions1: pos1,
@@ -188,19 +439,13 @@ func DiffStringsWithPositions(text1, text2 string, opts Options) DiffResult {
 
 // diffTokensIgnoreCase computes diff with case-insensitive comparison,
 // preserving original case in output.
-func diffTokensIgnoreCase(tokens1, tokens2 []string) []Diff {
-	// Create lowercased versions for comparison
-	lower1 := make([]string, len(tokens1))
-	lower2 := make([]string, len(tokens2))
-	for i, t := range tokens1 {
-		lower1[i] = strings.ToLower(t)
-	}
-	for i, t := range tokens2 {
-		lower2[i] = strings.ToLower(t)
-	}
+func diffTokensIgnoreCase(tokens1, tokens2 []string, fold CaseFold, algo DiffAlgorithm) []Diff {
+	// Create case-folded versions for comparison
+	lower1 := fold.foldTokens(tokens1)
+	lower2 := fold.foldTokens(tokens2)
 
-	// Use diffx on lowercased tokens
-	ops := diffx.DiffHistogram(lower1, lower2)
+	// Use diffx on case-folded tokens
+	ops := diffStringOps(lower1, lower2, algo)
 
 	// Convert back to diffs using original tokens
 	var result []Diff
@@ -224,6 +469,53 @@ func diffTokensIgnoreCase(tokens1, tokens2 []string) []Diff {
 	return result
 }
 
+// SwapResult returns r as if the inputs had been diffed the other way
+// round, from new to old: Delete and Insert are exchanged, as are Text1 and
+// Text2 and their positions, and the sides of Moves, so ComputeStatistics
+// on the result swaps old and new counts and deleted and inserted counts.
+// Equal tokens are unchanged, and in each run of changes between them the
+// deletions come first, as in any diff, so swapping a diff twice returns
+// it unchanged. r is not modified.
+func SwapResult(r DiffResult) DiffResult {
+	diffs := make([]Diff, 0, len(r.Diffs))
+	for i := 0; i < len(r.Diffs); {
+		if r.Diffs[i].Type == Equal {
+			diffs = append(diffs, r.Diffs[i])
+			i++
+			continue
+		}
+		end := i
+		for end < len(r.Diffs) && r.Diffs[end].Type != Equal {
+			end++
+		}
+		// Insertions become the deletions, which come first
+		for _, d := range r.Diffs[i:end] {
+			if d.Type == Insert {
+				diffs = append(diffs, Diff{Type: Delete, Token: d.Token})
+			}
+		}
+		for _, d := range r.Diffs[i:end] {
+			if d.Type == Delete {
+				diffs = append(diffs, Diff{Type: Insert, Token: d.Token})
+			}
+		}
+		i = end
+	}
+	var moves []TokenMove
+	for _, m := range r.Moves {
+		moves = append(moves, TokenMove{OldStart: m.NewStart, NewStart: m.OldStart, Length: m.Length, Chars: m.Chars})
+	}
+	return DiffResult{
+		Diffs:      diffs,
+		Text1:      r.Text2,
+		Text2:      r.Text1,
+		Positions1: r.Positions2,
+		Positions2: r.Positions1,
+		Truncated:  r.Truncated,
+		Moves:      moves,
+	}
+}
+
 // HasChanges returns true if the diff slice contains any non-Equal operations.
 func HasChanges(diffs []Diff) bool {
 	for _, d := range diffs {
@@ -234,38 +526,157 @@ func HasChanges(diffs []Diff) bool {
 	return false
 }
 
+// TextsDiffer reports whether text1 and text2 differ token-wise, as
+// HasChanges(DiffStrings(text1, text2, opts)) does, but stops as soon as the
+// answer is known: identical texts are not tokenized, texts with the same
+// tokens are not diffed, and neither are texts whose tokens differ when opts
+// matches tokens by their text alone, since any differing token is then a
+// change. Only options that let different tokens match, such as IgnoreCase,
+// TokenAliases, or IgnoreTokens, need a diff to decide.
+func TextsDiffer(text1, text2 string, opts Options) bool {
+	if text1 == text2 {
+		return false
+	}
+	tokens1, tokens2 := Tokenize(text1, opts), Tokenize(text2, opts)
+	if slices.Equal(tokens1, tokens2) {
+		return false
+	}
+	if !opts.matchesDifferentTokens() {
+		return true
+	}
+	return HasChanges(DiffStrings(text1, text2, opts))
+}
+
+// matchesDifferentTokens returns true if opts can match tokens whose text
+// differs.
+func (o Options) matchesDifferentTokens() bool {
+	return o.IgnoreCase || len(o.TokenAliases) > 0 || len(o.IgnoreTokens) > 0 ||
+		o.NumericTolerance > 0 || o.IgnoreWhitespaceChanges || o.CollapseSpaceForMatch
+}
+
 // DiffStatistics holds statistics about a diff operation.
 type DiffStatistics struct {
-	OldWords      int // total words in old text
-	NewWords      int // total words in new text
-	DeletedWords  int // words deleted (present in old but not new)
-	InsertedWords int // words inserted (present in new but not old)
-	CommonWords   int // words common to both texts
+	OldWords      int `json:"oldWords"`             // total words in old text
+	NewWords      int `json:"newWords"`             // total words in new text
+	DeletedWords  int `json:"deletedWords"`         // words deleted (present in old but not new)
+	InsertedWords int `json:"insertedWords"`        // words inserted (present in new but not old)
+	CommonWords   int `json:"commonWords"`          // words common to both texts
+	MovedWords    int `json:"movedWords,omitempty"` // words moved, as counted by MoveStatistics
+
+	// DeletedChars, InsertedChars, and CommonChars count the characters
+	// (runes) of the words counted as deleted, inserted, and common, except
+	// that when a change replaces one word with one word, the characters
+	// the two share by CharacterDiff are common: "cat" to "category" is 3
+	// common and 5 inserted characters. Whitespace between words is not
+	// counted, and a tab is one character. MovedChars counts the
+	// characters of MovedWords.
+	DeletedChars  int `json:"deletedChars"`
+	InsertedChars int `json:"insertedChars"`
+	CommonChars   int `json:"commonChars"`
+	MovedChars    int `json:"movedChars,omitempty"`
 }
 
-// ComputeStatistics calculates statistics for a diff.
+// Add adds the counts of o to st, such as to total the statistics of
+// several files.
+func (st *DiffStatistics) Add(o DiffStatistics) {
+	st.OldWords += o.OldWords
+	st.NewWords += o.NewWords
+	st.DeletedWords += o.DeletedWords
+	st.InsertedWords += o.InsertedWords
+	st.CommonWords += o.CommonWords
+	st.MovedWords += o.MovedWords
+	st.DeletedChars += o.DeletedChars
+	st.InsertedChars += o.InsertedChars
+	st.CommonChars += o.CommonChars
+	st.MovedChars += o.MovedChars
+}
+
+// ComputeStatistics calculates statistics for a diff. With opts.IgnoreCase,
+// deleted and inserted tokens in the same change that differ only in case,
+// as a case-sensitive diff would report them, are counted as common words,
+// so the counts agree with a case-insensitive diff of the same texts.
 func ComputeStatistics(text1, text2 string, diffs []Diff, opts Options) DiffStatistics {
-	tokens1 := Tokenize(text1, opts)
-	tokens2 := Tokenize(text2, opts)
+	return computeStatistics(len(Tokenize(text1, opts)), len(Tokenize(text2, opts)), diffs, opts)
+}
 
+// computeStatistics implements ComputeStatistics for texts of oldWords and
+// newWords tokens.
+func computeStatistics(oldWords, newWords int, diffs []Diff, opts Options) DiffStatistics {
 	var st DiffStatistics
-	st.OldWords = len(tokens1)
-	st.NewWords = len(tokens2)
+	st.OldWords = oldWords
+	st.NewWords = newWords
 
-	for _, d := range diffs {
-		switch d.Type {
-		case Equal:
+	for i := 0; i < len(diffs); {
+		if diffs[i].Type == Equal {
 			st.CommonWords++
-		case Delete:
-			st.DeletedWords++
-		case Insert:
-			st.InsertedWords++
+			st.CommonChars += utf8.RuneCountInString(diffs[i].Token)
+			i++
+			continue
+		}
+
+		// Collect the change: a run of Deletes and Inserts between Equals
+		var deleted, inserted []string
+		for ; i < len(diffs) && diffs[i].Type != Equal; i++ {
+			if diffs[i].Type == Delete {
+				deleted = append(deleted, diffs[i].Token)
+			} else {
+				inserted = append(inserted, diffs[i].Token)
+			}
 		}
+
+		var matched int
+		if opts.IgnoreCase && len(deleted) > 0 && len(inserted) > 0 {
+			var unmatched1, unmatched2 []string
+			for _, d := range diffTokensIgnoreCase(deleted, inserted, opts.CaseFold, opts.DiffAlgorithm) {
+				switch d.Type {
+				case Equal:
+					matched++
+					st.CommonChars += utf8.RuneCountInString(d.Token)
+				case Delete:
+					unmatched1 = append(unmatched1, d.Token)
+				case Insert:
+					unmatched2 = append(unmatched2, d.Token)
+				}
+			}
+			st.DeletedWords += len(deleted) - matched
+			st.InsertedWords += len(inserted) - matched
+			deleted, inserted = unmatched1, unmatched2
+		} else {
+			st.DeletedWords += len(deleted)
+			st.InsertedWords += len(inserted)
+		}
+		st.CommonWords += matched
+		st.addChangedChars(deleted, inserted)
 	}
 
 	return st
 }
 
+// addChangedChars adds the characters of a change that deleted and
+// inserted the given tokens to st, as described for DeletedChars.
+func (st *DiffStatistics) addChangedChars(deleted, inserted []string) {
+	if len(deleted) == 1 && len(inserted) == 1 {
+		for _, d := range CharacterDiff(deleted[0], inserted[0]) {
+			n := utf8.RuneCountInString(d.Token)
+			switch d.Type {
+			case Equal:
+				st.CommonChars += n
+			case Delete:
+				st.DeletedChars += n
+			case Insert:
+				st.InsertedChars += n
+			}
+		}
+		return
+	}
+	for _, t := range deleted {
+		st.DeletedChars += utf8.RuneCountInString(t)
+	}
+	for _, t := range inserted {
+		st.InsertedChars += utf8.RuneCountInString(t)
+	}
+}
+
 // DiffTokensWithPreprocessing computes the diff using histogram-style preprocessing.
 // This uses diffx's histogram diff algorithm which:
 // 1. Filters stopwords (common words like "the", "for", "in") from anchor selection
@@ -280,48 +691,183 @@ func DiffTokensWithPreprocessing(tokens1, tokens2 []string) []Diff {
 
 // DiffStringsWithPreprocessing tokenizes both strings and computes their diff
 // using histogram-based preprocessing that filters confusing tokens.
+// Inputs smaller than opts.PreprocessMinTokens are diffed without it.
 func DiffStringsWithPreprocessing(text1, text2 string, opts Options) []Diff {
 	tokens1 := Tokenize(text1, opts)
 	tokens2 := Tokenize(text2, opts)
 
+	if opts.overTokenLimit(len(tokens1), len(tokens2)) || opts.LineAnchored {
+		return DiffStringsWithPositionsAndPreprocessing(text1, text2, opts).Diffs
+	}
+	return diffTokensWithOptions(tokens1, tokens2, opts)
+}
+
+// diffTokensWithOptions diffs tokens as DiffStringsWithPreprocessing does,
+// honoring the comparison options, once the MaxTokens limit is checked.
+func diffTokensWithOptions(tokens1, tokens2 []string, opts Options) []Diff {
+	diffs := diffTokensPreprocessed(tokens1, tokens2, opts)
+	if len(opts.ExtraStopwords) > 0 && !opts.KeepStopwords {
+		diffs = eliminateStopwordAnchors(diffs, mergeStopwords(opts.ExtraStopwords))
+	}
+	return diffs
+}
+
+// diffTokensPreprocessed selects the diff for diffTokensWithOptions.
+func diffTokensPreprocessed(tokens1, tokens2 []string, opts Options) []Diff {
+	if len(opts.IgnoreTokens) > 0 {
+		return diffTokensIgnoring(tokens1, tokens2, opts)
+	}
+	if opts.customCompare() {
+		return diffTokensCompared(tokens1, tokens2, opts)
+	}
+	if opts.IgnoreCase && opts.skipPreprocessing(len(tokens1)+len(tokens2)) {
+		return diffTokensIgnoreCase(tokens1, tokens2, opts.CaseFold, opts.DiffAlgorithm)
+	}
 	if opts.IgnoreCase {
-		// For case-insensitive, use lowercased tokens for comparison
-		lower1 := make([]string, len(tokens1))
-		lower2 := make([]string, len(tokens2))
-		for i, t := range tokens1 {
-			lower1[i] = strings.ToLower(t)
+		// For case-insensitive, use case-folded tokens for comparison
+		lower1 := opts.CaseFold.foldTokens(tokens1)
+		lower2 := opts.CaseFold.foldTokens(tokens2)
+		// Use preprocessing on case-folded tokens, then map back to original case
+		anchors := tokenSet(opts.CaseFold.foldTokens(opts.AnchorTokens))
+		return diffTokensIgnoreCaseWithPreprocessing(tokens1, tokens2, lower1, lower2, anchors, opts.CaseFold, opts.DiffAlgorithm)
+	}
+	if anchors := tokenSet(opts.AnchorTokens); sharesToken(anchors, tokens1, tokens2) && !opts.skipPreprocessing(len(tokens1)+len(tokens2)) {
+		return diffTokensAnchored(tokens1, tokens2, anchors, opts.DiffAlgorithm)
+	}
+	return diffTokensWithDiffx(tokens1, tokens2, opts.DiffAlgorithm)
+}
+
+// tokenSet returns the set of tokens, or nil if there are none.
+func tokenSet(tokens []string) map[string]bool {
+	if len(tokens) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(tokens))
+	for _, t := range tokens {
+		set[t] = true
+	}
+	return set
+}
+
+// sharesToken returns true if a token in set occurs in both tokens1 and
+// tokens2.
+func sharesToken(set map[string]bool, tokens1, tokens2 []string) bool {
+	if len(set) == 0 {
+		return false
+	}
+	in1 := make(map[string]bool)
+	for _, t := range tokens1 {
+		if set[t] {
+			in1[t] = true
 		}
-		for i, t := range tokens2 {
-			lower2[i] = strings.ToLower(t)
+	}
+	for _, t := range tokens2 {
+		if in1[t] {
+			return true
 		}
-		// Use preprocessing on lowercased tokens, then map back to original case
-		return diffTokensIgnoreCaseWithPreprocessing(tokens1, tokens2, lower1, lower2)
 	}
-	return DiffTokensWithPreprocessing(tokens1, tokens2)
+	return false
+}
+
+// diffTokensAnchored diffs tokens after filtering them with
+// DiscardConfusingTokens, keeping anchors, for Options.AnchorTokens.
+func diffTokensAnchored(tokens1, tokens2 []string, anchors map[string]bool, algo DiffAlgorithm) []Diff {
+	filtered1, filtered2, map1, map2 := discardConfusingTokens(tokens1, tokens2, anchors)
+	if len(filtered1) == 0 && len(filtered2) == 0 {
+		return diffTokensWithDiffx(tokens1, tokens2, algo)
+	}
+	filteredDiffs := diffTokensWithDiffx(filtered1, filtered2, algo)
+	return ShiftBoundaries(expandFilteredDiffsWithCase(filteredDiffs, tokens1, tokens2, tokens1, tokens2, map1, map2))
 }
 
 // DiffStringsWithPositionsAndPreprocessing tokenizes and diffs strings using
 // histogram-based preprocessing, returning position info for formatting.
 // This allows formatters to preserve original spacing for Equal content.
+// Inputs smaller than opts.PreprocessMinTokens are diffed without it.
 func DiffStringsWithPositionsAndPreprocessing(text1, text2 string, opts Options) DiffResult {
 	tokens1, pos1 := TokenizeWithPositions(text1, opts)
 	tokens2, pos2 := TokenizeWithPositions(text2, opts)
 
+	if opts.overTokenLimit(len(tokens1), len(tokens2)) {
+		return diffLinesOnly(text1, text2, tokens1, tokens2, pos1, pos2, opts)
+	}
+	if opts.LineAnchored {
+		return diffLineAnchored(text1, text2, tokens1, tokens2, pos1, pos2, opts, diffTokensWithOptions)
+	}
+
+	return DiffResult{
+		Diffs:      diffTokensWithOptions(tokens1, tokens2, opts),
+		Text1:      text1,
+		Text2:      text2,
+		Positions1: pos1,
+		Positions2: pos2,
+	}
+}
+
+// diffLinesOnly is the MaxTokens fast path. It diffs the lines of text1 and
+// text2 as whole units, then expands each line back into its tokens, so an
+// unchanged line is Equal and a changed line is all Delete or all Insert.
+// The returned result has Truncated set.
+func diffLinesOnly(text1, text2 string, tokens1, tokens2 []string, pos1, pos2 []TokenPos, opts Options) DiffResult {
+	keys1, spans1 := tokenLines(text1, tokens1, pos1, opts)
+	keys2, spans2 := tokenLines(text2, tokens2, pos2, opts)
+
 	var diffs []Diff
-	if opts.IgnoreCase {
-		// For case-insensitive, use lowercased tokens for comparison
-		lower1 := make([]string, len(tokens1))
-		lower2 := make([]string, len(tokens2))
-		for i, t := range tokens1 {
-			lower1[i] = strings.ToLower(t)
+	emit := func(op Operation, tokens []string, spans [][2]int, from, to int) {
+		for _, span := range spans[from:to] {
+			for _, tok := range tokens[span[0]:span[1]] {
+				diffs = append(diffs, Diff{Type: op, Token: tok})
+			}
+		}
+	}
+	for _, op := range diffStringOps(keys1, keys2, opts.DiffAlgorithm) {
+		switch op.Type {
+		case diffx.Equal:
+			emit(Equal, tokens1, spans1, op.AStart, op.AEnd)
+		case diffx.Delete:
+			emit(Delete, tokens1, spans1, op.AStart, op.AEnd)
+		case diffx.Insert:
+			emit(Insert, tokens2, spans2, op.BStart, op.BEnd)
+		}
+	}
+
+	return DiffResult{
+		Diffs:      diffs,
+		Text1:      text1,
+		Text2:      text2,
+		Positions1: pos1,
+		Positions2: pos2,
+		Truncated:  true,
+	}
+}
+
+// diffLineAnchored is the LineAnchored path. It diffs the lines of text1
+// and text2 as whole units, as diffLinesOnly does, keeps each unchanged line
+// Equal, and diffs the tokens of each run of changed lines with diffTokens,
+// so no token is matched across an unchanged line. As with IgnoreCase,
+// Equal tokens are taken from tokens2.
+func diffLineAnchored(text1, text2 string, tokens1, tokens2 []string, pos1, pos2 []TokenPos, opts Options, diffTokens func([]string, []string, Options) []Diff) DiffResult {
+	keys1, spans1 := tokenLines(text1, tokens1, pos1, opts)
+	keys2, spans2 := tokenLines(text2, tokens2, pos2, opts)
+
+	var diffs []Diff
+	next1, next2 := 0, 0 // first token of each input not yet in diffs
+	changed := func(end1, end2 int) {
+		if end1 > next1 || end2 > next2 {
+			diffs = append(diffs, diffTokens(tokens1[next1:end1], tokens2[next2:end2], opts)...)
+		}
+	}
+	for _, op := range diffStringOps(keys1, keys2, opts.DiffAlgorithm) {
+		if op.Type != diffx.Equal {
+			continue
 		}
-		for i, t := range tokens2 {
-			lower2[i] = strings.ToLower(t)
+		changed(spans1[op.AStart][0], spans2[op.BStart][0])
+		next1, next2 = spans1[op.AEnd-1][1], spans2[op.BEnd-1][1]
+		for _, tok := range tokens2[spans2[op.BStart][0]:next2] {
+			diffs = append(diffs, Diff{Type: Equal, Token: tok})
 		}
-		diffs = diffTokensIgnoreCaseWithPreprocessing(tokens1, tokens2, lower1, lower2)
-	} else {
-		diffs = DiffTokensWithPreprocessing(tokens1, tokens2)
 	}
+	changed(len(tokens1), len(tokens2))
 
 	return DiffResult{
 		Diffs:      diffs,
@@ -332,17 +878,60 @@ func DiffStringsWithPositionsAndPreprocessing(text1, text2 string, opts Options)
 	}
 }
 
-// diffTokensIgnoreCaseWithPreprocessing handles case-insensitive diff with preprocessing.
-func diffTokensIgnoreCaseWithPreprocessing(tokens1, tokens2, lower1, lower2 []string) []Diff {
+// tokenLines groups tokens by the line of text they start on, skipping lines
+// without tokens. It returns a comparison key per line, built from the line's
+// tokens so that equal keys mean equal tokens, and the half-open token index
+// span of each line. Keys honor opts.IgnoreCase,
+// opts.IgnoreWhitespaceChanges, and opts.CollapseSpaceForMatch.
+func tokenLines(text string, tokens []string, positions []TokenPos, opts Options) ([]string, [][2]int) {
+	var keys []string
+	var spans [][2]int
+	lineStart, cursor := 0, 0
+	flush := func(end int) {
+		if end > lineStart {
+			lineTokens := tokens[lineStart:end]
+			if opts.CollapseSpaceForMatch {
+				lineTokens = slices.Clone(lineTokens)
+				for i, t := range lineTokens {
+					if isWhitespaceToken(t, opts) {
+						lineTokens[i] = " "
+					}
+				}
+			}
+			key := strings.Join(lineTokens, "\x00")
+			if opts.IgnoreWhitespaceChanges {
+				key = collapseWhitespace(key, opts)
+			}
+			if opts.IgnoreCase {
+				key = opts.CaseFold.Fold(key)
+			}
+			keys = append(keys, key)
+			spans = append(spans, [2]int{lineStart, end})
+		}
+		lineStart = end
+	}
+	for i, pos := range positions {
+		if strings.Contains(text[cursor:pos.Start], "\n") {
+			flush(i)
+		}
+		cursor = pos.Start
+	}
+	flush(len(tokens))
+	return keys, spans
+}
+
+// diffTokensIgnoreCaseWithPreprocessing handles case-insensitive diff with
+// preprocessing, never discarding the case-folded tokens in anchors.
+func diffTokensIgnoreCaseWithPreprocessing(tokens1, tokens2, lower1, lower2 []string, anchors map[string]bool, fold CaseFold, algo DiffAlgorithm) []Diff {
 	// Filter using lowercase versions
-	filtered1, filtered2, map1, map2 := DiscardConfusingTokens(lower1, lower2)
+	filtered1, filtered2, map1, map2 := discardConfusingTokens(lower1, lower2, anchors)
 
 	if len(filtered1) == 0 && len(filtered2) == 0 {
-		return diffTokensIgnoreCase(tokens1, tokens2)
+		return diffTokensIgnoreCase(tokens1, tokens2, fold, algo)
 	}
 
 	// Diff filtered lowercase tokens
-	filteredDiffs := DiffTokens(filtered1, filtered2)
+	filteredDiffs := diffTokensWithDiffx(filtered1, filtered2, algo)
 
 	// Expand back using original case tokens
 	expandedDiffs := expandFilteredDiffsWithCase(filteredDiffs, tokens1, tokens2, lower1, lower2, map1, map2)
@@ -1,7 +1,9 @@
 package tokendiff
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -169,6 +171,96 @@ func TestOperationString(t *testing.T) {
 	}
 }
 
+func TestSwapResult(t *testing.T) {
+	opts := DefaultOptions()
+	text1 := "the quick brown fox"
+	text2 := "the fox jumps"
+	result := DiffStringsWithPositions(text1, text2, opts)
+
+	swapped := SwapResult(result)
+	if swapped.Text1 != text2 || swapped.Text2 != text1 {
+		t.Errorf("SwapResult() texts = %q, %q; want %q, %q", swapped.Text1, swapped.Text2, text2, text1)
+	}
+	if !reflect.DeepEqual(swapped.Positions1, result.Positions2) || !reflect.DeepEqual(swapped.Positions2, result.Positions1) {
+		t.Errorf("SwapResult() did not swap positions")
+	}
+	wantDiffs := []Diff{{Equal, "the"}, {Insert, "quick"}, {Insert, "brown"}, {Equal, "fox"}, {Delete, "jumps"}}
+	if !reflect.DeepEqual(swapped.Diffs, wantDiffs) {
+		t.Errorf("SwapResult() diffs = %+v, want %+v", swapped.Diffs, wantDiffs)
+	}
+
+	// A replacement keeps its deletion first
+	replacement := SwapResult(DiffStringsWithPositions("hello there foo", "hello world foo", opts))
+	if got := FormatDiffResultAdvanced(replacement, DefaultFormatOptions()); got != "hello [-world-] {+there+} foo" {
+		t.Errorf("FormatDiffResultAdvanced(SwapResult()) of a replacement = %q, want %q", got, "hello [-world-] {+there+} foo")
+	}
+
+	// A deletion becomes an insertion
+	deletion := DiffStringsWithPositions("a b", "a", opts)
+	if got := SwapResult(deletion).Diffs; !reflect.DeepEqual(got, []Diff{{Equal, "a"}, {Insert, "b"}}) {
+		t.Errorf("SwapResult() of a deletion = %+v, want b inserted", got)
+	}
+
+	// Swapping twice is the identity
+	if twice := SwapResult(swapped); !reflect.DeepEqual(twice, result) {
+		t.Errorf("SwapResult(SwapResult(r)) = %+v, want %+v", twice, result)
+	}
+
+	// Statistics flip
+	st := ComputeStatistics(result.Text1, result.Text2, result.Diffs, opts)
+	want := DiffStatistics{
+		OldWords:      st.NewWords,
+		NewWords:      st.OldWords,
+		DeletedWords:  st.InsertedWords,
+		InsertedWords: st.DeletedWords,
+		CommonWords:   st.CommonWords,
+		DeletedChars:  st.InsertedChars,
+		InsertedChars: st.DeletedChars,
+		CommonChars:   st.CommonChars,
+	}
+	if got := ComputeStatistics(swapped.Text1, swapped.Text2, swapped.Diffs, opts); got != want {
+		t.Errorf("statistics of swapped result = %+v, want %+v", got, want)
+	}
+
+	// The swapped result formats like any other
+	if got := FormatDiffResultAdvanced(SwapResult(deletion), DefaultFormatOptions()); got != "a {+b+}" {
+		t.Errorf("FormatDiffResultAdvanced(SwapResult()) = %q, want %q", got, "a {+b+}")
+	}
+}
+
+func TestTextsDiffer(t *testing.T) {
+	ignoreCase := DefaultOptions()
+	ignoreCase.IgnoreCase = true
+	aliases := DefaultOptions()
+	aliases.TokenAliases = map[string]string{"colour": "color"}
+
+	tests := []struct {
+		name         string
+		text1, text2 string
+		opts         Options
+		want         bool
+	}{
+		{"identical", "a b c", "a b c", DefaultOptions(), false},
+		{"whitespace only", "a  b\nc", "a b c", DefaultOptions(), false},
+		{"different token", "a b c", "a x c", DefaultOptions(), true},
+		{"case only", "Hello World", "hello world", DefaultOptions(), true},
+		{"case only with IgnoreCase", "Hello World", "hello world", ignoreCase, false},
+		{"different token with IgnoreCase", "Hello World", "hello there", ignoreCase, true},
+		{"alias", "the colour", "the color", aliases, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TextsDiffer(tt.text1, tt.text2, tt.opts); got != tt.want {
+				t.Errorf("TextsDiffer() = %v, want %v", got, tt.want)
+			}
+			if want := HasChanges(DiffStrings(tt.text1, tt.text2, tt.opts)); tt.want != want {
+				t.Errorf("HasChanges(DiffStrings()) = %v, disagrees with TextsDiffer()", want)
+			}
+		})
+	}
+}
+
 // TestHasChanges tests the HasChanges helper function
 func TestHasChanges(t *testing.T) {
 	tests := []struct {
@@ -669,6 +761,104 @@ func TestComputeStatistics(t *testing.T) {
 	}
 }
 
+func TestComputeStatisticsChars(t *testing.T) {
+	tests := []struct {
+		name                            string
+		text1, text2                    string
+		opts                            Options
+		wantCommon, wantDel, wantInsert int
+	}{
+		// One word replaced by one: the shared characters are common
+		{"cat to category", "cat", "category", DefaultOptions(), 3, 0, 5},
+		{"category to cat", "category", "cat", DefaultOptions(), 3, 5, 0},
+		{"nothing shared", "the cat", "the dog", DefaultOptions(), 3, 3, 3},
+		// Several words: each word's characters count whole
+		{"two words replaced", "a cat", "category mat", DefaultOptions(), 0, 4, 11},
+		{"runes, not bytes", "café", "cafés", DefaultOptions(), 4, 0, 1},
+		{"unchanged", "hello world", "hello world", DefaultOptions(), 10, 0, 0},
+		{"case change with ignore case", "Hello cat", "hello dog", Options{IgnoreCase: true}, 5, 3, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs := DiffStrings(tt.text1, tt.text2, tt.opts)
+			st := ComputeStatistics(tt.text1, tt.text2, diffs, tt.opts)
+			if st.CommonChars != tt.wantCommon || st.DeletedChars != tt.wantDel || st.InsertedChars != tt.wantInsert {
+				t.Errorf("ComputeStatistics() chars = %d common, %d deleted, %d inserted; want %d, %d, %d",
+					st.CommonChars, st.DeletedChars, st.InsertedChars, tt.wantCommon, tt.wantDel, tt.wantInsert)
+			}
+		})
+	}
+}
+
+func TestDiffStatisticsAdd(t *testing.T) {
+	st := DiffStatistics{OldWords: 1, NewWords: 2, DeletedWords: 3, InsertedWords: 4, CommonWords: 5, MovedWords: 6, DeletedChars: 7, InsertedChars: 8, CommonChars: 9, MovedChars: 10}
+	total := st
+	total.Add(st)
+	want := DiffStatistics{OldWords: 2, NewWords: 4, DeletedWords: 6, InsertedWords: 8, CommonWords: 10, MovedWords: 12, DeletedChars: 14, InsertedChars: 16, CommonChars: 18, MovedChars: 20}
+	if total != want {
+		t.Errorf("Add() = %+v, want %+v", total, want)
+	}
+}
+
+func TestComputeStatisticsIgnoreCase(t *testing.T) {
+	tests := []struct {
+		name         string
+		text1        string
+		text2        string
+		opts         Options
+		wantCommon   int
+		wantDeleted  int
+		wantInserted int
+	}{
+		{
+			name:         "case change is common with ignore case",
+			text1:        "Hello",
+			text2:        "hello",
+			opts:         Options{IgnoreCase: true},
+			wantCommon:   1,
+			wantDeleted:  0,
+			wantInserted: 0,
+		},
+		{
+			name:         "case change differs without ignore case",
+			text1:        "Hello",
+			text2:        "hello",
+			opts:         Options{},
+			wantCommon:   0,
+			wantDeleted:  1,
+			wantInserted: 1,
+		},
+		{
+			name:         "case change next to a real change",
+			text1:        "Hello big World",
+			text2:        "hello small world",
+			opts:         Options{IgnoreCase: true},
+			wantCommon:   2,
+			wantDeleted:  1,
+			wantInserted: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A case-sensitive diff, as a caller might pass, and the
+			// case-insensitive diff must give the same counts
+			for _, diffs := range [][]Diff{
+				DiffStrings(tt.text1, tt.text2, Options{}),
+				DiffStrings(tt.text1, tt.text2, tt.opts),
+			} {
+				st := ComputeStatistics(tt.text1, tt.text2, diffs, tt.opts)
+				if st.CommonWords != tt.wantCommon || st.DeletedWords != tt.wantDeleted || st.InsertedWords != tt.wantInserted {
+					t.Errorf("ComputeStatistics(%v) common, deleted, inserted = %d, %d, %d; want %d, %d, %d",
+						diffs, st.CommonWords, st.DeletedWords, st.InsertedWords,
+						tt.wantCommon, tt.wantDeleted, tt.wantInserted)
+				}
+			}
+		})
+	}
+}
+
 // TestDiffStringsWithPreprocessingIgnoreCase tests case-insensitive preprocessing
 func TestDiffStringsWithPreprocessingIgnoreCase(t *testing.T) {
 	tests := []struct {
@@ -983,3 +1173,387 @@ func BenchmarkDiffStrings(b *testing.B) {
 		DiffStrings(text1, text2, opts)
 	}
 }
+
+func TestSkipPreprocessing(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		n         int
+		want      bool
+	}{
+		{"default below", 0, DefaultPreprocessMinTokens - 1, true},
+		{"default at", 0, DefaultPreprocessMinTokens, false},
+		{"custom below", 10, 9, true},
+		{"custom above", 10, 11, false},
+		{"negative always preprocesses", -1, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := Options{PreprocessMinTokens: tt.threshold}
+			if got := opts.skipPreprocessing(tt.n); got != tt.want {
+				t.Errorf("skipPreprocessing(%d) = %v, want %v", tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreprocessMinTokens(t *testing.T) {
+	text1 := "The cat and the dog and THE bird"
+	text2 := "the cat or the Dog and the fish"
+	tokens1, tokens2 := Tokenize(text1, DefaultOptions()), Tokenize(text2, DefaultOptions())
+	lower := func(tokens []string) []string {
+		out := make([]string, len(tokens))
+		for i, tok := range tokens {
+			out[i] = strings.ToLower(tok)
+		}
+		return out
+	}
+
+	plain := diffTokensIgnoreCase(tokens1, tokens2, CaseFoldNone, AlgoHistogram)
+	preprocessed := diffTokensIgnoreCaseWithPreprocessing(tokens1, tokens2, lower(tokens1), lower(tokens2), nil, CaseFoldNone, AlgoHistogram)
+
+	opts := DefaultOptions()
+	opts.IgnoreCase = true
+	if got := DiffStringsWithPreprocessing(text1, text2, opts); !reflect.DeepEqual(got, plain) {
+		t.Errorf("below threshold: DiffStringsWithPreprocessing() = %v, want plain diff %v", got, plain)
+	}
+	if got := DiffStringsWithPositionsAndPreprocessing(text1, text2, opts).Diffs; !reflect.DeepEqual(got, plain) {
+		t.Errorf("below threshold: DiffStringsWithPositionsAndPreprocessing() = %v, want plain diff %v", got, plain)
+	}
+
+	opts.PreprocessMinTokens = -1
+	if got := DiffStringsWithPreprocessing(text1, text2, opts); !reflect.DeepEqual(got, preprocessed) {
+		t.Errorf("always: DiffStringsWithPreprocessing() = %v, want %v", got, preprocessed)
+	}
+	if got := DiffStringsWithPositionsAndPreprocessing(text1, text2, opts).Diffs; !reflect.DeepEqual(got, preprocessed) {
+		t.Errorf("always: DiffStringsWithPositionsAndPreprocessing() = %v, want %v", got, preprocessed)
+	}
+}
+
+func TestKeepStopwords(t *testing.T) {
+	text1 := "we read the old manual today"
+	text2 := "they wrote the new guide yesterday"
+
+	// By default the histogram algorithm does not anchor on "the"
+	opts := DefaultOptions()
+	for _, d := range DiffStringsWithPreprocessing(text1, text2, opts) {
+		if d.Type == Equal {
+			t.Fatalf("default: DiffStringsWithPreprocessing() has Equal %q, want no Equal tokens", d.Token)
+		}
+	}
+
+	opts.KeepStopwords = true
+	opts.ExtraStopwords = []string{"the"}
+	want := []Diff{
+		{Type: Delete, Token: "we"},
+		{Type: Delete, Token: "read"},
+		{Type: Insert, Token: "they"},
+		{Type: Insert, Token: "wrote"},
+		{Type: Equal, Token: "the"},
+		{Type: Delete, Token: "old"},
+		{Type: Delete, Token: "manual"},
+		{Type: Delete, Token: "today"},
+		{Type: Insert, Token: "new"},
+		{Type: Insert, Token: "guide"},
+		{Type: Insert, Token: "yesterday"},
+	}
+	if got := DiffStringsWithPreprocessing(text1, text2, opts); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffStringsWithPreprocessing() = %v, want %v", got, want)
+	}
+	if got := DiffStringsWithPositionsAndPreprocessing(text1, text2, opts).Diffs; !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffStringsWithPositionsAndPreprocessing() = %v, want %v", got, want)
+	}
+}
+
+func TestExtraStopwords(t *testing.T) {
+	text1 := "alpha via beta"
+	text2 := "gamma via delta"
+
+	opts := DefaultOptions()
+	lone := []Diff{
+		{Type: Delete, Token: "alpha"},
+		{Type: Insert, Token: "gamma"},
+		{Type: Equal, Token: "via"},
+		{Type: Delete, Token: "beta"},
+		{Type: Insert, Token: "delta"},
+	}
+	if got := DiffStringsWithPreprocessing(text1, text2, opts); !reflect.DeepEqual(got, lone) {
+		t.Fatalf("default: DiffStringsWithPreprocessing() = %v, want %v", got, lone)
+	}
+
+	opts.ExtraStopwords = []string{"via"}
+	want := []Diff{
+		{Type: Delete, Token: "alpha"},
+		{Type: Insert, Token: "gamma"},
+		{Type: Insert, Token: "via"},
+		{Type: Delete, Token: "via"},
+		{Type: Delete, Token: "beta"},
+		{Type: Insert, Token: "delta"},
+	}
+	if got := DiffStringsWithPreprocessing(text1, text2, opts); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffStringsWithPreprocessing() = %v, want %v", got, want)
+	}
+	if got := DiffStringsWithPositionsAndPreprocessing(text1, text2, opts).Diffs; !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffStringsWithPositionsAndPreprocessing() = %v, want %v", got, want)
+	}
+	if stopwords["via"] {
+		t.Error("ExtraStopwords modified the package stopwords")
+	}
+
+	// KeepStopwords overrides ExtraStopwords
+	opts.KeepStopwords = true
+	if got := DiffStringsWithPreprocessing(text1, text2, opts); !reflect.DeepEqual(got, lone) {
+		t.Errorf("KeepStopwords: DiffStringsWithPreprocessing() = %v, want %v", got, lone)
+	}
+}
+
+func TestDiffTokenRanges(t *testing.T) {
+	tokens1 := []string{"a", "b", "c", "d", "e"}
+	tokens2 := []string{"a", "b", "X", "d", "e", "f"}
+
+	ranges := DiffTokenRanges(tokens1, tokens2)
+
+	// Expanding the ranges must reproduce DiffTokens exactly
+	var expanded []Diff
+	for _, r := range ranges {
+		switch r.Type {
+		case Equal:
+			if r.A2-r.A1 != r.B2-r.B1 {
+				t.Errorf("Equal range %+v has mismatched lengths", r)
+			}
+			for i := r.A1; i < r.A2; i++ {
+				expanded = append(expanded, Diff{Type: Equal, Token: tokens1[i]})
+			}
+		case Delete:
+			if r.B1 != r.B2 {
+				t.Errorf("Delete range %+v should be empty in tokens2", r)
+			}
+			for i := r.A1; i < r.A2; i++ {
+				expanded = append(expanded, Diff{Type: Delete, Token: tokens1[i]})
+			}
+		case Insert:
+			if r.A1 != r.A2 {
+				t.Errorf("Insert range %+v should be empty in tokens1", r)
+			}
+			for i := r.B1; i < r.B2; i++ {
+				expanded = append(expanded, Diff{Type: Insert, Token: tokens2[i]})
+			}
+		}
+	}
+
+	if want := DiffTokens(tokens1, tokens2); !reflect.DeepEqual(expanded, want) {
+		t.Errorf("expanded ranges = %v, want %v", expanded, want)
+	}
+
+	if got := DiffTokenRanges(nil, nil); len(got) != 0 {
+		t.Errorf("DiffTokenRanges(nil, nil) = %v, want empty", got)
+	}
+}
+
+// largeMostlyEqualTokens returns two 10,000-token inputs differing in one token
+func largeMostlyEqualTokens() ([]string, []string) {
+	tokens1 := make([]string, 10000)
+	for i := range tokens1 {
+		tokens1[i] = fmt.Sprintf("tok%d", i)
+	}
+	tokens2 := append([]string(nil), tokens1...)
+	tokens2[5000] = "changed"
+	return tokens1, tokens2
+}
+
+// Benchmark per-token diffing of a large, mostly equal input
+func BenchmarkDiffTokensLargeEqual(b *testing.B) {
+	tokens1, tokens2 := largeMostlyEqualTokens()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DiffTokens(tokens1, tokens2)
+	}
+}
+
+// Benchmark range-based diffing of the same input, for allocation comparison
+func BenchmarkDiffTokenRangesLargeEqual(b *testing.B) {
+	tokens1, tokens2 := largeMostlyEqualTokens()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DiffTokenRanges(tokens1, tokens2)
+	}
+}
+
+func TestMaxTokens(t *testing.T) {
+	text1 := "a b c\nd e f\n\ng h\n"
+	text2 := "a b c\nd x f\n\ng h\n"
+	lineLevel := []Diff{
+		{Equal, "a"}, {Equal, "b"}, {Equal, "c"},
+		{Delete, "d"}, {Delete, "e"}, {Delete, "f"},
+		{Insert, "d"}, {Insert, "x"}, {Insert, "f"},
+		{Equal, "g"}, {Equal, "h"},
+	}
+	wordLevel := []Diff{
+		{Equal, "a"}, {Equal, "b"}, {Equal, "c"}, {Equal, "d"},
+		{Delete, "e"}, {Insert, "x"},
+		{Equal, "f"}, {Equal, "g"}, {Equal, "h"},
+	}
+
+	tests := []struct {
+		name          string
+		text2         string
+		opts          Options
+		want          []Diff
+		wantTruncated bool
+	}{
+		{"no limit", text2, Options{}, wordLevel, false},
+		{"under limit", text2, Options{MaxTokens: 8}, wordLevel, false},
+		{"over limit", text2, Options{MaxTokens: 7}, lineLevel, true},
+		{
+			"over limit ignore case",
+			"A B C\nd x f\n\nG H\n",
+			Options{MaxTokens: 7, IgnoreCase: true},
+			lineLevel,
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, result := range map[string]DiffResult{
+				"DiffStringsWithPositions":                 DiffStringsWithPositions(text1, tt.text2, tt.opts),
+				"DiffStringsWithPositionsAndPreprocessing": DiffStringsWithPositionsAndPreprocessing(text1, tt.text2, tt.opts),
+			} {
+				if !reflect.DeepEqual(result.Diffs, tt.want) {
+					t.Errorf("%s diffs = %v, want %v", name, result.Diffs, tt.want)
+				}
+				if result.Truncated != tt.wantTruncated {
+					t.Errorf("%s Truncated = %v, want %v", name, result.Truncated, tt.wantTruncated)
+				}
+			}
+			if got := DiffStrings(text1, tt.text2, tt.opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DiffStrings = %v, want %v", got, tt.want)
+			}
+			if got := DiffStringsWithPreprocessing(text1, tt.text2, tt.opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DiffStringsWithPreprocessing = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// largeLineTexts returns two texts of many lines differing in every 100th
+// line, for exercising the MaxTokens fast path.
+func largeLineTexts() (string, string) {
+	var b1, b2 strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&b1, "line %d has some words in it\n", i)
+		if i%100 == 0 {
+			fmt.Fprintf(&b2, "line %d has other words in it\n", i)
+		} else {
+			fmt.Fprintf(&b2, "line %d has some words in it\n", i)
+		}
+	}
+	return b1.String(), b2.String()
+}
+
+func TestMaxTokensLargeInput(t *testing.T) {
+	text1, text2 := largeLineTexts()
+	opts := Options{MaxTokens: 1000}
+
+	result := DiffStringsWithPositionsAndPreprocessing(text1, text2, opts)
+	if !result.Truncated {
+		t.Fatal("Truncated = false, want the fast path above MaxTokens")
+	}
+
+	var deleted, inserted int
+	for _, d := range result.Diffs {
+		switch d.Type {
+		case Delete:
+			deleted++
+		case Insert:
+			inserted++
+		}
+	}
+	// 50 changed lines of 7 tokens each, reported as whole lines.
+	if deleted != 350 || inserted != 350 {
+		t.Errorf("deleted, inserted = %d, %d, want 350, 350", deleted, inserted)
+	}
+	formatted := FormatDiffResultAdvanced(result, DefaultFormatOptions())
+	if !strings.Contains(formatted, "line 100 has other words in it") {
+		t.Errorf("formatted fast-path result lost inserted line text")
+	}
+}
+
+func TestLineAnchored(t *testing.T) {
+	var b1, b2 strings.Builder
+	for i := 1; i <= 100; i++ {
+		fmt.Fprintf(&b1, "line %d has some words in it\n", i)
+		if i == 50 {
+			fmt.Fprintf(&b2, "line %d has other words in it\n", i)
+		} else {
+			fmt.Fprintf(&b2, "line %d has some words in it\n", i)
+		}
+	}
+	text1, text2 := b1.String(), b2.String()
+	opts := DefaultOptions()
+	opts.LineAnchored = true
+	lineOf := func(text string, pos TokenPos) int {
+		return strings.Count(text[:pos.Start], "\n") + 1
+	}
+
+	for name, result := range map[string]DiffResult{
+		"DiffStringsWithPositions":                 DiffStringsWithPositions(text1, text2, opts),
+		"DiffStringsWithPositionsAndPreprocessing": DiffStringsWithPositionsAndPreprocessing(text1, text2, opts),
+	} {
+		var changes []Diff
+		i1, i2 := 0, 0
+		for _, d := range result.Diffs {
+			switch d.Type {
+			case Equal:
+				p1, p2 := result.Positions1[i1], result.Positions2[i2]
+				if text1[p1.Start:p1.End] != d.Token || text2[p2.Start:p2.End] != d.Token {
+					t.Fatalf("%s: Equal %q at %v, %v does not match the texts", name, d.Token, p1, p2)
+				}
+				if l1, l2 := lineOf(text1, p1), lineOf(text2, p2); l1 != l2 {
+					t.Fatalf("%s: Equal %q matches line %d with line %d", name, d.Token, l1, l2)
+				}
+				i1++
+				i2++
+			case Delete:
+				if line := lineOf(text1, result.Positions1[i1]); line != 50 {
+					t.Errorf("%s: Delete %q on line %d, want line 50", name, d.Token, line)
+				}
+				changes = append(changes, d)
+				i1++
+			case Insert:
+				if line := lineOf(text2, result.Positions2[i2]); line != 50 {
+					t.Errorf("%s: Insert %q on line %d, want line 50", name, d.Token, line)
+				}
+				changes = append(changes, d)
+				i2++
+			}
+		}
+		if i1 != len(result.Positions1) || i2 != len(result.Positions2) {
+			t.Errorf("%s: diffs cover %d, %d tokens, want %d, %d", name, i1, i2, len(result.Positions1), len(result.Positions2))
+		}
+		want := []Diff{{Delete, "some"}, {Insert, "other"}}
+		if !reflect.DeepEqual(changes, want) {
+			t.Errorf("%s: changes = %v, want %v", name, changes, want)
+		}
+	}
+
+	if got, want := DiffStrings(text1, text2, opts), DiffStringsWithPositions(text1, text2, opts).Diffs; !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffStrings() differs from DiffStringsWithPositions()")
+	}
+}
+
+// Benchmark the MaxTokens line-level fast path on a large input
+func BenchmarkDiffStringsMaxTokens(b *testing.B) {
+	text1, text2 := largeLineTexts()
+	opts := Options{MaxTokens: 1000}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DiffStringsWithPositionsAndPreprocessing(text1, text2, opts)
+	}
+}
@@ -1,6 +1,9 @@
 package tokendiff
 
 import (
+	"fmt"
+	"regexp"
+	"sort"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -12,15 +15,86 @@ type TokenPos struct {
 	End   int // byte offset of token end (exclusive)
 }
 
+// Tokenizer splits text into tokens, returning each token's byte range in
+// text. Tokens must be in order and must not overlap; text between them,
+// such as whitespace, is not compared but is kept in formatted output. Set
+// Options.CustomTokenizer to diff with a Tokenizer, such as a lexer for a
+// programming language.
+type Tokenizer interface {
+	Tokenize(text string) ([]string, []TokenPos)
+}
+
+// DefaultTokenizer is the built-in tokenization as a Tokenizer: it calls
+// TokenizeWithPositions with Options, ignoring Options.CustomTokenizer. A
+// custom Tokenizer can use it for the text it does not handle itself.
+type DefaultTokenizer struct {
+	Options Options
+}
+
+// Tokenize splits text into tokens as TokenizeWithPositions does.
+func (t DefaultTokenizer) Tokenize(text string) ([]string, []TokenPos) {
+	opts := t.Options
+	opts.CustomTokenizer = nil
+	return TokenizeWithPositions(text, opts)
+}
+
 // TokenizeWithPositions splits text into tokens and tracks their positions.
 // This allows reconstructing original spacing for Equal content in diffs.
+// With opts.CustomTokenizer, it tokenizes with that instead. With
+// opts.TokenPattern, the tokens are the pattern's matches; an invalid
+// pattern is ignored, so validate it with TokenizeE.
 func TokenizeWithPositions(text string, opts Options) ([]string, []TokenPos) {
-	// Determine delimiter check function
-	var isDelimiter func(r rune) bool
+	t := newTokenizer(opts)
+	return t.tokenizeWithPositions(text)
+}
 
+// Tokenize splits text into tokens, treating delimiters as separate tokens.
+// Whitespace separates words but is not included in output unless
+// PreserveWhitespace is true, in which case each maximal run of whitespace
+// becomes a single token. With opts.CustomTokenizer, the tokens are its
+// tokens instead. With opts.TokenPattern, the tokens are the pattern's
+// matches; an invalid pattern is ignored, so validate it with TokenizeE.
+func Tokenize(text string, opts Options) []string {
+	t := newTokenizer(opts)
+	return t.tokenize(text)
+}
+
+// tokenizer is what Tokenize and TokenizeWithPositions derive from Options:
+// the delimiter and whitespace sets and the sorted delimiter sequences, so a
+// Differ can derive them once for many texts.
+type tokenizer struct {
+	custom             Tokenizer
+	pattern            *regexp.Regexp
+	isDelimiter        func(r rune) bool
+	isWS               func(r rune) bool
+	sequences          []string
+	preserveWhitespace bool
+}
+
+// newTokenizer returns the tokenizer for opts.
+func newTokenizer(opts Options) tokenizer {
+	t := tokenizer{
+		custom:             opts.CustomTokenizer,
+		preserveWhitespace: opts.PreserveWhitespace,
+	}
+	if t.custom != nil {
+		return t
+	}
+	if opts.tokenRegexp != nil && opts.tokenRegexp.String() == opts.TokenPattern {
+		t.pattern = opts.tokenRegexp
+		return t
+	}
+	if re, err := compileTokenPattern(opts.TokenPattern); re != nil && err == nil {
+		t.pattern = re
+		return t
+	}
+
+	// Determine delimiter check function
 	if opts.UsePunctuation {
-		isDelimiter = unicode.IsPunct
+		// Use Unicode punctuation category
+		t.isDelimiter = unicode.IsPunct
 	} else {
+		// Use explicit delimiter set
 		if opts.Delimiters == "" {
 			opts.Delimiters = DefaultDelimiters
 		}
@@ -28,25 +102,37 @@ func TokenizeWithPositions(text string, opts Options) ([]string, []TokenPos) {
 		for _, r := range opts.Delimiters {
 			delimSet[r] = true
 		}
-		isDelimiter = func(r rune) bool {
+		t.isDelimiter = func(r rune) bool {
 			return delimSet[r]
 		}
 	}
 
 	// Determine whitespace check function
-	var isWS func(r rune) bool
 	if opts.Whitespace == "" {
-		isWS = isWhitespace
+		t.isWS = isWhitespace
 	} else {
 		wsSet := make(map[rune]bool)
 		for _, r := range opts.Whitespace {
 			wsSet[r] = true
 		}
-		isWS = func(r rune) bool {
+		t.isWS = func(r rune) bool {
 			return wsSet[r]
 		}
 	}
 
+	t.sequences = sortedSequences(opts.DelimiterSequences)
+	return t
+}
+
+// tokenizeWithPositions implements TokenizeWithPositions.
+func (t *tokenizer) tokenizeWithPositions(text string) ([]string, []TokenPos) {
+	if t.custom != nil {
+		return t.custom.Tokenize(text)
+	}
+	if t.pattern != nil {
+		return tokenizePattern(text, t.pattern)
+	}
+
 	var tokens []string
 	var positions []TokenPos
 	var currentWord strings.Builder
@@ -62,19 +148,30 @@ func TokenizeWithPositions(text string, opts Options) ([]string, []TokenPos) {
 	}
 
 	i := 0
-	for _, r := range text {
-		runeLen := utf8.RuneLen(r)
+	for i < len(text) {
+		if seq := matchSequence(text[i:], t.sequences); seq != "" {
+			flushWord(i)
+			tokens = append(tokens, seq)
+			positions = append(positions, TokenPos{Start: i, End: i + len(seq)})
+			i += len(seq)
+			continue
+		}
+
+		r, runeLen := utf8.DecodeRuneInString(text[i:])
 		switch {
-		case isDelimiter(r):
+		case t.isDelimiter(r):
 			flushWord(i)
 			tokens = append(tokens, string(r))
 			positions = append(positions, TokenPos{Start: i, End: i + runeLen})
 
-		case isWS(r):
+		case t.isWS(r):
 			flushWord(i)
-			if opts.PreserveWhitespace {
-				tokens = append(tokens, string(r))
-				positions = append(positions, TokenPos{Start: i, End: i + runeLen})
+			if t.preserveWhitespace {
+				end := whitespaceRunEnd(text, i, t.isWS, t.isDelimiter, t.sequences)
+				tokens = append(tokens, text[i:end])
+				positions = append(positions, TokenPos{Start: i, End: end})
+				i = end
+				continue
 			}
 
 		default:
@@ -90,42 +187,15 @@ func TokenizeWithPositions(text string, opts Options) ([]string, []TokenPos) {
 	return tokens, positions
 }
 
-// Tokenize splits text into tokens, treating delimiters as separate tokens.
-// Whitespace separates words but is not included in output unless
-// PreserveWhitespace is true.
-func Tokenize(text string, opts Options) []string {
-	// Determine delimiter check function
-	var isDelimiter func(r rune) bool
-
-	if opts.UsePunctuation {
-		// Use Unicode punctuation category
-		isDelimiter = unicode.IsPunct
-	} else {
-		// Use explicit delimiter set
-		if opts.Delimiters == "" {
-			opts.Delimiters = DefaultDelimiters
-		}
-		delimSet := make(map[rune]bool)
-		for _, r := range opts.Delimiters {
-			delimSet[r] = true
-		}
-		isDelimiter = func(r rune) bool {
-			return delimSet[r]
-		}
+// tokenize implements Tokenize.
+func (t *tokenizer) tokenize(text string) []string {
+	if t.custom != nil {
+		tokens, _ := t.custom.Tokenize(text)
+		return tokens
 	}
-
-	// Determine whitespace check function
-	var isWS func(r rune) bool
-	if opts.Whitespace == "" {
-		isWS = isWhitespace
-	} else {
-		wsSet := make(map[rune]bool)
-		for _, r := range opts.Whitespace {
-			wsSet[r] = true
-		}
-		isWS = func(r rune) bool {
-			return wsSet[r]
-		}
+	if t.pattern != nil {
+		tokens, _ := tokenizePattern(text, t.pattern)
+		return tokens
 	}
 
 	var tokens []string
@@ -138,30 +208,124 @@ func Tokenize(text string, opts Options) []string {
 		}
 	}
 
-	for _, r := range text {
+	for i := 0; i < len(text); {
+		if seq := matchSequence(text[i:], t.sequences); seq != "" {
+			// Delimiter sequence: flush current word, add sequence as one token
+			flushWord()
+			tokens = append(tokens, seq)
+			i += len(seq)
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(text[i:])
 		switch {
-		case isDelimiter(r):
+		case t.isDelimiter(r):
 			// Delimiter: flush current word, add delimiter as its own token
 			flushWord()
 			tokens = append(tokens, string(r))
 
-		case isWS(r):
-			// Whitespace: flush current word
+		case t.isWS(r):
+			// Whitespace: flush current word; keep the whole run as one token
 			flushWord()
-			if opts.PreserveWhitespace {
-				tokens = append(tokens, string(r))
+			if t.preserveWhitespace {
+				end := whitespaceRunEnd(text, i, t.isWS, t.isDelimiter, t.sequences)
+				tokens = append(tokens, text[i:end])
+				i = end
+				continue
 			}
 
 		default:
 			// Regular character: add to current word
 			currentWord.WriteRune(r)
 		}
+		i += size
 	}
 
 	flushWord()
 	return tokens
 }
 
+// whitespaceRunEnd returns the byte offset just past the maximal run of
+// whitespace starting at text[start]. The run stops at any rune that is not
+// whitespace, is a delimiter, or begins a delimiter sequence.
+func whitespaceRunEnd(text string, start int, isWS, isDelimiter func(rune) bool, sequences []string) int {
+	i := start
+	for i < len(text) {
+		if i > start && matchSequence(text[i:], sequences) != "" {
+			break
+		}
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if !isWS(r) || isDelimiter(r) {
+			break
+		}
+		i += size
+	}
+	return i
+}
+
+// TokenizeE is like Tokenize but returns an error if opts.TokenPattern is
+// not a valid regular expression, rather than ignoring it.
+func TokenizeE(text string, opts Options) ([]string, error) {
+	if _, err := compileTokenPattern(opts.TokenPattern); err != nil {
+		return nil, err
+	}
+	return Tokenize(text, opts), nil
+}
+
+// compileTokenPattern compiles pattern, returning nil and no error for an
+// empty pattern.
+func compileTokenPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token pattern %q: %w", pattern, err)
+	}
+	return re, nil
+}
+
+// tokenizePattern returns the non-empty matches of re in text as tokens,
+// with their positions.
+func tokenizePattern(text string, re *regexp.Regexp) ([]string, []TokenPos) {
+	var tokens []string
+	var positions []TokenPos
+	for _, m := range re.FindAllStringIndex(text, -1) {
+		if m[0] == m[1] {
+			continue
+		}
+		tokens = append(tokens, text[m[0]:m[1]])
+		positions = append(positions, TokenPos{Start: m[0], End: m[1]})
+	}
+	return tokens, positions
+}
+
+// sortedSequences returns the non-empty delimiter sequences, longest first,
+// so that matchSequence prefers the longest match.
+func sortedSequences(sequences []string) []string {
+	var sorted []string
+	for _, seq := range sequences {
+		if seq != "" {
+			sorted = append(sorted, seq)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+	return sorted
+}
+
+// matchSequence returns the first of sequences that text starts with, or ""
+// if none match.
+func matchSequence(text string, sequences []string) string {
+	for _, seq := range sequences {
+		if strings.HasPrefix(text, seq) {
+			return seq
+		}
+	}
+	return ""
+}
+
 // isWhitespace returns true if r is a whitespace character.
 func isWhitespace(r rune) bool {
 	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
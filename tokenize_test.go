@@ -2,6 +2,7 @@ package tokendiff
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -54,6 +55,30 @@ func TestTokenize(t *testing.T) {
 			opts:     Options{Delimiters: DefaultDelimiters, PreserveWhitespace: true},
 			expected: []string{"a", " ", "b"},
 		},
+		{
+			name:     "preserve whitespace multi-space run",
+			input:    "a   b",
+			opts:     Options{Delimiters: DefaultDelimiters, PreserveWhitespace: true},
+			expected: []string{"a", "   ", "b"},
+		},
+		{
+			name:     "preserve whitespace mixed tab and space run",
+			input:    "a \t \tb",
+			opts:     Options{Delimiters: DefaultDelimiters, PreserveWhitespace: true},
+			expected: []string{"a", " \t \t", "b"},
+		},
+		{
+			name:     "preserve whitespace run broken by delimiter",
+			input:    "f  (  x",
+			opts:     Options{Delimiters: "()", PreserveWhitespace: true},
+			expected: []string{"f", "  ", "(", "  ", "x"},
+		},
+		{
+			name:     "preserve custom whitespace run",
+			input:    "a__-b",
+			opts:     Options{Delimiters: "()", Whitespace: "_-", PreserveWhitespace: true},
+			expected: []string{"a", "__-", "b"},
+		},
 		{
 			name:     "empty string",
 			input:    "",
@@ -325,6 +350,24 @@ func TestTokenizeWithPositions(t *testing.T) {
 			opts:       Options{PreserveWhitespace: true},
 			wantTokens: []string{"a", " ", "b"},
 		},
+		{
+			name:       "preserve whitespace multi-space run",
+			input:      "a   b",
+			opts:       Options{PreserveWhitespace: true},
+			wantTokens: []string{"a", "   ", "b"},
+		},
+		{
+			name:       "preserve whitespace mixed tab and space run",
+			input:      "x\t  \ty z",
+			opts:       Options{PreserveWhitespace: true},
+			wantTokens: []string{"x", "\t  \t", "y", " ", "z"},
+		},
+		{
+			name:       "preserve whitespace leading and trailing runs",
+			input:      "  a\n\n",
+			opts:       Options{PreserveWhitespace: true},
+			wantTokens: []string{"  ", "a", "\n\n"},
+		},
 		{
 			name:       "multiline",
 			input:      "line1\nline2",
@@ -403,3 +446,267 @@ func BenchmarkTokenize(b *testing.B) {
 		Tokenize(text, opts)
 	}
 }
+
+func TestDelimiterSequences(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		opts      Options
+		expected  []string
+		positions []TokenPos
+	}{
+		{
+			name:      "sequence as single token",
+			input:     "a == b",
+			opts:      Options{DelimiterSequences: []string{"=="}},
+			expected:  []string{"a", "==", "b"},
+			positions: []TokenPos{{0, 1}, {2, 4}, {5, 6}},
+		},
+		{
+			name:      "sequence inside word",
+			input:     "x->y",
+			opts:      Options{DelimiterSequences: []string{"->"}},
+			expected:  []string{"x", "->", "y"},
+			positions: []TokenPos{{0, 1}, {1, 3}, {3, 4}},
+		},
+		{
+			name:      "sequences before single delimiters",
+			input:     "a != b = c",
+			opts:      Options{Delimiters: "=!", DelimiterSequences: []string{"!="}},
+			expected:  []string{"a", "!=", "b", "=", "c"},
+			positions: []TokenPos{{0, 1}, {2, 4}, {5, 6}, {7, 8}, {9, 10}},
+		},
+		{
+			name:      "longest match first",
+			input:     "a===b",
+			opts:      Options{DelimiterSequences: []string{"==", "==="}},
+			expected:  []string{"a", "===", "b"},
+			positions: []TokenPos{{0, 1}, {1, 4}, {4, 5}},
+		},
+		{
+			name:      "overlapping sequences match greedily",
+			input:     "a====b",
+			opts:      Options{Delimiters: "=", DelimiterSequences: []string{"==="}},
+			expected:  []string{"a", "===", "=", "b"},
+			positions: []TokenPos{{0, 1}, {1, 4}, {4, 5}, {5, 6}},
+		},
+		{
+			name:      "multi-byte sequence",
+			input:     "a→→b",
+			opts:      Options{DelimiterSequences: []string{"→→"}},
+			expected:  []string{"a", "→→", "b"},
+			positions: []TokenPos{{0, 1}, {1, 7}, {7, 8}},
+		},
+		{
+			name:      "with punctuation",
+			input:     "f(x) -> y",
+			opts:      Options{UsePunctuation: true, DelimiterSequences: []string{"->"}},
+			expected:  []string{"f", "(", "x", ")", "->", "y"},
+			positions: []TokenPos{{0, 1}, {1, 2}, {2, 3}, {3, 4}, {5, 7}, {8, 9}},
+		},
+		{
+			name:      "empty sequences are ignored",
+			input:     "a b",
+			opts:      Options{DelimiterSequences: []string{""}},
+			expected:  []string{"a", "b"},
+			positions: []TokenPos{{0, 1}, {2, 3}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Tokenize(tt.input, tt.opts); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Tokenize() = %q, want %q", got, tt.expected)
+			}
+
+			tokens, positions := TokenizeWithPositions(tt.input, tt.opts)
+			if !reflect.DeepEqual(tokens, tt.expected) {
+				t.Errorf("TokenizeWithPositions() tokens = %q, want %q", tokens, tt.expected)
+			}
+			if !reflect.DeepEqual(positions, tt.positions) {
+				t.Errorf("TokenizeWithPositions() positions = %v, want %v", positions, tt.positions)
+			}
+			for i, pos := range positions {
+				if tt.input[pos.Start:pos.End] != tokens[i] {
+					t.Errorf("text[%d:%d] = %q, want token %q", pos.Start, pos.End, tt.input[pos.Start:pos.End], tokens[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTokenPattern(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		opts  Options
+		want  []string
+	}{
+		{
+			name:  "words and single non-space characters",
+			input: "foo(bar, 42)",
+			opts:  Options{TokenPattern: `\w+|\S`},
+			want:  []string{"foo", "(", "bar", ",", "42", ")"},
+		},
+		{
+			name:  "handles kept together",
+			input: "ping @dev-team now",
+			opts:  Options{TokenPattern: `@[\w-]+|\w+|\S`},
+			want:  []string{"ping", "@dev-team", "now"},
+		},
+		{
+			name:  "delimiters are ignored",
+			input: "a.b c",
+			opts:  Options{TokenPattern: `\S+`, Delimiters: "."},
+			want:  []string{"a.b", "c"},
+		},
+		{
+			name:  "empty matches are skipped",
+			input: "ab",
+			opts:  Options{TokenPattern: `x*`},
+			want:  nil,
+		},
+		{
+			name:  "multibyte text",
+			input: "héllo wörld!",
+			opts:  Options{TokenPattern: `\pL+|\S`},
+			want:  []string{"héllo", "wörld", "!"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Tokenize(tt.input, tt.opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Tokenize() = %q, want %q", got, tt.want)
+			}
+			got, err := TokenizeE(tt.input, tt.opts)
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TokenizeE() = %q, %v; want %q, nil", got, err, tt.want)
+			}
+
+			tokens, positions := TokenizeWithPositions(tt.input, tt.opts)
+			if !reflect.DeepEqual(tokens, tt.want) {
+				t.Errorf("TokenizeWithPositions() tokens = %q, want %q", tokens, tt.want)
+			}
+			if len(positions) != len(tokens) {
+				t.Fatalf("positions count = %d, tokens count = %d", len(positions), len(tokens))
+			}
+			for i, pos := range positions {
+				if extracted := tt.input[pos.Start:pos.End]; extracted != tokens[i] {
+					t.Errorf("Position[%d] extracts %q, but token is %q", i, extracted, tokens[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTokenizeEInvalidPattern(t *testing.T) {
+	opts := Options{TokenPattern: `(\w+`}
+	_, err := TokenizeE("a b", opts)
+	if err == nil || !strings.Contains(err.Error(), `invalid token pattern "(\\w+"`) {
+		t.Errorf("TokenizeE() error = %v, want an invalid token pattern error", err)
+	}
+
+	// Tokenize cannot report the error, so it falls back to the delimiter rules
+	if got, want := Tokenize("a b", opts), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Tokenize() = %q, want %q", got, want)
+	}
+}
+
+func TestWithTokenPattern(t *testing.T) {
+	opts := Options{TokenPattern: `\w+`}.withTokenPattern()
+	if tok := newTokenizer(opts); tok.pattern != opts.tokenRegexp {
+		t.Error("newTokenizer() compiled the pattern again instead of sharing it")
+	}
+
+	// A copy with another pattern does not use the stale compiled one
+	opts.TokenPattern = `\S+`
+	if got, want := Tokenize("a-b c", opts), []string{"a-b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Tokenize() = %q, want %q", got, want)
+	}
+
+	if opts := (Options{TokenPattern: `(\w+`}).withTokenPattern(); opts.tokenRegexp != nil {
+		t.Error("withTokenPattern() compiled an invalid pattern")
+	}
+}
+
+// pipeTokenizer splits text on '|', keeping each separator as a token.
+type pipeTokenizer struct{}
+
+func (pipeTokenizer) Tokenize(text string) ([]string, []TokenPos) {
+	var tokens []string
+	var positions []TokenPos
+	add := func(start, end int) {
+		if end > start {
+			tokens = append(tokens, text[start:end])
+			positions = append(positions, TokenPos{Start: start, End: end})
+		}
+	}
+	start := 0
+	for i, r := range text {
+		if r == '|' {
+			add(start, i)
+			add(i, i+1)
+			start = i + 1
+		}
+	}
+	add(start, len(text))
+	return tokens, positions
+}
+
+func TestCustomTokenizer(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CustomTokenizer = pipeTokenizer{}
+
+	tokens, positions := TokenizeWithPositions("one two|three", opts)
+	wantTokens := []string{"one two", "|", "three"}
+	wantPositions := []TokenPos{{0, 7}, {7, 8}, {8, 13}}
+	if !reflect.DeepEqual(tokens, wantTokens) || !reflect.DeepEqual(positions, wantPositions) {
+		t.Errorf("TokenizeWithPositions() = %q, %v; want %q, %v", tokens, positions, wantTokens, wantPositions)
+	}
+	if got := Tokenize("one two|three", opts); !reflect.DeepEqual(got, wantTokens) {
+		t.Errorf("Tokenize() = %q, want %q", got, wantTokens)
+	}
+
+	// Positions flow through to formatting: the changed field is marked
+	// whole, and the unchanged text is copied from the input
+	result := DiffStringsWithPositions("id|old name|  42", "id|new name|  42", opts)
+	if !reflect.DeepEqual(result.Positions2, []TokenPos{{0, 2}, {2, 3}, {3, 11}, {11, 12}, {12, 16}}) {
+		t.Errorf("Positions2 = %v", result.Positions2)
+	}
+	want := "id|[-old name-]{+new name+}|  42"
+	if got := FormatDiffResultAdvanced(result, DefaultFormatOptions()); got != want {
+		t.Errorf("FormatDiffResultAdvanced() = %q, want %q", got, want)
+	}
+
+	// The preprocessing entry point uses it too
+	diffs := DiffStringsWithPreprocessing("a b|c", "a b|d", opts)
+	wantDiffs := []Diff{
+		{Type: Equal, Token: "a b"},
+		{Type: Equal, Token: "|"},
+		{Type: Delete, Token: "c"},
+		{Type: Insert, Token: "d"},
+	}
+	if !reflect.DeepEqual(diffs, wantDiffs) {
+		t.Errorf("DiffStringsWithPreprocessing() = %v, want %v", diffs, wantDiffs)
+	}
+}
+
+func TestDefaultTokenizer(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CustomTokenizer = pipeTokenizer{}
+	text := "foo(bar) baz|qux"
+
+	builtin := DefaultOptions()
+	wantTokens, wantPositions := TokenizeWithPositions(text, builtin)
+	tokens, positions := DefaultTokenizer{Options: opts}.Tokenize(text)
+	if !reflect.DeepEqual(tokens, wantTokens) || !reflect.DeepEqual(positions, wantPositions) {
+		t.Errorf("DefaultTokenizer.Tokenize() = %q, %v; want %q, %v", tokens, positions, wantTokens, wantPositions)
+	}
+
+	// As a CustomTokenizer it gives the built-in result
+	builtin.CustomTokenizer = DefaultTokenizer{Options: DefaultOptions()}
+	if got := DiffStrings("a b c", "a x c", builtin); !reflect.DeepEqual(got, DiffStrings("a b c", "a x c", DefaultOptions())) {
+		t.Errorf("DiffStrings() with DefaultTokenizer = %v", got)
+	}
+}
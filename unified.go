@@ -23,6 +23,21 @@ type DiffHunk struct {
 	ContextBefore []string
 	// ContextAfter contains context lines after the change.
 	ContextAfter []string
+	// Parents is the number of parent files the hunk compares against.
+	// It is 1 for regular "@@" hunks and 2 or more for the combined
+	// "@@@" hunks git produces for merge commits. For combined hunks,
+	// OldStart and OldCount describe the first parent.
+	Parents int
+	// NoNewlineOld is true if the hunk ends the old file and its last line
+	// has no trailing newline ("\ No newline at end of file").
+	NoNewlineOld bool
+	// NoNewlineNew is true if the hunk ends the new file and its last line
+	// has no trailing newline.
+	NoNewlineNew bool
+	// WordDiffs is the word-level diff of OldLines and NewLines, as
+	// ApplyWordDiff returns it. ParseAndWordDiff sets it; it is nil
+	// otherwise.
+	WordDiffs []Diff
 }
 
 // UnifiedDiff represents a parsed unified diff.
@@ -37,11 +52,15 @@ type UnifiedDiff struct {
 
 // ParseUnifiedDiff parses a unified diff string into structured data.
 // It handles standard unified diff format as produced by diff -u or git diff.
+// A trailing "\r" is dropped from file names, so a diff saved with CRLF line
+// endings parses; hunk lines keep theirs, as it may belong to the file (see
+// Options.NormalizeEOL).
 func ParseUnifiedDiff(input string) ([]UnifiedDiff, error) {
 	var results []UnifiedDiff
 	var current *UnifiedDiff
 	var currentHunk *DiffHunk
 	inHunk := false
+	var lastKind byte
 
 	lines := strings.Split(input, "\n")
 
@@ -61,13 +80,13 @@ func ParseUnifiedDiff(input string) ([]UnifiedDiff, error) {
 				results = append(results, *current)
 			}
 			current = &UnifiedDiff{
-				OldFile: strings.TrimPrefix(line, "--- "),
+				OldFile: strings.TrimSuffix(strings.TrimPrefix(line, "--- "), "\r"),
 			}
 			continue
 		}
 
 		if strings.HasPrefix(line, "+++ ") && current != nil {
-			current.NewFile = strings.TrimPrefix(line, "+++ ")
+			current.NewFile = strings.TrimSuffix(strings.TrimPrefix(line, "+++ "), "\r")
 			continue
 		}
 
@@ -76,22 +95,9 @@ func ParseUnifiedDiff(input string) ([]UnifiedDiff, error) {
 			flushHunk()
 			currentHunk = &DiffHunk{}
 			inHunk = true
+			lastKind = 0
 
-			// Parse @@ -start,count +start,count @@
-			var oldStart, oldCount, newStart, newCount int
-			// Try parsing with counts
-			n, _ := fmt.Sscanf(line, "@@ -%d,%d +%d,%d @@",
-				&oldStart, &oldCount, &newStart, &newCount)
-			if n < 4 {
-				// Try without counts (single line changes)
-				fmt.Sscanf(line, "@@ -%d +%d @@", &oldStart, &newStart)
-				oldCount = 1
-				newCount = 1
-			}
-			currentHunk.OldStart = oldStart
-			currentHunk.OldCount = oldCount
-			currentHunk.NewStart = newStart
-			currentHunk.NewCount = newCount
+			parseHunkHeader(line, currentHunk)
 			continue
 		}
 
@@ -99,17 +105,30 @@ func ParseUnifiedDiff(input string) ([]UnifiedDiff, error) {
 			continue
 		}
 
+		// A "\ No newline at end of file" marker applies to the line before it
+		if isNoNewlineMarker(line) {
+			currentHunk.NoNewlineOld = currentHunk.NoNewlineOld || lastKind != '+'
+			currentHunk.NoNewlineNew = currentHunk.NoNewlineNew || lastKind != '-'
+			continue
+		}
+
 		// Process hunk content
-		if strings.HasPrefix(line, "-") {
-			currentHunk.OldLines = append(currentHunk.OldLines, line[1:])
-		} else if strings.HasPrefix(line, "+") {
-			currentHunk.NewLines = append(currentHunk.NewLines, line[1:])
-		} else if strings.HasPrefix(line, " ") {
+		kind, text, ok := classifyHunkLine(line, currentHunk.Parents)
+		if !ok {
+			continue
+		}
+		lastKind = kind
+		switch kind {
+		case '-':
+			currentHunk.OldLines = append(currentHunk.OldLines, text)
+		case '+':
+			currentHunk.NewLines = append(currentHunk.NewLines, text)
+		default:
 			// Context line
 			if len(currentHunk.OldLines) == 0 && len(currentHunk.NewLines) == 0 {
-				currentHunk.ContextBefore = append(currentHunk.ContextBefore, line[1:])
+				currentHunk.ContextBefore = append(currentHunk.ContextBefore, text)
 			} else {
-				currentHunk.ContextAfter = append(currentHunk.ContextAfter, line[1:])
+				currentHunk.ContextAfter = append(currentHunk.ContextAfter, text)
 			}
 		}
 	}
@@ -123,10 +142,276 @@ func ParseUnifiedDiff(input string) ([]UnifiedDiff, error) {
 	return results, nil
 }
 
+// hunkParents returns the number of parent files described by a hunk header:
+// 1 for "@@ -a,b +c,d @@" and N for combined "@@@ -a,b -c,d +e,f @@@" headers,
+// which use N+1 "@" characters.
+func hunkParents(header string) int {
+	n := 0
+	for n < len(header) && header[n] == '@' {
+		n++
+	}
+	if n < 2 {
+		return 1
+	}
+	return n - 1
+}
+
+// parseHunkHeader fills in the hunk's parent count and line ranges from its
+// header. Ranges without a count (e.g. "-5") have an implied count of 1.
+// For combined hunks, the old range is taken from the first parent.
+func parseHunkHeader(line string, hunk *DiffHunk) {
+	hunk.Parents = hunkParents(line)
+
+	fields := strings.Fields(line)
+	if len(fields) < hunk.Parents+2 {
+		return
+	}
+	hunk.OldStart, hunk.OldCount = parseHunkRange(fields[1], "-")
+	hunk.NewStart, hunk.NewCount = parseHunkRange(fields[hunk.Parents+1], "+")
+}
+
+// parseHunkRange parses a "-start,count" or "+start,count" range.
+func parseHunkRange(field, sign string) (start, count int) {
+	if !strings.HasPrefix(field, sign) {
+		return 0, 0
+	}
+	n, _ := fmt.Sscanf(field[1:], "%d,%d", &start, &count)
+	if n < 2 {
+		count = 1
+	}
+	return start, count
+}
+
+// isNoNewlineMarker returns true if the line is a "\ No newline at end of
+// file" marker, which diff writes after a line that lacks a trailing newline.
+// The marker text is localized, so only the "\ " prefix is checked.
+func isNoNewlineMarker(line string) bool {
+	return strings.HasPrefix(line, "\\ ")
+}
+
+// classifyHunkLine determines whether a hunk content line is removed ('-'),
+// added ('+'), or context (' '), and returns the line text without its prefix.
+// Regular hunks have a one-character prefix; combined hunks have one prefix
+// column per parent. A combined line is removed if any column is '-' (it is
+// present in a parent but not the result), added if any column is '+', and
+// context otherwise. ok is false for lines that aren't hunk content.
+func classifyHunkLine(line string, parents int) (kind byte, text string, ok bool) {
+	if parents < 1 {
+		parents = 1
+	}
+	if len(line) < parents {
+		return 0, "", false
+	}
+
+	kind = ' '
+	for i := 0; i < parents; i++ {
+		switch line[i] {
+		case '-':
+			kind = '-'
+		case '+':
+			if kind != '-' {
+				kind = '+'
+			}
+		case ' ':
+		default:
+			return 0, "", false
+		}
+	}
+	return kind, line[parents:], true
+}
+
 // ApplyWordDiff applies word-level diffing to a unified diff hunk.
-// It returns the word-level diff result for the changed lines.
+// It returns the word-level diff result for the changed lines. With
+// opts.NormalizeEOL, a trailing "\r" on each line is ignored.
 func ApplyWordDiff(hunk DiffHunk, opts Options) []Diff {
-	oldText := strings.Join(hunk.OldLines, "\n")
-	newText := strings.Join(hunk.NewLines, "\n")
+	oldLines, newLines := hunk.OldLines, hunk.NewLines
+	if opts.NormalizeEOL {
+		oldLines, newLines = trimCRs(oldLines), trimCRs(newLines)
+	}
+	oldText := strings.Join(oldLines, "\n")
+	newText := strings.Join(newLines, "\n")
 	return DiffStrings(oldText, newText, opts)
 }
+
+// ParseAndWordDiff parses a unified diff as ParseUnifiedDiff does and sets
+// each hunk's WordDiffs to its word-level diff from ApplyWordDiff, for
+// callers that render the results themselves.
+func ParseAndWordDiff(input string, opts Options) ([]UnifiedDiff, error) {
+	diffs, err := ParseUnifiedDiff(input)
+	if err != nil {
+		return nil, err
+	}
+	for i := range diffs {
+		for j := range diffs[i].Hunks {
+			hunk := &diffs[i].Hunks[j]
+			hunk.WordDiffs = ApplyWordDiff(*hunk, opts)
+		}
+	}
+	return diffs, nil
+}
+
+// FormatHunk renders a single hunk as ProcessUnifiedDiff renders one: a
+// "@@ -OldStart,OldCount +NewStart,NewCount @@" header rebuilt from the
+// hunk's ranges, the ContextBefore lines, the changed lines as a word diff,
+// and the ContextAfter lines. With fmtOpts.KeepDiffPrefixes, context lines
+// keep a " " prefix and the changed lines are written as the old lines
+// prefixed "-" with deleted words marked, then the new lines prefixed "+"
+// with inserted words marked. Combined hunks get a regular header for the
+// first parent. "\ No newline at end of file" markers are not written. The
+// result has no trailing newline.
+func FormatHunk(hunk DiffHunk, opts Options, fmtOpts FormatOptions) string {
+	if fmtOpts.ColorReset == "" {
+		fmtOpts.ColorReset = ANSIReset
+	}
+	contextPrefix := ""
+	if fmtOpts.KeepDiffPrefixes {
+		contextPrefix = " "
+	}
+
+	lines := []string{fmt.Sprintf("@@ -%s +%s @@", formatHunkRange(hunk.OldStart, hunk.OldCount), formatHunkRange(hunk.NewStart, hunk.NewCount))}
+	for _, line := range hunk.ContextBefore {
+		lines = append(lines, contextPrefix+line)
+	}
+	if len(hunk.OldLines) > 0 || len(hunk.NewLines) > 0 {
+		oldText := strings.Join(hunk.OldLines, "\n")
+		newText := strings.Join(hunk.NewLines, "\n")
+		if fmtOpts.KeepDiffPrefixes {
+			result := DiffStringsWithPositionsAndPreprocessing(oldText, newText, opts)
+			lines = append(lines, prefixLines(repeatPrefix("-", len(hunk.OldLines)), renderDiffSide(result, Delete, fmtOpts), Delete, fmtOpts)...)
+			lines = append(lines, prefixLines(repeatPrefix("+", len(hunk.NewLines)), renderDiffSide(result, Insert, fmtOpts), Insert, fmtOpts)...)
+		} else {
+			lines = append(lines, DiffWholeFiles(oldText, newText, opts, fmtOpts).Formatted)
+		}
+	}
+	for _, line := range hunk.ContextAfter {
+		lines = append(lines, contextPrefix+line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatHunkRange formats a hunk header range as "start,count", or "start"
+// when the count is 1, as diff -u does.
+func formatHunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// repeatPrefix returns n copies of prefix, one per line.
+func repeatPrefix(prefix string, n int) []string {
+	prefixes := make([]string, n)
+	for i := range prefixes {
+		prefixes[i] = prefix
+	}
+	return prefixes
+}
+
+// BuildHunks groups the changes in a whole-file diff result into hunks, the
+// token-level analog of unified diff hunks. Changes separated by more than
+// 2*contextTokens Equal tokens start a new hunk, and up to contextTokens
+// Equal tokens are attached on each side as context.
+//
+// In the returned hunks, ContextBefore and ContextAfter hold the context
+// tokens, while OldLines and NewLines hold the tokens of the changed region as
+// they appear in the old text (Equal and Delete) and new text (Equal and
+// Insert). OldStart/NewStart are the 1-based line numbers where each hunk
+// begins, including context, and OldCount/NewCount are the number of lines it
+// spans. Line information requires the result's position data; without it
+// those fields are left zero.
+func BuildHunks(result DiffResult, contextTokens int) []DiffHunk {
+	diffs := result.Diffs
+	if contextTokens < 0 {
+		contextTokens = 0
+	}
+
+	// Token indexes into each text before diffs[i]; the final entry holds
+	// the totals so ranges can be measured with a simple subtraction.
+	idx1 := make([]int, len(diffs)+1)
+	idx2 := make([]int, len(diffs)+1)
+	for i, d := range diffs {
+		idx1[i+1], idx2[i+1] = idx1[i], idx2[i]
+		if d.Type != Insert {
+			idx1[i+1]++
+		}
+		if d.Type != Delete {
+			idx2[i+1]++
+		}
+	}
+
+	var hunks []DiffHunk
+	i := 0
+	for i < len(diffs) {
+		if diffs[i].Type == Equal {
+			i++
+			continue
+		}
+
+		// Extend the group while the Equal gap to the next change is small
+		// enough that the two hunks' context would touch.
+		groupStart := i
+		groupEnd := i + 1
+		for j := groupEnd; j < len(diffs); j++ {
+			if diffs[j].Type == Equal {
+				continue
+			}
+			if j-groupEnd > 2*contextTokens {
+				break
+			}
+			groupEnd = j + 1
+		}
+		i = groupEnd
+
+		hunkStart := groupStart
+		for hunkStart > 0 && groupStart-hunkStart < contextTokens && diffs[hunkStart-1].Type == Equal {
+			hunkStart--
+		}
+		hunkEnd := groupEnd
+		for hunkEnd < len(diffs) && hunkEnd-groupEnd < contextTokens && diffs[hunkEnd].Type == Equal {
+			hunkEnd++
+		}
+
+		hunk := DiffHunk{Parents: 1}
+		for _, d := range diffs[hunkStart:groupStart] {
+			hunk.ContextBefore = append(hunk.ContextBefore, d.Token)
+		}
+		for _, d := range diffs[groupStart:groupEnd] {
+			if d.Type != Insert {
+				hunk.OldLines = append(hunk.OldLines, d.Token)
+			}
+			if d.Type != Delete {
+				hunk.NewLines = append(hunk.NewLines, d.Token)
+			}
+		}
+		for _, d := range diffs[groupEnd:hunkEnd] {
+			hunk.ContextAfter = append(hunk.ContextAfter, d.Token)
+		}
+
+		hunk.OldStart, hunk.OldCount = tokenLineRange(result.Text1, result.Positions1, idx1[hunkStart], idx1[hunkEnd])
+		hunk.NewStart, hunk.NewCount = tokenLineRange(result.Text2, result.Positions2, idx2[hunkStart], idx2[hunkEnd])
+		hunks = append(hunks, hunk)
+	}
+
+	return hunks
+}
+
+// tokenLineRange returns the 1-based line number of token start and the number
+// of lines spanned by tokens [start, end). An empty range reports the line
+// where the next token (or the end of the text) falls, with a count of 0.
+func tokenLineRange(text string, positions []TokenPos, start, end int) (line, count int) {
+	if len(positions) == 0 || end > len(positions) {
+		return 0, 0
+	}
+
+	offset := len(text)
+	if start < len(positions) {
+		offset = positions[start].Start
+	}
+	line = strings.Count(text[:offset], "\n") + 1
+	if end <= start {
+		return line, 0
+	}
+
+	last := strings.Count(text[:positions[end-1].End], "\n") + 1
+	return line, last - line + 1
+}
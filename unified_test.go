@@ -123,3 +123,364 @@ func TestApplyWordDiff(t *testing.T) {
 		})
 	}
 }
+
+func TestApplyWordDiffNormalizeEOL(t *testing.T) {
+	diffs, err := ParseUnifiedDiff("--- a/win.txt\r\n+++ b/win.txt\r\n@@ -1,2 +1,2 @@\r\n-one\r\n-two\r\n+one\n+two\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs[0].OldFile != "a/win.txt" || diffs[0].NewFile != "b/win.txt" {
+		t.Errorf("file names = %q, %q, want them without \\r", diffs[0].OldFile, diffs[0].NewFile)
+	}
+
+	hunk := diffs[0].Hunks[0]
+	opts := DefaultOptions()
+	opts.PreserveWhitespace = true
+	if !HasChanges(ApplyWordDiff(hunk, opts)) {
+		t.Error("ApplyWordDiff() without NormalizeEOL reported no changes")
+	}
+	opts.NormalizeEOL = true
+	if got := ApplyWordDiff(hunk, opts); HasChanges(got) {
+		t.Errorf("ApplyWordDiff() with NormalizeEOL = %v, want no changes", got)
+	}
+}
+
+func TestParseAndWordDiff(t *testing.T) {
+	input := `--- a/file.txt
++++ b/file.txt
+@@ -1,3 +1,3 @@
+ unchanged
+-hello world
++hello universe
+ more
+@@ -10,2 +10,2 @@
+-the quick brown fox
++the quick red fox
+ end
+`
+	opts := DefaultOptions()
+	diffs, err := ParseAndWordDiff(input, opts)
+	if err != nil {
+		t.Fatalf("ParseAndWordDiff() error = %v", err)
+	}
+	if len(diffs) != 1 || len(diffs[0].Hunks) != 2 {
+		t.Fatalf("ParseAndWordDiff() = %+v, want one file with two hunks", diffs)
+	}
+
+	want := [][]Diff{
+		{
+			{Type: Equal, Token: "hello"},
+			{Type: Delete, Token: "world"},
+			{Type: Insert, Token: "universe"},
+		},
+		{
+			{Type: Equal, Token: "the"},
+			{Type: Equal, Token: "quick"},
+			{Type: Delete, Token: "brown"},
+			{Type: Insert, Token: "red"},
+			{Type: Equal, Token: "fox"},
+		},
+	}
+	for i, hunk := range diffs[0].Hunks {
+		if len(hunk.WordDiffs) == 0 {
+			t.Errorf("hunk %d: WordDiffs is empty", i)
+		}
+		if !reflect.DeepEqual(hunk.WordDiffs, want[i]) {
+			t.Errorf("hunk %d: WordDiffs = %v, want %v", i, hunk.WordDiffs, want[i])
+		}
+		if got := ApplyWordDiff(hunk, opts); !reflect.DeepEqual(hunk.WordDiffs, got) {
+			t.Errorf("hunk %d: WordDiffs = %v, want ApplyWordDiff() = %v", i, hunk.WordDiffs, got)
+		}
+	}
+
+	// ParseUnifiedDiff leaves WordDiffs unset
+	parsed, err := ParseUnifiedDiff(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, hunk := range parsed[0].Hunks {
+		if hunk.WordDiffs != nil {
+			t.Errorf("ParseUnifiedDiff() hunk %d: WordDiffs = %v, want nil", i, hunk.WordDiffs)
+		}
+	}
+}
+
+func TestParseUnifiedDiffCombined(t *testing.T) {
+	input := `diff --cc file.txt
+index 1234567,89abcde..fedcba9
+--- a/file.txt
++++ b/file.txt
+@@@ -1,3 -1,3 +1,3 @@@
+  context
+- ours line
+ -theirs line
+++merged line
+  more context
+`
+
+	diffs, err := ParseUnifiedDiff(input)
+	if err != nil {
+		t.Fatalf("ParseUnifiedDiff() error = %v", err)
+	}
+	if len(diffs) != 1 || len(diffs[0].Hunks) != 1 {
+		t.Fatalf("ParseUnifiedDiff() got %+v, want 1 diff with 1 hunk", diffs)
+	}
+
+	hunk := diffs[0].Hunks[0]
+	if hunk.Parents != 2 {
+		t.Errorf("Parents = %d, want 2", hunk.Parents)
+	}
+	if hunk.OldStart != 1 || hunk.OldCount != 3 {
+		t.Errorf("Old range = %d,%d, want 1,3", hunk.OldStart, hunk.OldCount)
+	}
+	if hunk.NewStart != 1 || hunk.NewCount != 3 {
+		t.Errorf("New range = %d,%d, want 1,3", hunk.NewStart, hunk.NewCount)
+	}
+	if want := []string{"ours line", "theirs line"}; !reflect.DeepEqual(hunk.OldLines, want) {
+		t.Errorf("OldLines = %q, want %q", hunk.OldLines, want)
+	}
+	if want := []string{"merged line"}; !reflect.DeepEqual(hunk.NewLines, want) {
+		t.Errorf("NewLines = %q, want %q", hunk.NewLines, want)
+	}
+	if want := []string{"context"}; !reflect.DeepEqual(hunk.ContextBefore, want) {
+		t.Errorf("ContextBefore = %q, want %q", hunk.ContextBefore, want)
+	}
+	if want := []string{"more context"}; !reflect.DeepEqual(hunk.ContextAfter, want) {
+		t.Errorf("ContextAfter = %q, want %q", hunk.ContextAfter, want)
+	}
+}
+
+func TestClassifyHunkLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		parents  int
+		wantKind byte
+		wantText string
+		wantOK   bool
+	}{
+		{"-old", 1, '-', "old", true},
+		{"+new", 1, '+', "new", true},
+		{" ctx", 1, ' ', "ctx", true},
+		{"", 1, 0, "", false},
+		{"\\ No newline at end of file", 1, 0, "", false},
+		{"--gone from both", 2, '-', "gone from both", true},
+		{"- ours", 2, '-', "ours", true},
+		{" -theirs", 2, '-', "theirs", true},
+		{"++new in merge", 2, '+', "new in merge", true},
+		{" +from ours", 2, '+', "from ours", true},
+		{"  context", 2, ' ', "context", true},
+		{"+-mixed", 2, '-', "mixed", true},
+		{"x", 2, 0, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			kind, text, ok := classifyHunkLine(tt.line, tt.parents)
+			if kind != tt.wantKind || text != tt.wantText || ok != tt.wantOK {
+				t.Errorf("classifyHunkLine(%q, %d) = (%q, %q, %v), want (%q, %q, %v)",
+					tt.line, tt.parents, kind, text, ok, tt.wantKind, tt.wantText, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestBuildHunks(t *testing.T) {
+	text1 := "one two three four five six seven eight\nnine ten eleven twelve"
+	text2 := "one TWO three four five six seven eight\nnine ten eleven TWELVE"
+	result := DiffStringsWithPositions(text1, text2, DefaultOptions())
+
+	t.Run("distant changes split into separate hunks", func(t *testing.T) {
+		hunks := BuildHunks(result, 2)
+		if len(hunks) != 2 {
+			t.Fatalf("BuildHunks() returned %d hunks, want 2: %+v", len(hunks), hunks)
+		}
+
+		first := hunks[0]
+		if !reflect.DeepEqual(first.ContextBefore, []string{"one"}) {
+			t.Errorf("ContextBefore = %q, want [one]", first.ContextBefore)
+		}
+		if !reflect.DeepEqual(first.OldLines, []string{"two"}) || !reflect.DeepEqual(first.NewLines, []string{"TWO"}) {
+			t.Errorf("Old/NewLines = %q/%q, want [two]/[TWO]", first.OldLines, first.NewLines)
+		}
+		if !reflect.DeepEqual(first.ContextAfter, []string{"three", "four"}) {
+			t.Errorf("ContextAfter = %q, want [three four]", first.ContextAfter)
+		}
+		if first.OldStart != 1 || first.OldCount != 1 || first.NewStart != 1 || first.NewCount != 1 {
+			t.Errorf("first hunk range = -%d,%d +%d,%d, want -1,1 +1,1",
+				first.OldStart, first.OldCount, first.NewStart, first.NewCount)
+		}
+
+		second := hunks[1]
+		if !reflect.DeepEqual(second.ContextBefore, []string{"ten", "eleven"}) {
+			t.Errorf("ContextBefore = %q, want [ten eleven]", second.ContextBefore)
+		}
+		if len(second.ContextAfter) != 0 {
+			t.Errorf("ContextAfter = %q, want none", second.ContextAfter)
+		}
+		if second.OldStart != 2 || second.OldCount != 1 || second.NewStart != 2 || second.NewCount != 1 {
+			t.Errorf("second hunk range = -%d,%d +%d,%d, want -2,1 +2,1",
+				second.OldStart, second.OldCount, second.NewStart, second.NewCount)
+		}
+	})
+
+	t.Run("large context merges hunks", func(t *testing.T) {
+		hunks := BuildHunks(result, 5)
+		if len(hunks) != 1 {
+			t.Fatalf("BuildHunks() returned %d hunks, want 1", len(hunks))
+		}
+		hunk := hunks[0]
+		if hunk.OldLines[0] != "two" || hunk.OldLines[len(hunk.OldLines)-1] != "twelve" {
+			t.Errorf("OldLines = %q, want to span two..twelve", hunk.OldLines)
+		}
+		if hunk.OldStart != 1 || hunk.OldCount != 2 {
+			t.Errorf("Old range = %d,%d, want 1,2", hunk.OldStart, hunk.OldCount)
+		}
+	})
+
+	t.Run("no changes", func(t *testing.T) {
+		same := DiffStringsWithPositions(text1, text1, DefaultOptions())
+		if hunks := BuildHunks(same, 3); len(hunks) != 0 {
+			t.Errorf("BuildHunks() = %+v, want no hunks", hunks)
+		}
+	})
+
+	t.Run("pure insertion", func(t *testing.T) {
+		r := DiffStringsWithPositions("a\nb", "a\nnew\nb", DefaultOptions())
+		hunks := BuildHunks(r, 0)
+		if len(hunks) != 1 {
+			t.Fatalf("BuildHunks() returned %d hunks, want 1", len(hunks))
+		}
+		h := hunks[0]
+		if len(h.OldLines) != 0 || !reflect.DeepEqual(h.NewLines, []string{"new"}) {
+			t.Errorf("Old/NewLines = %q/%q, want []/[new]", h.OldLines, h.NewLines)
+		}
+		if h.OldCount != 0 || h.NewStart != 2 || h.NewCount != 1 {
+			t.Errorf("range = -%d,%d +%d,%d, want old count 0, +2,1",
+				h.OldStart, h.OldCount, h.NewStart, h.NewCount)
+		}
+	})
+}
+
+func TestParseUnifiedDiffNoNewline(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantOld   bool
+		wantNew   bool
+		wantLines []string
+	}{
+		{
+			name:      "old side only",
+			body:      "-old end\n\\ No newline at end of file\n+new end\n",
+			wantOld:   true,
+			wantLines: []string{"old end", "new end"},
+		},
+		{
+			name:      "new side only",
+			body:      "-old end\n+new end\n\\ No newline at end of file\n",
+			wantNew:   true,
+			wantLines: []string{"old end", "new end"},
+		},
+		{
+			name:      "both sides",
+			body:      "-old end\n\\ No newline at end of file\n+new end\n\\ No newline at end of file\n",
+			wantOld:   true,
+			wantNew:   true,
+			wantLines: []string{"old end", "new end"},
+		},
+		{
+			name:      "context line",
+			body:      "-old\n+new\n end\n\\ No newline at end of file\n",
+			wantOld:   true,
+			wantNew:   true,
+			wantLines: []string{"old", "new"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diffs, err := ParseUnifiedDiff("--- a/f\n+++ b/f\n@@ -1 +1 @@\n" + tt.body)
+			if err != nil {
+				t.Fatalf("ParseUnifiedDiff() error = %v", err)
+			}
+			hunk := diffs[0].Hunks[0]
+			if hunk.NoNewlineOld != tt.wantOld || hunk.NoNewlineNew != tt.wantNew {
+				t.Errorf("NoNewlineOld, NoNewlineNew = %v, %v; want %v, %v",
+					hunk.NoNewlineOld, hunk.NoNewlineNew, tt.wantOld, tt.wantNew)
+			}
+			lines := append(append([]string{}, hunk.OldLines...), hunk.NewLines...)
+			if !reflect.DeepEqual(lines, tt.wantLines) {
+				t.Errorf("changed lines = %q, want %q", lines, tt.wantLines)
+			}
+			if len(hunk.ContextAfter) > 1 {
+				t.Errorf("ContextAfter = %q, marker added as content", hunk.ContextAfter)
+			}
+		})
+	}
+}
+
+func TestFormatHunk(t *testing.T) {
+	diffs, err := ParseUnifiedDiff(`--- a/config.go
++++ b/config.go
+@@ -10,4 +10,4 @@ func load() {
+ 	cfg := defaults()
+ 	cfg.Name = name
+-	cfg.Timeout = 30
++	cfg.Timeout = 60
+ 	return cfg
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hunk := diffs[0].Hunks[0]
+	fmtOpts := DefaultFormatOptions()
+
+	tests := []struct {
+		name     string
+		hunk     DiffHunk
+		prefixes bool
+		expected string
+	}{
+		{
+			name: "context on both sides",
+			hunk: hunk,
+			expected: "@@ -10,4 +10,4 @@\n" +
+				"\tcfg := defaults()\n" +
+				"\tcfg.Name = name\n" +
+				"\tcfg.Timeout = [-30-] {+60+}\n" +
+				"\treturn cfg",
+		},
+		{
+			name:     "keep prefixes",
+			hunk:     hunk,
+			prefixes: true,
+			expected: "@@ -10,4 +10,4 @@\n" +
+				" \tcfg := defaults()\n" +
+				" \tcfg.Name = name\n" +
+				"-\tcfg.Timeout = [-30-]\n" +
+				"+\tcfg.Timeout = {+60+}\n" +
+				" \treturn cfg",
+		},
+		{
+			name: "single-line ranges and an insertion",
+			hunk: DiffHunk{
+				OldStart:      3,
+				OldCount:      1,
+				NewStart:      3,
+				NewCount:      2,
+				ContextBefore: []string{"one"},
+				NewLines:      []string{"two"},
+			},
+			expected: "@@ -3 +3,2 @@\none\n{+two+}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fmtOpts.KeepDiffPrefixes = tt.prefixes
+			if got := FormatHunk(tt.hunk, DefaultOptions(), fmtOpts); got != tt.expected {
+				t.Errorf("FormatHunk() =\n%q\nwant\n%q", got, tt.expected)
+			}
+		})
+	}
+}
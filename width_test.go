@@ -0,0 +1,39 @@
+package tokendiff
+
+import "testing"
+
+func TestVisibleWidth(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want int
+	}{
+		{"empty", "", 0},
+		{"ascii", "hello", 5},
+		{"multibyte latin", "héllo", 5},
+		{"color codes", "\033[0;31;1mhello\033[0m", 5},
+		{"color codes and wide runes", "\033[32m世界\033[0m", 4},
+		{"fullwidth forms", "ＡＢ", 4},
+		{"hangul", "한국어", 6},
+		{"emoji", "ok 😀", 5},
+		{"combining acute", "e\u0301", 1},
+		{"zero-width space", "a\u200bb", 2},
+		{"zero-width joiner sequence", "\U0001F468\u200d\U0001F469\u200d\U0001F467", 2},
+		{"trailing zero-width joiner", "a\u200d", 1},
+		{"variation selector", "\u263a\ufe0f", 1},
+		{"control characters", "a\x00\rb", 2},
+		{"tab", "a\tb", 3},
+		{"unterminated escape", "ab\033[31", 2},
+		{"hyperlink", OSC8Link("file:///tmp/a.txt", "a.txt"), 5},
+		{"BEL-terminated OSC", "\033]0;title\aab", 2},
+		{"invalid UTF-8", "a\xffb", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VisibleWidth(tt.s); got != tt.want {
+				t.Errorf("VisibleWidth(%q) = %d, want %d", tt.s, got, tt.want)
+			}
+		})
+	}
+}